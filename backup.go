@@ -0,0 +1,696 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	backupVersion      = 1
+	backupManifestName = "manifest.json"
+	backupServicesDir  = "services/"
+	backupNamePrefix   = "usa-backup-"
+	backupNameSuffix   = ".tar.gz"
+	backupTimeFormat   = "20060102T150405Z"
+
+	defaultBackupInterval  = 24 * time.Hour
+	defaultBackupRetention = 7
+
+	restoreModeMerge     = "merge"     // only entities missing in the storage are restored
+	restoreModeOverwrite = "overwrite" // the service is restored to the exact state of the backup
+)
+
+// backupManifest is the first file of the backup archive; every service is stored in services/<name>.ndjson
+type backupManifest struct {
+	Version  int                     `json:"version"`
+	Created  time.Time               `json:"created"`
+	Services []backupServiceManifest `json:"services"`
+}
+
+type backupServiceManifest struct {
+	Name        string `json:"name"`
+	Entities    int    `json:"entities"`
+	Fingerprint string `json:"fingerprint"` // checksum of field configuration of the service
+}
+
+// backupTarget stores backup archives, names of the archives contain time of the backup
+type backupTarget interface {
+	Save(ctx context.Context, name string, r io.ReadSeeker) error
+	List(ctx context.Context) ([]string, error) // names of backups ordered from the oldest
+	Open(ctx context.Context, name string) (io.ReadCloser, error)
+	Remove(ctx context.Context, name string) error
+}
+
+// createBackupTarget creates target by its location; s3://bucket/prefix uses S3 configured by AWS_* environment
+// variables, anything else is a local directory
+func createBackupTarget(location string) (backupTarget, error) {
+	if strings.HasPrefix(location, "s3://") {
+		parts := strings.SplitN(strings.TrimPrefix(location, "s3://"), "/", 2)
+		bucket, prefix := parts[0], ""
+		if len(parts) == 2 {
+			prefix = parts[1]
+		}
+		if bucket == "" {
+			return nil, fmt.Errorf("missing bucket in backup target %q", location)
+		}
+		if prefix != "" && !strings.HasSuffix(prefix, "/") {
+			prefix += "/"
+		}
+		return &s3BackupTarget{client: createS3Client(), bucket: bucket, prefix: prefix}, nil
+	}
+
+	if location == "" {
+		return nil, fmt.Errorf("missing backup target")
+	}
+	if err := os.MkdirAll(location, 0o755); err != nil {
+		return nil, fmt.Errorf("could not create backup directory: %w", err)
+	}
+
+	return &dirBackupTarget{dir: location}, nil
+}
+
+// backupSchedule creates backups of all services periodically
+type backupSchedule struct {
+	target    backupTarget
+	interval  time.Duration
+	retention int
+}
+
+// createBackupSchedule reads BACKUP_* environment variables, nil is returned when backups are not configured
+func createBackupSchedule() (*backupSchedule, error) {
+	location := os.Getenv("BACKUP_TARGET")
+	if location == "" {
+		return nil, nil
+	}
+
+	interval := defaultBackupInterval
+	if value := os.Getenv("BACKUP_INTERVAL"); value != "" {
+		var err error
+		interval, err = time.ParseDuration(value)
+		if err != nil || interval <= 0 {
+			return nil, fmt.Errorf("invalid backup interval %q in environment variable %q", value, "BACKUP_INTERVAL")
+		}
+	}
+
+	retention := defaultBackupRetention
+	if value := os.Getenv("BACKUP_RETENTION"); value != "" {
+		var err error
+		retention, err = strconv.Atoi(value)
+		if err != nil || retention < 0 {
+			return nil, fmt.Errorf("invalid backup retention %q in environment variable %q", value, "BACKUP_RETENTION")
+		}
+	}
+
+	target, err := createBackupTarget(location)
+	if err != nil {
+		return nil, err
+	}
+
+	return &backupSchedule{target: target, interval: interval, retention: retention}, nil
+}
+
+// Run creates backups until the context is canceled
+func (schedule *backupSchedule) Run(ctx context.Context, services []Service, logger *logrus.Logger) {
+	ticker := time.NewTicker(schedule.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		name, err := backupToTarget(ctx, services, schedule.target, schedule.retention, logger)
+		if err != nil {
+			logger.WithError(err).Error("scheduled backup failed")
+			continue
+		}
+		logger.Infof("scheduled backup %q created", name)
+	}
+}
+
+// backupToTarget saves backup of the services to the target and removes backups exceeding the retention
+func backupToTarget(ctx context.Context, services []Service, target backupTarget, retention int, logger *logrus.Logger) (string, error) {
+	tmp, err := os.CreateTemp("", "usa-backup-*")
+	if err != nil {
+		return "", fmt.Errorf("could not create temporary file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	manifest, err := createBackup(ctx, services, tmp)
+	if err != nil {
+		return "", err
+	}
+	if _, err = tmp.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+
+	name := getBackupName(manifest.Created)
+	if err = target.Save(ctx, name, tmp); err != nil {
+		return "", fmt.Errorf("could not save backup %q: %w", name, err)
+	}
+
+	removed, err := pruneBackups(ctx, target, retention)
+	if err != nil {
+		return name, fmt.Errorf("could not remove old backups: %w", err)
+	}
+	for _, old := range removed {
+		logger.Infof("backup %q removed by retention", old)
+	}
+
+	return name, nil
+}
+
+// getBackupServices returns the services followed by their internal services with user data (history and trash).
+// Idempotency keys expire shortly and values of unique keys are derived from entities (the index is rebuilt after
+// restore), so they are not backed up.
+func getBackupServices(services []Service) []Service {
+	backupServices := make([]Service, 0, len(services))
+	for _, service := range services {
+		backupServices = append(backupServices, service)
+		if service.Cfg.History {
+			backupServices = append(backupServices, Service{Cfg: ServiceConfig{Name: getHistoryServiceName(service.Cfg.Name)}, Storage: service.Storage})
+		}
+		if service.Cfg.SoftDelete {
+			backupServices = append(backupServices, Service{Cfg: ServiceConfig{Name: getTrashServiceName(service.Cfg.Name)}, Storage: service.Storage})
+		}
+	}
+
+	return backupServices
+}
+
+// createBackup writes gzipped tar archive with the manifest and entities of all services and their history and trash
+func createBackup(ctx context.Context, services []Service, w io.Writer) (backupManifest, error) {
+	manifest := backupManifest{Version: backupVersion, Created: time.Now().UTC()}
+	services = getBackupServices(services)
+
+	// size of every file has to be known before it is written to the archive
+	tmpDir, err := os.MkdirTemp("", "usa-backup-")
+	if err != nil {
+		return manifest, fmt.Errorf("could not create temporary directory: %w", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	for k := range services {
+		service := &services[k]
+		file, err := os.Create(filepath.Join(tmpDir, strconv.Itoa(k)))
+		if err != nil {
+			return manifest, err
+		}
+		count, err := service.Export(ctx, exportFormatNdjson, file)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return manifest, fmt.Errorf("could not export service %q: %w", service.Cfg.Name, err)
+		}
+
+		manifest.Services = append(manifest.Services, backupServiceManifest{
+			Name:        service.Cfg.Name,
+			Entities:    count,
+			Fingerprint: getConfigFingerprint(service.Cfg),
+		})
+	}
+
+	gz := gzip.NewWriter(w)
+	archive := tar.NewWriter(gz)
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return manifest, err
+	}
+	if err = writeBackupFile(archive, backupManifestName, int64(len(data)), bytes.NewReader(data), manifest.Created); err != nil {
+		return manifest, err
+	}
+
+	for k, serviceManifest := range manifest.Services {
+		file, err := os.Open(filepath.Join(tmpDir, strconv.Itoa(k)))
+		if err != nil {
+			return manifest, err
+		}
+		info, err := file.Stat()
+		if err == nil {
+			err = writeBackupFile(archive, backupServicesDir+serviceManifest.Name+".ndjson", info.Size(), file, manifest.Created)
+		}
+		_ = file.Close()
+		if err != nil {
+			return manifest, err
+		}
+	}
+
+	if err = archive.Close(); err != nil {
+		return manifest, fmt.Errorf("could not write backup: %w", err)
+	}
+	if err = gz.Close(); err != nil {
+		return manifest, fmt.Errorf("could not write backup: %w", err)
+	}
+
+	return manifest, nil
+}
+
+func writeBackupFile(archive *tar.Writer, name string, size int64, r io.Reader, modified time.Time) error {
+	header := &tar.Header{Name: name, Mode: 0o644, Size: size, ModTime: modified, Typeflag: tar.TypeReg}
+	if err := archive.WriteHeader(header); err != nil {
+		return fmt.Errorf("could not write backup: %w", err)
+	}
+	if _, err := io.Copy(archive, r); err != nil {
+		return fmt.Errorf("could not write backup: %w", err)
+	}
+
+	return nil
+}
+
+// getConfigFingerprint returns checksum of fields of the service, so restore can detect changed configuration
+func getConfigFingerprint(cfg ServiceConfig) string {
+	data, _ := json.Marshal(cfg.Fields) // keys of maps are sorted
+	sum := sha256.Sum256(data)
+
+	return hex.EncodeToString(sum[:])
+}
+
+func getBackupName(created time.Time) string {
+	return backupNamePrefix + created.UTC().Format(backupTimeFormat) + backupNameSuffix
+}
+
+// parseBackupName returns time of the backup, false is returned for files which are not backups
+func parseBackupName(name string) (time.Time, bool) {
+	if !strings.HasPrefix(name, backupNamePrefix) || !strings.HasSuffix(name, backupNameSuffix) {
+		return time.Time{}, false
+	}
+	created, err := time.Parse(backupTimeFormat, strings.TrimSuffix(strings.TrimPrefix(name, backupNamePrefix), backupNameSuffix))
+
+	return created, err == nil
+}
+
+// sortBackupNames keeps only names of backups and orders them from the oldest
+func sortBackupNames(names []string) []string {
+	backups := make([]string, 0, len(names))
+	for _, name := range names {
+		if _, ok := parseBackupName(name); ok {
+			backups = append(backups, name)
+		}
+	}
+	sort.Strings(backups) // names are ordered by time
+
+	return backups
+}
+
+// findBackup returns the latest backup created at or before given time
+func findBackup(ctx context.Context, target backupTarget, at time.Time) (string, error) {
+	names, err := target.List(ctx)
+	if err != nil {
+		return "", fmt.Errorf("could not list backups: %w", err)
+	}
+
+	for k := len(names) - 1; k >= 0; k-- {
+		created, _ := parseBackupName(names[k])
+		if !created.After(at) {
+			return names[k], nil
+		}
+	}
+
+	return "", fmt.Errorf("no backup created before %s", at.Format(time.RFC3339))
+}
+
+// pruneBackups removes the oldest backups so only given number of backups is kept; 0 keeps all backups
+func pruneBackups(ctx context.Context, target backupTarget, retention int) ([]string, error) {
+	if retention <= 0 {
+		return nil, nil
+	}
+
+	names, err := target.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(names) <= retention {
+		return nil, nil
+	}
+
+	removed := names[:len(names)-retention]
+	for _, name := range removed {
+		if err = target.Remove(ctx, name); err != nil {
+			return nil, err
+		}
+	}
+
+	return removed, nil
+}
+
+// dirBackupTarget stores backups in a local directory
+type dirBackupTarget struct {
+	dir string
+}
+
+func (target *dirBackupTarget) Save(_ context.Context, name string, r io.ReadSeeker) error {
+	// write and rename, so incomplete backup is never listed
+	tmp, err := os.CreateTemp(target.dir, ".tmp-"+name)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = io.Copy(tmp, r)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), filepath.Join(target.dir, name))
+}
+
+func (target *dirBackupTarget) List(_ context.Context) ([]string, error) {
+	entries, err := os.ReadDir(target.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			names = append(names, entry.Name())
+		}
+	}
+
+	return sortBackupNames(names), nil
+}
+
+func (target *dirBackupTarget) Open(_ context.Context, name string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(target.dir, name))
+}
+
+func (target *dirBackupTarget) Remove(_ context.Context, name string) error {
+	return os.Remove(filepath.Join(target.dir, name))
+}
+
+// s3BackupTarget stores backups in S3 bucket under the prefix
+type s3BackupTarget struct {
+	client *s3.S3
+	bucket string
+	prefix string
+}
+
+func (target *s3BackupTarget) Save(ctx context.Context, name string, r io.ReadSeeker) error {
+	_, err := target.client.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(target.bucket),
+		Key:         aws.String(target.prefix + name),
+		Body:        r,
+		ContentType: aws.String("application/gzip"),
+	})
+
+	return err
+}
+
+func (target *s3BackupTarget) List(ctx context.Context) ([]string, error) {
+	var names []string
+	err := target.client.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+		Bucket: aws.String(target.bucket),
+		Prefix: aws.String(target.prefix),
+	}, func(page *s3.ListObjectsV2Output, _ bool) bool {
+		for _, object := range page.Contents {
+			names = append(names, path.Base(*object.Key))
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return sortBackupNames(names), nil
+}
+
+func (target *s3BackupTarget) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	output, err := target.client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(target.bucket),
+		Key:    aws.String(target.prefix + name),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return output.Body, nil
+}
+
+func (target *s3BackupTarget) Remove(ctx context.Context, name string) error {
+	_, err := target.client.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(target.bucket),
+		Key:    aws.String(target.prefix + name),
+	})
+
+	return err
+}
+
+// restore restores services from the backup archive
+type restore struct {
+	services map[string]Service // selected services and their internal services
+	required []string           // selected services; internal services are missing in older backups
+	mode     string
+	dryRun   bool // only differences between the backup and the storage are reported
+	pageSize int
+	logger   *logrus.Logger
+}
+
+// restoreReport compares entities of the backup with entities in the storage before the restore
+type restoreReport struct {
+	Added     int // missing in the storage
+	Changed   int // different in the storage
+	Removed   int // missing in the backup
+	Unchanged int
+}
+
+func createRestore(services []Service, mode string, logger *logrus.Logger) (*restore, error) {
+	if mode != restoreModeMerge && mode != restoreModeOverwrite {
+		return nil, fmt.Errorf("unknown restore mode %q", mode)
+	}
+
+	r := &restore{
+		services: make(map[string]Service, len(services)),
+		mode:     mode,
+		pageSize: defaultMigrationPageSize,
+		logger:   logger,
+	}
+	for _, service := range services {
+		r.required = append(r.required, service.Cfg.Name)
+	}
+	for _, service := range getBackupServices(services) {
+		r.services[service.Cfg.Name] = service
+	}
+
+	return r, nil
+}
+
+// Run restores all selected services found in the backup archive
+func (r *restore) Run(ctx context.Context, archive io.Reader) (map[string]restoreReport, error) {
+	gz, err := gzip.NewReader(archive)
+	if err != nil {
+		return nil, fmt.Errorf("could not read backup: %w", err)
+	}
+	defer gz.Close()
+	reader := tar.NewReader(gz)
+
+	header, err := reader.Next()
+	if err != nil || header.Name != backupManifestName {
+		return nil, fmt.Errorf("could not read backup: %s is missing", backupManifestName)
+	}
+	var manifest backupManifest
+	if err = json.NewDecoder(reader).Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("could not decode backup manifest: %w", err)
+	}
+	if manifest.Version != backupVersion {
+		return nil, fmt.Errorf("unsupported backup version %d", manifest.Version)
+	}
+
+	manifests := make(map[string]backupServiceManifest, len(manifest.Services))
+	for _, serviceManifest := range manifest.Services {
+		manifests[serviceManifest.Name] = serviceManifest
+	}
+	for _, name := range r.required {
+		if _, found := manifests[name]; !found {
+			return nil, fmt.Errorf("service %q is not in the backup", name)
+		}
+	}
+
+	reports := make(map[string]restoreReport, len(r.services))
+	for {
+		header, err = reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return reports, fmt.Errorf("could not read backup: %w", err)
+		}
+
+		name := strings.TrimSuffix(strings.TrimPrefix(header.Name, backupServicesDir), ".ndjson")
+		service, found := r.services[name]
+		if !found {
+			continue
+		}
+		if fingerprint := getConfigFingerprint(service.Cfg); fingerprint != manifests[name].Fingerprint {
+			r.logger.Warnf("service %q: configuration of fields changed since the backup was created", name)
+		}
+
+		report, err := r.restoreService(ctx, service, reader)
+		if err != nil {
+			return reports, fmt.Errorf("could not restore service %q: %w", name, err)
+		}
+		reports[name] = report
+
+		r.logReport(name, report)
+
+		// restored entities are stored without claiming values of their unique keys and indexing their references
+		if !r.dryRun {
+			if err = service.RebuildIndexes(ctx, false, r.logger); err != nil {
+				return reports, fmt.Errorf("service %q restored but its indexes not: %w", name, err)
+			}
+		}
+	}
+
+	return reports, nil
+}
+
+func (r *restore) restoreService(ctx context.Context, service Service, entities io.Reader) (restoreReport, error) {
+	var report restoreReport
+	serviceName := service.Cfg.Name
+
+	// checksums of current entities, entities found in the backup are removed
+	current := make(map[string][]byte)
+	cursor := ""
+	for {
+		page, next, err := listPage(ctx, service.Storage, serviceName, cursor, r.pageSize)
+		if err != nil {
+			return report, err
+		}
+		for _, e := range page {
+			if current[e.Id], err = entityChecksum(e); err != nil {
+				return report, err
+			}
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+
+	scanner := bufio.NewScanner(entities)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var e Entity
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return report, fmt.Errorf("could not decode entity: %w", err)
+		}
+		sum, err := entityChecksum(e)
+		if err != nil {
+			return report, err
+		}
+
+		currentSum, found := current[e.Id]
+		delete(current, e.Id)
+		switch {
+		case !found:
+			report.Added++
+			r.logDiff(serviceName, "+", e.Id)
+			err = r.insert(ctx, serviceName, e)
+		case !bytes.Equal(sum, currentSum):
+			report.Changed++
+			r.logDiff(serviceName, "~", e.Id)
+			if r.mode == restoreModeOverwrite {
+				err = r.replace(ctx, serviceName, e)
+			}
+		default:
+			report.Unchanged++
+		}
+		if err != nil {
+			return report, err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return report, fmt.Errorf("could not read backup: %w", err)
+	}
+
+	ids := make([]string, 0, len(current))
+	for id := range current {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		report.Removed++
+		r.logDiff(serviceName, "-", id)
+		// entities referencing the removed entity are handled by on_delete of their ref fields
+		if r.mode == restoreModeOverwrite && !r.dryRun {
+			if err := service.deletePermanently(ctx, serviceName, Entity{Id: id}); err != nil {
+				return report, fmt.Errorf("could not delete entity %q: %w", id, err)
+			}
+		}
+	}
+
+	return report, nil
+}
+
+func (r *restore) insert(ctx context.Context, serviceName string, e Entity) error {
+	if r.dryRun {
+		return nil
+	}
+
+	// already expired entities are not kept by storages with TTL
+	err := r.services[serviceName].Storage.Insert(ctx, serviceName, e)
+	if err != nil && !errors.Is(err, errEntityExists) && !errors.Is(err, errEntityExpired) {
+		return fmt.Errorf("could not insert entity %q: %w", e.Id, err)
+	}
+
+	return nil
+}
+
+func (r *restore) replace(ctx context.Context, serviceName string, e Entity) error {
+	if r.dryRun {
+		return nil
+	}
+
+	if err := r.services[serviceName].Storage.Delete(ctx, serviceName, e.Id); err != nil {
+		return fmt.Errorf("could not delete entity %q: %w", e.Id, err)
+	}
+
+	return r.insert(ctx, serviceName, e)
+}
+
+func (r *restore) logReport(serviceName string, report restoreReport) {
+	action := "restored"
+	if r.dryRun {
+		action = "would be restored"
+	}
+	if r.mode == restoreModeMerge {
+		r.logger.Infof("service %q: %d entities %s, %d changed and %d missing in the backup are kept, %d unchanged",
+			serviceName, report.Added, action, report.Changed, report.Removed, report.Unchanged)
+		return
+	}
+	r.logger.Infof("service %q: %d entities %s, %d replaced, %d removed, %d unchanged",
+		serviceName, report.Added+report.Changed, action, report.Changed, report.Removed, report.Unchanged)
+}
+
+// logDiff logs difference between the backup and the storage in dry run
+func (r *restore) logDiff(serviceName, change, id string) {
+	if r.dryRun {
+		r.logger.Infof("service %q: %s %s", serviceName, change, id)
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func backupTestServices(t *testing.T) []Service {
+	t.Setenv("BOLT_FILE", filepath.Join(t.TempDir(), "usa.db"))
+	bolt, err := CreateBoltStorage([]string{"cats"})
+	assert.Nil(t, err)
+	t.Cleanup(func() {
+		_ = bolt.Close()
+	})
+
+	return []Service{
+		{Cfg: testServiceConfig("dogs"), Storage: CreateMemStorage([]string{"dogs"})},
+		{Cfg: testServiceConfig("cats"), Storage: bolt},
+	}
+}
+
+func TestBackupRestore(t *testing.T) {
+	ctx := context.Background()
+	services := backupTestServices(t)
+	dogs, cats := services[0], services[1]
+
+	var rex, buddy Entity
+	var err error
+	rex, err = dogs.Storage.Add(ctx, "dogs", map[string]interface{}{"name": "rex"})
+	assert.Nil(t, err)
+	buddy, err = dogs.Storage.Add(ctx, "dogs", map[string]interface{}{"name": "buddy"})
+	assert.Nil(t, err)
+	_, err = cats.Storage.Add(ctx, "cats", map[string]interface{}{"name": "tom"})
+	assert.Nil(t, err)
+
+	var archive bytes.Buffer
+	manifest, err := createBackup(ctx, services, &archive)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, manifest.Services[0].Entities)
+	assert.Equal(t, 1, manifest.Services[1].Entities)
+	assert.Equal(t, getConfigFingerprint(dogs.Cfg), manifest.Services[0].Fingerprint)
+
+	// rex is deleted, buddy is changed and a new dog is added after the backup
+	assert.Nil(t, dogs.Storage.Delete(ctx, "dogs", rex.Id))
+	assert.Nil(t, dogs.Storage.Delete(ctx, "dogs", buddy.Id))
+	changed := buddy
+	changed.Payload = map[string]interface{}{"name": "maximus"}
+	assert.Nil(t, dogs.Storage.Insert(ctx, "dogs", changed))
+	added, err := dogs.Storage.Add(ctx, "dogs", map[string]interface{}{"name": "bob"})
+	assert.Nil(t, err)
+	expected := map[string]restoreReport{
+		"dogs": {Added: 1, Changed: 1, Removed: 1},
+		"cats": {Unchanged: 1},
+	}
+
+	// dry run does not change anything
+	r, err := createRestore(services, restoreModeOverwrite, logrus.New())
+	assert.Nil(t, err)
+	r.dryRun = true
+	reports, err := r.Run(ctx, bytes.NewReader(archive.Bytes()))
+	assert.Nil(t, err)
+	assert.Equal(t, expected, reports)
+	list, _ := dogs.Storage.List(ctx, "dogs")
+	assert.Len(t, list, 2)
+
+	// merge restores only missing entities
+	r, err = createRestore(services, restoreModeMerge, logrus.New())
+	assert.Nil(t, err)
+	reports, err = r.Run(ctx, bytes.NewReader(archive.Bytes()))
+	assert.Nil(t, err)
+	assert.Equal(t, expected, reports)
+	list, _ = dogs.Storage.List(ctx, "dogs")
+	assert.Len(t, list, 3)
+	e, err := dogs.Storage.Get(ctx, "dogs", buddy.Id)
+	assert.Nil(t, err)
+	assert.Equal(t, changed.Payload, e.Payload)
+
+	// overwrite restores the exact state of the backup
+	r, err = createRestore(services, restoreModeOverwrite, logrus.New())
+	assert.Nil(t, err)
+	reports, err = r.Run(ctx, bytes.NewReader(archive.Bytes()))
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]restoreReport{
+		"dogs": {Changed: 1, Removed: 1, Unchanged: 1},
+		"cats": {Unchanged: 1},
+	}, reports)
+	list, _ = dogs.Storage.List(ctx, "dogs")
+	assert.Len(t, list, 2)
+	for k, e := range []Entity{rex, buddy} {
+		assert.Equal(t, e.Id, list[k].Id)
+		assert.Equal(t, e.Payload, list[k].Payload)
+		assert.True(t, e.Created.Equal(list[k].Created))
+	}
+	_, err = dogs.Storage.Get(ctx, "dogs", added.Id)
+	assert.Error(t, err)
+
+	// single service is restored, unknown service is refused
+	r, err = createRestore(services[1:], restoreModeOverwrite, logrus.New())
+	assert.Nil(t, err)
+	reports, err = r.Run(ctx, bytes.NewReader(archive.Bytes()))
+	assert.Nil(t, err)
+	assert.Len(t, reports, 1)
+
+	r, err = createRestore([]Service{{Cfg: testServiceConfig("birds"), Storage: CreateMemStorage(nil)}}, restoreModeMerge, logrus.New())
+	assert.Nil(t, err)
+	_, err = r.Run(ctx, bytes.NewReader(archive.Bytes()))
+	assert.Contains(t, err.Error(), `service "birds" is not in the backup`)
+
+	_, err = createRestore(services, "replace", logrus.New())
+	assert.Error(t, err)
+}
+
+func TestBackupInternalServices(t *testing.T) {
+	ctx := context.Background()
+	cfg := testServiceConfig("dogs")
+	cfg.History, cfg.SoftDelete = true, true
+	storage := CreateMemStorage([]string{"dogs", getHistoryServiceName("dogs"), getTrashServiceName("dogs")})
+	dogs := Service{Cfg: cfg, Storage: storage}
+
+	_, err := dogs.Put(ctx, map[string]interface{}{"name": "rex"}, nil)
+	assert.Nil(t, err)
+	list, _ := dogs.List(ctx)
+	assert.Nil(t, dogs.Delete(ctx, list[0].Id, 0))
+
+	var archive bytes.Buffer
+	manifest, err := createBackup(ctx, []Service{dogs}, &archive)
+	assert.Nil(t, err)
+	assert.Len(t, manifest.Services, 3)
+
+	// history and trash are restored with the service
+	restored := Service{Cfg: cfg, Storage: CreateMemStorage([]string{"dogs", getHistoryServiceName("dogs"), getTrashServiceName("dogs")})}
+	r, err := createRestore([]Service{restored}, restoreModeMerge, logrus.New())
+	assert.Nil(t, err)
+	reports, err := r.Run(ctx, bytes.NewReader(archive.Bytes()))
+	assert.Nil(t, err)
+	assert.Equal(t, restoreReport{Added: 2}, reports[getHistoryServiceName("dogs")])
+	assert.Equal(t, restoreReport{Added: 1}, reports[getTrashServiceName("dogs")])
+	_, err = restored.Undelete(ctx, list[0].Id)
+	assert.Nil(t, err)
+}
+
+func TestRestoreUniqueIndex(t *testing.T) {
+	ctx := context.Background()
+	yes := true
+	cfg := testServiceConfig("people")
+	cfg.Fields["name"].Unique = &yes
+	people := Service{Cfg: cfg, Storage: CreateMemStorage([]string{"people", getUniqueServiceName("people")})}
+	_, err := people.Put(ctx, map[string]interface{}{"name": "alice"}, nil)
+	assert.Nil(t, err)
+
+	var archive bytes.Buffer
+	_, err = createBackup(ctx, []Service{people}, &archive)
+	assert.Nil(t, err)
+
+	// values of restored entities are claimed
+	restored := Service{Cfg: cfg, Storage: CreateMemStorage([]string{"people", getUniqueServiceName("people")})}
+	r, err := createRestore([]Service{restored}, restoreModeMerge, logrus.New())
+	assert.Nil(t, err)
+	_, err = r.Run(ctx, bytes.NewReader(archive.Bytes()))
+	assert.Nil(t, err)
+	_, err = restored.Put(ctx, map[string]interface{}{"name": "alice"}, nil)
+	assert.ErrorIs(t, err, errUniqueViolation)
+
+	// restored entity using a value of other entity fails the restore
+	conflicting := Service{Cfg: cfg, Storage: CreateMemStorage([]string{"people", getUniqueServiceName("people")})}
+	_, err = conflicting.Put(ctx, map[string]interface{}{"name": "alice"}, nil)
+	assert.Nil(t, err)
+	r, err = createRestore([]Service{conflicting}, restoreModeMerge, logrus.New())
+	assert.Nil(t, err)
+	_, err = r.Run(ctx, bytes.NewReader(archive.Bytes()))
+	assert.ErrorIs(t, err, errUniqueViolation)
+}
+
+func TestRestoreRefs(t *testing.T) {
+	ctx := context.Background()
+	people, dogs := createTestRefServices(OnDeleteCascade)
+	var archive bytes.Buffer
+	_, err := createBackup(ctx, []Service{people, dogs}, &archive)
+	assert.Nil(t, err)
+
+	// entities referencing entities removed by the restore are handled by on_delete
+	alice, err := people.Put(ctx, map[string]interface{}{"name": "alice"}, nil)
+	assert.Nil(t, err)
+	rex, err := dogs.Put(ctx, map[string]interface{}{"name": "rex", "owner": alice.Id}, nil)
+	assert.Nil(t, err)
+	r, err := createRestore([]Service{people}, restoreModeOverwrite, logrus.New())
+	assert.Nil(t, err)
+	reports, err := r.Run(ctx, bytes.NewReader(archive.Bytes()))
+	assert.Nil(t, err)
+	assert.Equal(t, restoreReport{Removed: 1}, reports["people"])
+	_, err = dogs.Get(ctx, rex.Id)
+	assert.ErrorIs(t, err, errEntityNotFound)
+}
+
+func TestBackupTargets(t *testing.T) {
+	ctx := context.Background()
+	services := backupTestServices(t)
+	_, err := services[0].Storage.Add(ctx, "dogs", map[string]interface{}{"name": "rex"})
+	assert.Nil(t, err)
+
+	fake := newFakeS3(t)
+	dir := filepath.Join(t.TempDir(), "backups")
+	for _, location := range []string{dir, "s3://" + testBucketName + "/backups"} {
+		target, err := createBackupTarget(location)
+		assert.Nil(t, err, location)
+
+		created := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+		for k := 0; k < 3; k++ {
+			name := getBackupName(created.Add(time.Duration(k) * time.Hour))
+			assert.Nil(t, target.Save(ctx, name, bytes.NewReader([]byte("backup"))), location)
+		}
+
+		name, err := backupToTarget(ctx, services, target, 2, logrus.New())
+		assert.Nil(t, err, location)
+		names, err := target.List(ctx)
+		assert.Nil(t, err, location)
+		assert.Equal(t, []string{"usa-backup-20240501T140000Z.tar.gz", name}, names, location)
+
+		// point in time selects the latest older backup
+		found, err := findBackup(ctx, target, created.Add(150*time.Minute))
+		assert.Nil(t, err, location)
+		assert.Equal(t, names[0], found, location)
+		_, err = findBackup(ctx, target, created)
+		assert.Error(t, err, location)
+
+		found, err = findBackup(ctx, target, time.Now())
+		assert.Nil(t, err, location)
+		archive, err := target.Open(ctx, found)
+		assert.Nil(t, err, location)
+		r, err := createRestore(services, restoreModeMerge, logrus.New())
+		assert.Nil(t, err)
+		reports, err := r.Run(ctx, archive)
+		assert.Nil(t, err, location)
+		assert.Equal(t, restoreReport{Unchanged: 1}, reports["dogs"], location)
+		assert.Nil(t, archive.Close())
+	}
+	assert.Contains(t, fake.objects, "backups/usa-backup-20240501T140000Z.tar.gz")
+}
@@ -1,24 +1,62 @@
 package main
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
-	"github.com/go-yaml/yaml"
 	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+	"io"
 	"os"
+	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 )
 
 type Config struct {
 	ServiceConfigs []ServiceConfig
+	StorageConfigs []StorageConfig
 	logger         *logrus.Logger
 }
 
+// configFile represents one configuration file. The file can contain just a list of services
+// or a document with services, named storages and reusable field fragments shared across all files.
+type configFile struct {
+	Services  []ServiceConfig         `yaml:"services"`
+	Storages  []StorageConfig         `yaml:"storages"`
+	Fragments map[string]*FieldConfig `yaml:"fragments"`
+}
+
+// StorageConfig is a named storage instance used by services. Storages read their settings from environment
+// variables; Env overrides them for this instance, so more instances of the same type can be configured.
+type StorageConfig struct {
+	Name string            `yaml:"name"`
+	Type string            `yaml:"type"`
+	Env  map[string]string `yaml:"env"`
+}
+
 type ServiceConfig struct {
-	Name      string                  `yaml:"name"`
-	ApiConfig ApiConfig               `yaml:"api"`
-	Fields    map[string]*FieldConfig `yaml:"fields"`
+	Name           string                  `yaml:"name"`
+	Path           string                  `yaml:"path"`            // URL path of the service, name is used when empty
+	Storage        string                  `yaml:"storage"`         // storage name (or type) of the service, default storage is used when empty
+	History        bool                    `yaml:"history"`         // keep every version of entities
+	SoftDelete     bool                    `yaml:"soft_delete"`     // deleted entities are moved to trash and can be restored
+	TrashRetention string                  `yaml:"trash_retention"` // deleted entities are purged after it (e.g. 30d), kept when empty
+	Retention      string                  `yaml:"retention"`       // entities are deleted after it (e.g. 30d), kept when empty
+	Expiration     bool                    `yaml:"expiration"`      // entities can expire at their own time (X-Expires-At header)
+	Idempotency    string                  `yaml:"idempotency"`     // how long Idempotency-Key of create is remembered (e.g. 24h), ignored when empty
+	UniqueKeys     []UniqueKeyConfig       `yaml:"unique_keys"`     // combinations of fields unique across entities
+	ApiConfig      ApiConfig               `yaml:"api"`
+	Fields         map[string]*FieldConfig `yaml:"fields"`
+}
+
+// UniqueKeyConfig is a combination of top-level fields which no two entities of the service can share
+type UniqueKeyConfig struct {
+	Fields          []string `yaml:"fields"`
+	CaseInsensitive bool     `yaml:"case_insensitive"` // strings are compared in lower case (e.g. emails)
 }
 
 type ApiConfig struct {
@@ -43,6 +81,14 @@ const (
 	FieldTypeInt              = 3
 	FieldTypeFloat            = 4
 	FieldTypeDate             = 5
+	FieldTypeRef              = 6
+)
+
+// behaviour of references to the entity when it is deleted
+const (
+	OnDeleteRestrict = "restrict" // the entity cannot be deleted while it is referenced
+	OnDeleteCascade  = "cascade"  // referencing entities are deleted too
+	OnDeleteSetNull  = "set-null" // references are set to null
 )
 
 type FieldRule uint8
@@ -54,6 +100,7 @@ const (
 
 type FieldConfig struct {
 	Name     string
+	Ref      *string                  `yaml:"$ref,omitempty"` // name of the fragment
 	Type     string                   `yaml:"type"`
 	Required *bool                    `yaml:"required,omitempty"`
 	Min      *int                     `yaml:"min,omitempty"`
@@ -62,6 +109,19 @@ type FieldConfig struct {
 	Rule     *string                  `yaml:"rule,omitempty"`
 	Fields   *map[string]*FieldConfig `yaml:"fields"`
 	Items    *FieldConfig             `yaml:"items"`
+	// Unique top-level field cannot have the same value in two entities, CaseInsensitive compares strings in lower case
+	Unique          *bool `yaml:"unique,omitempty"`
+	CaseInsensitive *bool `yaml:"case_insensitive,omitempty"`
+	// Service is name of the service referenced by ref field, OnDelete is what happens when the referenced entity
+	// is deleted (restrict by default)
+	Service  *string `yaml:"service,omitempty"`
+	OnDelete *string `yaml:"on_delete,omitempty"`
+	// Default is value of the field missing in the payload (`now` for dates and `uuid` for strings are generated),
+	// Nullable allows null value which is kept in the payload
+	Default  interface{} `yaml:"default,omitempty"`
+	Nullable *bool       `yaml:"nullable,omitempty"`
+	// Computed top-level field is set from other field (e.g. `slug(name)`), value sent by clients is ignored
+	Computed *string `yaml:"computed,omitempty"`
 }
 
 type Limit struct {
@@ -71,15 +131,61 @@ type Limit struct {
 	Unlimited bool
 }
 
-func ParseConfig(filename string, logger *logrus.Logger) (*Config, error) {
-	var apiConfigs []ServiceConfig
-	content, err := os.ReadFile(filename)
+// ParseConfig loads configuration from a file, all yaml files in a directory or files matching a glob pattern
+func ParseConfig(path string, logger *logrus.Logger) (*Config, error) {
+	filenames, err := resolveConfigFiles(path)
 	if err != nil {
-		return nil, fmt.Errorf("could not read data from file %q", filename)
+		return nil, err
 	}
 
-	if err = yaml.Unmarshal(content, &apiConfigs); err != nil {
-		return nil, fmt.Errorf("could not unmarshal yaml data from file %q", filename)
+	var apiConfigs []ServiceConfig
+	var storageConfigs []StorageConfig
+	fragments := make(map[string]*FieldConfig)
+	serviceOrigins := make(map[string]string)
+	storageOrigins := make(map[string]string)
+	fragmentOrigins := make(map[string]string)
+	for _, filename := range filenames {
+		file, err := parseConfigFile(filename)
+		if err != nil {
+			return nil, err
+		}
+
+		for name, fragment := range file.Fragments {
+			if origin, found := fragmentOrigins[name]; found {
+				return nil, fmt.Errorf("fragment %q from file %q is already defined in file %q", name, filename, origin)
+			}
+			fragmentOrigins[name] = filename
+			fragments[name] = fragment
+		}
+
+		for _, storage := range file.Storages {
+			if origin, found := storageOrigins[storage.Name]; found {
+				return nil, fmt.Errorf("storage %q from file %q is already defined in file %q", storage.Name, filename, origin)
+			}
+			storageOrigins[storage.Name] = filename
+			storageConfigs = append(storageConfigs, storage)
+		}
+
+		for _, service := range file.Services {
+			if origin, found := serviceOrigins[service.Name]; found {
+				return nil, fmt.Errorf("service %q from file %q is already defined in file %q", service.Name, filename, origin)
+			}
+			serviceOrigins[service.Name] = filename
+			apiConfigs = append(apiConfigs, service)
+		}
+
+		logger.Debugf("configuration file %q loaded", filename)
+	}
+
+	// replace fragment references with copies of fragments
+	for _, service := range apiConfigs {
+		for name, field := range service.Fields {
+			resolved, err := resolveFieldRefs(field, fragments, nil)
+			if err != nil {
+				return nil, fmt.Errorf("service %q, field %q: %w", service.Name, name, err)
+			}
+			service.Fields[name] = resolved
+		}
 	}
 
 	// backfill names from map keys to map values
@@ -90,12 +196,188 @@ func ParseConfig(filename string, logger *logrus.Logger) (*Config, error) {
 	}
 	cfg := Config{
 		ServiceConfigs: apiConfigs,
+		StorageConfigs: storageConfigs,
 		logger:         logger,
 	}
 
 	return &cfg, nil
 }
 
+// resolveConfigFiles returns sorted list of configuration files for given path
+func resolveConfigFiles(path string) ([]string, error) {
+	var filenames []string
+	if strings.ContainsAny(path, "*?[") {
+		matches, err := filepath.Glob(path)
+		if err != nil {
+			return nil, fmt.Errorf("invalid glob pattern %q: %w", path, err)
+		}
+		filenames = matches
+	} else {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, fmt.Errorf("could not read configuration from %q", path)
+		}
+		if !info.IsDir() {
+			return []string{path}, nil
+		}
+
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return nil, fmt.Errorf("could not read configuration directory %q", path)
+		}
+		for _, entry := range entries {
+			ext := filepath.Ext(entry.Name())
+			if !entry.IsDir() && (ext == ".yml" || ext == ".yaml") {
+				filenames = append(filenames, filepath.Join(path, entry.Name()))
+			}
+		}
+	}
+
+	if len(filenames) == 0 {
+		return nil, fmt.Errorf("no configuration files found in %q", path)
+	}
+	sort.Strings(filenames)
+
+	return filenames, nil
+}
+
+func parseConfigFile(filename string) (configFile, error) {
+	var file configFile
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return file, fmt.Errorf("could not read data from file %q", filename)
+	}
+
+	// detect whether the file is a plain list of services or a document
+	var raw interface{}
+	if err = decodeYaml(content, &raw); err != nil {
+		return file, fmt.Errorf("could not unmarshal yaml data from file %q: %w", filename, err)
+	}
+
+	switch raw.(type) {
+	case nil:
+		return file, nil
+	case []interface{}:
+		err = decodeYaml(content, &file.Services)
+	case map[string]interface{}:
+		err = decodeYaml(content, &file)
+	default:
+		return file, fmt.Errorf("file %q must contain list of services or services and fragments", filename)
+	}
+
+	if err != nil {
+		return file, fmt.Errorf("could not unmarshal yaml data from file %q: %w", filename, err)
+	}
+
+	return file, nil
+}
+
+// decodeYaml decodes the first yaml document; unknown keys are rejected so typos in configuration are not ignored
+func decodeYaml(content []byte, out interface{}) error {
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(out); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+
+	return nil
+}
+
+// resolveFieldRefs returns the field with all fragment references replaced. Options set next to the reference
+// (all options except type, fields and items) override options of the fragment.
+func resolveFieldRefs(field *FieldConfig, fragments map[string]*FieldConfig, stack []string) (*FieldConfig, error) {
+	if field == nil {
+		return nil, nil
+	}
+
+	resolved := *field
+	if field.Ref != nil {
+		refName := *field.Ref
+		for _, name := range stack {
+			if name == refName {
+				return nil, fmt.Errorf("circular reference of fragment %q", refName)
+			}
+		}
+
+		fragment, found := fragments[refName]
+		if !found {
+			return nil, fmt.Errorf("unknown fragment %q", refName)
+		}
+		if field.Type != "" || field.Fields != nil || field.Items != nil {
+			return nil, fmt.Errorf("type, fields and items cannot be combined with fragment reference %q", refName)
+		}
+
+		base, err := resolveFieldRefs(fragment, fragments, append(stack, refName))
+		if err != nil {
+			return nil, err
+		}
+
+		resolved = *base
+		if field.Required != nil {
+			resolved.Required = field.Required
+		}
+		if field.Min != nil {
+			resolved.Min = field.Min
+		}
+		if field.Max != nil {
+			resolved.Max = field.Max
+		}
+		if field.Format != nil {
+			resolved.Format = field.Format
+		}
+		if field.Rule != nil {
+			resolved.Rule = field.Rule
+		}
+		if field.Unique != nil {
+			resolved.Unique = field.Unique
+		}
+		if field.CaseInsensitive != nil {
+			resolved.CaseInsensitive = field.CaseInsensitive
+		}
+		if field.Service != nil {
+			resolved.Service = field.Service
+		}
+		if field.OnDelete != nil {
+			resolved.OnDelete = field.OnDelete
+		}
+		if field.Default != nil {
+			resolved.Default = field.Default
+		}
+		if field.Nullable != nil {
+			resolved.Nullable = field.Nullable
+		}
+		if field.Computed != nil {
+			resolved.Computed = field.Computed
+		}
+		resolved.Ref = nil
+
+		return &resolved, nil
+	}
+
+	// copy nested fields so the fragment can be shared by multiple services
+	if field.Fields != nil {
+		fields := make(map[string]*FieldConfig, len(*field.Fields))
+		for name, f := range *field.Fields {
+			r, err := resolveFieldRefs(f, fragments, stack)
+			if err != nil {
+				return nil, fmt.Errorf("field %q: %w", name, err)
+			}
+			fields[name] = r
+		}
+		resolved.Fields = &fields
+	}
+
+	if field.Items != nil {
+		items, err := resolveFieldRefs(field.Items, fragments, stack)
+		if err != nil {
+			return nil, fmt.Errorf("items: %w", err)
+		}
+		resolved.Items = items
+	}
+
+	return &resolved, nil
+}
+
 func (c *Config) GetServiceNames() []string {
 	var services []string
 
@@ -106,17 +388,194 @@ func (c *Config) GetServiceNames() []string {
 	return services
 }
 
+// GetStorageServiceConfigs returns services stored in storages including internal services (history of entities,
+// trash of deleted entities, idempotency keys, unique values, references)
+func (c *Config) GetStorageServiceConfigs() []ServiceConfig {
+	configs := make([]ServiceConfig, 0, len(c.ServiceConfigs))
+	for _, service := range c.ServiceConfigs {
+		configs = append(configs, service)
+		if service.History {
+			configs = append(configs, ServiceConfig{Name: getHistoryServiceName(service.Name), Storage: service.Storage})
+		}
+		if service.SoftDelete {
+			configs = append(configs, ServiceConfig{Name: getTrashServiceName(service.Name), Storage: service.Storage})
+		}
+		if service.Idempotency != "" {
+			configs = append(configs, ServiceConfig{Name: getIdempotencyServiceName(service.Name), Storage: service.Storage})
+		}
+		if len(service.GetUniqueKeys()) > 0 {
+			configs = append(configs, ServiceConfig{Name: getUniqueServiceName(service.Name), Storage: service.Storage})
+		}
+		if len(service.GetRefFields()) > 0 {
+			configs = append(configs, ServiceConfig{Name: getRefsServiceName(service.Name), Storage: service.Storage})
+		}
+	}
+
+	return configs
+}
+
+// SelectServices keeps only services with given names; all services are kept when no name is given
+func (c *Config) SelectServices(names []string) error {
+	if len(names) == 0 {
+		return nil
+	}
+
+	services := make(map[string]ServiceConfig, len(c.ServiceConfigs))
+	for _, service := range c.ServiceConfigs {
+		services[service.Name] = service
+	}
+
+	selected := make([]ServiceConfig, 0, len(names))
+	for _, name := range names {
+		service, found := services[name]
+		if !found {
+			return fmt.Errorf("unknown service %q", name)
+		}
+		selected = append(selected, service)
+	}
+	c.ServiceConfigs = selected
+
+	return nil
+}
+
+func (c *Config) GetServicePaths() []string {
+	var paths []string
+
+	for _, service := range c.ServiceConfigs {
+		paths = append(paths, service.GetPath())
+	}
+
+	return paths
+}
+
 func (c *Config) Validate() error {
+	if err := c.validateStorageConfigs(); err != nil {
+		return err
+	}
 	for _, serviceConfig := range c.ServiceConfigs {
+		if serviceConfig.Storage != "" && !c.hasStorage(serviceConfig.Storage) {
+			return fmt.Errorf("service %q: unknown storage %q", serviceConfig.Name, serviceConfig.Storage)
+		}
+		if _, err := serviceConfig.ParseRetention(); err != nil {
+			return fmt.Errorf("service %q: %w", serviceConfig.Name, err)
+		}
+		if serviceConfig.TrashRetention != "" {
+			if !serviceConfig.SoftDelete {
+				return fmt.Errorf("service %q: trash retention requires soft delete", serviceConfig.Name)
+			}
+			if _, err := serviceConfig.ParseTrashRetention(); err != nil {
+				return fmt.Errorf("service %q: %w", serviceConfig.Name, err)
+			}
+		}
+		if serviceConfig.Idempotency != "" {
+			if _, err := serviceConfig.ParseIdempotency(); err != nil {
+				return fmt.Errorf("service %q: %w", serviceConfig.Name, err)
+			}
+		}
+		if err := serviceConfig.validateUniqueKeys(); err != nil {
+			return fmt.Errorf("service %q: %w", serviceConfig.Name, err)
+		}
 		for _, fc := range serviceConfig.Fields {
 			if err := c.validateFieldConfig(fc); err != nil {
 				return err
 			}
+			if err := c.validateRefFieldConfig(fc); err != nil {
+				return fmt.Errorf("service %q: %w", serviceConfig.Name, err)
+			}
+			if err := serviceConfig.validateComputedField(fc); err != nil {
+				return fmt.Errorf("service %q: %w", serviceConfig.Name, err)
+			}
 		}
 	}
 	return nil
 }
 
+// validateStorageConfigs checks named storages have unique names and known types
+func (c *Config) validateStorageConfigs() error {
+	names := make([]string, 0, len(c.StorageConfigs))
+	for _, storage := range c.StorageConfigs {
+		names = append(names, storage.Name)
+		if !isStorageType(storage.Type) {
+			return fmt.Errorf("storage %q: unknown storage type %q", storage.Name, storage.Type)
+		}
+	}
+
+	return validateSlugs("storage name", names)
+}
+
+// hasStorage reports whether the name is a named storage or a storage type
+func (c *Config) hasStorage(name string) bool {
+	for _, storage := range c.StorageConfigs {
+		if storage.Name == name {
+			return true
+		}
+	}
+
+	return isStorageType(name)
+}
+
+// GetStorageConfig returns the named storage; a storage type without named storage is an instance of that type
+func (c *Config) GetStorageConfig(name string) StorageConfig {
+	for _, storage := range c.StorageConfigs {
+		if storage.Name == name {
+			return storage
+		}
+	}
+
+	return StorageConfig{Name: name, Type: name}
+}
+
+// validateComputedField checks the computed field is a string computed from other top-level string field
+func (s ServiceConfig) validateComputedField(fc *FieldConfig) error {
+	if fc.Computed == nil {
+		return nil
+	}
+	if fc.Type != "string" {
+		return fmt.Errorf("field config error %q: computed field must be a string", fc.Name)
+	}
+	if fc.Default != nil || (fc.Required != nil && *fc.Required) {
+		return fmt.Errorf("field config error %q: computed field cannot have default or be required", fc.Name)
+	}
+
+	_, source, err := parseComputed(*fc.Computed)
+	if err != nil {
+		return fmt.Errorf("field config error %q: %w", fc.Name, err)
+	}
+	field, found := s.Fields[source]
+	if !found || field.Type != "string" || field.Computed != nil {
+		return fmt.Errorf("field config error %q: computed from %q which is not a string field", fc.Name, source)
+	}
+
+	return nil
+}
+
+// validateRefFieldConfig checks the top-level ref field references a configured service
+func (c *Config) validateRefFieldConfig(fc *FieldConfig) error {
+	if fieldType, _ := fc.GetType(); fieldType != FieldTypeRef {
+		return nil
+	}
+
+	found := false
+	for _, service := range c.ServiceConfigs {
+		found = found || service.Name == *fc.Service
+	}
+	if !found {
+		return fmt.Errorf("field config error %q: unknown referenced service %q", fc.Name, *fc.Service)
+	}
+
+	switch fc.GetOnDelete() {
+	case OnDeleteRestrict, OnDeleteCascade:
+	case OnDeleteSetNull:
+		if fc.Nullable == nil || !*fc.Nullable {
+			return fmt.Errorf("field config error %q: reference set to null must be nullable", fc.Name)
+		}
+	default:
+		return fmt.Errorf("field config error %q: invalid on_delete %q, use %q, %q or %q", fc.Name, *fc.OnDelete, OnDeleteRestrict, OnDeleteCascade, OnDeleteSetNull)
+	}
+
+	return nil
+}
+
 func (c *Config) validateFieldConfig(fc *FieldConfig) error {
 	name := fc.Name
 	fieldType, err := fc.GetType()
@@ -133,6 +592,15 @@ func (c *Config) validateFieldConfig(fc *FieldConfig) error {
 			return fmt.Errorf("field config error %q: at least one field must be specifid", name)
 		}
 		for _, f := range *fc.Fields {
+			if f.Unique != nil && *f.Unique {
+				return fmt.Errorf("field config error %q: only top-level fields can be unique", f.Name)
+			}
+			if f.Computed != nil {
+				return fmt.Errorf("field config error %q: only top-level fields can be computed", f.Name)
+			}
+			if f.Type == "ref" {
+				return fmt.Errorf("field config error %q: only top-level fields can be references", f.Name)
+			}
 			if err = c.validateFieldConfig(f); err != nil {
 				return err
 			}
@@ -150,6 +618,15 @@ func (c *Config) validateFieldConfig(fc *FieldConfig) error {
 		if fc.Items == nil {
 			return fmt.Errorf("field config error %q: items must be specified", name)
 		}
+		if fc.Items.Unique != nil && *fc.Items.Unique {
+			return fmt.Errorf("field config error %q: only top-level fields can be unique", name)
+		}
+		if fc.Items.Type == "ref" {
+			return fmt.Errorf("field config error %q: only top-level fields can be references", name)
+		}
+		if fc.Items.Computed != nil || fc.Items.Default != nil {
+			return fmt.Errorf("field config error %q: items cannot have default or be computed", name)
+		}
 		if err = c.validateFieldConfig(fc.Items); err != nil {
 			return err
 		}
@@ -180,6 +657,24 @@ func (c *Config) validateFieldConfig(fc *FieldConfig) error {
 		if fc.Min != nil && fc.Max != nil && *fc.Min > *fc.Max {
 			return fmt.Errorf("field config error %q: invalid setting of min/max - min > max", name)
 		}
+	case FieldTypeRef:
+		if fc.Service == nil || *fc.Service == "" {
+			return fmt.Errorf("field config error %q: referenced service must be specified", name)
+		}
+	}
+	if fieldType != FieldTypeRef && (fc.Service != nil || fc.OnDelete != nil) {
+		return fmt.Errorf("field config error %q: service and on_delete can be set for ref fields only", name)
+	}
+	// default is used when the field is missing, which a required field can not be
+	if fc.Default != nil && fc.Required != nil && *fc.Required {
+		return fmt.Errorf("field config error %q: required field can not have default", name)
+	}
+	if fc.Default != nil && !fc.isGeneratedDefault() {
+		optional := *fc
+		optional.Required = nil
+		if err = Validate(optional, fc.Default, true); err != nil {
+			return fmt.Errorf("field config error %q: invalid default: %w", name, err)
+		}
 	}
 
 	return nil
@@ -187,6 +682,7 @@ func (c *Config) validateFieldConfig(fc *FieldConfig) error {
 
 func fulfillFieldNames(name string, cfg *FieldConfig) {
 	cfg.Name = name
+	cfg.Default = normalizeYamlValue(cfg.Default)
 	if cfg.Fields != nil {
 		for n, f := range *cfg.Fields {
 			fulfillFieldNames(n, f)
@@ -198,6 +694,124 @@ func fulfillFieldNames(name string, cfg *FieldConfig) {
 	}
 }
 
+// GetPath returns URL path of the service (without leading slash)
+func (s ServiceConfig) GetPath() string {
+	if s.Path == "" {
+		return s.Name
+	}
+
+	return s.Path
+}
+
+// GetStorage returns storage name of the service
+func (s ServiceConfig) GetStorage(defaultStorage string) string {
+	if s.Storage == "" {
+		return defaultStorage
+	}
+
+	return s.Storage
+}
+
+// ParseRetention returns how long entities are kept after they were created, 0 when they are kept forever
+func (s ServiceConfig) ParseRetention() (time.Duration, error) {
+	if s.Retention == "" {
+		return 0, nil
+	}
+
+	retention, err := parseRetention(s.Retention)
+	if err != nil {
+		return 0, fmt.Errorf("could not parse retention: %w", err)
+	}
+
+	return retention, nil
+}
+
+// IsExpiring reports whether entities of the service can expire, so the janitor deletes them
+func (s ServiceConfig) IsExpiring() bool {
+	return s.Expiration || s.Retention != ""
+}
+
+// ParseTrashRetention returns how long deleted entities are kept in trash
+func (s ServiceConfig) ParseTrashRetention() (time.Duration, error) {
+	retention, err := parseRetention(s.TrashRetention)
+	if err != nil {
+		return 0, fmt.Errorf("could not parse trash retention: %w", err)
+	}
+
+	return retention, nil
+}
+
+// GetRefFields returns top-level ref fields of the service ordered by name
+func (s ServiceConfig) GetRefFields() []*FieldConfig {
+	var fields []*FieldConfig
+	for _, field := range s.Fields {
+		if fieldType, _ := field.GetType(); fieldType == FieldTypeRef {
+			fields = append(fields, field)
+		}
+	}
+	sort.Slice(fields, func(i, j int) bool { return fields[i].Name < fields[j].Name })
+
+	return fields
+}
+
+// GetUniqueKeys returns unique fields (ordered by name) followed by composite unique keys of the service
+func (s ServiceConfig) GetUniqueKeys() []UniqueKeyConfig {
+	var names []string
+	for name, field := range s.Fields {
+		if field.Unique != nil && *field.Unique {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	keys := make([]UniqueKeyConfig, 0, len(names)+len(s.UniqueKeys))
+	for _, name := range names {
+		caseInsensitive := s.Fields[name].CaseInsensitive != nil && *s.Fields[name].CaseInsensitive
+		keys = append(keys, UniqueKeyConfig{Fields: []string{name}, CaseInsensitive: caseInsensitive})
+	}
+
+	return append(keys, s.UniqueKeys...)
+}
+
+// validateUniqueKeys checks unique keys consist of top-level scalar fields
+func (s ServiceConfig) validateUniqueKeys() error {
+	for _, key := range s.GetUniqueKeys() {
+		if len(key.Fields) == 0 {
+			return fmt.Errorf("unique key must have at least one field")
+		}
+		for _, name := range key.Fields {
+			field, found := s.Fields[name]
+			if !found {
+				return fmt.Errorf("unique key %q: unknown field %q", key.GetName(), name)
+			}
+			fieldType, err := field.GetType()
+			if err != nil {
+				return err
+			}
+			if fieldType == FieldTypeObject || fieldType == FieldTypeArray {
+				return fmt.Errorf("unique key %q: field %q must be a string, number or date", key.GetName(), name)
+			}
+		}
+	}
+
+	return nil
+}
+
+// GetName returns name of the key used in error messages and in the index
+func (k UniqueKeyConfig) GetName() string {
+	return strings.Join(k.Fields, "+")
+}
+
+// ParseIdempotency returns how long idempotency keys of created entities are remembered
+func (s ServiceConfig) ParseIdempotency() (time.Duration, error) {
+	window, err := parseRetention(s.Idempotency)
+	if err != nil {
+		return 0, fmt.Errorf("could not parse idempotency window: %w", err)
+	}
+
+	return window, nil
+}
+
 func (l LimitsConfig) ParseGet() (Limit, error) {
 	res, err := parseLimit(l.Get)
 	if err != nil {
@@ -242,6 +856,7 @@ func (f FieldConfig) GetType() (FieldType, error) {
 		"int":    FieldTypeInt,
 		"float":  FieldTypeFloat,
 		"date":   FieldTypeDate,
+		"ref":    FieldTypeRef,
 	}
 
 	fieldType, ok := mapping[f.Type]
@@ -252,6 +867,15 @@ func (f FieldConfig) GetType() (FieldType, error) {
 	return FieldTypeObject, fmt.Errorf("could not resolve type for %s", f.Type)
 }
 
+// GetOnDelete returns what happens when the entity referenced by the field is deleted
+func (f FieldConfig) GetOnDelete() string {
+	if f.OnDelete == nil {
+		return OnDeleteRestrict
+	}
+
+	return *f.OnDelete
+}
+
 func (f FieldConfig) GetRulesMapping() map[string]FieldRule {
 	return map[string]FieldRule{
 		"email": FieldRuleEmail,
@@ -310,3 +934,22 @@ func parseLimit(limit string) (Limit, error) {
 		Unlimited: false,
 	}, nil
 }
+
+var retentionDaysRegExp = regexp.MustCompile(`^(\d{1,5})d$`)
+
+// parseRetention parses a positive duration with days (e.g. 30d) or any unit of time.ParseDuration (e.g. 12h)
+func parseRetention(value string) (time.Duration, error) {
+	if matches := retentionDaysRegExp.FindStringSubmatch(value); matches != nil {
+		days, _ := strconv.Atoi(matches[1]) // ignore error -> checked by regexp
+		if days > 0 {
+			return time.Duration(days) * 24 * time.Hour, nil
+		}
+	}
+
+	retention, err := time.ParseDuration(value)
+	if err != nil || retention <= 0 {
+		return 0, fmt.Errorf("invalid retention %q", value)
+	}
+
+	return retention, nil
+}
@@ -1,8 +1,11 @@
 package main
 
 import (
+	"fmt"
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 )
@@ -82,3 +85,245 @@ func TestSampleConfig(t *testing.T) {
 	assert.Equal(t, false, putLimit.Unlimited)
 	assert.Len(t, people.Fields, 8)
 }
+
+func TestSplitConfig(t *testing.T) {
+	for _, path := range []string{"./examples/split", "./examples/split/*.yml"} {
+		cfg, err := ParseConfig(path, logrus.New())
+		assert.Nil(t, err, path)
+		assert.Nil(t, cfg.Validate(), path)
+		assert.Equal(t, []string{"people", "shops"}, cfg.GetServiceNames(), path)
+
+		people := cfg.ServiceConfigs[0]
+		assert.Nil(t, people.Fields["email"].Ref)
+		assert.Equal(t, "email", people.Fields["email"].Name)
+		assert.Equal(t, "string", people.Fields["email"].Type)
+		assert.True(t, *people.Fields["email"].Required)
+		assert.Equal(t, 100, *people.Fields["email"].Max)
+		assert.Nil(t, people.Fields["home"].Required)
+		assert.Equal(t, "home", people.Fields["home"].Name)
+
+		shops := cfg.ServiceConfigs[1]
+		assert.Nil(t, shops.Fields["contact"].Required)
+		assert.Equal(t, "contact", shops.Fields["contact"].Name)
+		assert.True(t, *shops.Fields["address"].Required)
+
+		// fragments must not be shared between services
+		assert.NotSame(t, people.Fields["home"], shops.Fields["address"])
+		assert.Equal(t, "street", (*people.Fields["home"].Fields)["street"].Name)
+	}
+}
+
+func TestFragmentOverrides(t *testing.T) {
+	dir := t.TempDir()
+	content := `fragments:
+  text:
+    type: string
+  id:
+    type: ref
+    service: people
+services:
+  - name: people
+    fields:
+      name:
+        $ref: text
+      email:
+        $ref: text
+        unique: true
+        case_insensitive: true
+      slug:
+        $ref: text
+        computed: slug(name)
+      status:
+        $ref: text
+        default: draft
+      note:
+        $ref: text
+        nullable: true
+  - name: dogs
+    fields:
+      owner:
+        $ref: id
+        service: people
+        on_delete: cascade
+`
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "a.yml"), []byte(content), 0o600))
+	cfg, err := ParseConfig(dir, logrus.New())
+	assert.Nil(t, err)
+	assert.Nil(t, cfg.Validate())
+
+	// every option set next to the reference overrides the fragment
+	people, dogs := cfg.ServiceConfigs[0].Fields, cfg.ServiceConfigs[1].Fields
+	assert.True(t, *people["email"].Unique)
+	assert.True(t, *people["email"].CaseInsensitive)
+	assert.Equal(t, "slug(name)", *people["slug"].Computed)
+	assert.Equal(t, "draft", people["status"].Default)
+	assert.True(t, *people["note"].Nullable)
+	assert.Equal(t, "people", *dogs["owner"].Service)
+	assert.Equal(t, OnDeleteCascade, *dogs["owner"].OnDelete)
+	assert.Equal(t, []UniqueKeyConfig{{Fields: []string{"email"}, CaseInsensitive: true}}, cfg.ServiceConfigs[0].GetUniqueKeys())
+
+	// options are not shared by other fields of the fragment
+	assert.Nil(t, people["name"].Unique)
+	assert.Nil(t, people["name"].Computed)
+	assert.Nil(t, people["name"].Default)
+	assert.Nil(t, people["name"].Nullable)
+}
+
+func TestSplitConfigErrors(t *testing.T) {
+	write := func(dir, name, content string) {
+		assert.Nil(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600))
+	}
+
+	// duplicate service names across files
+	dir := t.TempDir()
+	write(dir, "a.yml", "- name: dogs\n  fields:\n    name:\n      type: string\n")
+	write(dir, "b.yml", "- name: dogs\n  fields:\n    name:\n      type: string\n")
+	_, err := ParseConfig(dir, logrus.New())
+	assert.Contains(t, fmt.Sprint(err), `service "dogs"`)
+
+	// duplicate service names in one file
+	dir = t.TempDir()
+	write(dir, "a.yml", "- name: dogs\n  fields:\n    name:\n      type: string\n- name: dogs\n  fields:\n    name:\n      type: string\n")
+	_, err = ParseConfig(filepath.Join(dir, "a.yml"), logrus.New())
+	assert.Contains(t, fmt.Sprint(err), `service "dogs"`)
+
+	// unknown fragment
+	dir = t.TempDir()
+	write(dir, "a.yml", "- name: dogs\n  fields:\n    name:\n      $ref: missing\n")
+	_, err = ParseConfig(dir, logrus.New())
+	assert.Contains(t, fmt.Sprint(err), `unknown fragment "missing"`)
+
+	// circular fragments
+	dir = t.TempDir()
+	write(dir, "a.yml", "fragments:\n  a:\n    type: object\n    fields:\n      b:\n        $ref: b\n  b:\n    $ref: a\nservices:\n  - name: dogs\n    fields:\n      name:\n        $ref: a\n")
+	_, err = ParseConfig(dir, logrus.New())
+	assert.Contains(t, fmt.Sprint(err), "circular reference")
+
+	// duplicate storage names across files
+	dir = t.TempDir()
+	write(dir, "a.yml", "storages:\n  - name: archive\n    type: bolt\n")
+	write(dir, "b.yml", "storages:\n  - name: archive\n    type: mem\n")
+	_, err = ParseConfig(dir, logrus.New())
+	assert.Contains(t, fmt.Sprint(err), `storage "archive"`)
+
+	// unknown keys are rejected
+	dir = t.TempDir()
+	write(dir, "a.yml", "- name: dogs\n  fields:\n    name:\n      type: string\n      requried: true\n")
+	_, err = ParseConfig(dir, logrus.New())
+	assert.Contains(t, fmt.Sprint(err), "requried")
+
+	// no files
+	_, err = ParseConfig(filepath.Join(t.TempDir(), "*.yml"), logrus.New())
+	assert.Error(t, err)
+}
+
+func TestServicePath(t *testing.T) {
+	assert.Equal(t, "dogs", ServiceConfig{Name: "dogs"}.GetPath())
+	assert.Equal(t, "puppies", ServiceConfig{Name: "dogs", Path: "puppies"}.GetPath())
+}
+
+func TestParseRetention(t *testing.T) {
+	cases := map[string]time.Duration{
+		"30d": 30 * 24 * time.Hour,
+		"12h": 12 * time.Hour,
+		"90m": 90 * time.Minute,
+	}
+	for value, expected := range cases {
+		retention, err := parseRetention(value)
+		assert.Nil(t, err, value)
+		assert.Equal(t, expected, retention, value)
+	}
+
+	for _, value := range []string{"", "0d", "-1h", "month", "1y"} {
+		_, err := parseRetention(value)
+		assert.Error(t, err, value)
+	}
+
+	// trash retention is checked with configuration
+	cfg := Config{ServiceConfigs: []ServiceConfig{{Name: "dogs", TrashRetention: "30d"}}, logger: logrus.New()}
+	assert.Error(t, cfg.Validate())
+	cfg.ServiceConfigs[0].SoftDelete = true
+	assert.Nil(t, cfg.Validate())
+	cfg.ServiceConfigs[0].TrashRetention = "month"
+	assert.Error(t, cfg.Validate())
+
+	cfg = Config{ServiceConfigs: []ServiceConfig{{Name: "dogs", Idempotency: "24h"}}, logger: logrus.New()}
+	assert.Nil(t, cfg.Validate())
+	cfg.ServiceConfigs[0].Idempotency = "0h"
+	assert.Error(t, cfg.Validate())
+
+	// unique keys consist of top-level scalar fields
+	yes := true
+	fields := map[string]*FieldConfig{"name": {Name: "name", Type: "string", Unique: &yes}, "owner": {Name: "owner", Type: "object", Fields: &map[string]*FieldConfig{"name": {Name: "name", Type: "string"}}}}
+	cfg = Config{ServiceConfigs: []ServiceConfig{{Name: "dogs", Fields: fields}}, logger: logrus.New()}
+	assert.Nil(t, cfg.Validate())
+	cfg.ServiceConfigs[0].UniqueKeys = []UniqueKeyConfig{{Fields: []string{"name", "breed"}}}
+	assert.Error(t, cfg.Validate())
+	cfg.ServiceConfigs[0].UniqueKeys = []UniqueKeyConfig{{Fields: []string{"name", "owner"}}}
+	assert.Error(t, cfg.Validate())
+	cfg.ServiceConfigs[0].UniqueKeys = []UniqueKeyConfig{{}}
+	assert.Error(t, cfg.Validate())
+	cfg.ServiceConfigs[0].UniqueKeys = nil
+	(*fields["owner"].Fields)["name"].Unique = &yes
+	assert.Error(t, cfg.Validate())
+
+	// references point to configured services
+	people, setNull, unknown := "people", OnDeleteSetNull, "ignore"
+	owner := &FieldConfig{Name: "owner", Type: "ref", Service: &people}
+	cfg = Config{ServiceConfigs: []ServiceConfig{{Name: "dogs", Fields: map[string]*FieldConfig{"owner": owner}}}, logger: logrus.New()}
+	assert.Error(t, cfg.Validate())
+	cfg.ServiceConfigs = append(cfg.ServiceConfigs, ServiceConfig{Name: "people"})
+	assert.Nil(t, cfg.Validate())
+	owner.OnDelete = &unknown
+	assert.Error(t, cfg.Validate())
+	owner.OnDelete = &setNull
+	assert.Error(t, cfg.Validate())
+	owner.Nullable = &yes
+	assert.Nil(t, cfg.Validate())
+	owner.Service = nil
+	assert.Error(t, cfg.Validate())
+
+	// defaults are valid values of the field, computed fields are computed from string fields
+	format, invalid, slug := "2006-01-02", "today", "slug(name)"
+	fields = map[string]*FieldConfig{
+		"name":    {Name: "name", Type: "string"},
+		"born":    {Name: "born", Type: "date", Format: &format, Default: DefaultNow},
+		"weight":  {Name: "weight", Type: "int", Default: 10.0},
+		"slug":    {Name: "slug", Type: "string", Computed: &slug},
+		"comment": {Name: "comment", Type: "string", Nullable: &yes, Default: nil},
+	}
+	cfg = Config{ServiceConfigs: []ServiceConfig{{Name: "dogs", Fields: fields}}, logger: logrus.New()}
+	assert.Nil(t, cfg.Validate())
+	fields["weight"].Default = "heavy"
+	assert.Error(t, cfg.Validate())
+	fields["weight"].Default = nil
+	fields["born"].Default = invalid
+	assert.Error(t, cfg.Validate())
+	fields["born"].Default = nil
+	fields["weight"].Default, fields["weight"].Required = 10.0, &yes
+	assert.Error(t, cfg.Validate())
+	fields["weight"].Default, fields["weight"].Required = nil, nil
+	slug = "slug(weight)"
+	assert.Error(t, cfg.Validate())
+	slug = "hash(name)"
+	assert.Error(t, cfg.Validate())
+}
+
+func TestValidateStorages(t *testing.T) {
+	dogs := testServiceConfig("dogs")
+	dogs.Storage = "archive"
+	cfg := &Config{ServiceConfigs: []ServiceConfig{dogs}, StorageConfigs: []StorageConfig{{Name: "archive", Type: "bolt"}}}
+	assert.Nil(t, cfg.Validate())
+	assert.Equal(t, StorageConfig{Name: "archive", Type: "bolt"}, cfg.GetStorageConfig("archive"))
+	assert.Equal(t, StorageConfig{Name: "mem", Type: "mem"}, cfg.GetStorageConfig("mem"))
+
+	cfg.StorageConfigs[0].Type = "tape"
+	assert.Contains(t, fmt.Sprint(cfg.Validate()), `unknown storage type "tape"`)
+
+	cfg.StorageConfigs = nil
+	assert.Contains(t, fmt.Sprint(cfg.Validate()), `unknown storage "archive"`)
+
+	dogs.Storage = "mem" // storage type is a storage too
+	cfg.ServiceConfigs = []ServiceConfig{dogs}
+	assert.Nil(t, cfg.Validate())
+}
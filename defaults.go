@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	uuid "github.com/nu7hatch/gouuid"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// generated default values
+const (
+	DefaultNow  = "now"  // current time of date field
+	DefaultUuid = "uuid" // random UUID of string field
+)
+
+var computedPattern = regexp.MustCompile(`^([a-z]+)\(([^()]+)\)$`)
+
+// computedFunctions compute value of computed field from its source field
+var computedFunctions = map[string]func(string) string{
+	"slug":  slugify,
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+}
+
+// parseComputed returns function and source field of computed field expression like `slug(name)`
+func parseComputed(expression string) (func(string) string, string, error) {
+	match := computedPattern.FindStringSubmatch(expression)
+	if match == nil {
+		return nil, "", fmt.Errorf("invalid computed expression %q, use function(field)", expression)
+	}
+	function, found := computedFunctions[match[1]]
+	if !found {
+		return nil, "", fmt.Errorf("unknown function %q of computed expression, use slug, lower or upper", match[1])
+	}
+
+	return function, strings.TrimSpace(match[2]), nil
+}
+
+// slugify returns lower case letters and digits of the value with other characters replaced by dashes
+func slugify(value string) string {
+	var slug strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(value) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if dash && slug.Len() > 0 {
+				slug.WriteRune('-')
+			}
+			slug.WriteRune(r)
+			dash = false
+		} else {
+			dash = true
+		}
+	}
+
+	return slug.String()
+}
+
+// isGeneratedDefault reports whether the default value of the field is generated for every entity
+func (f FieldConfig) isGeneratedDefault() bool {
+	fieldType, _ := f.GetType()
+	return (fieldType == FieldTypeDate && f.Default == DefaultNow) || (fieldType == FieldTypeString && f.Default == DefaultUuid)
+}
+
+// getDefault returns default value of the field; ok is false when the field has no default
+func (f FieldConfig) getDefault(now time.Time) (value interface{}, ok bool, err error) {
+	if f.Default == nil {
+		return nil, false, nil
+	}
+	if !f.isGeneratedDefault() {
+		return f.Default, true, nil
+	}
+
+	if f.Default == DefaultNow {
+		return now.Format(*f.Format), true, nil
+	}
+	id, err := uuid.NewV4()
+	if err != nil {
+		return nil, false, fmt.Errorf("could not create default value of field %q: %w", f.Name, err)
+	}
+
+	return id.String(), true, nil
+}
+
+// prepare returns copy of the payload with default values of missing fields and computed fields; on update, missing
+// fields keep values of the current payload instead of new defaults
+func (e *Service) prepare(payload map[string]interface{}, current interface{}) (map[string]interface{}, error) {
+	currentPayload, _ := current.(map[string]interface{})
+	prepared, err := applyDefaults(e.Cfg.Fields, payload, currentPayload, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+
+	for name, field := range e.Cfg.Fields {
+		if field.Computed == nil {
+			continue
+		}
+		function, source, err := parseComputed(*field.Computed)
+		if err != nil {
+			return nil, err
+		}
+		if value, ok := prepared[source].(string); ok {
+			prepared[name] = function(value)
+		} else {
+			delete(prepared, name)
+		}
+	}
+
+	return prepared, nil
+}
+
+// applyDefaults sets default values of missing fields in the copy of the payload and its nested objects
+func applyDefaults(fields map[string]*FieldConfig, payload, current map[string]interface{}, now time.Time) (map[string]interface{}, error) {
+	prepared := make(map[string]interface{}, len(payload))
+	for name, value := range payload {
+		prepared[name] = value
+	}
+
+	for name, field := range fields {
+		value, set := prepared[name]
+		if !set {
+			if currentValue, found := current[name]; found && field.Default != nil {
+				prepared[name] = currentValue
+				continue
+			}
+			defaultValue, ok, err := field.getDefault(now)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				prepared[name] = defaultValue
+			}
+			continue
+		}
+
+		object, ok := value.(map[string]interface{})
+		if !ok || field.Fields == nil {
+			continue
+		}
+		currentObject, _ := current[name].(map[string]interface{})
+		child, err := applyDefaults(*field.Fields, object, currentObject, now)
+		if err != nil {
+			return nil, err
+		}
+		prepared[name] = child
+	}
+
+	return prepared, nil
+}
+
+// normalizeYamlValue converts value decoded from yaml to types of values decoded from json
+func normalizeYamlValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		normalized := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			normalized[fmt.Sprint(key)] = normalizeYamlValue(item)
+		}
+		return normalized
+	case map[string]interface{}:
+		normalized := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			normalized[key] = normalizeYamlValue(item)
+		}
+		return normalized
+	case []interface{}:
+		normalized := make([]interface{}, len(v))
+		for i, item := range v {
+			normalized[i] = normalizeYamlValue(item)
+		}
+		return normalized
+	case int:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case uint64:
+		return float64(v)
+	case float32:
+		return float64(v)
+	}
+
+	return value
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestSlugify(t *testing.T) {
+	cases := map[string]string{
+		"Rex":                "rex",
+		"  Hot Dogs! 2 ":     "hot-dogs-2",
+		"Tomáš -- Kozák":     "tomáš-kozák",
+		"already-a-slug":     "already-a-slug",
+		"!!!":                "",
+		"dog_with/odd.chars": "dog-with-odd-chars",
+	}
+
+	for value, expectation := range cases {
+		assert.Equal(t, expectation, slugify(value), value)
+	}
+}
+
+func TestDefaultsAndComputedFields(t *testing.T) {
+	ctx := context.Background()
+	format, slug := "2006-01-02", "slug(name)"
+	cfg := testServiceConfig("dogs")
+	cfg.Fields["born"] = &FieldConfig{Name: "born", Type: "date", Format: &format, Default: DefaultNow}
+	cfg.Fields["tag"] = &FieldConfig{Name: "tag", Type: "string", Default: DefaultUuid}
+	cfg.Fields["weight"] = &FieldConfig{Name: "weight", Type: "float", Default: 10.0}
+	cfg.Fields["slug"] = &FieldConfig{Name: "slug", Type: "string", Computed: &slug}
+	cfg.Fields["owner"] = &FieldConfig{Name: "owner", Type: "object", Fields: &map[string]*FieldConfig{
+		"name":  {Name: "name", Type: "string"},
+		"phone": {Name: "phone", Type: "string", Default: "unknown"},
+	}}
+	dogs := Service{Cfg: cfg, Storage: CreateMemStorage([]string{"dogs"})}
+
+	// missing fields get defaults, computed field ignores value of the client
+	payload := map[string]interface{}{"name": "Big Rex", "slug": "custom", "owner": map[string]interface{}{"name": "alice"}}
+	assert.Nil(t, dogs.Validate(ctx, payload))
+	rex, err := dogs.Put(ctx, payload, nil)
+	assert.Nil(t, err)
+	stored := rex.Payload.(map[string]interface{})
+	assert.Equal(t, time.Now().UTC().Format(format), stored["born"])
+	assert.Len(t, stored["tag"], 36)
+	assert.Equal(t, 10.0, stored["weight"])
+	assert.Equal(t, "big-rex", stored["slug"])
+	assert.Equal(t, "unknown", stored["owner"].(map[string]interface{})["phone"])
+	assert.Equal(t, "custom", payload["slug"]) // payload of the request is not changed
+
+	// update keeps current values of missing fields with defaults
+	rex, err = dogs.Update(ctx, rex.Id, map[string]interface{}{"name": "Rex", "weight": 12.5}, 0)
+	assert.Nil(t, err)
+	updated := rex.Payload.(map[string]interface{})
+	assert.Equal(t, stored["tag"], updated["tag"])
+	assert.Equal(t, 12.5, updated["weight"])
+	assert.Equal(t, "rex", updated["slug"])
+	_, found := updated["owner"]
+	assert.False(t, found)
+
+	// computed field is removed when its source is missing
+	rex, err = dogs.Update(ctx, rex.Id, map[string]interface{}{"slug": "custom"}, 0)
+	assert.Nil(t, err)
+	_, found = rex.Payload.(map[string]interface{})["slug"]
+	assert.False(t, found)
+}
+
+func TestNormalizeYamlValue(t *testing.T) {
+	value := map[interface{}]interface{}{"count": 2, "tags": []interface{}{"a", 1}, "name": "rex"}
+	expected := map[string]interface{}{"count": 2.0, "tags": []interface{}{"a", 1.0}, "name": "rex"}
+	assert.Equal(t, expected, normalizeYamlValue(value))
+}
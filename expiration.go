@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+	"os"
+	"time"
+)
+
+const defaultJanitorInterval = 10 * time.Minute
+
+var expiredEntitiesDeleted = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "usa_expired_entities_deleted_total",
+	Help: "Number of expired entities deleted by the janitor.",
+}, []string{"service"})
+
+// getExpiration returns time when the entity expires; it is the earlier of expires_at of the entity and the retention
+// of the service counted from the created time
+func (e *Service) getExpiration(entity Entity) (time.Time, bool) {
+	var expiration time.Time
+	if retention, err := e.Cfg.ParseRetention(); err == nil && retention > 0 {
+		expiration = entity.Created.Add(retention)
+	}
+	if entity.ExpiresAt != nil && (expiration.IsZero() || entity.ExpiresAt.Before(expiration)) {
+		expiration = *entity.ExpiresAt
+	}
+
+	return expiration, !expiration.IsZero()
+}
+
+// isExpired reports whether the entity must not be visible anymore
+func (e *Service) isExpired(entity Entity, now time.Time) bool {
+	expiration, ok := e.getExpiration(entity)
+	return ok && !now.Before(expiration)
+}
+
+// withoutExpired returns entities which are not expired; the list is not modified as it can be shared by the storage
+func (e *Service) withoutExpired(list []Entity) []Entity {
+	now := time.Now()
+	visible := make([]Entity, 0, len(list))
+	for _, entity := range list {
+		if !e.isExpired(entity, now) {
+			visible = append(visible, entity)
+		}
+	}
+
+	return visible
+}
+
+// getCurrent returns the entity from the storage; expired entity is reported as not found
+func (e *Service) getCurrent(ctx context.Context, id string) (Entity, error) {
+	entity, err := e.Storage.Get(ctx, e.Cfg.Name, id)
+	if err != nil {
+		return Entity{}, err
+	}
+	if e.isExpired(entity, time.Now()) {
+		return Entity{}, fmt.Errorf("%w: %q expired", errEntityNotFound, id)
+	}
+
+	return entity, nil
+}
+
+// DeleteExpired permanently deletes expired entities of the service (including their history and trash) and returns
+// their number; expired idempotency keys and values of unique keys of the expired entities are deleted too. Entities
+// referencing expired entities are handled by on_delete of their ref fields; an expired entity restricted by a ref
+// field is kept until it is not referenced and errRefRestricted is returned after the other entities are deleted.
+// Entities of services without retention or expiration are not read, only their idempotency keys are deleted.
+func (e *Service) DeleteExpired(ctx context.Context) (deleted int, err error) {
+	ctx, span := e.startSpan(ctx, "service.delete_expired")
+	defer func() { endSpan(span, err) }()
+
+	now := time.Now()
+	if !e.Cfg.IsExpiring() {
+		return 0, e.deleteExpiredIdempotencyKeys(ctx, now)
+	}
+
+	list, err := e.Storage.List(ctx, e.Cfg.Name)
+	if err != nil {
+		return 0, err
+	}
+	// the list can be shared by the storage, so entities are deleted after they are collected
+	var expired []Entity
+	for _, entity := range list {
+		if e.isExpired(entity, now) {
+			expired = append(expired, entity)
+		}
+	}
+	restricted := 0
+	for _, entity := range expired {
+		err = e.deletePermanently(ctx, e.Cfg.Name, entity)
+		if errors.Is(err, errRefRestricted) {
+			restricted++
+			continue
+		}
+		if err != nil {
+			return deleted, fmt.Errorf("could not delete expired entity %q: %w", entity.Id, err)
+		}
+		e.releaseUniqueValues(ctx, entity)
+		if err = e.deleteHistory(ctx, entity.Id, int(entity.GetVersion())); err != nil {
+			return deleted, err
+		}
+		deleted++
+	}
+
+	if err = e.deleteExpiredIdempotencyKeys(ctx, now); err != nil {
+		return deleted, err
+	}
+
+	if !e.Cfg.SoftDelete {
+		return deleted, getRestrictedError(restricted)
+	}
+
+	trash, err := e.listTrash(ctx)
+	if err != nil {
+		return deleted, err
+	}
+	for _, entity := range trash {
+		if !e.isExpired(entity, now) {
+			continue
+		}
+		err = e.deletePermanently(ctx, getTrashServiceName(e.Cfg.Name), entity)
+		if errors.Is(err, errRefRestricted) {
+			restricted++
+			continue
+		}
+		if err != nil {
+			return deleted, fmt.Errorf("could not delete expired entity %q from trash: %w", entity.Id, err)
+		}
+		if err = e.deleteHistory(ctx, entity.Id, int(entity.GetVersion())+1); err != nil {
+			return deleted, err
+		}
+		deleted++
+	}
+
+	return deleted, getRestrictedError(restricted)
+}
+
+// getRestrictedError returns errRefRestricted when some entities were not deleted because they are referenced
+func getRestrictedError(restricted int) error {
+	if restricted == 0 {
+		return nil
+	}
+
+	return fmt.Errorf("%w: %d entities are kept until they are not referenced", errRefRestricted, restricted)
+}
+
+type expirationJanitor struct {
+	services []Service
+	interval time.Duration
+}
+
+// createExpirationJanitor returns janitor of services whose entities can expire or which remember idempotency keys
+func createExpirationJanitor(services []Service) (*expirationJanitor, error) {
+	janitor := &expirationJanitor{interval: defaultJanitorInterval}
+	for _, service := range services {
+		if service.Cfg.IsExpiring() || service.Cfg.Idempotency != "" {
+			janitor.services = append(janitor.services, service)
+		}
+	}
+	if value := os.Getenv("JANITOR_INTERVAL"); value != "" {
+		interval, err := time.ParseDuration(value)
+		if err != nil || interval <= 0 {
+			return nil, fmt.Errorf("invalid janitor interval %q in environment variable %q", value, "JANITOR_INTERVAL")
+		}
+		janitor.interval = interval
+	}
+
+	return janitor, nil
+}
+
+// Run deletes expired entities until the context is canceled
+func (janitor *expirationJanitor) Run(ctx context.Context, logger *logrus.Logger) {
+	ticker := time.NewTicker(janitor.interval)
+	defer ticker.Stop()
+
+	for {
+		janitor.clean(ctx, logger)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (janitor *expirationJanitor) clean(ctx context.Context, logger *logrus.Logger) {
+	for _, service := range janitor.services {
+		deleted, err := service.DeleteExpired(ctx)
+		if err != nil {
+			logger.WithError(err).Errorf("could not delete expired entities of service %q", service.Cfg.Name)
+		}
+		if deleted > 0 {
+			expiredEntitiesDeleted.WithLabelValues(service.Cfg.Name).Add(float64(deleted))
+			logger.Infof("%d expired entities of service %q deleted", deleted, service.Cfg.Name)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestExpiration(t *testing.T) {
+	ctx := context.Background()
+	cfg := testServiceConfig("forms")
+	cfg.Retention = "30d"
+	cfg.History = true
+	cfg.SoftDelete = true
+	forms := Service{Cfg: cfg, Storage: CreateMemStorage(nil)}
+
+	now := time.Now()
+	soon, past := now.Add(time.Hour), now.Add(-time.Minute)
+	for _, e := range []Entity{
+		{Id: "old", Created: now.Add(-31 * 24 * time.Hour), Payload: map[string]interface{}{"name": "old"}},
+		{Id: "expired", Created: now, Payload: map[string]interface{}{"name": "expired"}, ExpiresAt: &past},
+		{Id: "expiring", Created: now, Payload: map[string]interface{}{"name": "expiring"}, ExpiresAt: &soon},
+		{Id: "deleted", Created: now.Add(-40 * 24 * time.Hour), Payload: map[string]interface{}{"name": "deleted"}},
+	} {
+		assert.Nil(t, forms.Storage.Insert(ctx, "forms", e))
+	}
+	assert.Nil(t, forms.Storage.Insert(ctx, getHistoryServiceName("forms"), Entity{Id: getVersionId("old", 1), Created: now}))
+	deleted, err := forms.Storage.Get(ctx, "forms", "deleted")
+	assert.Nil(t, err)
+	assert.Nil(t, forms.moveToTrash(ctx, deleted, now))
+
+	// expired entities are invisible before the janitor deletes them
+	list, err := forms.List(ctx)
+	assert.Nil(t, err)
+	assert.Len(t, list, 1)
+	assert.Equal(t, "expiring", list[0].Id)
+	_, err = forms.Get(ctx, "old")
+	assert.ErrorIs(t, err, errEntityNotFound)
+	_, err = forms.Update(ctx, "expired", map[string]interface{}{"name": "new"}, 0)
+	assert.ErrorIs(t, err, errEntityNotFound)
+	_, err = forms.History(ctx, "old")
+	assert.ErrorIs(t, err, errEntityNotFound)
+	_, err = forms.Version(ctx, "old", 1)
+	assert.ErrorIs(t, err, errEntityNotFound)
+	trash, err := forms.Trash(ctx)
+	assert.Nil(t, err)
+	assert.Empty(t, trash)
+	_, err = forms.GetDeleted(ctx, "deleted")
+	assert.ErrorIs(t, err, errEntityNotFound)
+
+	// expiration of the service retention is used when the entity expires later
+	later := now.Add(60 * 24 * time.Hour)
+	expiration, ok := forms.getExpiration(Entity{Created: now, ExpiresAt: &later})
+	assert.True(t, ok)
+	assert.Equal(t, now.Add(30*24*time.Hour), expiration)
+
+	janitor, err := createExpirationJanitor([]Service{forms})
+	assert.Nil(t, err)
+	janitor.clean(ctx, logrus.New())
+	assert.Equal(t, float64(3), testutil.ToFloat64(expiredEntitiesDeleted.WithLabelValues("forms")))
+
+	stored, err := forms.Storage.List(ctx, "forms")
+	assert.Nil(t, err)
+	assert.Len(t, stored, 1)
+	_, err = forms.Storage.Get(ctx, getHistoryServiceName("forms"), getVersionId("old", 1))
+	assert.ErrorIs(t, err, errEntityNotFound)
+	trash, err = forms.listTrash(ctx)
+	assert.Nil(t, err)
+	assert.Empty(t, trash)
+
+	// services whose entities cannot expire are not scanned
+	plain, expiring, idempotent := testServiceConfig("dogs"), testServiceConfig("cats"), testServiceConfig("mice")
+	expiring.Expiration = true
+	idempotent.Idempotency = "24h"
+	stg := CreateMemStorage(nil)
+	janitor, err = createExpirationJanitor([]Service{{Cfg: plain, Storage: stg}, {Cfg: expiring, Storage: stg}, {Cfg: idempotent, Storage: stg}})
+	assert.Nil(t, err)
+	assert.Len(t, janitor.services, 2)
+	assert.Equal(t, "cats", janitor.services[0].Cfg.Name)
+	assert.Equal(t, "mice", janitor.services[1].Cfg.Name)
+	mice := Service{Cfg: idempotent, Storage: noListStorage{Storage: stg, serviceName: "mice"}}
+	_, err = mice.DeleteExpired(ctx)
+	assert.Nil(t, err)
+
+	t.Setenv("JANITOR_INTERVAL", "-1s")
+	_, err = createExpirationJanitor(nil)
+	assert.Error(t, err)
+}
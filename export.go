@@ -0,0 +1,387 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	exportFormatNdjson = "ndjson"
+	exportFormatCsv    = "csv"
+
+	exportPageSize = 500
+
+	// CSV columns with entity metadata, payload fields use dotted paths
+	csvIdColumn      = "_id"
+	csvCreatedColumn = "_created"
+)
+
+var exportContentTypes = map[string]string{
+	exportFormatNdjson: "application/x-ndjson",
+	exportFormatCsv:    "text/csv",
+}
+
+// csvColumn is a payload field stored in one CSV column; objects are flattened, arrays are stored as JSON
+type csvColumn struct {
+	path  []string
+	field *FieldConfig
+}
+
+// importReport contains number of imported entities and errors of rows which were not imported
+type importReport struct {
+	Imported int
+	Errors   []importRowError
+}
+
+type importRowError struct {
+	Row int // line number of the row (header of CSV is the first line)
+	Err error
+}
+
+func (e importRowError) Error() string {
+	return fmt.Sprintf("row %d: %s", e.Row, e.Err)
+}
+
+// importRecord is one imported entity; ID and created time are generated when missing
+type importRecord struct {
+	Id        string                 `json:"id"`
+	Created   *time.Time             `json:"created"`
+	Payload   map[string]interface{} `json:"payload"`
+	ExpiresAt *time.Time             `json:"expires_at"`
+}
+
+// Export writes all entities of the service in given format and returns number of exported entities
+func (e *Service) Export(ctx context.Context, format string, w io.Writer) (count int, err error) {
+	ctx, span := e.startSpan(ctx, "service.export")
+	defer func() { endSpan(span, err) }()
+
+	var write func(Entity) error
+	var flush func() error
+	switch format {
+	case exportFormatNdjson:
+		encoder := json.NewEncoder(w)
+		write = func(entity Entity) error {
+			return encoder.Encode(entity)
+		}
+		flush = func() error { return nil }
+	case exportFormatCsv:
+		columns := getCsvColumns(e.Cfg.Fields, nil)
+		writer := csv.NewWriter(w)
+		if err = writer.Write(getCsvHeader(columns)); err != nil {
+			return 0, err
+		}
+		write = func(entity Entity) error {
+			return writer.Write(encodeCsvRecord(columns, entity))
+		}
+		flush = func() error {
+			writer.Flush()
+			return writer.Error()
+		}
+	default:
+		return 0, fmt.Errorf("unknown export format %q", format)
+	}
+
+	cursor := ""
+	for {
+		page, next, err := listPage(ctx, e.Storage, e.Cfg.Name, cursor, exportPageSize)
+		if err != nil {
+			return count, err
+		}
+
+		for _, entity := range e.withoutExpired(page) {
+			if err = write(entity); err != nil {
+				return count, fmt.Errorf("could not write entity %q: %w", entity.Id, err)
+			}
+			count++
+		}
+
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+
+	return count, flush()
+}
+
+// Import validates every row and stores valid rows; invalid rows are reported and do not stop the import
+func (e *Service) Import(ctx context.Context, format string, r io.Reader) (report importReport, err error) {
+	ctx, span := e.startSpan(ctx, "service.import")
+	defer func() { endSpan(span, err) }()
+
+	var read func() (int, importRecord, error)
+	switch format {
+	case exportFormatNdjson:
+		read = createNdjsonReader(r)
+	case exportFormatCsv:
+		read, err = createCsvReader(r, e.Cfg.Fields)
+		if err != nil {
+			return report, err
+		}
+	default:
+		return report, fmt.Errorf("unknown import format %q", format)
+	}
+
+	for {
+		row, record, err := read()
+		if err == io.EOF {
+			return report, nil
+		}
+		var rowErr importRowError
+		if errors.As(err, &rowErr) {
+			report.Errors = append(report.Errors, rowErr)
+			continue
+		}
+		if err != nil {
+			return report, err
+		}
+
+		if err = e.importRecord(ctx, record); err != nil {
+			report.Errors = append(report.Errors, importRowError{Row: row, Err: err})
+			continue
+		}
+		report.Imported++
+	}
+}
+
+func (e *Service) importRecord(ctx context.Context, record importRecord) error {
+	if record.Payload == nil {
+		return fmt.Errorf("payload is missing")
+	}
+	if err := e.Validate(ctx, record.Payload); err != nil {
+		return err
+	}
+
+	if record.Id == "" {
+		_, err := e.Put(ctx, record.Payload, record.ExpiresAt)
+		return err
+	}
+	payload, err := e.prepare(record.Payload, nil)
+	if err != nil {
+		return err
+	}
+	if err = e.checkRefs(ctx, payload); err != nil {
+		return err
+	}
+
+	entity := Entity{Id: record.Id, Created: time.Now(), Payload: payload, ExpiresAt: record.ExpiresAt}
+	if record.Created != nil {
+		entity.Created = *record.Created
+	}
+
+	return e.insert(ctx, entity)
+}
+
+func createNdjsonReader(r io.Reader) func() (int, importRecord, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	row := 0
+
+	return func() (int, importRecord, error) {
+		for scanner.Scan() {
+			row++
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" {
+				continue
+			}
+
+			var record importRecord
+			if err := json.Unmarshal([]byte(line), &record); err != nil {
+				return row, record, importRowError{Row: row, Err: fmt.Errorf("could not parse json: %w", err)}
+			}
+			return row, record, nil
+		}
+		if err := scanner.Err(); err != nil {
+			return row, importRecord{}, err
+		}
+
+		return row, importRecord{}, io.EOF
+	}
+}
+
+func createCsvReader(r io.Reader, fields map[string]*FieldConfig) (func() (int, importRecord, error), error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("could not read csv header: %w", err)
+	}
+
+	known := make(map[string]csvColumn)
+	for _, column := range getCsvColumns(fields, nil) {
+		known[strings.Join(column.path, ".")] = column
+	}
+
+	columns := make([]*csvColumn, len(header))
+	for k, name := range header {
+		if name == csvIdColumn || name == csvCreatedColumn {
+			continue
+		}
+		column, found := known[name]
+		if !found {
+			return nil, fmt.Errorf("unknown csv column %q", name)
+		}
+		columns[k] = &column
+	}
+
+	return func() (int, importRecord, error) {
+		values, err := reader.Read()
+		if err == io.EOF {
+			return 0, importRecord{}, io.EOF
+		}
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			return parseErr.StartLine, importRecord{}, importRowError{Row: parseErr.StartLine, Err: parseErr.Err}
+		}
+		if err != nil {
+			return 0, importRecord{}, err
+		}
+
+		row, _ := reader.FieldPos(0)
+		if len(values) != len(header) {
+			return row, importRecord{}, importRowError{Row: row, Err: fmt.Errorf("expected %d columns, got %d", len(header), len(values))}
+		}
+
+		record := importRecord{Payload: make(map[string]interface{})}
+		for k, value := range values {
+			switch {
+			case header[k] == csvIdColumn:
+				record.Id = value
+			case header[k] == csvCreatedColumn:
+				if value == "" {
+					continue
+				}
+				created, err := time.Parse(time.RFC3339Nano, value)
+				if err != nil {
+					return row, record, importRowError{Row: row, Err: fmt.Errorf("column %q: %w", header[k], err)}
+				}
+				record.Created = &created
+			case value != "":
+				if err = columns[k].decode(record.Payload, value); err != nil {
+					return row, record, importRowError{Row: row, Err: fmt.Errorf("column %q: %w", header[k], err)}
+				}
+			}
+		}
+
+		return row, record, nil
+	}, nil
+}
+
+// getCsvColumns returns columns of all fields ordered by path; fields of objects are flattened
+func getCsvColumns(fields map[string]*FieldConfig, prefix []string) []csvColumn {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var columns []csvColumn
+	for _, name := range names {
+		field := fields[name]
+		path := append(prefix[:len(prefix):len(prefix)], name)
+		if fieldType, _ := field.GetType(); fieldType == FieldTypeObject && field.Fields != nil {
+			columns = append(columns, getCsvColumns(*field.Fields, path)...)
+			continue
+		}
+		columns = append(columns, csvColumn{path: path, field: field})
+	}
+
+	return columns
+}
+
+func getCsvHeader(columns []csvColumn) []string {
+	header := []string{csvIdColumn, csvCreatedColumn}
+	for _, column := range columns {
+		header = append(header, strings.Join(column.path, "."))
+	}
+
+	return header
+}
+
+func encodeCsvRecord(columns []csvColumn, entity Entity) []string {
+	record := []string{entity.Id, entity.Created.Format(time.RFC3339Nano)}
+	for _, column := range columns {
+		record = append(record, column.encode(entity.Payload))
+	}
+
+	return record
+}
+
+// encode returns value of the column in the payload; missing value is empty
+func (column csvColumn) encode(payload interface{}) string {
+	value := payload
+	for _, name := range column.path {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return ""
+		}
+		value = object[name]
+	}
+
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		// empty value is a missing value, so empty strings (and strings starting with a quote) are quoted as JSON
+		if v == "" || strings.HasPrefix(v, `"`) {
+			data, _ := json.Marshal(v)
+			return string(data)
+		}
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		data, _ := json.Marshal(v)
+		return string(data)
+	}
+}
+
+// decode converts the value by type of the field and sets it to the payload
+func (column csvColumn) decode(payload map[string]interface{}, value string) error {
+	var decoded interface{}
+	fieldType, _ := column.field.GetType()
+	switch fieldType {
+	case FieldTypeString, FieldTypeDate, FieldTypeRef:
+		decoded = value
+		if strings.HasPrefix(value, `"`) {
+			var quoted string
+			if err := json.Unmarshal([]byte(value), &quoted); err != nil {
+				return fmt.Errorf("invalid quoted string: %w", err)
+			}
+			decoded = quoted
+		}
+	case FieldTypeInt, FieldTypeFloat:
+		number, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("invalid number %q", value)
+		}
+		decoded = number
+	default:
+		if err := json.Unmarshal([]byte(value), &decoded); err != nil {
+			return fmt.Errorf("invalid json: %w", err)
+		}
+	}
+
+	object := payload
+	for _, name := range column.path[:len(column.path)-1] {
+		child, ok := object[name].(map[string]interface{})
+		if !ok {
+			child = make(map[string]interface{})
+			object[name] = child
+		}
+		object = child
+	}
+	object[column.path[len(column.path)-1]] = decoded
+
+	return nil
+}
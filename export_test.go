@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+	"time"
+)
+
+func exportTestService() Service {
+	required := true
+	fields := map[string]*FieldConfig{
+		"name": {Name: "name", Type: "string", Required: &required},
+		"age":  {Name: "age", Type: "int"},
+		"tags": {Name: "tags", Type: "array", Items: &FieldConfig{Name: "array", Type: "string"}},
+		"address": {Name: "address", Type: "object", Fields: &map[string]*FieldConfig{
+			"city": {Name: "city", Type: "string"},
+			"zip":  {Name: "zip", Type: "string"},
+		}},
+	}
+
+	return Service{
+		Cfg:     ServiceConfig{Name: "people", Fields: fields},
+		Storage: CreateMemStorage([]string{"people"}),
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	ctx := context.Background()
+	service := exportTestService()
+	created := time.Date(2024, 5, 1, 12, 30, 0, 123, time.UTC)
+	entities := []Entity{
+		{Id: "1", Created: created, Payload: map[string]interface{}{
+			"name": "John, Jr.", "age": float64(42), "tags": []interface{}{"a", "b"},
+			"address": map[string]interface{}{"city": "Prague"},
+		}},
+		{Id: "2", Created: created.Add(time.Second), Payload: map[string]interface{}{"name": "Jane"}},
+		{Id: "3", Created: created.Add(2 * time.Second), Payload: map[string]interface{}{
+			"name": `"Rex"`, "address": map[string]interface{}{"city": ""},
+		}},
+	}
+	for _, e := range entities {
+		assert.Nil(t, service.Storage.Insert(ctx, "people", e))
+	}
+
+	var csvData bytes.Buffer
+	count, err := service.Export(ctx, exportFormatCsv, &csvData)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, count)
+	assert.Equal(t, `_id,_created,address.city,address.zip,age,name,tags
+1,2024-05-01T12:30:00.000000123Z,Prague,,42,"John, Jr.","[""a"",""b""]"
+2,2024-05-01T12:30:01.000000123Z,,,,Jane,
+3,2024-05-01T12:30:02.000000123Z,"""""",,,"""\""Rex\""""",
+`, csvData.String())
+
+	var ndjsonData bytes.Buffer
+	count, err = service.Export(ctx, exportFormatNdjson, &ndjsonData)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, count)
+	assert.Equal(t, 3, strings.Count(ndjsonData.String(), "\n"))
+
+	_, err = service.Export(ctx, "xml", &ndjsonData)
+	assert.Error(t, err)
+
+	// both formats are imported back with the same IDs and created times
+	for format, data := range map[string]string{exportFormatCsv: csvData.String(), exportFormatNdjson: ndjsonData.String()} {
+		imported := exportTestService()
+		report, err := imported.Import(ctx, format, strings.NewReader(data))
+		assert.Nil(t, err, format)
+		assert.Equal(t, importReport{Imported: 3}, report, format)
+
+		list, err := imported.List(ctx)
+		assert.Nil(t, err)
+		assert.Equal(t, entities, list, format)
+	}
+}
+
+func TestImportErrors(t *testing.T) {
+	ctx := context.Background()
+	service := exportTestService()
+
+	report, err := service.Import(ctx, exportFormatCsv, strings.NewReader(`name,age,address.city
+John,42,Prague
+,1,
+Jane,old,
+"Multi
+line",2,Brno
+Jim,"broken
+`))
+	assert.Nil(t, err)
+	assert.Equal(t, 2, report.Imported)
+	assert.Len(t, report.Errors, 3)
+	assert.Equal(t, 3, report.Errors[0].Row)
+	assert.Contains(t, report.Errors[0].Error(), `field "name": required`)
+	assert.Equal(t, 4, report.Errors[1].Row)
+	assert.Contains(t, report.Errors[1].Error(), `column "age": invalid number "old"`)
+	assert.Equal(t, 7, report.Errors[2].Row)
+
+	list, err := service.List(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{"name": "John", "age": float64(42), "address": map[string]interface{}{"city": "Prague"}}, list[0].Payload)
+	assert.Equal(t, "Multi\nline", list[1].Payload.(map[string]interface{})["name"])
+
+	_, err = service.Import(ctx, exportFormatCsv, strings.NewReader("name,unknown\n"))
+	assert.Contains(t, err.Error(), `unknown csv column "unknown"`)
+
+	report, err = service.Import(ctx, exportFormatNdjson, strings.NewReader(`{"id": "a", "payload": {"name": "Bob"}}
+
+{"id": "a", "payload": {"name": "Bob"}}
+{"payload": {"age": 5}}
+not json
+{"id": "b"}
+`))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, report.Imported)
+	var rows []int
+	for _, rowErr := range report.Errors {
+		rows = append(rows, rowErr.Row)
+	}
+	assert.Equal(t, []int{3, 4, 5, 6}, rows)
+	assert.ErrorIs(t, report.Errors[0].Err, errEntityExists)
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel/attribute"
+	"strconv"
+	"time"
+)
+
+const (
+	historyServiceSuffix = "__history"
+
+	// maxVersionConflicts is number of attempts to change the entity when other changes store a new version meanwhile
+	maxVersionConflicts = 5
+)
+
+var historyWriteErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "usa_history_write_errors_total",
+	Help: "Number of entity versions not recorded in history although the change was stored.",
+}, []string{"service"})
+
+var errVersionNotRestorable = errors.New("version can not be restored")
+
+type actorContextKey struct{}
+
+// entityVersion is one version of the entity. Versions are stored in the history service of the service
+// as entities with ID "<entity ID>.v<version>" created at the time of the version; the version number is the version
+// of the entity (its ETag) and the deletion is recorded as the version following the deleted one.
+type entityVersion struct {
+	Version      int         `json:"version"`
+	Timestamp    time.Time   `json:"timestamp"`
+	Actor        string      `json:"actor,omitempty"`
+	Deleted      bool        `json:"deleted,omitempty"`
+	RestoredFrom int         `json:"restored_from,omitempty"` // version restored by this version
+	Payload      interface{} `json:"payload"`
+}
+
+func getHistoryServiceName(serviceName string) string {
+	return serviceName + historyServiceSuffix
+}
+
+func getVersionId(id string, version int) string {
+	return id + ".v" + strconv.Itoa(version)
+}
+
+// withActor returns context with the actor recorded in history of changed entities
+func withActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorContextKey{}, actor)
+}
+
+func getActor(ctx context.Context) string {
+	actor, _ := ctx.Value(actorContextKey{}).(string)
+	return actor
+}
+
+// History returns all versions of the entity from the oldest one; entities created before history was enabled
+// have only the current version. History of expired entity is not visible anymore.
+func (e *Service) History(ctx context.Context, id string) (versions []entityVersion, err error) {
+	ctx, span := e.startSpan(ctx, "service.history")
+	defer func() { endSpan(span, err) }()
+
+	current, latest, err := e.getLatestVersion(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	versions, err = e.getVersions(ctx, id, latest)
+	if err != nil || len(versions) > 0 {
+		return versions, err
+	}
+	if current == nil {
+		return nil, fmt.Errorf("%w: %q", errEntityNotFound, id)
+	}
+
+	return []entityVersion{getInitialVersion(*current)}, nil
+}
+
+// Version returns one version of the entity
+func (e *Service) Version(ctx context.Context, id string, version int) (entityVersion, error) {
+	if version < 1 {
+		return entityVersion{}, fmt.Errorf("%w: version %d of %q", errEntityNotFound, version, id)
+	}
+
+	current, _, err := e.getLatestVersion(ctx, id)
+	if err != nil {
+		return entityVersion{}, err
+	}
+	v, err := e.getVersion(ctx, id, version)
+	if !errors.Is(err, errEntityNotFound) || current == nil {
+		return v, err
+	}
+
+	// the current version of entity changed before history was enabled is not recorded
+	if int(current.GetVersion()) != version {
+		return entityVersion{}, err
+	}
+
+	return getInitialVersion(*current), nil
+}
+
+// RestoreVersion replaces payload of the entity with payload of given version; it is recorded as a new version
+func (e *Service) RestoreVersion(ctx context.Context, id string, version int) (Entity, error) {
+	v, err := e.Version(ctx, id, version)
+	if err != nil {
+		return Entity{}, err
+	}
+	if v.Deleted {
+		return Entity{}, fmt.Errorf("%w: version %d is deletion of the entity", errVersionNotRestorable, version)
+	}
+
+	payload, ok := v.Payload.(map[string]interface{})
+	if !ok {
+		return Entity{}, fmt.Errorf("%w: payload of version %d is not an object", errVersionNotRestorable, version)
+	}
+	// configuration of the service could change since the version was created
+	if err = e.Validate(ctx, payload); err != nil {
+		return Entity{}, fmt.Errorf("%w: version %d is not valid: %s", errVersionNotRestorable, version, err)
+	}
+
+	return e.update(ctx, id, payload, 0, version)
+}
+
+// getLatestVersion returns the current entity (nil when it is deleted) and number of its latest version, 0 when it
+// is not known because the entity was permanently deleted. Expired entity is reported as not found.
+func (e *Service) getLatestVersion(ctx context.Context, id string) (*Entity, int, error) {
+	current, err := e.Storage.Get(ctx, e.Cfg.Name, id)
+	if err == nil {
+		if e.isExpired(current, time.Now()) {
+			return nil, 0, fmt.Errorf("%w: %q expired", errEntityNotFound, id)
+		}
+		return &current, int(current.GetVersion()), nil
+	}
+	if !errors.Is(err, errEntityNotFound) {
+		return nil, 0, err
+	}
+	if !e.Cfg.SoftDelete {
+		return nil, 0, nil
+	}
+
+	deleted, err := e.GetDeleted(ctx, id)
+	if errors.Is(err, errEntityNotFound) {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return nil, int(deleted.GetVersion()) + 1, nil // the deletion is the latest version
+}
+
+// getVersions reads recorded versions of the entity up to the latest one skipping versions which were not recorded;
+// when the latest version is not known, versions are read from the first one until the first missing version
+func (e *Service) getVersions(ctx context.Context, id string, latest int) ([]entityVersion, error) {
+	var versions []entityVersion
+	if latest == 0 {
+		for version := 1; ; version++ {
+			v, err := e.getVersion(ctx, id, version)
+			if errors.Is(err, errEntityNotFound) {
+				return versions, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			versions = append(versions, v)
+		}
+	}
+
+	for version := 1; version <= latest; version++ {
+		v, err := e.getVersion(ctx, id, version)
+		if errors.Is(err, errEntityNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, v)
+	}
+
+	return versions, nil
+}
+
+func (e *Service) getVersion(ctx context.Context, id string, version int) (entityVersion, error) {
+	stored, err := e.Storage.Get(ctx, getHistoryServiceName(e.Cfg.Name), getVersionId(id, version))
+	if errors.Is(err, errEntityNotFound) {
+		return entityVersion{}, fmt.Errorf("%w: version %d of %q", errEntityNotFound, version, id)
+	}
+	if err != nil {
+		return entityVersion{}, fmt.Errorf("could not read history: %w", err)
+	}
+
+	return decodeEntityVersion(stored)
+}
+
+// recordVersion stores the version of the entity after its change was stored; previous state of the entity (nil for
+// a new entity) is recorded first when it was changed before history was enabled. The version number is the version
+// of the entity, so concurrent changes are recorded in their order without reading the history. The change can not
+// be taken back anymore, so a failure is only counted and reported in the trace; the request must not fail as its
+// retry would repeat the change.
+func (e *Service) recordVersion(ctx context.Context, previous *Entity, id string, v entityVersion) {
+	ctx, span := e.startSpan(ctx, "service.record_version", attribute.String("usa.entity.id", id))
+	err := e.storeVersion(ctx, previous, id, v)
+	endSpan(span, err)
+	if err != nil {
+		historyWriteErrors.WithLabelValues(e.Cfg.Name).Inc()
+	}
+}
+
+func (e *Service) storeVersion(ctx context.Context, previous *Entity, id string, v entityVersion) error {
+	historyName := getHistoryServiceName(e.Cfg.Name)
+	if previous != nil {
+		err := e.Storage.Insert(ctx, historyName, encodeEntityVersion(id, getInitialVersion(*previous)))
+		if err != nil && !errors.Is(err, errEntityExists) {
+			return fmt.Errorf("could not record history of entity %q: %w", id, err)
+		}
+	}
+
+	if err := e.Storage.Insert(ctx, historyName, encodeEntityVersion(id, v)); err != nil {
+		return fmt.Errorf("could not record version %d of entity %q: %w", v.Version, id, err)
+	}
+
+	return nil
+}
+
+// deleteHistory permanently deletes all versions of the entity up to the latest one (until the first missing version
+// when it is 0)
+func (e *Service) deleteHistory(ctx context.Context, id string, latest int) error {
+	if !e.Cfg.History {
+		return nil
+	}
+
+	historyName := getHistoryServiceName(e.Cfg.Name)
+	for version := 1; latest == 0 || version <= latest; version++ {
+		err := e.Storage.Delete(ctx, historyName, getVersionId(id, version))
+		if errors.Is(err, errEntityNotFound) && latest == 0 {
+			return nil
+		}
+		if err != nil && !errors.Is(err, errEntityNotFound) {
+			return fmt.Errorf("could not delete history of entity %q: %w", id, err)
+		}
+	}
+
+	return nil
+}
+
+// getInitialVersion returns the version of the entity changed before history was recorded
+func getInitialVersion(current Entity) entityVersion {
+	timestamp := current.Created
+	if current.Updated != nil {
+		timestamp = *current.Updated
+	}
+
+	return entityVersion{Version: int(current.GetVersion()), Timestamp: timestamp, Payload: current.Payload}
+}
+
+func encodeEntityVersion(id string, v entityVersion) Entity {
+	payload := map[string]interface{}{
+		"version": float64(v.Version),
+		"payload": v.Payload,
+	}
+	if v.Actor != "" {
+		payload["actor"] = v.Actor
+	}
+	if v.Deleted {
+		payload["deleted"] = true
+	}
+	if v.RestoredFrom > 0 {
+		payload["restored_from"] = float64(v.RestoredFrom)
+	}
+
+	return Entity{Id: getVersionId(id, v.Version), Created: v.Timestamp, Payload: payload}
+}
+
+func decodeEntityVersion(stored Entity) (entityVersion, error) {
+	data, err := json.Marshal(stored.Payload)
+	if err != nil {
+		return entityVersion{}, fmt.Errorf("could not decode version %q: %w", stored.Id, err)
+	}
+
+	var v entityVersion
+	if err = json.Unmarshal(data, &v); err != nil {
+		return entityVersion{}, fmt.Errorf("could not decode version %q: %w", stored.Id, err)
+	}
+	v.Timestamp = stored.Created
+
+	return v, nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+// failingHistoryStorage fails to record versions to the history services
+type failingHistoryStorage struct {
+	Storage
+}
+
+func (s failingHistoryStorage) Insert(ctx context.Context, serviceName string, e Entity) error {
+	if strings.HasSuffix(serviceName, historyServiceSuffix) {
+		return errors.New("storage is unavailable")
+	}
+
+	return s.Storage.Insert(ctx, serviceName, e)
+}
+
+func TestHistoryVersions(t *testing.T) {
+	ctx := context.Background()
+	cfg := testServiceConfig("dogs")
+	dogs := Service{Cfg: cfg, Storage: CreateMemStorage([]string{"dogs", "dogs__history"})}
+
+	// versions changed before history was enabled are not recorded
+	entity, err := dogs.Put(ctx, map[string]interface{}{"name": "rex"}, nil)
+	assert.Nil(t, err)
+	_, err = dogs.Update(ctx, entity.Id, map[string]interface{}{"name": "max"}, 0)
+	assert.Nil(t, err)
+	v, err := dogs.Version(ctx, entity.Id, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{"name": "max"}, v.Payload)
+	_, err = dogs.Version(ctx, entity.Id, 1)
+	assert.ErrorIs(t, err, errEntityNotFound)
+
+	// version numbers are versions of the entity
+	dogs.Cfg.History = true
+	updated, err := dogs.Update(ctx, entity.Id, map[string]interface{}{"name": "bob"}, 2)
+	assert.Nil(t, err)
+	versions, err := dogs.History(ctx, entity.Id)
+	assert.Nil(t, err)
+	assert.Len(t, versions, 2)
+	assert.Equal(t, 2, versions[0].Version)
+	assert.Equal(t, int(updated.Version), versions[1].Version)
+	assert.Equal(t, map[string]interface{}{"name": "bob"}, versions[1].Payload)
+
+	// the change is stored although its version is not recorded
+	dogs.Storage = failingHistoryStorage{dogs.Storage}
+	updated, err = dogs.Update(ctx, entity.Id, map[string]interface{}{"name": "rex"}, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(4), updated.Version)
+	assert.Equal(t, float64(1), testutil.ToFloat64(historyWriteErrors.WithLabelValues("dogs")))
+	_, err = dogs.Version(ctx, entity.Id, 4)
+	assert.Nil(t, err) // the current version
+
+	// missing version is recorded by the following change as its previous state
+	dogs.Storage = dogs.Storage.(failingHistoryStorage).Storage
+	_, err = dogs.Update(ctx, entity.Id, map[string]interface{}{"name": "max"}, 0)
+	assert.Nil(t, err)
+	versions, err = dogs.History(ctx, entity.Id)
+	assert.Nil(t, err)
+	assert.Len(t, versions, 4)
+	assert.Equal(t, 4, versions[2].Version)
+	assert.Equal(t, map[string]interface{}{"name": "rex"}, versions[2].Payload)
+}
+
+func TestEntityOwner(t *testing.T) {
+	ctx := withActor(context.Background(), "alice")
+	cfg := testServiceConfig("dogs")
+	cfg.SoftDelete = true
+	dogs := Service{Cfg: cfg, Storage: CreateMemStorage([]string{"dogs", "dogs__trash"})}
+
+	// the owner is the actor who created the entity, whichever actor changes it later
+	entity, err := dogs.Put(ctx, map[string]interface{}{"name": "rex"}, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "alice", entity.Owner)
+	ctx = withActor(ctx, "bob")
+	_, err = dogs.Update(ctx, entity.Id, map[string]interface{}{"name": "max"}, 0)
+	assert.Nil(t, err)
+	stored, err := dogs.Get(ctx, entity.Id)
+	assert.Nil(t, err)
+	assert.Equal(t, "alice", stored.Owner)
+
+	// the owner is kept in the trash
+	assert.Nil(t, dogs.Delete(ctx, entity.Id, 0))
+	deleted, err := dogs.GetDeleted(ctx, entity.Id)
+	assert.Nil(t, err)
+	assert.Equal(t, "alice", deleted.Owner)
+	_, err = dogs.Undelete(ctx, entity.Id)
+	assert.Nil(t, err)
+	stored, err = dogs.Get(ctx, entity.Id)
+	assert.Nil(t, err)
+	assert.Equal(t, "alice", stored.Owner)
+
+	// entities created without an actor have no owner
+	entity, err = dogs.Put(context.Background(), map[string]interface{}{"name": "bob"}, nil)
+	assert.Nil(t, err)
+	assert.Empty(t, entity.Owner)
+}
@@ -10,50 +10,139 @@ import (
 	"github.com/sirupsen/logrus"
 	ginlogrus "github.com/toorop/gin-logrus"
 	ginprometheus "github.com/zsais/go-gin-prometheus"
+	"net"
 	"net/http"
 	"os"
-	"os/signal"
+	"sort"
+	"strconv"
 	"strings"
-	"syscall"
+	"sync"
 	"time"
 )
 
+const (
+	metricsPath  = "metrics"
+	logLevelPath = "log_level"
+	healthzPath  = "healthz"
+	readyzPath   = "readyz"
+	adminPath    = "admin"
+
+	nextCursorHeader = "X-Next-Cursor"
+	actorHeader      = "X-Actor"
+	deletedAtHeader  = "X-Deleted-At"
+	expiresAtHeader  = "X-Expires-At"
+	maxPageLimit     = 1000
+
+	idempotencyKeyHeader     = "Idempotency-Key"
+	idempotentReplayedHeader = "Idempotent-Replayed"
+	maxIdempotencyKeyLength  = 255
+
+	// adminContextKey is set in gin context of requests authorized by ADMIN_API_KEY
+	adminContextKey = "usa.admin"
+)
+
+// reservedPaths contains first segments of built-in routes (including the ones reserved for future use)
+var reservedPaths = []string{
+	metricsPath,
+	logLevelPath,
+	healthzPath,
+	readyzPath,
+	adminPath,
+	"health",
+	"openapi.json",
+}
+
+const healthCheckTimeout = 3 * time.Second
+
 type httpServer struct {
-	endpoints map[string]Service
-	engine    *gin.Engine
-	logger    *logrus.Logger
+	endpoints  map[string]Service
+	storages   map[string]Storage // storages by name, used for health checks
+	engine     *gin.Engine
+	logger     *logrus.Logger
+	adminToken string // ADMIN_API_KEY, admin endpoints are disabled when empty
+	indexes    *indexStatus
+}
+
+// indexStatus is status of indexes rebuilt in background on startup; the server is not ready until they are rebuilt
+type indexStatus struct {
+	mu     sync.Mutex
+	status componentStatus
 }
 
-func createHttpServer(endpoints map[string]Service, logger *logrus.Logger) (*httpServer, error) {
+func (s *indexStatus) set(status componentStatus) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status = status
+}
+
+func (s *indexStatus) get() componentStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.status
+}
+
+type componentStatus struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type healthResponse struct {
+	Status     string                     `json:"status"`
+	Components map[string]componentStatus `json:"components,omitempty"`
+}
+
+func createHttpServer(endpoints map[string]Service, storages map[string]Storage, logger *logrus.Logger) (*httpServer, error) {
 	gin.SetMode(gin.ReleaseMode)
 
 	server := &httpServer{
-		endpoints: endpoints,
-		engine:    gin.New(),
-		logger:    logger,
+		endpoints:  endpoints,
+		storages:   storages,
+		engine:     gin.New(),
+		logger:     logger,
+		adminToken: os.Getenv("ADMIN_API_KEY"),
+		indexes:    &indexStatus{status: componentStatus{Status: "ok"}},
 	}
 
 	server.engine.Use(ginlogrus.Logger(logger))
 	server.engine.Use(gin.Recovery())
+	server.engine.Use(createTracingMiddleware())
 	server.registerPrometheus()
+	server.registerLogLevelHandler()
+	server.registerHealthHandlers()
+	server.registerAdminHandlers()
+	server.registerIndexHandler()
 
 	for _, endpoint := range endpoints {
+		if err := server.checkRouteCollision(endpoint.Cfg.GetPath()); err != nil {
+			return nil, err
+		}
+
 		err := server.registerHandlers(endpoint)
 		if err != nil {
 			return nil, err
 		}
 	}
 
-	server.registerLogLevelHandler()
-	server.registerIndexHandler()
 	server.engine.NoRoute(notFound)
 	server.engine.NoMethod(notFound)
 
 	return server, nil
 }
 
+// checkRouteCollision makes sure the service path does not shadow any route registered by the server
+func (server *httpServer) checkRouteCollision(path string) error {
+	for _, route := range server.engine.Routes() {
+		segment := strings.SplitN(strings.TrimPrefix(route.Path, "/"), "/", 2)[0]
+		if segment == path {
+			return fmt.Errorf("service path %q collides with built-in route %q", path, route.Path)
+		}
+	}
+
+	return nil
+}
+
 func (server *httpServer) registerHandlers(endpoint Service) error {
-	name := endpoint.Cfg.Name
+	path := endpoint.Cfg.GetPath()
 
 	type limitFunc func() (Limit, error)
 	type handler struct {
@@ -70,6 +159,12 @@ func (server *httpServer) registerHandlers(endpoint Service) error {
 			limitFunc:    endpoint.Cfg.ApiConfig.Limits.ParseList,
 			callbackFunc: server.createListEndpoint(endpoint),
 		},
+		{
+			httpMethod:   http.MethodGet,
+			url:          "/export",
+			limitFunc:    endpoint.Cfg.ApiConfig.Limits.ParseList,
+			callbackFunc: server.createExportEndpoint(endpoint),
+		},
 		{
 			httpMethod:   http.MethodGet,
 			url:          "/:id",
@@ -88,6 +183,12 @@ func (server *httpServer) registerHandlers(endpoint Service) error {
 			limitFunc:    endpoint.Cfg.ApiConfig.Limits.ParsePut,
 			callbackFunc: server.createPutEndpoint(endpoint),
 		},
+		{
+			httpMethod:   http.MethodPut,
+			url:          "/:id",
+			limitFunc:    endpoint.Cfg.ApiConfig.Limits.ParsePut,
+			callbackFunc: server.createUpdateEndpoint(endpoint),
+		},
 		{
 			httpMethod:   http.MethodDelete,
 			url:          "/:id",
@@ -96,9 +197,42 @@ func (server *httpServer) registerHandlers(endpoint Service) error {
 		},
 	}
 
-	group := server.engine.Group(fmt.Sprintf("/%s", name))
+	if endpoint.Cfg.SoftDelete {
+		handlers = append(handlers, handler{
+			httpMethod:   http.MethodPost,
+			url:          "/:id/restore",
+			limitFunc:    endpoint.Cfg.ApiConfig.Limits.ParsePut,
+			callbackFunc: server.createUndeleteEndpoint(endpoint),
+		})
+	}
+
+	if endpoint.Cfg.History {
+		handlers = append(handlers,
+			handler{
+				httpMethod:   http.MethodGet,
+				url:          "/:id/history",
+				limitFunc:    endpoint.Cfg.ApiConfig.Limits.ParseGet,
+				callbackFunc: server.createHistoryEndpoint(endpoint),
+			},
+			handler{
+				httpMethod:   http.MethodGet,
+				url:          "/:id/versions/:version",
+				limitFunc:    endpoint.Cfg.ApiConfig.Limits.ParseGet,
+				callbackFunc: server.createVersionEndpoint(endpoint),
+			},
+			handler{
+				httpMethod:   http.MethodPost,
+				url:          "/:id/versions/:version/restore",
+				limitFunc:    endpoint.Cfg.ApiConfig.Limits.ParsePut,
+				callbackFunc: server.createRestoreVersionEndpoint(endpoint),
+			},
+		)
+	}
+
+	group := server.engine.Group(fmt.Sprintf("/%s", path))
 	group.Use(createCORSMiddleware(endpoint))
 	group.Use(server.createAuthMiddleware(endpoint))
+	group.Use(createActorMiddleware())
 
 	for _, h := range handlers {
 		hLimit, err := h.limitFunc()
@@ -120,9 +254,16 @@ func (server *httpServer) registerHandlers(endpoint Service) error {
 
 func (server *httpServer) createAuthMiddleware(endpoint Service) gin.HandlerFunc {
 	return func(c *gin.Context) {
+		bearerTokenHeader := c.GetHeader("Authorization")
+		parts := strings.Split(bearerTokenHeader, " ")
+
+		// admin token is accepted by all services
+		if server.adminToken != "" && len(parts) == 2 && parts[1] == server.adminToken {
+			c.Set(adminContextKey, true)
+			return
+		}
+
 		if endpoint.Cfg.ApiConfig.Bearer != nil && *endpoint.Cfg.ApiConfig.Bearer != "" {
-			bearerTokenHeader := c.GetHeader("Authorization")
-			parts := strings.Split(bearerTokenHeader, " ")
 			if len(parts) != 2 {
 				server.logger.Tracef("invalid auth input: %q", bearerTokenHeader)
 				_ = c.AbortWithError(http.StatusUnauthorized, fmt.Errorf("invalid Authorization header input"))
@@ -140,27 +281,196 @@ func (server *httpServer) createAuthMiddleware(endpoint Service) gin.HandlerFunc
 
 func (server *httpServer) createListEndpoint(endpoint Service) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		list, err := endpoint.List()
+		includeDeleted, ok := server.parseIncludeDeleted(c, endpoint)
+		if !ok {
+			return
+		}
+		expand, ok := parseExpand(c, endpoint)
+		if !ok {
+			return
+		}
+
+		// paged listing when limit or cursor is requested
+		limitParam, cursor := c.Query("limit"), c.Query("cursor")
+		if (limitParam != "" || cursor != "") && includeDeleted {
+			c.String(http.StatusBadRequest, "include_deleted cannot be combined with paging")
+			return
+		}
+		if limitParam != "" || cursor != "" {
+			limit := maxPageLimit
+			if limitParam != "" {
+				var err error
+				limit, err = strconv.Atoi(limitParam)
+				if err != nil || limit < 1 || limit > maxPageLimit {
+					c.String(http.StatusBadRequest, "limit must be a number between 1 and %d", maxPageLimit)
+					return
+				}
+			}
+
+			list, next, err := endpoint.ListPage(c.Request.Context(), cursor, limit)
+			if err != nil {
+				server.logger.WithError(err).Debug("could not read page from storage")
+				c.String(http.StatusBadRequest, "could not read page from storage")
+				return
+			}
+
+			if next != "" {
+				c.Header(nextCursorHeader, next)
+			}
+			server.writeList(c, endpoint, list, expand)
+			return
+		}
+
+		list, err := endpoint.List(c.Request.Context())
 		if err != nil {
 			c.String(http.StatusInternalServerError, "could not read data from storage")
 			return
 		}
 
+		if includeDeleted {
+			deleted, err := endpoint.Trash(c.Request.Context())
+			if err != nil {
+				server.logger.WithError(err).Errorf("could not read trash of service %q", endpoint.Cfg.Name)
+				c.String(http.StatusInternalServerError, "could not read data from storage")
+				return
+			}
+			list = append(list, deleted...)
+		}
+
+		server.writeList(c, endpoint, list, expand)
+	}
+}
+
+// writeList writes the entities with expanded references
+func (server *httpServer) writeList(c *gin.Context, endpoint Service, list []Entity, expand []string) {
+	if len(expand) == 0 {
 		c.JSON(200, list)
+		return
+	}
+
+	// the list can be shared by the storage, so expanded entities are copies
+	expanded := make([]Entity, 0, len(list))
+	for _, entity := range list {
+		payload, err := endpoint.ExpandRefs(c.Request.Context(), entity.Payload, expand)
+		if err != nil {
+			server.logger.WithError(err).Errorf("could not expand references of service %q", endpoint.Cfg.Name)
+			c.String(http.StatusInternalServerError, "could not read data from storage")
+			return
+		}
+		entity.Payload = payload
+		expanded = append(expanded, entity)
+	}
+
+	c.JSON(200, expanded)
+}
+
+// parseExpand reads comma separated ref fields of expand query parameter; ok is false when the request was refused
+func parseExpand(c *gin.Context, endpoint Service) (fields []string, ok bool) {
+	value := c.Query("expand")
+	if value == "" {
+		return nil, true
+	}
+
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		field, found := endpoint.Cfg.Fields[name]
+		if !found || field.Type != "ref" {
+			c.String(http.StatusBadRequest, "expand must be a list of ref fields, %q is not", name)
+			return nil, false
+		}
+		fields = append(fields, name)
+	}
+
+	return fields, true
+}
+
+// parseIncludeDeleted reads include_deleted query parameter allowed only to admin; ok is false when the request
+// was refused
+func (server *httpServer) parseIncludeDeleted(c *gin.Context, endpoint Service) (includeDeleted bool, ok bool) {
+	value := c.Query("include_deleted")
+	if value == "" || !endpoint.Cfg.SoftDelete {
+		return false, true
+	}
+
+	includeDeleted, err := strconv.ParseBool(value)
+	if err != nil {
+		c.String(http.StatusBadRequest, "include_deleted must be true or false")
+		return false, false
+	}
+	if includeDeleted && !c.GetBool(adminContextKey) {
+		c.String(http.StatusForbidden, "deleted entities are available only with admin token")
+		return false, false
+	}
+
+	return includeDeleted, true
+}
+
+// createExportEndpoint streams all entities of the service as NDJSON or CSV file
+func (server *httpServer) createExportEndpoint(endpoint Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		format := c.DefaultQuery("format", exportFormatNdjson)
+		contentType, found := exportContentTypes[format]
+		if !found {
+			c.String(http.StatusBadRequest, "unknown format %q, use %q or %q", format, exportFormatNdjson, exportFormatCsv)
+			return
+		}
+
+		c.Header("Content-Type", contentType)
+		c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", endpoint.Cfg.Name+"."+format))
+		c.Status(http.StatusOK)
+
+		count, err := endpoint.Export(c.Request.Context(), format, c.Writer)
+		if err != nil {
+			// the response is already being sent, the client gets incomplete file
+			server.logger.WithError(err).Errorf("export of service %q failed after %d entities", endpoint.Cfg.Name, count)
+			return
+		}
+		server.logger.Debugf("%d entities of service %q exported", count, endpoint.Cfg.Name)
 	}
 }
 
 func (server *httpServer) createGetEndpoint(endpoint Service) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		id := c.Param("id")
+		includeDeleted, ok := server.parseIncludeDeleted(c, endpoint)
+		if !ok {
+			return
+		}
+		expand, ok := parseExpand(c, endpoint)
+		if !ok {
+			return
+		}
 
-		entity, err := endpoint.Get(id)
+		entity, err := endpoint.Get(c.Request.Context(), id)
+		if err != nil && includeDeleted {
+			entity, err = endpoint.GetDeleted(c.Request.Context(), id)
+		}
 		if err != nil {
 			c.String(http.StatusNotFound, "could not find entity with id %q", id)
 			return
 		}
 
-		c.JSON(200, entity.Payload)
+		if entity.DeletedAt != nil {
+			c.Header(deletedAtHeader, entity.DeletedAt.UTC().Format(time.RFC3339))
+		} else {
+			// deleted entity keeps its version, so it has no ETag to not be confused with the entity before deletion
+			etag := formatETag(entity.GetVersion())
+			c.Header("ETag", etag)
+			if matchesETag(c.GetHeader("If-None-Match"), etag) {
+				c.Status(http.StatusNotModified)
+				return
+			}
+		}
+		if expiration, ok := endpoint.getExpiration(entity); ok {
+			c.Header(expiresAtHeader, expiration.UTC().Format(time.RFC3339))
+		}
+		payload, err := endpoint.ExpandRefs(c.Request.Context(), entity.Payload, expand)
+		if err != nil {
+			server.logger.WithError(err).Errorf("could not expand references of entity %q", id)
+			c.String(http.StatusInternalServerError, "could not read data from storage")
+			return
+		}
+		c.JSON(200, payload)
 	}
 }
 func (server *httpServer) createPutEndpoint(endpoint Service) gin.HandlerFunc {
@@ -173,26 +483,270 @@ func (server *httpServer) createPutEndpoint(endpoint Service) gin.HandlerFunc {
 			return
 		}
 
-		if err := endpoint.Validate(rawJson); err != nil {
+		if err := endpoint.Validate(c.Request.Context(), rawJson); err != nil {
 			c.String(http.StatusBadRequest, "invalid input: %s", err.Error())
 			server.logger.WithError(err).Debugf("invalid input data: %q", rawData)
 			return
 		}
 
-		if err := endpoint.Put(rawJson); err != nil {
+		var expiresAt *time.Time
+		if value := c.GetHeader(expiresAtHeader); value != "" {
+			if !endpoint.Cfg.Expiration {
+				c.String(http.StatusBadRequest, "%s header is not allowed, expiration is not enabled for the service", expiresAtHeader)
+				return
+			}
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil || !t.After(time.Now()) {
+				c.String(http.StatusBadRequest, "%s header must be time in the future in RFC3339 format", expiresAtHeader)
+				return
+			}
+			expiresAt = &t
+		}
+
+		key := c.GetHeader(idempotencyKeyHeader)
+		if len(key) > maxIdempotencyKeyLength {
+			c.String(http.StatusBadRequest, "%s header must have at most %d characters", idempotencyKeyHeader, maxIdempotencyKeyLength)
+			return
+		}
+
+		var err error
+		replayed := false
+		if key != "" && endpoint.Cfg.Idempotency != "" {
+			_, replayed, err = endpoint.PutIdempotent(c.Request.Context(), key, rawJson, expiresAt)
+		} else {
+			_, err = endpoint.Put(c.Request.Context(), rawJson, expiresAt)
+		}
+		if errors.Is(err, errIdempotencyKeyReused) || errors.Is(err, errIdempotencyKeyInProgress) || errors.Is(err, errUniqueViolation) {
+			c.String(http.StatusConflict, "%s", err.Error())
+			return
+		}
+		if errors.Is(err, errRefNotFound) {
+			c.String(http.StatusBadRequest, "invalid input: %s", err.Error())
+			return
+		}
+		if err != nil {
 			c.String(http.StatusInternalServerError, "could not store requested data")
 			server.logger.WithError(err).Errorf("could not store data")
 			return
 		}
 
+		if replayed {
+			c.Header(idempotentReplayedHeader, "true")
+		}
+		c.String(http.StatusNoContent, "")
+	}
+}
+
+// createUpdateEndpoint replaces payload of an existing entity
+func (server *httpServer) createUpdateEndpoint(endpoint Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.Param("id")
+
+		var rawJson map[string]interface{}
+		rawData, _ := c.GetRawData()
+		if err := json.Unmarshal(rawData, &rawJson); err != nil {
+			c.String(http.StatusBadRequest, "could not parse json data: %w", err)
+			server.logger.WithError(err).Debugf("could not parse input data: %q", rawData)
+			return
+		}
+
+		if err := endpoint.Validate(c.Request.Context(), rawJson); err != nil {
+			c.String(http.StatusBadRequest, "invalid input: %s", err.Error())
+			server.logger.WithError(err).Debugf("invalid input data: %q", rawData)
+			return
+		}
+
+		version, ok := parseIfMatch(c)
+		if !ok {
+			return
+		}
+		entity, err := endpoint.Update(c.Request.Context(), id, rawJson, version)
+		if err != nil {
+			server.writeChangeError(c, id, err)
+			return
+		}
+
+		c.Header("ETag", formatETag(entity.Version))
+		c.String(http.StatusNoContent, "")
+	}
+}
+
+// createUndeleteEndpoint restores soft deleted entity from the trash
+func (server *httpServer) createUndeleteEndpoint(endpoint Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.Param("id")
+
+		_, err := endpoint.Undelete(c.Request.Context(), id)
+		if errors.Is(err, errEntityExists) {
+			c.String(http.StatusConflict, "entity with id %q already exists", id)
+			return
+		}
+		if errors.Is(err, errEntityExpired) {
+			c.String(http.StatusGone, "entity with id %q is already expired", id)
+			return
+		}
+		if errors.Is(err, errEntityNotFound) {
+			c.String(http.StatusNotFound, "could not find deleted entity with id %q", id)
+			return
+		}
+		if errors.Is(err, errUniqueViolation) {
+			c.String(http.StatusConflict, "%s", err.Error())
+			return
+		}
+		if err != nil {
+			server.logger.WithError(err).Errorf("could not restore entity %q", id)
+			c.String(http.StatusInternalServerError, "could not store requested data")
+			return
+		}
+
 		c.String(http.StatusNoContent, "")
 	}
 }
+
+func (server *httpServer) createHistoryEndpoint(endpoint Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.Param("id")
+
+		versions, err := endpoint.History(c.Request.Context(), id)
+		if err != nil {
+			server.writeReadError(c, id, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, versions)
+	}
+}
+
+func (server *httpServer) createVersionEndpoint(endpoint Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.Param("id")
+		version, err := strconv.Atoi(c.Param("version"))
+		if err != nil {
+			c.String(http.StatusBadRequest, "version must be a number")
+			return
+		}
+
+		v, err := endpoint.Version(c.Request.Context(), id, version)
+		if err != nil {
+			server.writeReadError(c, id, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, v)
+	}
+}
+
+// createRestoreVersionEndpoint replaces payload of the entity with payload of its older version
+func (server *httpServer) createRestoreVersionEndpoint(endpoint Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.Param("id")
+		version, err := strconv.Atoi(c.Param("version"))
+		if err != nil {
+			c.String(http.StatusBadRequest, "version must be a number")
+			return
+		}
+
+		_, err = endpoint.RestoreVersion(c.Request.Context(), id, version)
+		if errors.Is(err, errVersionNotRestorable) {
+			c.String(http.StatusBadRequest, "%s", err.Error())
+			return
+		}
+		if err != nil {
+			server.writeChangeError(c, id, err)
+			return
+		}
+
+		c.String(http.StatusNoContent, "")
+	}
+}
+
+func (server *httpServer) writeReadError(c *gin.Context, id string, err error) {
+	if errors.Is(err, errEntityNotFound) {
+		c.String(http.StatusNotFound, "could not find entity with id %q", id)
+		return
+	}
+
+	server.logger.WithError(err).Errorf("could not read history of entity %q", id)
+	c.String(http.StatusInternalServerError, "could not read data from storage")
+}
+
+func (server *httpServer) writeChangeError(c *gin.Context, id string, err error) {
+	if errors.Is(err, errEntityNotFound) {
+		c.String(http.StatusNotFound, "could not find entity with id %q", id)
+		return
+	}
+
+	if errors.Is(err, errVersionConflict) {
+		c.String(http.StatusPreconditionFailed, "entity with id %q was changed in the meantime", id)
+		return
+	}
+
+	if errors.Is(err, errUniqueViolation) || errors.Is(err, errRefRestricted) {
+		c.String(http.StatusConflict, "%s", err.Error())
+		return
+	}
+
+	if errors.Is(err, errRefNotFound) {
+		c.String(http.StatusBadRequest, "invalid input: %s", err.Error())
+		return
+	}
+
+	server.logger.WithError(err).Errorf("could not change entity %q", id)
+	c.String(http.StatusInternalServerError, "could not store requested data")
+}
+
+// formatETag returns strong ETag of the entity version
+func formatETag(version int64) string {
+	return strconv.Quote(strconv.FormatInt(version, 10))
+}
+
+// matchesETag reports whether If-None-Match header value matches the ETag (weak comparison)
+func matchesETag(header, etag string) bool {
+	for _, value := range strings.Split(header, ",") {
+		value = strings.TrimPrefix(strings.TrimSpace(value), "W/")
+		if value == "*" || value == etag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseIfMatch returns version of the entity required by If-Match header, 0 when any version can be changed.
+// Value which is not ETag of any version can never match, so the request fails with 412 right away.
+func parseIfMatch(c *gin.Context) (int64, bool) {
+	value := strings.TrimSpace(c.GetHeader("If-Match"))
+	if value == "" || value == "*" {
+		return 0, true
+	}
+
+	unquoted, err := strconv.Unquote(value)
+	if err == nil {
+		var version int64
+		version, err = strconv.ParseInt(unquoted, 10, 64)
+		if err == nil && version > 0 {
+			return version, true
+		}
+	}
+
+	c.String(http.StatusPreconditionFailed, "If-Match header %q does not match any version of the entity", value)
+	return 0, false
+}
+
 func (server *httpServer) createDeleteEndpoint(endpoint Service) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		id := c.Param("id")
 
-		if err := endpoint.Delete(id); err != nil {
+		version, ok := parseIfMatch(c)
+		if !ok {
+			return
+		}
+		err := endpoint.Delete(c.Request.Context(), id, version)
+		if errors.Is(err, errVersionConflict) || errors.Is(err, errRefRestricted) {
+			server.writeChangeError(c, id, err)
+			return
+		}
+		if err != nil {
 			server.logger.WithError(err).Info("could not delete entity")
 			c.String(http.StatusNotFound, "could not find an entity with id %q", id)
 			return
@@ -204,6 +758,7 @@ func (server *httpServer) createDeleteEndpoint(endpoint Service) gin.HandlerFunc
 
 func (server *httpServer) registerPrometheus() {
 	p := ginprometheus.NewPrometheus("gin")
+	p.MetricsPath = "/" + metricsPath
 	p.ReqCntURLLabelMappingFn = func(c *gin.Context) string {
 		url := c.FullPath()
 		return url
@@ -219,7 +774,7 @@ func (server *httpServer) registerLogLevelHandler() {
 		return
 	}
 
-	server.engine.POST("/log_level", func(c *gin.Context) {
+	server.engine.POST("/"+logLevelPath, func(c *gin.Context) {
 		bearerTokenHeader := c.GetHeader("Authorization")
 		parts := strings.Split(bearerTokenHeader, " ")
 		if len(parts) != 2 {
@@ -260,6 +815,108 @@ func (server *httpServer) registerLogLevelHandler() {
 	server.logger.Trace("Log level change endpoint created")
 }
 
+// registerHealthHandlers registers liveness (/healthz) and readiness (/readyz) probes. Liveness only reports
+// the application is running so an unreachable backend does not restart it; readiness checks all storage backends
+// are reachable and ready and indexes are rebuilt.
+func (server *httpServer) registerHealthHandlers() {
+	server.engine.GET("/"+healthzPath, func(c *gin.Context) {
+		c.JSON(http.StatusOK, healthResponse{Status: "ok"})
+	})
+	server.engine.GET("/"+readyzPath, server.writeReadiness)
+}
+
+func (server *httpServer) writeReadiness(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), healthCheckTimeout)
+	defer cancel()
+
+	response := healthResponse{
+		Status:     "ok",
+		Components: make(map[string]componentStatus, len(server.storages)),
+	}
+
+	for name, stg := range server.storages {
+		component := componentStatus{Status: "ok"}
+		if err := stg.Health(ctx); err != nil {
+			component = componentStatus{Status: "error", Error: err.Error()}
+			server.logger.WithError(err).Warnf("storage %q health check failed", name)
+		} else if !stg.Ready() {
+			component = componentStatus{Status: "not_ready"}
+		}
+
+		if component.Status != "ok" {
+			response.Status = component.Status
+		}
+		response.Components[name] = component
+	}
+
+	if indexes := server.indexes.get(); indexes.Status != "ok" {
+		response.Status = indexes.Status
+		response.Components["indexes"] = indexes
+	}
+
+	code := http.StatusOK
+	if response.Status != "ok" {
+		code = http.StatusServiceUnavailable
+	}
+
+	c.JSON(code, response)
+}
+
+// registerAdminHandlers registers administration endpoints protected by ADMIN_API_KEY
+func (server *httpServer) registerAdminHandlers() {
+	apiToken := server.adminToken
+	if apiToken == "" {
+		server.logger.Trace("Admin endpoints not going to work because there is no ADMIN_API_KEY environment variable")
+		return
+	}
+
+	group := server.engine.Group("/" + adminPath)
+	group.Use(createBearerAuthMiddleware(apiToken))
+
+	// online backup of the storage as file download, storage query parameter selects storage by name and is required
+	// when more storages support backups
+	group.GET("/backup", func(c *gin.Context) {
+		backups := make(map[string]BackupStorage)
+		var names []string
+		for storageName, stg := range server.storages {
+			if b, ok := asBackupStorage(stg); ok {
+				backups[storageName] = b
+				names = append(names, storageName)
+			}
+		}
+		sort.Strings(names)
+
+		name := c.Query("storage")
+		if name == "" && len(names) > 1 {
+			c.String(http.StatusBadRequest, "storage query parameter is required, storages supporting backups: %s", strings.Join(names, ", "))
+			return
+		}
+		if name == "" && len(names) == 1 {
+			name = names[0]
+		}
+
+		backup, found := backups[name]
+		if !found {
+			c.String(http.StatusNotFound, "no storage supporting backups found")
+			return
+		}
+
+		filename := fmt.Sprintf("usa-%s-%s.db", name, time.Now().UTC().Format("20060102T150405Z"))
+		c.Header("Content-Type", "application/octet-stream")
+		c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+
+		size, err := backup.Backup(c.Request.Context(), c.Writer)
+		if err != nil {
+			server.logger.WithError(err).Errorf("backup of storage %q failed", name)
+			_ = c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		server.logger.Infof("backup of storage %q created (%d bytes)", name, size)
+	})
+
+	server.logger.Trace("Admin endpoints created")
+}
+
 func (server *httpServer) registerIndexHandler() {
 	server.engine.GET("/", func(c *gin.Context) {
 		var services []string
@@ -279,10 +936,18 @@ func (server *httpServer) registerIndexHandler() {
 	})
 }
 
-func (server *httpServer) Run(port int) {
+// Run serves HTTP requests until the context is canceled. In-flight requests have a grace period to finish;
+// after that their contexts are canceled so storage operations are interrupted.
+func (server *httpServer) Run(ctx context.Context, port int) {
+	baseCtx, cancelBase := context.WithCancel(context.Background())
+	defer cancelBase()
+
 	srv := &http.Server{
 		Addr:    fmt.Sprintf(":%d", port),
 		Handler: server.engine,
+		BaseContext: func(net.Listener) context.Context {
+			return baseCtx
+		},
 	}
 
 	go func() {
@@ -291,15 +956,15 @@ func (server *httpServer) Run(port int) {
 		}
 	}()
 
-	quit := make(chan os.Signal)
-	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
-	<-quit
+	<-ctx.Done()
 	server.logger.Info("Shutting down server...")
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	if err := srv.Shutdown(ctx); err != nil {
-		server.logger.Fatal("Server forced to shutdown:", err)
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		server.logger.WithError(err).Error("Server forced to shutdown, canceling in-flight requests")
+		cancelBase()
+		_ = srv.Close()
 	}
 
 	server.logger.Info("Server exiting...")
@@ -327,8 +992,10 @@ func createCORSMiddleware(endpoint Service) gin.HandlerFunc {
 		}
 		c.Writer.Header().Set("Access-Control-Allow-Origin", origin)
 		c.Writer.Header().Set("Access-Control-Allow-Credentials", "true")
-		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, accept, origin, Cache-Control, X-Requested-With")
+		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, accept, origin, Cache-Control, X-Requested-With, X-Actor, X-Expires-At, If-Match, If-None-Match, Idempotency-Key")
 		c.Writer.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS, GET, PUT, DELETE")
+		// response headers other than the simple ones are not readable by browsers unless they are exposed
+		c.Writer.Header().Set("Access-Control-Expose-Headers", "ETag, X-Next-Cursor, X-Expires-At, X-Deleted-At, Idempotent-Replayed")
 
 		if c.Request.Method == "OPTIONS" {
 			c.AbortWithStatus(204)
@@ -339,6 +1006,25 @@ func createCORSMiddleware(endpoint Service) gin.HandlerFunc {
 	}
 }
 
+// createActorMiddleware passes the actor from request header to the history of changed entities
+func createActorMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if actor := c.GetHeader(actorHeader); actor != "" {
+			c.Request = c.Request.WithContext(withActor(c.Request.Context(), actor))
+		}
+	}
+}
+
+func createBearerAuthMiddleware(token string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		parts := strings.Split(c.GetHeader("Authorization"), " ")
+		if len(parts) != 2 || parts[1] != token {
+			_ = c.AbortWithError(http.StatusUnauthorized, fmt.Errorf("invalid Authorization bearer token"))
+			return
+		}
+	}
+}
+
 func notFound(c *gin.Context) {
 	c.String(404, "not found")
 }
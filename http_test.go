@@ -0,0 +1,427 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func createTestServer(t *testing.T, serviceConfigs ...ServiceConfig) *httpServer {
+	var names []string
+	for _, cfg := range serviceConfigs {
+		names = append(names, cfg.Name)
+	}
+
+	stg := CreateMemStorage(names)
+	endpoints := make(map[string]Service, len(serviceConfigs))
+	for _, cfg := range serviceConfigs {
+		endpoints[cfg.Name] = Service{Cfg: cfg, Storage: stg, Services: endpoints}
+	}
+
+	server, err := createHttpServer(endpoints, map[string]Storage{"mem": stg}, logrus.New())
+	assert.Nil(t, err)
+
+	return server
+}
+
+func testServiceConfig(name string) ServiceConfig {
+	return ServiceConfig{
+		Name: name,
+		ApiConfig: ApiConfig{
+			Limits: LimitsConfig{Get: "0", List: "0", Put: "0", Delete: "0"},
+		},
+		Fields: map[string]*FieldConfig{
+			"name": {Name: "name", Type: "string"},
+		},
+	}
+}
+
+func doRequest(server *httpServer, method, url, body string, headers ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, url, strings.NewReader(body))
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	rec := httptest.NewRecorder()
+	server.engine.ServeHTTP(rec, req)
+
+	return rec
+}
+
+func TestServicePathRouting(t *testing.T) {
+	cfg := testServiceConfig("dogs")
+	cfg.Path = "puppies"
+	server := createTestServer(t, cfg)
+
+	assert.Equal(t, http.StatusNoContent, doRequest(server, http.MethodPut, "/puppies", `{"name": "rex"}`).Code)
+	assert.Equal(t, http.StatusOK, doRequest(server, http.MethodGet, "/puppies", "").Code)
+	assert.Equal(t, http.StatusNotFound, doRequest(server, http.MethodGet, "/dogs", "").Code)
+}
+
+func TestServicePathCollision(t *testing.T) {
+	cfg := testServiceConfig("dogs")
+	cfg.Path = metricsPath
+
+	stg := CreateMemStorage([]string{"dogs"})
+	_, err := createHttpServer(map[string]Service{"dogs": {Cfg: cfg, Storage: stg}}, map[string]Storage{"mem": stg}, logrus.New())
+	assert.Error(t, err)
+}
+
+type notReadyStorage struct {
+	*memStorage
+}
+
+func (s notReadyStorage) Ready() bool {
+	return false
+}
+
+func TestHealthEndpoints(t *testing.T) {
+	server := createTestServer(t, testServiceConfig("dogs"))
+
+	res := doRequest(server, http.MethodGet, "/healthz", "")
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.JSONEq(t, `{"status": "ok"}`, res.Body.String())
+	res = doRequest(server, http.MethodGet, "/readyz", "")
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.JSONEq(t, `{"status": "ok", "components": {"mem": {"status": "ok"}}}`, res.Body.String())
+
+	// storage is alive but not ready yet
+	stg := notReadyStorage{CreateMemStorage([]string{"dogs"})}
+	server.storages = map[string]Storage{"s3": stg}
+
+	assert.Equal(t, http.StatusOK, doRequest(server, http.MethodGet, "/healthz", "").Code)
+	res = doRequest(server, http.MethodGet, "/readyz", "")
+	assert.Equal(t, http.StatusServiceUnavailable, res.Code)
+	assert.JSONEq(t, `{"status": "not_ready", "components": {"s3": {"status": "not_ready"}}}`, res.Body.String())
+
+	// indexes are not rebuilt yet or could not be rebuilt
+	server.storages = map[string]Storage{"mem": CreateMemStorage([]string{"dogs"})}
+	server.indexes.set(componentStatus{Status: "not_ready"})
+	res = doRequest(server, http.MethodGet, "/readyz", "")
+	assert.Equal(t, http.StatusServiceUnavailable, res.Code)
+	assert.JSONEq(t, `{"status": "not_ready", "components": {"mem": {"status": "ok"}, "indexes": {"status": "not_ready"}}}`, res.Body.String())
+	server.indexes.set(componentStatus{Status: "error", Error: "could not rebuild indexes of services dogs"})
+	res = doRequest(server, http.MethodGet, "/readyz", "")
+	assert.Equal(t, http.StatusServiceUnavailable, res.Code)
+	assert.Contains(t, res.Body.String(), `"indexes":{"status":"error","error":"could not rebuild indexes of services dogs"}`)
+}
+
+func TestCORSHeaders(t *testing.T) {
+	server := createTestServer(t, testServiceConfig("dogs"))
+
+	res := doRequest(server, http.MethodOptions, "/dogs", "")
+	assert.Equal(t, http.StatusNoContent, res.Code)
+	assert.Contains(t, res.Header().Get("Access-Control-Allow-Headers"), "Idempotency-Key")
+
+	res = doRequest(server, http.MethodGet, "/dogs", "")
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, "*", res.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "ETag, X-Next-Cursor, X-Expires-At, X-Deleted-At, Idempotent-Replayed", res.Header().Get("Access-Control-Expose-Headers"))
+}
+
+func TestPagedListEndpoint(t *testing.T) {
+	server := createTestServer(t, testServiceConfig("dogs"))
+	for _, name := range []string{"a", "b", "c"} {
+		assert.Equal(t, http.StatusNoContent, doRequest(server, http.MethodPut, "/dogs", `{"name": "`+name+`"}`).Code)
+	}
+
+	res := doRequest(server, http.MethodGet, "/dogs?limit=2", "")
+	assert.Equal(t, http.StatusOK, res.Code)
+	next := res.Header().Get(nextCursorHeader)
+	assert.NotEmpty(t, next)
+	assert.Contains(t, res.Body.String(), `"name":"b"`)
+	assert.NotContains(t, res.Body.String(), `"name":"c"`)
+
+	res = doRequest(server, http.MethodGet, "/dogs?limit=2&cursor="+next, "")
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Empty(t, res.Header().Get(nextCursorHeader))
+	assert.Contains(t, res.Body.String(), `"name":"c"`)
+
+	assert.Equal(t, http.StatusBadRequest, doRequest(server, http.MethodGet, "/dogs?limit=0", "").Code)
+	assert.Equal(t, http.StatusBadRequest, doRequest(server, http.MethodGet, "/dogs?limit=2&cursor=missing", "").Code)
+}
+
+func TestAdminBackupEndpoint(t *testing.T) {
+	t.Setenv("ADMIN_API_KEY", "secret")
+	t.Setenv("BOLT_FILE", filepath.Join(t.TempDir(), "usa.db"))
+	stg, err := CreateBoltStorage([]string{"dogs"})
+	assert.Nil(t, err)
+	defer stg.Close()
+
+	cfg := testServiceConfig("dogs")
+	instrumented := InstrumentStorage("bolt", stg)
+	server, err := createHttpServer(map[string]Service{"dogs": {Cfg: cfg, Storage: instrumented}}, map[string]Storage{"bolt": instrumented}, logrus.New())
+	assert.Nil(t, err)
+
+	assert.Equal(t, http.StatusUnauthorized, doRequest(server, http.MethodGet, "/admin/backup", "").Code)
+	res := doRequest(server, http.MethodGet, "/admin/backup", "", "Authorization", "Bearer secret")
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Contains(t, res.Header().Get("Content-Disposition"), "usa-bolt-")
+	assert.NotZero(t, res.Body.Len())
+
+	// storage must be selected when more storages support backups
+	server.storages["archive"] = instrumented
+	assert.Equal(t, http.StatusBadRequest, doRequest(server, http.MethodGet, "/admin/backup", "", "Authorization", "Bearer secret").Code)
+	res = doRequest(server, http.MethodGet, "/admin/backup?storage=archive", "", "Authorization", "Bearer secret")
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Contains(t, res.Header().Get("Content-Disposition"), "usa-archive-")
+	assert.Equal(t, http.StatusNotFound, doRequest(server, http.MethodGet, "/admin/backup?storage=missing", "", "Authorization", "Bearer secret").Code)
+}
+
+func TestExportEndpoint(t *testing.T) {
+	server := createTestServer(t, testServiceConfig("dogs"))
+	assert.Equal(t, http.StatusNoContent, doRequest(server, http.MethodPut, "/dogs", `{"name": "rex"}`).Code)
+
+	res := doRequest(server, http.MethodGet, "/dogs/export?format=csv", "")
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, "text/csv", res.Header().Get("Content-Type"))
+	assert.Equal(t, `attachment; filename="dogs.csv"`, res.Header().Get("Content-Disposition"))
+	assert.True(t, strings.HasPrefix(res.Body.String(), "_id,_created,name\n"))
+	assert.Contains(t, res.Body.String(), ",rex\n")
+
+	res = doRequest(server, http.MethodGet, "/dogs/export", "")
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, "application/x-ndjson", res.Header().Get("Content-Type"))
+	assert.Contains(t, res.Body.String(), `"payload":{"name":"rex"}`)
+
+	assert.Equal(t, http.StatusBadRequest, doRequest(server, http.MethodGet, "/dogs/export?format=xml", "").Code)
+}
+
+func TestHistoryEndpoints(t *testing.T) {
+	cfg := testServiceConfig("dogs")
+	cfg.History = true
+	server := createTestServer(t, cfg, testServiceConfig("cats"))
+
+	assert.Equal(t, http.StatusNoContent, doRequest(server, http.MethodPut, "/dogs", `{"name": "rex"}`, actorHeader, "alice").Code)
+	dogs := server.endpoints["dogs"]
+	list, err := dogs.List(context.Background())
+	assert.Nil(t, err)
+	id := list[0].Id
+
+	assert.Equal(t, http.StatusNoContent, doRequest(server, http.MethodPut, "/dogs/"+id, `{"name": "max"}`, actorHeader, "bob").Code)
+	assert.Equal(t, http.StatusBadRequest, doRequest(server, http.MethodPut, "/dogs/"+id, `{"name": 1}`).Code)
+	assert.Equal(t, http.StatusNotFound, doRequest(server, http.MethodPut, "/dogs/missing", `{"name": "max"}`).Code)
+	res := doRequest(server, http.MethodGet, "/dogs/"+id, "")
+	assert.JSONEq(t, `{"name": "max"}`, res.Body.String())
+
+	var versions []entityVersion
+	res = doRequest(server, http.MethodGet, "/dogs/"+id+"/history", "")
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Nil(t, json.Unmarshal(res.Body.Bytes(), &versions))
+	assert.Len(t, versions, 2)
+	assert.Equal(t, "alice", versions[0].Actor)
+	assert.Equal(t, map[string]interface{}{"name": "max"}, versions[1].Payload)
+	assert.Equal(t, "bob", versions[1].Actor)
+
+	// restore creates a new version with the old payload
+	assert.Equal(t, http.StatusNoContent, doRequest(server, http.MethodPost, "/dogs/"+id+"/versions/1/restore", "").Code)
+	res = doRequest(server, http.MethodGet, "/dogs/"+id, "")
+	assert.JSONEq(t, `{"name": "rex"}`, res.Body.String())
+	var v entityVersion
+	res = doRequest(server, http.MethodGet, "/dogs/"+id+"/versions/3", "")
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Nil(t, json.Unmarshal(res.Body.Bytes(), &v))
+	assert.Equal(t, 1, v.RestoredFrom)
+	assert.Equal(t, http.StatusNotFound, doRequest(server, http.MethodGet, "/dogs/"+id+"/versions/4", "").Code)
+	assert.Equal(t, http.StatusBadRequest, doRequest(server, http.MethodGet, "/dogs/"+id+"/versions/last", "").Code)
+
+	// deletion is recorded and can not be restored
+	assert.Equal(t, http.StatusNoContent, doRequest(server, http.MethodDelete, "/dogs/"+id, "").Code)
+	res = doRequest(server, http.MethodGet, "/dogs/"+id+"/versions/4", "")
+	assert.Nil(t, json.Unmarshal(res.Body.Bytes(), &v))
+	assert.True(t, v.Deleted)
+	assert.Equal(t, http.StatusBadRequest, doRequest(server, http.MethodPost, "/dogs/"+id+"/versions/4/restore", "").Code)
+	assert.Equal(t, http.StatusNotFound, doRequest(server, http.MethodPost, "/dogs/"+id+"/versions/2/restore", "").Code)
+
+	// entities without history have only the current version
+	assert.Equal(t, http.StatusNotFound, doRequest(server, http.MethodGet, "/cats/"+id+"/history", "").Code)
+}
+
+func TestSoftDeleteEndpoints(t *testing.T) {
+	t.Setenv("ADMIN_API_KEY", "admin")
+	cfg := testServiceConfig("dogs")
+	cfg.SoftDelete = true
+	bearer := "secret"
+	cfg.ApiConfig.Bearer = &bearer
+	server := createTestServer(t, cfg)
+	auth, admin := "Bearer secret", "Bearer admin"
+
+	assert.Equal(t, http.StatusNoContent, doRequest(server, http.MethodPut, "/dogs", `{"name": "rex"}`, "Authorization", auth).Code)
+	dogs := server.endpoints["dogs"]
+	list, err := dogs.List(context.Background())
+	assert.Nil(t, err)
+	id := list[0].Id
+
+	// deleted entity is hidden
+	assert.Equal(t, http.StatusNoContent, doRequest(server, http.MethodDelete, "/dogs/"+id, "", "Authorization", auth).Code)
+	assert.Equal(t, http.StatusNotFound, doRequest(server, http.MethodGet, "/dogs/"+id, "", "Authorization", auth).Code)
+	assert.Equal(t, http.StatusNotFound, doRequest(server, http.MethodDelete, "/dogs/"+id, "", "Authorization", auth).Code)
+	assert.JSONEq(t, `[]`, doRequest(server, http.MethodGet, "/dogs", "", "Authorization", auth).Body.String())
+
+	// only admin can see deleted entities
+	assert.Equal(t, http.StatusForbidden, doRequest(server, http.MethodGet, "/dogs?include_deleted=true", "", "Authorization", auth).Code)
+	res := doRequest(server, http.MethodGet, "/dogs/"+id+"?include_deleted=true", "", "Authorization", admin)
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.JSONEq(t, `{"name": "rex"}`, res.Body.String())
+	assert.NotEmpty(t, res.Header().Get(deletedAtHeader))
+	assert.Empty(t, res.Header().Get("ETag"))
+	var deleted []Entity
+	res = doRequest(server, http.MethodGet, "/dogs?include_deleted=true", "", "Authorization", admin)
+	assert.Nil(t, json.Unmarshal(res.Body.Bytes(), &deleted))
+	assert.Len(t, deleted, 1)
+	assert.Equal(t, id, deleted[0].Id)
+	assert.True(t, list[0].Created.Equal(deleted[0].Created))
+	assert.NotNil(t, deleted[0].DeletedAt)
+	assert.Equal(t, http.StatusBadRequest, doRequest(server, http.MethodGet, "/dogs?include_deleted=true&limit=1", "", "Authorization", admin).Code)
+
+	// restore keeps ID and created time, the version follows the version of the deletion
+	assert.Equal(t, http.StatusNoContent, doRequest(server, http.MethodPost, "/dogs/"+id+"/restore", "", "Authorization", auth).Code)
+	assert.Equal(t, http.StatusNotFound, doRequest(server, http.MethodPost, "/dogs/"+id+"/restore", "", "Authorization", auth).Code)
+	res = doRequest(server, http.MethodGet, "/dogs/"+id, "", "Authorization", auth)
+	assert.JSONEq(t, `{"name": "rex"}`, res.Body.String())
+	assert.Empty(t, res.Header().Get(deletedAtHeader))
+	assert.Equal(t, `"3"`, res.Header().Get("ETag"))
+	restored, err := dogs.Get(context.Background(), id)
+	assert.Nil(t, err)
+	assert.True(t, list[0].Created.Equal(restored.Created))
+	trash, err := dogs.Trash(context.Background())
+	assert.Nil(t, err)
+	assert.Empty(t, trash)
+}
+
+func TestExpiresAtHeader(t *testing.T) {
+	cfg := testServiceConfig("dogs")
+	server := createTestServer(t, cfg)
+	expiresAt := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+
+	// the header is accepted by services with expiration only
+	assert.Equal(t, http.StatusBadRequest, doRequest(server, http.MethodPut, "/dogs", `{"name": "rex"}`, expiresAtHeader, expiresAt.Format(time.RFC3339)).Code)
+	cfg.Expiration = true
+	server = createTestServer(t, cfg)
+
+	assert.Equal(t, http.StatusBadRequest, doRequest(server, http.MethodPut, "/dogs", `{"name": "rex"}`, expiresAtHeader, "tomorrow").Code)
+	assert.Equal(t, http.StatusBadRequest, doRequest(server, http.MethodPut, "/dogs", `{"name": "rex"}`, expiresAtHeader, "2020-01-01T00:00:00Z").Code)
+	assert.Equal(t, http.StatusNoContent, doRequest(server, http.MethodPut, "/dogs", `{"name": "rex"}`, expiresAtHeader, expiresAt.Format(time.RFC3339)).Code)
+
+	var list []Entity
+	res := doRequest(server, http.MethodGet, "/dogs", "")
+	assert.Nil(t, json.Unmarshal(res.Body.Bytes(), &list))
+	assert.Len(t, list, 1)
+	assert.True(t, expiresAt.Equal(*list[0].ExpiresAt))
+
+	res = doRequest(server, http.MethodGet, "/dogs/"+list[0].Id, "")
+	assert.Equal(t, expiresAt.Format(time.RFC3339), res.Header().Get(expiresAtHeader))
+}
+
+func TestETagPreconditions(t *testing.T) {
+	server := createTestServer(t, testServiceConfig("dogs"))
+	assert.Equal(t, http.StatusNoContent, doRequest(server, http.MethodPut, "/dogs", `{"name": "rex"}`).Code)
+
+	var list []Entity
+	res := doRequest(server, http.MethodGet, "/dogs", "")
+	assert.Nil(t, json.Unmarshal(res.Body.Bytes(), &list))
+	path := "/dogs/" + list[0].Id
+
+	res = doRequest(server, http.MethodGet, path, "")
+	assert.Equal(t, `"1"`, res.Header().Get("ETag"))
+	assert.Equal(t, http.StatusNotModified, doRequest(server, http.MethodGet, path, "", "If-None-Match", `W/"1"`).Code)
+	assert.Equal(t, http.StatusOK, doRequest(server, http.MethodGet, path, "", "If-None-Match", `"2"`).Code)
+
+	// update of the current version only
+	res = doRequest(server, http.MethodPut, path, `{"name": "max"}`, "If-Match", `"1"`)
+	assert.Equal(t, http.StatusNoContent, res.Code)
+	assert.Equal(t, `"2"`, res.Header().Get("ETag"))
+	assert.Equal(t, http.StatusPreconditionFailed, doRequest(server, http.MethodPut, path, `{"name": "lost"}`, "If-Match", `"1"`).Code)
+	assert.Equal(t, http.StatusPreconditionFailed, doRequest(server, http.MethodPut, path, `{"name": "lost"}`, "If-Match", "abc").Code)
+	assert.Equal(t, http.StatusNotFound, doRequest(server, http.MethodPut, "/dogs/missing", `{"name": "max"}`, "If-Match", `"1"`).Code)
+
+	// update without precondition always succeeds
+	res = doRequest(server, http.MethodPut, path, `{"name": "buddy"}`)
+	assert.Equal(t, `"3"`, res.Header().Get("ETag"))
+	res = doRequest(server, http.MethodGet, path, "")
+	assert.Equal(t, `{"name":"buddy"}`, res.Body.String())
+
+	assert.Equal(t, http.StatusPreconditionFailed, doRequest(server, http.MethodDelete, path, "", "If-Match", `"2"`).Code)
+	assert.Equal(t, http.StatusNoContent, doRequest(server, http.MethodDelete, path, "", "If-Match", `"3"`).Code)
+	assert.Equal(t, http.StatusNotFound, doRequest(server, http.MethodGet, path, "").Code)
+}
+
+func TestIdempotencyKeyHeader(t *testing.T) {
+	cfg := testServiceConfig("dogs")
+	cfg.Idempotency = "24h"
+	server := createTestServer(t, cfg)
+
+	res := doRequest(server, http.MethodPut, "/dogs", `{"name": "rex"}`, idempotencyKeyHeader, "abc")
+	assert.Equal(t, http.StatusNoContent, res.Code)
+	assert.Empty(t, res.Header().Get(idempotentReplayedHeader))
+	res = doRequest(server, http.MethodPut, "/dogs", `{ "name":"rex" }`, idempotencyKeyHeader, "abc")
+	assert.Equal(t, http.StatusNoContent, res.Code)
+	assert.Equal(t, "true", res.Header().Get(idempotentReplayedHeader))
+	assert.Equal(t, http.StatusConflict, doRequest(server, http.MethodPut, "/dogs", `{"name": "max"}`, idempotencyKeyHeader, "abc").Code)
+	assert.Equal(t, http.StatusBadRequest, doRequest(server, http.MethodPut, "/dogs", `{"name": "max"}`, idempotencyKeyHeader, strings.Repeat("k", 256)).Code)
+
+	var list []Entity
+	assert.Nil(t, json.Unmarshal(doRequest(server, http.MethodGet, "/dogs", "").Body.Bytes(), &list))
+	assert.Len(t, list, 1)
+}
+
+func TestUniqueKeyConflict(t *testing.T) {
+	yes := true
+	cfg := testServiceConfig("dogs")
+	cfg.Fields["name"].Unique = &yes
+	server := createTestServer(t, cfg)
+
+	assert.Equal(t, http.StatusNoContent, doRequest(server, http.MethodPut, "/dogs", `{"name": "rex"}`).Code)
+	assert.Equal(t, http.StatusNoContent, doRequest(server, http.MethodPut, "/dogs", `{"name": "max"}`).Code)
+	res := doRequest(server, http.MethodPut, "/dogs", `{"name": "rex"}`)
+	assert.Equal(t, http.StatusConflict, res.Code)
+	assert.Contains(t, res.Body.String(), `"name"`)
+
+	var list []Entity
+	assert.Nil(t, json.Unmarshal(doRequest(server, http.MethodGet, "/dogs", "").Body.Bytes(), &list))
+	assert.Len(t, list, 2)
+	max := list[0]
+	if max.Payload.(map[string]interface{})["name"] != "max" {
+		max = list[1]
+	}
+	assert.Equal(t, http.StatusConflict, doRequest(server, http.MethodPut, "/dogs/"+max.Id, `{"name": "rex"}`).Code)
+	assert.Equal(t, http.StatusNoContent, doRequest(server, http.MethodPut, "/dogs/"+max.Id, `{"name": "buddy"}`).Code)
+}
+
+func TestRefEndpoints(t *testing.T) {
+	target := "people"
+	dogs := testServiceConfig("dogs")
+	dogs.Fields["owner"] = &FieldConfig{Name: "owner", Type: "ref", Service: &target}
+	server := createTestServer(t, testServiceConfig("people"), dogs)
+
+	assert.Equal(t, http.StatusNoContent, doRequest(server, http.MethodPut, "/people", `{"name": "alice"}`).Code)
+	var people []Entity
+	assert.Nil(t, json.Unmarshal(doRequest(server, http.MethodGet, "/people", "").Body.Bytes(), &people))
+	assert.Len(t, people, 1)
+	alice := people[0]
+
+	assert.Equal(t, http.StatusBadRequest, doRequest(server, http.MethodPut, "/dogs", `{"name": "rex", "owner": "missing"}`).Code)
+	assert.Equal(t, http.StatusNoContent, doRequest(server, http.MethodPut, "/dogs", `{"name": "rex", "owner": "`+alice.Id+`"}`).Code)
+
+	var list []Entity
+	assert.Nil(t, json.Unmarshal(doRequest(server, http.MethodGet, "/dogs?expand=owner", "").Body.Bytes(), &list))
+	assert.Len(t, list, 1)
+	owner := list[0].Payload.(map[string]interface{})["owner"].(map[string]interface{})
+	assert.Equal(t, alice.Id, owner["id"])
+	assert.Equal(t, "alice", owner["payload"].(map[string]interface{})["name"])
+
+	var payload map[string]interface{}
+	assert.Nil(t, json.Unmarshal(doRequest(server, http.MethodGet, "/dogs/"+list[0].Id+"?expand=owner", "").Body.Bytes(), &payload))
+	assert.Equal(t, alice.Id, payload["owner"].(map[string]interface{})["id"])
+	assert.Nil(t, json.Unmarshal(doRequest(server, http.MethodGet, "/dogs/"+list[0].Id, "").Body.Bytes(), &payload))
+	assert.Equal(t, alice.Id, payload["owner"])
+	assert.Equal(t, http.StatusBadRequest, doRequest(server, http.MethodGet, "/dogs?expand=name", "").Code)
+
+	assert.Equal(t, http.StatusConflict, doRequest(server, http.MethodDelete, "/people/"+alice.Id, "").Code)
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	idempotencyServiceSuffix = "__idempotency"
+
+	// idempotencyPendingTimeout is time after which unfinished request (e.g. interrupted by a crash) does not block
+	// other requests with the same key anymore
+	idempotencyPendingTimeout = time.Minute
+)
+
+var (
+	errIdempotencyKeyReused     = errors.New("idempotency key was already used with different request")
+	errIdempotencyKeyInProgress = errors.New("request with the same idempotency key is in progress")
+)
+
+// idempotencyRecord is payload of the key stored in the idempotency service of the service. The record ID is derived
+// from the key, it is created when the first request with the key starts and expires after the idempotency window.
+type idempotencyRecord struct {
+	Key         string `json:"key"`
+	RequestHash string `json:"request_hash"`
+	EntityId    string `json:"entity_id,omitempty"` // empty until the entity is created
+}
+
+func getIdempotencyServiceName(serviceName string) string {
+	return serviceName + idempotencyServiceSuffix
+}
+
+// getIdempotencyId returns ID of the record of the key; keys can be long, so IDs are hashes of the same length
+func getIdempotencyId(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:16])
+}
+
+// getRequestHash identifies the create request; keys of the payload are ordered, so only the content matters
+func getRequestHash(payload map[string]interface{}, expiresAt *time.Time) (string, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return "", fmt.Errorf("could not encode payload: %w", err)
+	}
+	if expiresAt != nil {
+		data = append(data, expiresAt.UTC().Format(time.RFC3339Nano)...)
+	}
+	sum := sha256.Sum256(data)
+
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// PutIdempotent stores a new entity only once per idempotency key. When the same request is repeated within
+// the idempotency window, the entity created by the first request is returned and replayed is true. The key used
+// with different payload fails with errIdempotencyKeyReused.
+func (e *Service) PutIdempotent(ctx context.Context, key string, payload map[string]interface{}, expiresAt *time.Time) (entity Entity, replayed bool, err error) {
+	ctx, span := e.startSpan(ctx, "service.put_idempotent")
+	defer func() { endSpan(span, err) }()
+
+	window, err := e.Cfg.ParseIdempotency()
+	if err != nil {
+		return Entity{}, false, err
+	}
+	hash, err := getRequestHash(payload, expiresAt)
+	if err != nil {
+		return Entity{}, false, err
+	}
+
+	name := getIdempotencyServiceName(e.Cfg.Name)
+	record := idempotencyRecord{Key: key, RequestHash: hash}
+	for attempt := 1; ; attempt++ {
+		now := time.Now()
+		expires := now.Add(window)
+		stored := Entity{Id: getIdempotencyId(key), Created: now.Truncate(time.Microsecond), Payload: encodeIdempotencyRecord(record), Version: 1, ExpiresAt: &expires}
+		err = e.Storage.Insert(ctx, name, stored)
+		if err == nil {
+			return e.putRecorded(ctx, stored, record, payload, expiresAt)
+		}
+		if !errors.Is(err, errEntityExists) {
+			return Entity{}, false, fmt.Errorf("could not store idempotency key: %w", err)
+		}
+
+		// the key is known: the request is replayed unless the record is not valid anymore
+		existing, err := e.Storage.Get(ctx, name, stored.Id)
+		if errors.Is(err, errEntityNotFound) && attempt < maxVersionConflicts {
+			continue
+		}
+		if err != nil {
+			return Entity{}, false, fmt.Errorf("could not read idempotency key: %w", err)
+		}
+		previous, err := decodeIdempotencyRecord(existing)
+		if err != nil {
+			return Entity{}, false, err
+		}
+
+		abandoned := previous.EntityId == "" && now.Sub(existing.Created) > idempotencyPendingTimeout
+		if (abandoned || isIdempotencyKeyExpired(existing, now)) && attempt < maxVersionConflicts {
+			err = e.Storage.DeleteVersion(ctx, name, existing.Id, existing.GetVersion())
+			if err != nil && !errors.Is(err, errEntityNotFound) && !errors.Is(err, errVersionConflict) {
+				return Entity{}, false, fmt.Errorf("could not delete idempotency key: %w", err)
+			}
+			continue
+		}
+		if previous.Key != key || previous.RequestHash != hash {
+			return Entity{}, false, errIdempotencyKeyReused
+		}
+		if previous.EntityId == "" {
+			return Entity{}, false, errIdempotencyKeyInProgress
+		}
+
+		return Entity{Id: previous.EntityId}, true, nil
+	}
+}
+
+// putRecorded stores the entity and finishes the record of its idempotency key. The record is deleted only when
+// the entity is not stored, so the request can be repeated; when the entity is stored although the request failed,
+// the record is finished too, so a repeated request does not create another entity.
+func (e *Service) putRecorded(ctx context.Context, stored Entity, record idempotencyRecord, payload map[string]interface{}, expiresAt *time.Time) (Entity, bool, error) {
+	name := getIdempotencyServiceName(e.Cfg.Name)
+	entity, err := e.Put(ctx, payload, expiresAt)
+	if err != nil && entity.Id == "" {
+		_ = e.Storage.Delete(ctx, name, stored.Id)
+		return Entity{}, false, err
+	}
+
+	record.EntityId = entity.Id
+	stored.Payload = encodeIdempotencyRecord(record)
+	if _, updateErr := e.Storage.Update(ctx, name, stored); updateErr != nil {
+		return entity, false, fmt.Errorf("entity %q stored but its idempotency key not: %w", entity.Id, updateErr)
+	}
+
+	return entity, false, err
+}
+
+// deleteExpiredIdempotencyKeys permanently deletes records of keys older than the idempotency window
+func (e *Service) deleteExpiredIdempotencyKeys(ctx context.Context, now time.Time) error {
+	if e.Cfg.Idempotency == "" {
+		return nil
+	}
+
+	name := getIdempotencyServiceName(e.Cfg.Name)
+	list, err := e.Storage.List(ctx, name)
+	if err != nil {
+		return err
+	}
+	// the list can be shared by the storage, so records are deleted after they are collected
+	var expired []string
+	for _, stored := range list {
+		if isIdempotencyKeyExpired(stored, now) {
+			expired = append(expired, stored.Id)
+		}
+	}
+	for _, id := range expired {
+		if err = e.Storage.Delete(ctx, name, id); err != nil && !errors.Is(err, errEntityNotFound) {
+			return fmt.Errorf("could not delete expired idempotency key: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func isIdempotencyKeyExpired(stored Entity, now time.Time) bool {
+	return stored.ExpiresAt != nil && !now.Before(*stored.ExpiresAt)
+}
+
+func encodeIdempotencyRecord(record idempotencyRecord) map[string]interface{} {
+	payload := map[string]interface{}{
+		"key":          record.Key,
+		"request_hash": record.RequestHash,
+	}
+	if record.EntityId != "" {
+		payload["entity_id"] = record.EntityId
+	}
+
+	return payload
+}
+
+func decodeIdempotencyRecord(stored Entity) (idempotencyRecord, error) {
+	data, err := json.Marshal(stored.Payload)
+	if err != nil {
+		return idempotencyRecord{}, fmt.Errorf("could not decode idempotency key %q: %w", stored.Id, err)
+	}
+
+	var record idempotencyRecord
+	if err = json.Unmarshal(data, &record); err != nil {
+		return idempotencyRecord{}, fmt.Errorf("could not decode idempotency key %q: %w", stored.Id, err)
+	}
+
+	return record, nil
+}
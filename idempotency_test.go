@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// timeoutStorage stores inserted entities of the service but reports the writes as failed
+type timeoutStorage struct {
+	Storage
+	serviceName string
+}
+
+func (s timeoutStorage) Insert(ctx context.Context, serviceName string, e Entity) error {
+	if err := s.Storage.Insert(ctx, serviceName, e); err != nil || serviceName != s.serviceName {
+		return err
+	}
+
+	return errors.New("storage response timed out")
+}
+
+func TestPutIdempotent(t *testing.T) {
+	ctx := context.Background()
+	cfg := testServiceConfig("dogs")
+	cfg.Idempotency = "24h"
+	dogs := Service{Cfg: cfg, Storage: CreateMemStorage([]string{"dogs", "dogs__idempotency"})}
+
+	// the same request creates one entity only
+	entity, replayed, err := dogs.PutIdempotent(ctx, "key", map[string]interface{}{"name": "rex"}, nil)
+	assert.Nil(t, err)
+	assert.False(t, replayed)
+	again, replayed, err := dogs.PutIdempotent(ctx, "key", map[string]interface{}{"name": "rex"}, nil)
+	assert.Nil(t, err)
+	assert.True(t, replayed)
+	assert.Equal(t, entity.Id, again.Id)
+	list, err := dogs.List(ctx)
+	assert.Nil(t, err)
+	assert.Len(t, list, 1)
+
+	_, _, err = dogs.PutIdempotent(ctx, "key", map[string]interface{}{"name": "max"}, nil)
+	assert.ErrorIs(t, err, errIdempotencyKeyReused)
+
+	// unfinished request blocks the key until it is abandoned
+	name := getIdempotencyServiceName("dogs")
+	hash, err := getRequestHash(map[string]interface{}{"name": "max"}, nil)
+	assert.Nil(t, err)
+	pending := Entity{Id: getIdempotencyId("pending"), Created: time.Now(), Payload: encodeIdempotencyRecord(idempotencyRecord{Key: "pending", RequestHash: hash})}
+	assert.Nil(t, dogs.Storage.Insert(ctx, name, pending))
+	_, _, err = dogs.PutIdempotent(ctx, "pending", map[string]interface{}{"name": "max"}, nil)
+	assert.ErrorIs(t, err, errIdempotencyKeyInProgress)
+	pending.Created = time.Now().Add(-2 * idempotencyPendingTimeout)
+	_, err = dogs.Storage.Update(ctx, name, pending)
+	assert.Nil(t, err)
+	_, replayed, err = dogs.PutIdempotent(ctx, "pending", map[string]interface{}{"name": "max"}, nil)
+	assert.Nil(t, err)
+	assert.False(t, replayed)
+
+	// key can be used again after the window
+	expiresAt := time.Now().Add(-time.Second)
+	expired := Entity{Id: getIdempotencyId("expired"), Created: time.Now().Add(-25 * time.Hour), ExpiresAt: &expiresAt,
+		Payload: encodeIdempotencyRecord(idempotencyRecord{Key: "expired", EntityId: "old"})}
+	assert.Nil(t, dogs.Storage.Insert(ctx, name, expired))
+	_, replayed, err = dogs.PutIdempotent(ctx, "expired", map[string]interface{}{"name": "buddy"}, nil)
+	assert.Nil(t, err)
+	assert.False(t, replayed)
+	list, err = dogs.List(ctx)
+	assert.Nil(t, err)
+	assert.Len(t, list, 3)
+
+	// the janitor deletes expired keys
+	_, err = dogs.Storage.Update(ctx, name, expired)
+	assert.Nil(t, err)
+	_, err = dogs.DeleteExpired(ctx)
+	assert.Nil(t, err)
+	keys, err := dogs.Storage.List(ctx, name)
+	assert.Nil(t, err)
+	assert.Len(t, keys, 2)
+}
+
+func TestPutIdempotentStoredOnFailure(t *testing.T) {
+	ctx := context.Background()
+	cfg := testServiceConfig("dogs")
+	cfg.Idempotency = "24h"
+	dogs := Service{Cfg: cfg, Storage: timeoutStorage{CreateMemStorage([]string{"dogs", "dogs__idempotency"}), "dogs"}}
+	expiresAt := time.Now().Add(time.Hour)
+
+	// the key is finished when the entity is stored although the request failed
+	entity, _, err := dogs.PutIdempotent(ctx, "key", map[string]interface{}{"name": "rex"}, &expiresAt)
+	assert.Error(t, err)
+	assert.NotEmpty(t, entity.Id)
+	again, replayed, err := dogs.PutIdempotent(ctx, "key", map[string]interface{}{"name": "rex"}, &expiresAt)
+	assert.Nil(t, err)
+	assert.True(t, replayed)
+	assert.Equal(t, entity.Id, again.Id)
+	list, err := dogs.List(ctx)
+	assert.Nil(t, err)
+	assert.Len(t, list, 1)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"strings"
+	"time"
+)
+
+// indexId is ID of the record with configuration an index (unique values, references) was built for; it can not
+// collide with IDs of records of the index which are hashes
+const indexId = "index"
+
+// getIndexKeys identifies configuration of an index, so its change is detected
+func getIndexKeys(cfg interface{}) string {
+	data, _ := json.Marshal(cfg)
+	sum := sha256.Sum256(data)
+
+	return hex.EncodeToString(sum[:])
+}
+
+// storeIndexKeys records configuration of the index service the index was built for
+func (e *Service) storeIndexKeys(ctx context.Context, indexName, keys string) error {
+	index := Entity{Id: indexId, Created: time.Now().Truncate(time.Microsecond), Payload: map[string]interface{}{"keys": keys}, Version: 1}
+	err := e.Storage.Insert(ctx, indexName, index)
+	if errors.Is(err, errEntityExists) {
+		index.Version = 0
+		_, err = e.Storage.Update(ctx, indexName, index)
+	}
+	if err != nil {
+		return fmt.Errorf("could not store keys of index %q: %w", indexName, err)
+	}
+
+	return nil
+}
+
+// isIndexCurrent reports whether the index service was built for given configuration
+func (e *Service) isIndexCurrent(ctx context.Context, indexName, keys string) (bool, error) {
+	index, err := e.Storage.Get(ctx, indexName, indexId)
+	if errors.Is(err, errEntityNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("could not read keys of index %q: %w", indexName, err)
+	}
+	payload, _ := index.Payload.(map[string]interface{})
+
+	return payload["keys"] == keys, nil
+}
+
+// hasIndexes reports whether the service has unique keys or ref fields whose values are indexed
+func (e *Service) hasIndexes() bool {
+	return len(e.Cfg.GetUniqueKeys()) > 0 || len(e.Cfg.GetRefFields()) > 0
+}
+
+// RebuildIndexes rebuilds unique index and ref index of the service; when changed is true, only indexes whose
+// configuration changed since they were built (or which are not complete) are rebuilt
+func (e *Service) RebuildIndexes(ctx context.Context, changed bool, logger *logrus.Logger) error {
+	if len(e.Cfg.GetUniqueKeys()) > 0 {
+		current := false
+		if changed {
+			var err error
+			if current, err = e.isUniqueIndexCurrent(ctx); err != nil {
+				return err
+			}
+		}
+		if !current {
+			claimed, err := e.RebuildUniqueIndex(ctx)
+			if err != nil {
+				return fmt.Errorf("could not rebuild unique index: %w", err)
+			}
+			logger.Infof("unique index of service %q rebuilt, %d value(s) claimed", e.Cfg.Name, claimed)
+		}
+	}
+
+	if len(e.Cfg.GetRefFields()) > 0 {
+		current := false
+		if changed {
+			var err error
+			if current, err = e.isRefIndexCurrent(ctx); err != nil {
+				return err
+			}
+		}
+		if !current {
+			indexed, err := e.RebuildRefIndex(ctx)
+			if err != nil {
+				return fmt.Errorf("could not rebuild ref index: %w", err)
+			}
+			logger.Infof("ref index of service %q rebuilt, %d reference(s) indexed", e.Cfg.Name, indexed)
+		}
+	}
+
+	return nil
+}
+
+// rebuildIndexes rebuilds indexes of services whose configuration changed since their index was built; storages are
+// loaded in background, so the indexes are rebuilt when storages are ready. Services whose indexes could not be
+// rebuilt (e.g. entities share a unique value) are reported by the returned error.
+func rebuildIndexes(ctx context.Context, services []Service, logger *logrus.Logger) error {
+	var failed []string
+	for _, service := range services {
+		if !service.hasIndexes() {
+			continue
+		}
+		if err := waitUntilReady(ctx, service.Storage); err != nil {
+			logger.WithError(err).Errorf("could not check indexes of service %q", service.Cfg.Name)
+			failed = append(failed, service.Cfg.Name)
+			continue
+		}
+		if err := service.RebuildIndexes(ctx, true, logger); err != nil {
+			logger.WithError(err).Errorf("could not rebuild indexes of service %q", service.Cfg.Name)
+			failed = append(failed, service.Cfg.Name)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("could not rebuild indexes of services %s, run reindex command for details", strings.Join(failed, ", "))
+	}
+
+	return nil
+}
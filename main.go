@@ -1,24 +1,81 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"github.com/sirupsen/logrus"
 	"gopkg.in/alecthomas/kingpin.v2"
+	"io"
 	"os"
-	"strings"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 var (
-	app                   = kingpin.New("usa", "Universal store API [USA] => Runs HTTP JSON REST API based on YAML configuration.")
-	runCommand            = app.Command("run", "Run the application")
-	runCommandConfig      = runCommand.Arg("config-file", "Path to configuration file").Required().String()
-	runCommandStorageType = runCommand.Arg("storage-type", "Type of the storage").Required().String()
-	verbose               = app.Flag("verbose", "Verbose mode sets log level to trace").Short('v').Bool()
+	app                      = kingpin.New("usa", "Universal store API [USA] => Runs HTTP JSON REST API based on YAML configuration.")
+	runCommand               = app.Command("run", "Run the application")
+	runCommandConfig         = runCommand.Arg("config-file", "Path to configuration file, directory or glob pattern").Required().String()
+	runCommandStorageType    = runCommand.Arg("storage-type", "Default storage (name or type) for services without storage in configuration").Required().String()
+	migrateCommand           = app.Command("migrate", "Copy entities of services from one storage to another")
+	migrateCommandConfig     = migrateCommand.Arg("config-file", "Path to configuration file, directory or glob pattern").Required().String()
+	migrateCommandFrom       = migrateCommand.Flag("from", "Name or type of the source storage").Required().String()
+	migrateCommandTo         = migrateCommand.Flag("to", "Name or type of the target storage").Required().String()
+	migrateCommandServices   = migrateCommand.Flag("service", "Service to migrate (repeatable), all services by default").Strings()
+	migrateCommandDryRun     = migrateCommand.Flag("dry-run", "Only report what would be copied").Bool()
+	migrateCommandStateFile  = migrateCommand.Flag("state-file", "File with progress of the migration used to resume interrupted migration").Default("usa-migrate-state.json").String()
+	migrateCommandVerify     = migrateCommand.Flag("verify", "Compare counts and checksums of entities after the migration").Default("true").Bool()
+	exportCommand            = app.Command("export", "Export entities of a service as NDJSON or CSV")
+	exportCommandConfig      = exportCommand.Arg("config-file", "Path to configuration file, directory or glob pattern").Required().String()
+	exportCommandStorageType = exportCommand.Arg("storage-type", "Default storage (name or type) for services without storage in configuration").Required().String()
+	exportCommandService     = exportCommand.Flag("service", "Name of the exported service").Required().String()
+	exportCommandFormat      = exportCommand.Flag("format", "Format of the file (ndjson, csv)").Default(exportFormatNdjson).Enum(exportFormatNdjson, exportFormatCsv)
+	exportCommandOutput      = exportCommand.Flag("output", "Output file, standard output by default").Short('o').Default("-").String()
+	importCommand            = app.Command("import", "Import entities of a service from NDJSON or CSV file")
+	importCommandConfig      = importCommand.Arg("config-file", "Path to configuration file, directory or glob pattern").Required().String()
+	importCommandStorageType = importCommand.Arg("storage-type", "Default storage (name or type) for services without storage in configuration").Required().String()
+	importCommandService     = importCommand.Flag("service", "Name of the imported service").Required().String()
+	importCommandFormat      = importCommand.Flag("format", "Format of the file (ndjson, csv)").Default(exportFormatNdjson).Enum(exportFormatNdjson, exportFormatCsv)
+	importCommandInput       = importCommand.Flag("input", "Input file, standard input by default").Short('i').Default("-").String()
+	backupCommand            = app.Command("backup", "Create compressed archive with entities of services")
+	backupCommandConfig      = backupCommand.Arg("config-file", "Path to configuration file, directory or glob pattern").Required().String()
+	backupCommandStorageType = backupCommand.Arg("storage-type", "Default storage (name or type) for services without storage in configuration").Required().String()
+	backupCommandServices    = backupCommand.Flag("service", "Service to back up (repeatable), all services by default").Strings()
+	backupCommandOutput      = backupCommand.Flag("output", "Output file").Short('o').String()
+	backupCommandTarget      = backupCommand.Flag("target", "Directory or s3://bucket/prefix where the backup is saved").Envar("BACKUP_TARGET").String()
+	backupCommandRetention   = backupCommand.Flag("retention", "Number of backups kept in the target, 0 keeps all backups").Default("0").Int()
+	restoreCommand           = app.Command("restore", "Restore entities of services from a backup")
+	restoreCommandConfig     = restoreCommand.Arg("config-file", "Path to configuration file, directory or glob pattern").Required().String()
+	restoreCommandStorage    = restoreCommand.Arg("storage-type", "Default storage (name or type) for services without storage in configuration").Required().String()
+	restoreCommandServices   = restoreCommand.Flag("service", "Service to restore (repeatable), all services by default").Strings()
+	restoreCommandInput      = restoreCommand.Flag("input", "Backup file").Short('i').String()
+	restoreCommandTarget     = restoreCommand.Flag("target", "Directory or s3://bucket/prefix with backups").Envar("BACKUP_TARGET").String()
+	restoreCommandAt         = restoreCommand.Flag("at", "Restore the latest backup from the target created at or before given time (RFC3339), the latest backup by default").String()
+	restoreCommandMode       = restoreCommand.Flag("mode", "merge restores only missing entities, overwrite restores the exact state of the backup").Default(restoreModeMerge).Enum(restoreModeMerge, restoreModeOverwrite)
+	restoreCommandDryRun     = restoreCommand.Flag("dry-run", "Only report differences between the backup and the storage").Bool()
+	reindexCommand           = app.Command("reindex", "Rebuild unique and ref indexes of services from their entities")
+	reindexCommandConfig     = reindexCommand.Arg("config-file", "Path to configuration file, directory or glob pattern").Required().String()
+	reindexCommandStorage    = reindexCommand.Arg("storage-type", "Default storage (name or type) for services without storage in configuration").Required().String()
+	reindexCommandServices   = reindexCommand.Flag("service", "Service to reindex (repeatable), all services by default").Strings()
+	verbose                  = app.Flag("verbose", "Verbose mode sets log level to trace").Short('v').Bool()
 )
 
 func main() {
 	switch kingpin.MustParse(app.Parse(os.Args[1:])) {
 	case runCommand.FullCommand():
 		run()
+	case migrateCommand.FullCommand():
+		migrate()
+	case exportCommand.FullCommand():
+		export()
+	case importCommand.FullCommand():
+		importEntities()
+	case backupCommand.FullCommand():
+		backup()
+	case restoreCommand.FullCommand():
+		restoreBackup()
+	case reindexCommand.FullCommand():
+		reindex()
 	}
 }
 
@@ -26,6 +83,20 @@ func run() {
 	logger := createLogger()
 	logger.Info("Program starting...")
 
+	// canceled on shutdown signal
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	shutdownTracing, err := setupTracing(logger)
+	if err != nil {
+		logger.WithError(err).Fatalf("could not set up tracing")
+	}
+	defer func() {
+		if err := shutdownTracing(context.Background()); err != nil {
+			logger.WithError(err).Error("could not flush traces")
+		}
+	}()
+
 	cfg, err := ParseConfig(*runCommandConfig, logger)
 	if err != nil {
 		logger.WithError(err).Fatalf("could not parse configuration")
@@ -40,26 +111,416 @@ func run() {
 		logger.WithError(err).Fatalf("service name validation falied")
 	}
 
-	stg, err := CreateStorageByType(*runCommandStorageType, serviceNames)
+	if err = ValidateServicePaths(cfg.GetServicePaths()); err != nil {
+		logger.WithError(err).Fatalf("service path validation falied")
+	}
+
+	storages, err := CreateStorages(ctx, *runCommandStorageType, cfg, logger)
 	if err != nil {
 		logger.WithError(err).Fatalf("could not create storage")
 	}
 
-	logger.Infof("Storage prepared for %d service(s) (%s)", len(serviceNames), strings.Join(serviceNames, ", "))
-
 	endpoints := make(map[string]Service, len(serviceNames))
 	for _, serviceConfig := range cfg.ServiceConfigs {
 		endpoints[serviceConfig.Name] = Service{
-			Cfg:     serviceConfig,
-			Storage: stg,
+			Cfg:      serviceConfig,
+			Storage:  storages[serviceConfig.GetStorage(*runCommandStorageType)],
+			Services: endpoints,
 		}
 	}
 
-	server, err := createHttpServer(endpoints, logger)
+	schedule, err := createBackupSchedule()
+	if err != nil {
+		logger.WithError(err).Fatalf("could not configure backups")
+	}
+
+	services := make([]Service, 0, len(serviceNames))
+	for _, serviceName := range serviceNames {
+		services = append(services, endpoints[serviceName])
+	}
+
+	purger, err := createTrashPurger(services)
+	if err != nil {
+		logger.WithError(err).Fatalf("could not configure trash purging")
+	}
+
+	janitor, err := createExpirationJanitor(services)
+	if err != nil {
+		logger.WithError(err).Fatalf("could not configure deleting of expired entities")
+	}
+
+	server, err := createHttpServer(endpoints, storages, logger)
 	if err != nil {
 		logger.WithError(err).Fatalf("could not create http server")
 	}
-	server.Run(8080)
+
+	if schedule != nil {
+		go schedule.Run(ctx, services, logger)
+		logger.Infof("Backups scheduled every %s", schedule.interval)
+	}
+	if purger != nil {
+		go purger.Run(ctx, logger)
+		logger.Infof("Trash purged every %s", purger.interval)
+	}
+	go janitor.Run(ctx, logger)
+	// the server is not ready until the indexes are rebuilt, so it does not take writes the indexes do not check
+	server.indexes.set(componentStatus{Status: "not_ready"})
+	go func() {
+		status := componentStatus{Status: "ok"}
+		if err := rebuildIndexes(ctx, services, logger); err != nil {
+			status = componentStatus{Status: "error", Error: err.Error()}
+		}
+		server.indexes.set(status)
+	}()
+	server.Run(ctx, 8080)
+
+	closeStorages(storages, logger)
+}
+
+func migrate() {
+	logger := createLogger()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	if *migrateCommandFrom == *migrateCommandTo {
+		logger.Fatalf("source and target storage must be different")
+	}
+
+	cfg, err := ParseConfig(*migrateCommandConfig, logger)
+	if err != nil {
+		logger.WithError(err).Fatalf("could not parse configuration")
+	}
+
+	if err = cfg.Validate(); err != nil {
+		logger.WithError(err).Fatalf("invalid configuration file")
+	}
+
+	if err = cfg.SelectServices(*migrateCommandServices); err != nil {
+		logger.WithError(err).Fatalf("could not select services")
+	}
+	// internal services (history of entities) are migrated too
+	var serviceNames []string
+	for _, serviceConfig := range cfg.GetStorageServiceConfigs() {
+		serviceNames = append(serviceNames, serviceConfig.Name)
+	}
+
+	from, err := CreateStorage(ctx, cfg.GetStorageConfig(*migrateCommandFrom), cfg, logger)
+	if err != nil {
+		logger.WithError(err).Fatalf("could not create source storage")
+	}
+
+	to, err := CreateStorage(ctx, cfg.GetStorageConfig(*migrateCommandTo), cfg, logger)
+	if err != nil {
+		_ = closeStorage(from)
+		logger.WithError(err).Fatalf("could not create target storage")
+	}
+
+	// storages are closed before exit, so durable storages flush written entities
+	storages := map[string]Storage{*migrateCommandFrom: from, *migrateCommandTo: to}
+	err = runMigration(ctx, from, to, serviceNames, logger)
+	if err == nil && !*migrateCommandDryRun {
+		// migrated values of unique keys can collide with entities already stored in the target storage and
+		// migrated references are added to the references of the target storage
+		migrated := make([]Service, 0, len(cfg.ServiceConfigs))
+		for _, serviceConfig := range cfg.ServiceConfigs {
+			migrated = append(migrated, Service{Cfg: serviceConfig, Storage: to})
+		}
+		err = rebuildCommandIndexes(ctx, migrated, logger)
+	}
+	closeStorages(storages, logger)
+	if err != nil {
+		logger.WithError(err).Fatalf("migration failed")
+	}
+}
+
+func runMigration(ctx context.Context, from, to Storage, serviceNames []string, logger *logrus.Logger) error {
+	for _, stg := range []Storage{from, to} {
+		if err := waitUntilReady(ctx, stg); err != nil {
+			return fmt.Errorf("storage is not ready: %w", err)
+		}
+	}
+
+	m, err := createMigration(from, *migrateCommandFrom, to, *migrateCommandTo, *migrateCommandStateFile, logger)
+	if err != nil {
+		return fmt.Errorf("could not prepare migration: %w", err)
+	}
+	m.dryRun = *migrateCommandDryRun
+
+	if err = m.Run(ctx, serviceNames); err != nil {
+		return fmt.Errorf("%w (run the command again to resume)", err)
+	}
+
+	if *migrateCommandVerify && !m.dryRun {
+		return m.Verify(ctx, serviceNames)
+	}
+
+	return nil
+}
+
+func export() {
+	logger := createLogger()
+	// standard output can be used for exported data
+	logger.SetOutput(os.Stderr)
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	service, err := createCommandService(ctx, *exportCommandConfig, *exportCommandStorageType, *exportCommandService, logger)
+	if err != nil {
+		logger.WithError(err).Fatalf("could not prepare service")
+	}
+	defer closeStorage(service.Storage)
+
+	output := os.Stdout
+	if *exportCommandOutput != "-" {
+		output, err = os.Create(*exportCommandOutput)
+		if err != nil {
+			logger.WithError(err).Fatalf("could not create output file")
+		}
+	}
+
+	count, err := service.Export(ctx, *exportCommandFormat, output)
+	if err != nil {
+		logger.WithError(err).Fatalf("export failed")
+	}
+	if err = output.Close(); err != nil {
+		logger.WithError(err).Fatalf("could not write output file")
+	}
+
+	logger.Infof("%d entities of service %q exported", count, service.Cfg.Name)
+}
+
+func importEntities() {
+	logger := createLogger()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	service, err := createCommandService(ctx, *importCommandConfig, *importCommandStorageType, *importCommandService, logger)
+	if err != nil {
+		logger.WithError(err).Fatalf("could not prepare service")
+	}
+
+	input := os.Stdin
+	if *importCommandInput != "-" {
+		input, err = os.Open(*importCommandInput)
+		if err != nil {
+			logger.WithError(err).Fatalf("could not open input file")
+		}
+		defer input.Close()
+	}
+
+	report, err := service.Import(ctx, *importCommandFormat, input)
+	for _, rowErr := range report.Errors {
+		logger.Error(rowErr.Error())
+	}
+	if closeErr := closeStorage(service.Storage); closeErr != nil {
+		logger.WithError(closeErr).Error("could not close storage")
+	}
+	if err != nil {
+		logger.WithError(err).Fatalf("import failed after %d entities", report.Imported)
+	}
+
+	logger.Infof("%d entities of service %q imported, %d row(s) failed", report.Imported, service.Cfg.Name, len(report.Errors))
+	if len(report.Errors) > 0 {
+		os.Exit(1)
+	}
+}
+
+func backup() {
+	logger := createLogger()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	if (*backupCommandOutput == "") == (*backupCommandTarget == "") {
+		logger.Fatalf("exactly one of --output and --target has to be set")
+	}
+
+	var target backupTarget
+	var err error
+	if *backupCommandTarget != "" {
+		if target, err = createBackupTarget(*backupCommandTarget); err != nil {
+			logger.WithError(err).Fatalf("could not create backup target")
+		}
+	}
+
+	services, storages, err := createCommandServices(ctx, *backupCommandConfig, *backupCommandStorageType, *backupCommandServices, logger)
+	if err != nil {
+		logger.WithError(err).Fatalf("could not prepare services")
+	}
+
+	name := *backupCommandOutput
+	if target != nil {
+		name, err = backupToTarget(ctx, services, target, *backupCommandRetention, logger)
+	} else {
+		err = backupToFile(ctx, services, name)
+	}
+	closeStorages(storages, logger)
+	if err != nil {
+		logger.WithError(err).Fatalf("backup failed")
+	}
+
+	logger.Infof("backup %q of %d service(s) created", name, len(services))
+}
+
+func backupToFile(ctx context.Context, services []Service, filename string) error {
+	output, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("could not create output file: %w", err)
+	}
+
+	_, err = createBackup(ctx, services, output)
+	if closeErr := output.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+func restoreBackup() {
+	logger := createLogger()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	if (*restoreCommandInput == "") == (*restoreCommandTarget == "") {
+		logger.Fatalf("exactly one of --input and --target has to be set")
+	}
+
+	input, err := openBackup(ctx, *restoreCommandInput, *restoreCommandTarget, *restoreCommandAt, logger)
+	if err != nil {
+		logger.WithError(err).Fatalf("could not open backup")
+	}
+	defer input.Close()
+
+	services, storages, err := createCommandServices(ctx, *restoreCommandConfig, *restoreCommandStorage, *restoreCommandServices, logger)
+	if err != nil {
+		logger.WithError(err).Fatalf("could not prepare services")
+	}
+
+	r, err := createRestore(services, *restoreCommandMode, logger)
+	if err == nil {
+		r.dryRun = *restoreCommandDryRun
+		_, err = r.Run(ctx, input)
+	}
+	closeStorages(storages, logger)
+	if err != nil {
+		logger.WithError(err).Fatalf("restore failed")
+	}
+}
+
+func reindex() {
+	logger := createLogger()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	services, storages, err := createCommandServices(ctx, *reindexCommandConfig, *reindexCommandStorage, *reindexCommandServices, logger)
+	if err != nil {
+		logger.WithError(err).Fatalf("could not prepare services")
+	}
+
+	err = rebuildCommandIndexes(ctx, services, logger)
+	closeStorages(storages, logger)
+	if err != nil {
+		logger.WithError(err).Fatalf("reindex failed")
+	}
+}
+
+// rebuildCommandIndexes rebuilds unique and ref indexes of services with unique keys or ref fields
+func rebuildCommandIndexes(ctx context.Context, services []Service, logger *logrus.Logger) error {
+	for _, service := range services {
+		if err := service.RebuildIndexes(ctx, false, logger); err != nil {
+			return fmt.Errorf("service %q: %w", service.Cfg.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// openBackup opens the backup file or the latest backup in the target created at or before given time
+func openBackup(ctx context.Context, filename, location, at string, logger *logrus.Logger) (io.ReadCloser, error) {
+	if filename != "" {
+		return os.Open(filename)
+	}
+
+	before := time.Now()
+	if at != "" {
+		var err error
+		if before, err = time.Parse(time.RFC3339, at); err != nil {
+			return nil, fmt.Errorf("invalid time of the backup: %w", err)
+		}
+	}
+
+	target, err := createBackupTarget(location)
+	if err != nil {
+		return nil, err
+	}
+	name, err := findBackup(ctx, target, before)
+	if err != nil {
+		return nil, err
+	}
+	logger.Infof("restoring backup %q", name)
+
+	return target.Open(ctx, name)
+}
+
+// createCommandService creates the service with its storage for commands working with one service
+func createCommandService(ctx context.Context, configPath, defaultStorageType, serviceName string, logger *logrus.Logger) (Service, error) {
+	services, _, err := createCommandServices(ctx, configPath, defaultStorageType, []string{serviceName}, logger)
+	if err != nil {
+		return Service{}, err
+	}
+
+	return services[0], nil
+}
+
+// createCommandServices creates selected services (all services when none is selected) with their storages
+func createCommandServices(ctx context.Context, configPath, defaultStorageType string, serviceNames []string, logger *logrus.Logger) ([]Service, map[string]Storage, error) {
+	cfg, err := ParseConfig(configPath, logger)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not parse configuration: %w", err)
+	}
+
+	if err = cfg.Validate(); err != nil {
+		return nil, nil, fmt.Errorf("invalid configuration file: %w", err)
+	}
+
+	if err = cfg.SelectServices(serviceNames); err != nil {
+		return nil, nil, err
+	}
+
+	storages, err := CreateStorages(ctx, defaultStorageType, cfg, logger)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, stg := range storages {
+		if err = waitUntilReady(ctx, stg); err != nil {
+			closeStorages(storages, logger)
+			return nil, nil, fmt.Errorf("storage is not ready: %w", err)
+		}
+	}
+
+	services := make([]Service, 0, len(cfg.ServiceConfigs))
+	registry := make(map[string]Service, len(cfg.ServiceConfigs))
+	for _, serviceConfig := range cfg.ServiceConfigs {
+		service := Service{Cfg: serviceConfig, Storage: storages[serviceConfig.GetStorage(defaultStorageType)], Services: registry}
+		services = append(services, service)
+		registry[serviceConfig.Name] = service
+	}
+
+	return services, storages, nil
+}
+
+func closeStorages(storages map[string]Storage, logger *logrus.Logger) {
+	for name, stg := range storages {
+		if err := closeStorage(stg); err != nil {
+			logger.WithError(err).Errorf("could not close storage %q", name)
+		}
+	}
 }
 
 func createLogger() *logrus.Logger {
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"os"
+	"sort"
+	"time"
+)
+
+const defaultMigrationPageSize = 500
+
+// migration copies entities of services from one storage to another keeping their IDs and created times.
+// Progress is saved to the state file after every page, so interrupted migration continues where it stopped.
+type migration struct {
+	from, to       Storage
+	fromType       string
+	toType         string
+	dryRun         bool
+	pageSize       int
+	stateFile      string // empty means progress is not saved
+	state          migrationState
+	logger         *logrus.Logger
+	statusInterval time.Duration
+}
+
+type migrationState struct {
+	From     string                            `json:"from"`
+	To       string                            `json:"to"`
+	Services map[string]*migrationServiceState `json:"services"`
+}
+
+type migrationServiceState struct {
+	Cursor  string `json:"cursor"` // ID of the last migrated entity
+	Copied  int    `json:"copied"`
+	Skipped int    `json:"skipped"` // entities already present in the target storage
+	Done    bool   `json:"done"`
+}
+
+func createMigration(from Storage, fromType string, to Storage, toType string, stateFile string, logger *logrus.Logger) (*migration, error) {
+	m := &migration{
+		from:      from,
+		to:        to,
+		fromType:  fromType,
+		toType:    toType,
+		pageSize:  defaultMigrationPageSize,
+		stateFile: stateFile,
+		state: migrationState{
+			From:     fromType,
+			To:       toType,
+			Services: make(map[string]*migrationServiceState),
+		},
+		logger:         logger,
+		statusInterval: 10 * time.Second,
+	}
+
+	if stateFile == "" {
+		return m, nil
+	}
+
+	data, err := os.ReadFile(stateFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read migration state: %w", err)
+	}
+
+	if err = json.Unmarshal(data, &m.state); err != nil {
+		return nil, fmt.Errorf("could not decode migration state %q: %w", stateFile, err)
+	}
+	if m.state.From != fromType || m.state.To != toType {
+		return nil, fmt.Errorf("migration state %q belongs to migration from %q to %q", stateFile, m.state.From, m.state.To)
+	}
+	if m.state.Services == nil {
+		m.state.Services = make(map[string]*migrationServiceState)
+	}
+	logger.Infof("resuming migration from state file %q", stateFile)
+
+	return m, nil
+}
+
+// Run migrates all given services; the state file is removed when everything is migrated
+func (m *migration) Run(ctx context.Context, serviceNames []string) error {
+	for _, serviceName := range serviceNames {
+		if err := m.migrateService(ctx, serviceName); err != nil {
+			return fmt.Errorf("could not migrate service %q: %w", serviceName, err)
+		}
+	}
+
+	if m.stateFile != "" && !m.dryRun {
+		if err := os.Remove(m.stateFile); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("could not remove migration state: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (m *migration) migrateService(ctx context.Context, serviceName string) error {
+	state, found := m.state.Services[serviceName]
+	if !found || m.dryRun {
+		state = &migrationServiceState{}
+		m.state.Services[serviceName] = state
+	}
+	if state.Done {
+		m.logger.Infof("service %q: already migrated (%d copied, %d skipped)", serviceName, state.Copied, state.Skipped)
+		return nil
+	}
+
+	lastStatus := time.Now()
+	for {
+		page, next, err := listPage(ctx, m.from, serviceName, state.Cursor, m.pageSize)
+		if err != nil && state.Cursor != "" {
+			// the last migrated entity could be deleted in the meantime, already migrated entities are skipped
+			m.logger.WithError(err).Warnf("service %q: could not continue from entity %q, starting from the beginning", serviceName, state.Cursor)
+			state.Cursor = ""
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		for _, e := range page {
+			copied, err := m.migrateEntity(ctx, serviceName, e)
+			if err != nil {
+				return err
+			}
+			if copied {
+				state.Copied++
+			} else {
+				state.Skipped++
+			}
+		}
+
+		if len(page) > 0 {
+			state.Cursor = page[len(page)-1].Id
+		}
+		state.Done = next == ""
+		if err = m.saveState(); err != nil {
+			return err
+		}
+
+		if time.Since(lastStatus) >= m.statusInterval {
+			m.logger.Infof("service %q: %d entities copied, %d skipped", serviceName, state.Copied, state.Skipped)
+			lastStatus = time.Now()
+		}
+
+		if state.Done {
+			break
+		}
+	}
+
+	if m.dryRun {
+		m.logger.Infof("service %q: %d entities would be copied, %d already exist in %s storage", serviceName, state.Copied, state.Skipped, m.toType)
+	} else {
+		m.logger.Infof("service %q: migration finished, %d entities copied, %d already existed in %s storage", serviceName, state.Copied, state.Skipped, m.toType)
+	}
+
+	return nil
+}
+
+// migrateEntity inserts the entity to the target storage; false is returned when the entity already exists there
+// or the target storage does not keep it because it is already expired
+func (m *migration) migrateEntity(ctx context.Context, serviceName string, e Entity) (bool, error) {
+	if m.dryRun {
+		_, err := m.to.Get(ctx, serviceName, e.Id)
+		if errors.Is(err, errEntityNotFound) {
+			return true, nil
+		}
+		if err != nil {
+			return false, fmt.Errorf("could not check entity %q: %w", e.Id, err)
+		}
+		return false, nil
+	}
+
+	err := m.to.Insert(ctx, serviceName, e)
+	if errors.Is(err, errEntityExists) || errors.Is(err, errEntityExpired) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("could not insert entity %q: %w", e.Id, err)
+	}
+
+	return true, nil
+}
+
+func (m *migration) saveState() error {
+	if m.stateFile == "" || m.dryRun {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(m.state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("could not encode migration state: %w", err)
+	}
+
+	// write and rename, so the state file is never truncated
+	tmp := m.stateFile + ".tmp"
+	if err = os.WriteFile(tmp, data, 0o600); err != nil {
+		return fmt.Errorf("could not write migration state: %w", err)
+	}
+	if err = os.Rename(tmp, m.stateFile); err != nil {
+		return fmt.Errorf("could not write migration state: %w", err)
+	}
+
+	return nil
+}
+
+// Verify compares number of entities and checksum of every service in both storages
+func (m *migration) Verify(ctx context.Context, serviceNames []string) error {
+	failed := 0
+	for _, serviceName := range serviceNames {
+		fromCount, fromChecksum, err := checksumService(ctx, m.from, serviceName, m.pageSize)
+		if err != nil {
+			return fmt.Errorf("could not verify service %q in %s storage: %w", serviceName, m.fromType, err)
+		}
+		toCount, toChecksum, err := checksumService(ctx, m.to, serviceName, m.pageSize)
+		if err != nil {
+			return fmt.Errorf("could not verify service %q in %s storage: %w", serviceName, m.toType, err)
+		}
+
+		if fromCount != toCount || fromChecksum != toChecksum {
+			failed++
+			m.logger.Errorf("service %q: verification failed, %s storage: %d entities (checksum %s), %s storage: %d entities (checksum %s)",
+				serviceName, m.fromType, fromCount, fromChecksum, m.toType, toCount, toChecksum)
+			continue
+		}
+		m.logger.Infof("service %q: verified %d entities (checksum %s)", serviceName, fromCount, fromChecksum)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("verification of %d service(s) failed", failed)
+	}
+
+	return nil
+}
+
+// checksumService returns number of entities and checksum of the service independent of the order of entities
+func checksumService(ctx context.Context, stg Storage, serviceName string, pageSize int) (int, string, error) {
+	sums := make(map[string][]byte)
+	cursor := ""
+	for {
+		page, next, err := listPage(ctx, stg, serviceName, cursor, pageSize)
+		if err != nil {
+			return 0, "", err
+		}
+
+		for _, e := range page {
+			sums[e.Id], err = entityChecksum(e)
+			if err != nil {
+				return 0, "", err
+			}
+		}
+
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+
+	ids := make([]string, 0, len(sums))
+	for id := range sums {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	h := sha256.New()
+	for _, id := range ids {
+		h.Write(sums[id])
+	}
+
+	return len(ids), hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// entityChecksum returns checksum of the entity; created time is used with microsecond precision supported by all storages
+func entityChecksum(e Entity) ([]byte, error) {
+	payload, err := json.Marshal(e.Payload)
+	if err != nil {
+		return nil, fmt.Errorf("could not encode entity %q: %w", e.Id, err)
+	}
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s\n%d\n%s", e.Id, e.Created.Truncate(time.Microsecond).UnixMicro(), payload)))
+
+	return sum[:], nil
+}
+
+// waitUntilReady waits until the storage finishes its initial load
+func waitUntilReady(ctx context.Context, stg Storage) error {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for !stg.Ready() {
+		if err := stg.Health(ctx); err != nil {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type unavailableStorage struct {
+	Storage
+}
+
+func (s unavailableStorage) Get(_ context.Context, _, _ string) (Entity, error) {
+	return Entity{}, errors.New("storage is unavailable")
+}
+
+func TestMigration(t *testing.T) {
+	ctx := context.Background()
+	t.Setenv("BOLT_FILE", filepath.Join(t.TempDir(), "usa.db"))
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+	services := []string{"dogs", "cats"}
+
+	from := CreateMemStorage(services)
+	for i := 0; i < 7; i++ {
+		_, err := from.Add(ctx, "dogs", map[string]interface{}{"name": "rex", "age": float64(i)})
+		assert.Nil(t, err)
+	}
+	_, err := from.Add(ctx, "cats", map[string]interface{}{"name": "tom"})
+	assert.Nil(t, err)
+	dogs, _ := from.List(ctx, "dogs")
+
+	to, err := CreateBoltStorage(services)
+	assert.Nil(t, err)
+	defer to.Close()
+	// entity already present in the target storage is skipped
+	assert.Nil(t, to.Insert(ctx, "dogs", dogs[0]))
+
+	// dry run does not write anything
+	m, err := createMigration(from, "mem", to, "bolt", stateFile, logrus.New())
+	assert.Nil(t, err)
+	m.dryRun = true
+	assert.Nil(t, m.Run(ctx, services))
+	assert.Equal(t, 6, m.state.Services["dogs"].Copied)
+	assert.Equal(t, 1, m.state.Services["dogs"].Skipped)
+	list, _ := to.List(ctx, "dogs")
+	assert.Len(t, list, 1)
+	assert.NoFileExists(t, stateFile)
+
+	// failed read of the target storage is not counted as missing entity
+	m, err = createMigration(from, "mem", unavailableStorage{to}, "bolt", stateFile, logrus.New())
+	assert.Nil(t, err)
+	m.dryRun = true
+	assert.Error(t, m.Run(ctx, services))
+
+	// interrupted migration is resumed from the state file
+	state := migrationState{From: "mem", To: "bolt", Services: map[string]*migrationServiceState{
+		"dogs": {Cursor: dogs[2].Id, Copied: 2, Skipped: 1},
+	}}
+	data, _ := json.Marshal(state)
+	assert.Nil(t, os.WriteFile(stateFile, data, 0o600))
+
+	m, err = createMigration(from, "mem", to, "bolt", stateFile, logrus.New())
+	assert.Nil(t, err)
+	m.pageSize = 2
+	assert.Nil(t, m.Run(ctx, services))
+	assert.Equal(t, &migrationServiceState{Cursor: dogs[6].Id, Copied: 6, Skipped: 1, Done: true}, m.state.Services["dogs"])
+	assert.NoFileExists(t, stateFile)
+
+	// entities 1 and 2 were skipped by the resumed migration
+	assert.Contains(t, m.Verify(ctx, services).Error(), "verification of 1 service(s) failed")
+	for _, e := range dogs[1:3] {
+		assert.Nil(t, to.Insert(ctx, "dogs", e))
+	}
+	assert.Nil(t, m.Verify(ctx, services))
+
+	list, _ = to.List(ctx, "cats")
+	assert.Len(t, list, 1)
+	e, err := to.Get(ctx, "dogs", dogs[3].Id)
+	assert.Nil(t, err)
+	assert.Equal(t, dogs[3].Created.UnixNano(), e.Created.UnixNano())
+
+	// state of another migration is refused
+	assert.Nil(t, os.WriteFile(stateFile, data, 0o600))
+	_, err = createMigration(from, "mem", to, "sql", stateFile, logrus.New())
+	assert.Error(t, err)
+}
+
+func TestChecksumService(t *testing.T) {
+	ctx := context.Background()
+	a := CreateMemStorage([]string{"dogs"})
+	b := CreateMemStorage([]string{"dogs"})
+
+	created := time.Now()
+	e1 := Entity{Id: "1", Created: created, Payload: map[string]interface{}{"name": "rex"}}
+	e2 := Entity{Id: "2", Created: created.Add(time.Second), Payload: map[string]interface{}{"name": "max"}}
+	assert.Nil(t, a.Insert(ctx, "dogs", e1))
+	assert.Nil(t, a.Insert(ctx, "dogs", e2))
+
+	// order of entities and sub-microsecond precision does not matter
+	e1.Created = e1.Created.Truncate(time.Microsecond)
+	assert.Nil(t, b.Insert(ctx, "dogs", e2))
+	assert.Nil(t, b.Insert(ctx, "dogs", e1))
+	assert.ErrorIs(t, b.Insert(ctx, "dogs", e1), errEntityExists)
+
+	countA, sumA, err := checksumService(ctx, a, "dogs", 1)
+	assert.Nil(t, err)
+	countB, sumB, err := checksumService(ctx, b, "dogs", 1)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, countA)
+	assert.Equal(t, countA, countB)
+	assert.Equal(t, sumA, sumB)
+
+	assert.Nil(t, b.Delete(ctx, "dogs", "1"))
+	e1.Payload = map[string]interface{}{"name": "rexx"}
+	assert.Nil(t, b.Insert(ctx, "dogs", e1))
+	_, sumB, err = checksumService(ctx, b, "dogs", 10)
+	assert.Nil(t, err)
+	assert.NotEqual(t, sumA, sumB)
+}
@@ -0,0 +1,437 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"time"
+)
+
+const (
+	refsServiceSuffix = "__refs"
+
+	// refShards is number of records the entities referencing one entity by one field are split into, so a change of
+	// a referencing entity rewrites a part of them only and concurrent changes conflict less often
+	refShards = 16
+
+	// maxRefConflicts is number of attempts to change a record shared by the referencing entities
+	maxRefConflicts = 20
+)
+
+var (
+	errRefNotFound   = errors.New("referenced entity does not exist")
+	errRefRestricted = errors.New("entity is referenced by other entities")
+)
+
+// reference is a ref field of a service pointing to entities of other service
+type reference struct {
+	service Service
+	field   *FieldConfig
+}
+
+// refRecord is payload of the record of entities referencing one entity by a ref field; it is stored in the refs
+// service of the referencing service, so the referencing entities are found without reading all of them. The
+// entities are split into refShards records by their ID; the record ID is derived from the field, the referenced ID
+// and the shard.
+type refRecord struct {
+	Field  string   `json:"field"`
+	Target string   `json:"target"`
+	Ids    []string `json:"ids"`
+}
+
+func getRefsServiceName(serviceName string) string {
+	return serviceName + refsServiceSuffix
+}
+
+func getRefRecordId(field, target string, shard uint32) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%s\x00%d", field, target, shard)))
+	return hex.EncodeToString(sum[:16])
+}
+
+// getRefShard returns shard of the record containing the referencing entity
+func getRefShard(entityId string) uint32 {
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(entityId))
+
+	return hash.Sum32() % refShards
+}
+
+// getReferences returns ref fields of all services pointing to the service
+func (e *Service) getReferences() []reference {
+	var names []string
+	for name := range e.Services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var refs []reference
+	for _, name := range names {
+		service := e.Services[name]
+		for _, field := range service.Cfg.GetRefFields() {
+			if *field.Service == e.Cfg.Name {
+				refs = append(refs, reference{service: service, field: field})
+			}
+		}
+	}
+
+	return refs
+}
+
+// checkRefs returns errRefNotFound when the payload references an entity which does not exist; references to services
+// which are not available (e.g. a command working with selected services only) are not checked. The check is not
+// atomic with the write, so the referenced entity can be deleted before the payload is stored.
+func (e *Service) checkRefs(ctx context.Context, payload interface{}) error {
+	fields, ok := payload.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+
+	for _, field := range e.Cfg.GetRefFields() {
+		id, ok := fields[field.Name].(string)
+		if !ok {
+			continue
+		}
+		target, found := e.Services[*field.Service]
+		if !found {
+			continue
+		}
+		_, err := target.getCurrent(ctx, id)
+		if errors.Is(err, errEntityNotFound) {
+			return fmt.Errorf("%w: field %q references %q of service %q", errRefNotFound, field.Name, id, target.Cfg.Name)
+		}
+		if err != nil {
+			return fmt.Errorf("could not read entity referenced by field %q: %w", field.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// getReferencingIds returns IDs of entities referencing the entity by the ref field. The IDs are read from the ref
+// index, which can contain entities not referencing it anymore (e.g. the change of the reference failed), so each
+// entity is checked.
+func (e *Service) getReferencingIds(ctx context.Context, ref reference, id string) ([]string, error) {
+	var refIds []string
+	for shard := uint32(0); shard < refShards; shard++ {
+		stored, err := ref.service.Storage.Get(ctx, getRefsServiceName(ref.service.Cfg.Name), getRefRecordId(ref.field.Name, id, shard))
+		if errors.Is(err, errEntityNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not read references of service %q: %w", ref.service.Cfg.Name, err)
+		}
+		record, err := decodeRefRecord(stored)
+		if err != nil {
+			return nil, err
+		}
+		refIds = append(refIds, record.Ids...)
+	}
+
+	var ids []string
+	for _, refId := range refIds {
+		entity, err := ref.service.getCurrent(ctx, refId)
+		if errors.Is(err, errEntityNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not read entity %q of service %q: %w", refId, ref.service.Cfg.Name, err)
+		}
+		if payload, ok := entity.Payload.(map[string]interface{}); ok && payload[ref.field.Name] == id {
+			ids = append(ids, entity.Id)
+		}
+	}
+
+	return ids, nil
+}
+
+// checkRestrictedRefs returns errRefRestricted when the entity is referenced by a field restricting its deletion
+func (e *Service) checkRestrictedRefs(ctx context.Context, refs []reference, id string) error {
+	for _, ref := range refs {
+		if ref.field.GetOnDelete() != OnDeleteRestrict {
+			continue
+		}
+		ids, err := e.getReferencingIds(ctx, ref, id)
+		if err != nil {
+			return err
+		}
+		if len(ids) > 0 {
+			return fmt.Errorf("%w: %d entities of service %q reference it by field %q", errRefRestricted, len(ids), ref.service.Cfg.Name, ref.field.Name)
+		}
+	}
+
+	return nil
+}
+
+// deleteRefs deletes entities referencing the deleted entity or sets their references to null
+func (e *Service) deleteRefs(ctx context.Context, refs []reference, id string) error {
+	for _, ref := range refs {
+		onDelete := ref.field.GetOnDelete()
+		if onDelete == OnDeleteRestrict {
+			continue
+		}
+		ids, err := e.getReferencingIds(ctx, ref, id)
+		if err != nil {
+			return err
+		}
+		for _, refId := range ids {
+			if onDelete == OnDeleteCascade {
+				err = ref.service.Delete(ctx, refId, 0)
+			} else {
+				err = ref.service.setRefNull(ctx, refId, ref.field.Name, id)
+			}
+			if err != nil && !errors.Is(err, errEntityNotFound) {
+				return fmt.Errorf("could not %s entity %q of service %q: %w", onDelete, refId, ref.service.Cfg.Name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// deletePermanently deletes the entity from the storage service (the service or its trash) without moving it to the
+// trash; entities referencing it are handled by on_delete of their ref fields like by Delete, so errRefRestricted is
+// returned when a field restricts the deletion
+func (e *Service) deletePermanently(ctx context.Context, serviceName string, entity Entity) error {
+	refs := e.getReferences()
+	if err := e.checkRestrictedRefs(ctx, refs, entity.Id); err != nil {
+		return err
+	}
+	if err := e.Storage.Delete(ctx, serviceName, entity.Id); err != nil && !errors.Is(err, errEntityNotFound) {
+		return err
+	}
+	if serviceName == e.Cfg.Name {
+		e.removeRefIds(ctx, entity.Id, e.getRefValues(entity.Payload))
+	}
+
+	return e.deleteRefs(ctx, refs, entity.Id)
+}
+
+// setRefNull sets the field to null unless the entity references other entity meanwhile
+func (e *Service) setRefNull(ctx context.Context, id, field, target string) error {
+	for attempt := 1; ; attempt++ {
+		current, err := e.getCurrent(ctx, id)
+		if err != nil {
+			return err
+		}
+		payload, ok := current.Payload.(map[string]interface{})
+		if !ok || payload[field] != target {
+			return nil
+		}
+
+		// the stored payload can be shared by the storage, so it is copied
+		updated := make(map[string]interface{}, len(payload))
+		for name, value := range payload {
+			updated[name] = value
+		}
+		updated[field] = nil
+		_, err = e.update(ctx, id, updated, current.GetVersion(), 0)
+		if errors.Is(err, errVersionConflict) && attempt < maxVersionConflicts {
+			continue
+		}
+
+		return err
+	}
+}
+
+// ExpandRefs returns copy of the payload with values of given ref fields replaced by the referenced entities;
+// references to entities which do not exist are kept
+func (e *Service) ExpandRefs(ctx context.Context, payload interface{}, fields []string) (interface{}, error) {
+	values, ok := payload.(map[string]interface{})
+	if !ok || len(fields) == 0 {
+		return payload, nil
+	}
+
+	expanded := make(map[string]interface{}, len(values))
+	for name, value := range values {
+		expanded[name] = value
+	}
+	for _, name := range fields {
+		id, ok := values[name].(string)
+		if !ok {
+			continue
+		}
+		target, found := e.Services[*e.Cfg.Fields[name].Service]
+		if !found {
+			continue
+		}
+		entity, err := target.getCurrent(ctx, id)
+		if errors.Is(err, errEntityNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not read entity referenced by field %q: %w", name, err)
+		}
+		expanded[name] = entity
+	}
+
+	return expanded, nil
+}
+
+// getRefValues returns IDs referenced by ref fields of the payload by field name
+func (e *Service) getRefValues(payload interface{}) map[string]string {
+	values := map[string]string{}
+	fields, ok := payload.(map[string]interface{})
+	if !ok {
+		return values
+	}
+	for _, field := range e.Cfg.GetRefFields() {
+		if id, ok := fields[field.Name].(string); ok {
+			values[field.Name] = id
+		}
+	}
+
+	return values
+}
+
+// getChangedRefValues returns values which are not in the previous ones
+func getChangedRefValues(values, previous map[string]string) map[string]string {
+	changed := make(map[string]string, len(values))
+	for field, id := range values {
+		if previous[field] != id {
+			changed[field] = id
+		}
+	}
+
+	return changed
+}
+
+// addRefIds adds the entity to the ref index of entities it references; it is done before the entity is stored, so
+// the entity is not missed by a deletion of the referenced entity
+func (e *Service) addRefIds(ctx context.Context, entityId string, values map[string]string) error {
+	for field, target := range values {
+		if _, err := e.changeRefRecord(ctx, field, target, entityId, true); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// removeRefIds removes the entity from the ref index; records left by a failure are checked when they are read
+func (e *Service) removeRefIds(ctx context.Context, entityId string, values map[string]string) {
+	for field, target := range values {
+		_, _ = e.changeRefRecord(ctx, field, target, entityId, false)
+	}
+}
+
+// changeRefRecord adds the entity to the record of entities referencing the target by the field or removes it from
+// the record and reports whether the record changed; the record is deleted when no entity is left
+func (e *Service) changeRefRecord(ctx context.Context, field, target, entityId string, add bool) (bool, error) {
+	name := getRefsServiceName(e.Cfg.Name)
+	id := getRefRecordId(field, target, getRefShard(entityId))
+	for attempt := 1; ; attempt++ {
+		stored, err := e.Storage.Get(ctx, name, id)
+		switch {
+		case errors.Is(err, errEntityNotFound):
+			if !add {
+				return false, nil
+			}
+			record := refRecord{Field: field, Target: target, Ids: []string{entityId}}
+			err = e.Storage.Insert(ctx, name, Entity{Id: id, Created: time.Now().Truncate(time.Microsecond), Payload: encodeRefRecord(record), Version: 1})
+		case err == nil:
+			var record refRecord
+			if record, err = decodeRefRecord(stored); err != nil {
+				return false, err
+			}
+			ids := make([]string, 0, len(record.Ids)+1)
+			for _, refId := range record.Ids {
+				if refId != entityId {
+					ids = append(ids, refId)
+				}
+			}
+			if found := len(ids) < len(record.Ids); found == add {
+				return false, nil
+			}
+			if add {
+				ids = append(ids, entityId)
+			}
+			if len(ids) == 0 {
+				err = e.Storage.DeleteVersion(ctx, name, id, stored.GetVersion())
+			} else {
+				record.Ids = ids
+				_, err = e.Storage.Update(ctx, name, Entity{Id: id, Created: stored.Created, Payload: encodeRefRecord(record), Version: stored.GetVersion()})
+			}
+		}
+		if (errors.Is(err, errEntityExists) || errors.Is(err, errEntityNotFound) || errors.Is(err, errVersionConflict)) && attempt < maxRefConflicts {
+			continue
+		}
+		if err != nil {
+			return false, fmt.Errorf("could not store reference of field %q: %w", field, err)
+		}
+
+		return true, nil
+	}
+}
+
+// RebuildRefIndex adds all entities of the service to the ref index, so entities stored without it (existing
+// entities of a new ref field, restored or migrated entities) are found by deletions of the referenced entities.
+// It returns number of newly indexed references.
+func (e *Service) RebuildRefIndex(ctx context.Context) (indexed int, err error) {
+	ctx, span := e.startSpan(ctx, "service.rebuild_ref_index")
+	defer func() { endSpan(span, err) }()
+
+	list, err := e.List(ctx)
+	if err != nil {
+		return 0, err
+	}
+	for _, entity := range list {
+		for field, target := range e.getRefValues(entity.Payload) {
+			changed, err := e.changeRefRecord(ctx, field, target, entity.Id, true)
+			if err != nil {
+				return indexed, err
+			}
+			if changed {
+				indexed++
+			}
+		}
+	}
+
+	return indexed, e.storeIndexKeys(ctx, getRefsServiceName(e.Cfg.Name), e.getRefIndexKeys())
+}
+
+// getRefIndexKeys identifies ref fields of the service, services they reference and number of shards of the records
+func (e *Service) getRefIndexKeys() string {
+	fields := make(map[string]string)
+	for _, field := range e.Cfg.GetRefFields() {
+		fields[field.Name] = *field.Service
+	}
+
+	return getIndexKeys(map[string]interface{}{"fields": fields, "shards": refShards})
+}
+
+// isRefIndexCurrent reports whether references of the current ref fields were indexed
+func (e *Service) isRefIndexCurrent(ctx context.Context) (bool, error) {
+	return e.isIndexCurrent(ctx, getRefsServiceName(e.Cfg.Name), e.getRefIndexKeys())
+}
+
+func encodeRefRecord(record refRecord) map[string]interface{} {
+	ids := make([]interface{}, 0, len(record.Ids))
+	for _, id := range record.Ids {
+		ids = append(ids, id)
+	}
+
+	return map[string]interface{}{
+		"field":  record.Field,
+		"target": record.Target,
+		"ids":    ids,
+	}
+}
+
+func decodeRefRecord(stored Entity) (refRecord, error) {
+	data, err := json.Marshal(stored.Payload)
+	if err != nil {
+		return refRecord{}, fmt.Errorf("could not decode references %q: %w", stored.Id, err)
+	}
+
+	var record refRecord
+	if err = json.Unmarshal(data, &record); err != nil {
+		return refRecord{}, fmt.Errorf("could not decode references %q: %w", stored.Id, err)
+	}
+
+	return record, nil
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// noListStorage fails to list entities of the service, so entities referencing other entity must be found without
+// reading all of them
+type noListStorage struct {
+	Storage
+	serviceName string
+}
+
+func (s noListStorage) List(ctx context.Context, serviceName string) ([]Entity, error) {
+	if serviceName == s.serviceName {
+		return nil, errors.New("entities must not be listed")
+	}
+
+	return s.Storage.List(ctx, serviceName)
+}
+
+func createTestRefServices(onDelete string) (people, dogs Service) {
+	people = Service{Cfg: testServiceConfig("people")}
+	dogs = Service{Cfg: testServiceConfig("dogs")}
+	target := "people"
+	dogs.Cfg.Fields["owner"] = &FieldConfig{Name: "owner", Type: "ref", Service: &target, OnDelete: &onDelete}
+
+	stg := CreateMemStorage([]string{"people", "people__trash", "dogs", "dogs__refs"})
+	services := map[string]Service{}
+	for _, service := range []*Service{&people, &dogs} {
+		service.Storage = stg
+		service.Services = services
+		services[service.Cfg.Name] = *service
+	}
+
+	return people, dogs
+}
+
+func TestRefs(t *testing.T) {
+	ctx := context.Background()
+	people, dogs := createTestRefServices(OnDeleteRestrict)
+
+	alice, err := people.Put(ctx, map[string]interface{}{"name": "alice"}, nil)
+	assert.Nil(t, err)
+	_, err = dogs.Put(ctx, map[string]interface{}{"name": "rex", "owner": "missing"}, nil)
+	assert.ErrorIs(t, err, errRefNotFound)
+	rex, err := dogs.Put(ctx, map[string]interface{}{"name": "rex", "owner": alice.Id}, nil)
+	assert.Nil(t, err)
+	_, err = dogs.Update(ctx, rex.Id, map[string]interface{}{"name": "rex", "owner": "missing"}, 0)
+	assert.ErrorIs(t, err, errRefNotFound)
+
+	// referenced entity is expanded, missing one is kept as id
+	expanded, err := dogs.ExpandRefs(ctx, map[string]interface{}{"name": "rex", "owner": alice.Id}, []string{"owner"})
+	assert.Nil(t, err)
+	assert.Equal(t, alice.Id, expanded.(map[string]interface{})["owner"].(Entity).Id)
+	expanded, err = dogs.ExpandRefs(ctx, map[string]interface{}{"name": "rex", "owner": "missing"}, []string{"owner"})
+	assert.Nil(t, err)
+	assert.Equal(t, "missing", expanded.(map[string]interface{})["owner"])
+
+	assert.ErrorIs(t, people.Delete(ctx, alice.Id, 0), errRefRestricted)
+	assert.Nil(t, dogs.Delete(ctx, rex.Id, 0))
+	assert.Nil(t, people.Delete(ctx, alice.Id, 0))
+}
+
+func TestRefsOnDelete(t *testing.T) {
+	ctx := context.Background()
+
+	people, dogs := createTestRefServices(OnDeleteCascade)
+	alice, err := people.Put(ctx, map[string]interface{}{"name": "alice"}, nil)
+	assert.Nil(t, err)
+	bob, err := people.Put(ctx, map[string]interface{}{"name": "bob"}, nil)
+	assert.Nil(t, err)
+	for _, owner := range []string{alice.Id, alice.Id, bob.Id} {
+		_, err = dogs.Put(ctx, map[string]interface{}{"name": "rex", "owner": owner}, nil)
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, people.Delete(ctx, alice.Id, 0))
+	list, err := dogs.List(ctx)
+	assert.Nil(t, err)
+	assert.Len(t, list, 1)
+
+	people, dogs = createTestRefServices(OnDeleteSetNull)
+	alice, err = people.Put(ctx, map[string]interface{}{"name": "alice"}, nil)
+	assert.Nil(t, err)
+	rex, err := dogs.Put(ctx, map[string]interface{}{"name": "rex", "owner": alice.Id}, nil)
+	assert.Nil(t, err)
+	assert.Nil(t, people.Delete(ctx, alice.Id, 0))
+	rex, err = dogs.Get(ctx, rex.Id)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{"name": "rex", "owner": nil}, rex.Payload)
+	assert.Equal(t, int64(2), rex.Version)
+}
+
+func TestRefsSoftDelete(t *testing.T) {
+	ctx := context.Background()
+	people, dogs := createTestRefServices(OnDeleteCascade)
+	people.Cfg.SoftDelete = true
+	alice, err := people.Put(ctx, map[string]interface{}{"name": "alice"}, nil)
+	assert.Nil(t, err)
+	rex, err := dogs.Put(ctx, map[string]interface{}{"name": "rex", "owner": alice.Id}, nil)
+	assert.Nil(t, err)
+
+	// referencing entities are kept until the deleted entity is purged, so it can be restored with them
+	assert.Nil(t, people.Delete(ctx, alice.Id, 0))
+	_, err = dogs.Get(ctx, rex.Id)
+	assert.Nil(t, err)
+	_, err = people.Undelete(ctx, alice.Id)
+	assert.Nil(t, err)
+	assert.Nil(t, people.Delete(ctx, alice.Id, 0))
+	purged, err := people.PurgeTrash(ctx, time.Now())
+	assert.Nil(t, err)
+	assert.Equal(t, 1, purged)
+	_, err = dogs.Get(ctx, rex.Id)
+	assert.ErrorIs(t, err, errEntityNotFound)
+
+	// restricting references are checked by the soft delete
+	onDelete := OnDeleteRestrict
+	dogs.Cfg.Fields["owner"].OnDelete = &onDelete
+	bob, err := people.Put(ctx, map[string]interface{}{"name": "bob"}, nil)
+	assert.Nil(t, err)
+	_, err = dogs.Put(ctx, map[string]interface{}{"name": "max", "owner": bob.Id}, nil)
+	assert.Nil(t, err)
+	assert.ErrorIs(t, people.Delete(ctx, bob.Id, 0), errRefRestricted)
+}
+
+func TestRefIndex(t *testing.T) {
+	ctx := context.Background()
+	people, dogs := createTestRefServices(OnDeleteCascade)
+	alice, err := people.Put(ctx, map[string]interface{}{"name": "alice"}, nil)
+	assert.Nil(t, err)
+	bob, err := people.Put(ctx, map[string]interface{}{"name": "bob"}, nil)
+	assert.Nil(t, err)
+
+	// the index follows changes of references
+	rex, err := dogs.Put(ctx, map[string]interface{}{"name": "rex", "owner": alice.Id}, nil)
+	assert.Nil(t, err)
+	_, err = dogs.Update(ctx, rex.Id, map[string]interface{}{"name": "rex", "owner": bob.Id}, 0)
+	assert.Nil(t, err)
+	ref := people.getReferences()[0]
+	ids, err := people.getReferencingIds(ctx, ref, alice.Id)
+	assert.Nil(t, err)
+	assert.Empty(t, ids)
+	ids, err = people.getReferencingIds(ctx, ref, bob.Id)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{rex.Id}, ids)
+
+	// entities stored without the index are indexed by the rebuild
+	max := Entity{Id: "max", Created: time.Now(), Payload: map[string]interface{}{"name": "max", "owner": alice.Id}}
+	assert.Nil(t, dogs.Storage.Insert(ctx, "dogs", max))
+	ids, err = people.getReferencingIds(ctx, ref, alice.Id)
+	assert.Nil(t, err)
+	assert.Empty(t, ids)
+	current, err := dogs.isRefIndexCurrent(ctx)
+	assert.Nil(t, err)
+	assert.False(t, current)
+	indexed, err := dogs.RebuildRefIndex(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, indexed)
+	current, err = dogs.isRefIndexCurrent(ctx)
+	assert.Nil(t, err)
+	assert.True(t, current)
+
+	// referencing entities are found without reading all entities
+	dogs.Storage = noListStorage{Storage: dogs.Storage, serviceName: "dogs"}
+	people.Services["dogs"] = dogs
+	assert.Nil(t, people.Delete(ctx, alice.Id, 0))
+	_, err = dogs.Get(ctx, max.Id)
+	assert.ErrorIs(t, err, errEntityNotFound)
+	records, err := dogs.Storage.List(ctx, getRefsServiceName("dogs"))
+	assert.Nil(t, err)
+	assert.Len(t, records, 2) // the index and references of bob
+}
+
+func TestRefIndexShards(t *testing.T) {
+	ctx := context.Background()
+	people, dogs := createTestRefServices(OnDeleteCascade)
+	alice, err := people.Put(ctx, map[string]interface{}{"name": "alice"}, nil)
+	assert.Nil(t, err)
+
+	var expected []string
+	for i := 0; i < 40; i++ {
+		dog, err := dogs.Put(ctx, map[string]interface{}{"name": fmt.Sprintf("dog %d", i), "owner": alice.Id}, nil)
+		assert.Nil(t, err)
+		expected = append(expected, dog.Id)
+	}
+
+	// the references are split into records and all of them are read
+	records, err := dogs.Storage.List(ctx, getRefsServiceName("dogs"))
+	assert.Nil(t, err)
+	assert.Greater(t, len(records), 1)
+	assert.LessOrEqual(t, len(records), refShards)
+	ids, err := people.getReferencingIds(ctx, people.getReferences()[0], alice.Id)
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, expected, ids)
+
+	assert.Nil(t, people.Delete(ctx, alice.Id, 0))
+	list, err := dogs.List(ctx)
+	assert.Nil(t, err)
+	assert.Empty(t, list)
+	records, err = dogs.Storage.List(ctx, getRefsServiceName("dogs"))
+	assert.Nil(t, err)
+	assert.Empty(t, records)
+}
+
+func TestRefsPermanentDelete(t *testing.T) {
+	ctx := context.Background()
+	people, dogs := createTestRefServices(OnDeleteRestrict)
+	people.Cfg.SoftDelete = true
+	people.Cfg.Expiration = true
+
+	// expired entity restricted by a reference is kept
+	alice, err := people.Put(ctx, map[string]interface{}{"name": "alice"}, nil)
+	assert.Nil(t, err)
+	rex, err := dogs.Put(ctx, map[string]interface{}{"name": "rex", "owner": alice.Id}, nil)
+	assert.Nil(t, err)
+	past := time.Now().Add(-time.Minute)
+	alice.ExpiresAt = &past
+	_, err = people.Storage.Update(ctx, "people", alice)
+	assert.Nil(t, err)
+	deleted, err := people.DeleteExpired(ctx)
+	assert.ErrorIs(t, err, errRefRestricted)
+	assert.Equal(t, 0, deleted)
+	_, err = people.Storage.Get(ctx, "people", alice.Id)
+	assert.Nil(t, err)
+
+	// referencing entities are deleted with the expired entity
+	onDelete := OnDeleteCascade
+	dogs.Cfg.Fields["owner"].OnDelete = &onDelete
+	deleted, err = people.DeleteExpired(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, deleted)
+	_, err = dogs.Get(ctx, rex.Id)
+	assert.ErrorIs(t, err, errEntityNotFound)
+
+	// entity referencing a deleted entity (stored concurrently with the deletion) is handled by purge of the trash
+	bob, err := people.Put(ctx, map[string]interface{}{"name": "bob"}, nil)
+	assert.Nil(t, err)
+	max, err := dogs.Put(ctx, map[string]interface{}{"name": "max", "owner": bob.Id}, nil)
+	assert.Nil(t, err)
+	assert.Nil(t, people.moveToTrash(ctx, bob, time.Now().Add(-time.Hour)))
+	onDelete = OnDeleteRestrict
+	purged, err := people.PurgeTrash(ctx, time.Now())
+	assert.ErrorIs(t, err, errRefRestricted)
+	assert.Equal(t, 0, purged)
+	onDelete = OnDeleteSetNull
+	purged, err = people.PurgeTrash(ctx, time.Now())
+	assert.Nil(t, err)
+	assert.Equal(t, 1, purged)
+	max, err = dogs.Get(ctx, max.Id)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{"name": "max", "owner": nil}, max.Payload)
+}
@@ -1,41 +1,234 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"time"
 )
 
 type Service struct {
 	Cfg     ServiceConfig
 	Storage Storage
+	// Services are all services by name shared by them to resolve references between entities
+	Services map[string]Service
 }
 
-func (e *Service) Validate(payload map[string]interface{}) error {
+func (e *Service) Validate(ctx context.Context, payload map[string]interface{}) error {
+	_, span := e.startSpan(ctx, "service.validate")
 	t := true
-	return Validate(FieldConfig{
+	err := Validate(FieldConfig{
 		Name:     "root",
 		Type:     "object",
 		Required: &t,
 		Fields:   &e.Cfg.Fields,
 	}, payload, true)
+	endSpan(span, err)
+
+	return err
 }
 
-func (e *Service) Put(payload map[string]interface{}) error {
-	_, err := e.Storage.Add(e.Cfg.Name, payload)
+// Put stores a new entity owned by the actor of the request; expiresAt is optional time when the entity expires. When
+// the write fails although the entity was stored (e.g. the response of the storage timed out), the error is returned
+// with the stored entity.
+func (e *Service) Put(ctx context.Context, payload map[string]interface{}, expiresAt *time.Time) (entity Entity, err error) {
+	ctx, span := e.startSpan(ctx, "service.put")
+	defer func() { endSpan(span, err) }()
+
+	if payload, err = e.prepare(payload, nil); err != nil {
+		return Entity{}, err
+	}
+	if err = e.checkRefs(ctx, payload); err != nil {
+		return Entity{}, err
+	}
+	entity, err = createEntity(payload)
+	if err == nil {
+		// some storages keep only microseconds of created time
+		entity.Created = entity.Created.Truncate(time.Microsecond)
+		entity.ExpiresAt = expiresAt
+		entity.Owner = getActor(ctx)
+		err = e.insert(ctx, entity)
+	}
+	if errors.Is(err, errUniqueViolation) {
+		return Entity{}, err
+	}
 	if err != nil {
-		return fmt.Errorf("could not put new entity into storage: %w", err)
+		err = fmt.Errorf("could not put new entity into storage: %w", err)
+		if entity.Id != "" {
+			if _, getErr := e.Storage.Get(ctx, e.Cfg.Name, entity.Id); getErr == nil {
+				return entity, err
+			}
+		}
+		return Entity{}, err
+	}
+
+	if e.Cfg.History {
+		e.recordVersion(ctx, nil, entity.Id, entityVersion{Version: int(entity.GetVersion()), Timestamp: entity.Created, Actor: getActor(ctx), Payload: payload})
 	}
 
-	return nil
+	return entity, nil
+}
+
+// Update replaces payload of the entity keeping its ID and created time; the entity must have given version
+// (any version when 0) otherwise errVersionConflict is returned
+func (e *Service) Update(ctx context.Context, id string, payload map[string]interface{}, version int64) (entity Entity, err error) {
+	ctx, span := e.startSpan(ctx, "service.update", attribute.String("usa.entity.id", id))
+	defer func() { endSpan(span, err) }()
+
+	return e.update(ctx, id, payload, version, 0)
 }
 
-func (e *Service) List() ([]Entity, error) {
-	return e.Storage.List(e.Cfg.Name)
+func (e *Service) update(ctx context.Context, id string, payload map[string]interface{}, version int64, restoredFrom int) (Entity, error) {
+	for attempt := 1; ; attempt++ {
+		current, err := e.getCurrent(ctx, id)
+		if err != nil {
+			return Entity{}, err
+		}
+		if err = checkVersion(current, version); err != nil {
+			return Entity{}, err
+		}
+		prepared, err := e.prepare(payload, current.Payload)
+		if err != nil {
+			return Entity{}, err
+		}
+		if err = e.checkRefs(ctx, prepared); err != nil {
+			return Entity{}, err
+		}
+
+		// new values of unique keys are claimed before the change, the old ones are released after it
+		currentIds, err := e.getUniqueIds(current.Payload)
+		if err != nil {
+			return Entity{}, err
+		}
+		updatedIds, err := e.getUniqueIds(prepared)
+		if err != nil {
+			return Entity{}, err
+		}
+		claimed, err := e.claimUniqueIds(ctx, id, updatedIds)
+		if err != nil {
+			return Entity{}, err
+		}
+		// new references are indexed before the change and kept when it fails (the index is checked when it is read,
+		// while a reference removed by a failed change could be indexed by a concurrent change), the old ones are
+		// removed after it
+		currentRefs := e.getRefValues(current.Payload)
+		updatedRefs := e.getRefValues(prepared)
+		if err = e.addRefIds(ctx, id, getChangedRefValues(updatedRefs, currentRefs)); err != nil {
+			e.releaseUniqueIds(ctx, id, claimed)
+			return Entity{}, err
+		}
+
+		// the read version is replaced only, so the history records the right previous state
+		updated, err := e.Storage.Update(ctx, e.Cfg.Name, Entity{Id: id, Created: current.Created, Payload: prepared, Version: current.GetVersion(), ExpiresAt: current.ExpiresAt, Owner: current.Owner})
+		if err != nil {
+			e.releaseUniqueIds(ctx, id, claimed)
+		}
+		if errors.Is(err, errVersionConflict) && version == 0 && attempt < maxVersionConflicts {
+			continue
+		}
+		if err != nil {
+			return Entity{}, err
+		}
+		e.releaseUniqueIds(ctx, id, getUniqueIdList(currentIds, updatedIds))
+		e.removeRefIds(ctx, id, getChangedRefValues(currentRefs, updatedRefs))
+
+		if e.Cfg.History {
+			v := entityVersion{Version: int(updated.Version), Timestamp: time.Now(), Actor: getActor(ctx), RestoredFrom: restoredFrom, Payload: prepared}
+			e.recordVersion(ctx, &current, id, v)
+		}
+
+		return updated, nil
+	}
 }
 
-func (e *Service) Get(id string) (Entity, error) {
-	return e.Storage.Get(e.Cfg.Name, id)
+func (e *Service) List(ctx context.Context) (list []Entity, err error) {
+	ctx, span := e.startSpan(ctx, "service.list")
+	defer func() { endSpan(span, err) }()
+
+	list, err = e.Storage.List(ctx, e.Cfg.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	return e.withoutExpired(list), nil
+}
+
+// ListPage returns one page of entities and cursor of the next page
+func (e *Service) ListPage(ctx context.Context, cursor string, limit int) (list []Entity, next string, err error) {
+	ctx, span := e.startSpan(ctx, "service.list_page")
+	defer func() { endSpan(span, err) }()
+
+	// page of entities with expired ones is shorter
+	list, next, err = listPage(ctx, e.Storage, e.Cfg.Name, cursor, limit)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return e.withoutExpired(list), next, nil
+}
+
+func (e *Service) Get(ctx context.Context, id string) (entity Entity, err error) {
+	ctx, span := e.startSpan(ctx, "service.get", attribute.String("usa.entity.id", id))
+	defer func() { endSpan(span, err) }()
+
+	return e.getCurrent(ctx, id)
+}
+
+// Delete deletes the entity with given version (any version when 0) otherwise errVersionConflict is returned;
+// entities referencing it are handled by on_delete of their ref fields. References are checked before the deletion
+// and handled after it, so an entity referencing the entity stored between them is not handled. Soft deleted entity
+// can be restored, so only restricting references are checked and the others are handled when it is purged.
+func (e *Service) Delete(ctx context.Context, id string, version int64) (err error) {
+	ctx, span := e.startSpan(ctx, "service.delete", attribute.String("usa.entity.id", id))
+	defer func() { endSpan(span, err) }()
+
+	refs := e.getReferences()
+	if !e.Cfg.History && !e.Cfg.SoftDelete && !e.hasIndexes() && len(refs) == 0 {
+		return e.Storage.DeleteVersion(ctx, e.Cfg.Name, id, version)
+	}
+
+	for attempt := 1; ; attempt++ {
+		current, err := e.getCurrent(ctx, id)
+		if err != nil {
+			return err
+		}
+		if err = checkVersion(current, version); err != nil {
+			return err
+		}
+		if err = e.checkRestrictedRefs(ctx, refs, id); err != nil {
+			return err
+		}
+
+		deletedAt := time.Now()
+		if e.Cfg.SoftDelete {
+			err = e.moveToTrash(ctx, current, deletedAt)
+		} else {
+			err = e.Storage.DeleteVersion(ctx, e.Cfg.Name, id, current.GetVersion())
+		}
+		if errors.Is(err, errVersionConflict) && version == 0 && attempt < maxVersionConflicts {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		e.releaseUniqueValues(ctx, current)
+		e.removeRefIds(ctx, id, e.getRefValues(current.Payload))
+
+		if e.Cfg.History {
+			v := entityVersion{Version: int(current.GetVersion()) + 1, Timestamp: deletedAt, Actor: getActor(ctx), Deleted: true}
+			e.recordVersion(ctx, &current, id, v)
+		}
+
+		if e.Cfg.SoftDelete {
+			return nil
+		}
+
+		return e.deleteRefs(ctx, refs, id)
+	}
 }
 
-func (e *Service) Delete(id string) error {
-	return e.Storage.Delete(e.Cfg.Name, id)
+func (e *Service) startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return startSpan(ctx, name, append(attrs, attribute.String("usa.service", e.Cfg.Name))...)
 }
@@ -1,15 +1,38 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	uuid "github.com/nu7hatch/gouuid"
+	"github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"strings"
 	"time"
 )
 
+const defaultStorageTimeout = 5 * time.Second
+
+var storageTypes = []string{"mem", "s3", "firestore", "bolt", "sql", "redis"}
+
+var (
+	errStorageNotReady = errors.New("storage is not ready yet")
+	errEntityExists    = errors.New("entity with the same id already exists")
+	errEntityExpired   = errors.New("entity is already expired")
+	errEntityNotFound  = errors.New("entity not found")
+	errVersionConflict = errors.New("entity was changed in the meantime")
+)
+
 type Entity struct {
-	Id      string      `json:"id"`
-	Created time.Time   `json:"created"`
-	Payload interface{} `json:"payload"`
+	Id        string      `json:"id"`
+	Created   time.Time   `json:"created"`
+	Payload   interface{} `json:"payload"`
+	Version   int64       `json:"version,omitempty"`    // incremented by every update of the entity
+	ExpiresAt *time.Time  `json:"expires_at,omitempty"` // entity is deleted after this time
+	DeletedAt *time.Time  `json:"deleted_at,omitempty"` // set only for soft deleted entities read from the trash
+	Updated   *time.Time  `json:"updated,omitempty"`    // time of the last update, kept by firestore storage only
+	Owner     string      `json:"owner,omitempty"`      // actor who created the entity
 }
 
 func createEntity(payload interface{}) (Entity, error) {
@@ -22,25 +45,237 @@ func createEntity(payload interface{}) (Entity, error) {
 		Id:      uuidV4.String(),
 		Created: time.Now(),
 		Payload: payload,
+		Version: 1,
 	}, nil
 }
 
+// GetVersion returns version of the entity; entities stored before versions were introduced have the first version
+func (e Entity) GetVersion() int64 {
+	if e.Version < 1 {
+		return 1
+	}
+
+	return e.Version
+}
+
+// checkVersion fails with errVersionConflict when the stored entity does not have the expected version;
+// version 0 matches any version
+func checkVersion(stored Entity, version int64) error {
+	if version != 0 && stored.GetVersion() != version {
+		return fmt.Errorf("%w: %q has version %d, expected %d", errVersionConflict, stored.Id, stored.GetVersion(), version)
+	}
+
+	return nil
+}
+
 type Storage interface {
-	Add(serviceName string, payload interface{}) (Entity, error)
-	List(serviceName string) ([]Entity, error)
-	Get(serviceName, id string) (Entity, error)
-	Delete(serviceName, id string) error
+	Add(ctx context.Context, serviceName string, payload interface{}) (Entity, error)
+	// Insert stores the entity keeping its ID and created time; fails with errEntityExists when the ID is taken and
+	// with errEntityExpired when the storage expires entities (redis TTL) and the entity is already expired
+	Insert(ctx context.Context, serviceName string, e Entity) error
+	// Update replaces the stored entity with the same ID and increments its version, the stored entity with its new
+	// version is returned; fails with errEntityNotFound when the entity does not exist and with errVersionConflict when
+	// version of the entity (unless 0) is not the stored one
+	Update(ctx context.Context, serviceName string, e Entity) (Entity, error)
+	List(ctx context.Context, serviceName string) ([]Entity, error)
+	Get(ctx context.Context, serviceName, id string) (Entity, error)
+	Delete(ctx context.Context, serviceName, id string) error
+	// DeleteVersion deletes the entity only when it has given version (any version when 0); fails with
+	// errVersionConflict otherwise
+	DeleteVersion(ctx context.Context, serviceName, id string, version int64) error
+	// Health checks the storage backend is reachable and working
+	Health(ctx context.Context) error
+	// Ready reports whether the storage is able to serve requests (e.g. initial load is finished)
+	Ready() bool
+}
+
+// PagedStorage is implemented by storages able to list entities page by page efficiently
+type PagedStorage interface {
+	// ListPage returns at most limit entities (all when limit is 0) following the entity with ID cursor
+	// (from the beginning when cursor is empty) and the cursor of the next page (empty for the last page)
+	ListPage(ctx context.Context, serviceName, cursor string, limit int) ([]Entity, string, error)
+}
+
+// BackupStorage is implemented by storages able to write online backup of all their data
+type BackupStorage interface {
+	Backup(ctx context.Context, w io.Writer) (int64, error)
+}
+
+// unwrapper is implemented by storage decorators
+type unwrapper interface {
+	Unwrap() Storage
+}
+
+// listPage uses paged listing of the storage when available; otherwise it pages the full list
+func listPage(ctx context.Context, stg Storage, serviceName, cursor string, limit int) ([]Entity, string, error) {
+	if paged, ok := stg.(PagedStorage); ok {
+		return paged.ListPage(ctx, serviceName, cursor, limit)
+	}
+
+	list, err := stg.List(ctx, serviceName)
+	if err != nil {
+		return nil, "", err
+	}
+
+	start := 0
+	if cursor != "" {
+		start = -1
+		for k, e := range list {
+			if e.Id == cursor {
+				start = k + 1
+				break
+			}
+		}
+		if start < 0 {
+			return nil, "", fmt.Errorf("could not find cursor entity %q", cursor)
+		}
+	}
+
+	list = list[start:]
+	if limit > 0 && len(list) > limit {
+		return list[:limit], list[limit-1].Id, nil
+	}
+
+	return list, "", nil
 }
 
-func CreateStorageByType(storageType string, serviceNames []string) (Storage, error) {
+// asBackupStorage returns the storage (or the storage wrapped by decorators) supporting backups
+func asBackupStorage(stg Storage) (BackupStorage, bool) {
+	for {
+		if backup, ok := stg.(BackupStorage); ok {
+			return backup, true
+		}
+		wrapper, ok := stg.(unwrapper)
+		if !ok {
+			return nil, false
+		}
+		stg = wrapper.Unwrap()
+	}
+}
+
+// closeStorage releases resources of the storage (or the storage wrapped by decorators) if it holds any
+func closeStorage(stg Storage) error {
+	for {
+		if closer, ok := stg.(io.Closer); ok {
+			return closer.Close()
+		}
+		wrapper, ok := stg.(unwrapper)
+		if !ok {
+			return nil
+		}
+		stg = wrapper.Unwrap()
+	}
+}
+
+// CreateStorages creates one instrumented storage of every named storage (or storage type) used by services; services
+// without storage use the default storage. Storages are returned by name.
+func CreateStorages(ctx context.Context, defaultStorage string, cfg *Config, logger *logrus.Logger) (map[string]Storage, error) {
+	var names []string
+	services := make(map[string][]ServiceConfig)
+	for _, serviceConfig := range cfg.ServiceConfigs {
+		name := serviceConfig.GetStorage(defaultStorage)
+		if _, found := services[name]; !found {
+			names = append(names, name)
+		}
+		services[name] = append(services[name], serviceConfig)
+	}
+
+	storages := make(map[string]Storage, len(names))
+	for _, name := range names {
+		storageCfg := cfg.GetStorageConfig(name)
+		nameCfg := &Config{ServiceConfigs: services[name], logger: cfg.logger}
+		stg, err := CreateStorage(ctx, storageCfg, nameCfg, logger)
+		if err != nil {
+			for _, created := range storages {
+				_ = closeStorage(created)
+			}
+			return nil, fmt.Errorf("could not create %q storage for service(s) %s: %w", name, strings.Join(nameCfg.GetServiceNames(), ", "), err)
+		}
+
+		storages[name] = InstrumentStorage(name, stg)
+		logger.Infof("Storage %q (%s) prepared for %d service(s) (%s)", name, storageCfg.Type, len(nameCfg.ServiceConfigs), strings.Join(nameCfg.GetServiceNames(), ", "))
+	}
+
+	return storages, nil
+}
+
+// CreateStorage creates the named storage; environment variables of the storage are set while it is created
+func CreateStorage(ctx context.Context, storageCfg StorageConfig, cfg *Config, logger *logrus.Logger) (stg Storage, err error) {
+	restore := make(map[string]*string, len(storageCfg.Env))
+	for name, value := range storageCfg.Env {
+		if previous, found := os.LookupEnv(name); found {
+			restore[name] = &previous
+		} else {
+			restore[name] = nil
+		}
+		if err = os.Setenv(name, value); err != nil {
+			break
+		}
+	}
+	defer func() {
+		for name, previous := range restore {
+			if previous == nil {
+				_ = os.Unsetenv(name)
+			} else {
+				_ = os.Setenv(name, *previous)
+			}
+		}
+	}()
+	if err != nil {
+		return nil, fmt.Errorf("could not set environment of storage %q: %w", storageCfg.Name, err)
+	}
+
+	return CreateStorageByType(ctx, storageCfg.Type, cfg, logger)
+}
+
+// CreateStorageByType creates storage of given type. Context is used for background operations of the storage
+// (e.g. initial load) and should be canceled when the application is shutting down.
+func CreateStorageByType(ctx context.Context, storageType string, cfg *Config, logger *logrus.Logger) (Storage, error) {
+	storageCfg := &Config{ServiceConfigs: cfg.GetStorageServiceConfigs(), logger: cfg.logger}
+	serviceNames := storageCfg.GetServiceNames()
 	switch storageType {
 	case "mem":
+		if os.Getenv("MEM_WAL_DIR") != "" {
+			return CreateWalMemStorage(ctx, serviceNames, logger)
+		}
 		return CreateMemStorage(serviceNames), nil
 	case "s3":
-		return CreateS3Storage(serviceNames)
+		return CreateS3Storage(ctx, serviceNames, logger)
 	case "firestore":
-		return CreateFirestoreStorage()
+		return CreateFirestoreStorage(ctx)
+	case "bolt":
+		return CreateBoltStorage(serviceNames)
+	case "sql":
+		return CreateSqlStorage(ctx, storageCfg.ServiceConfigs)
+	case "redis":
+		return CreateRedisStorage()
 	}
 
 	return nil, fmt.Errorf("unknown storage type %q", storageType)
 }
+
+// isStorageType reports whether CreateStorageByType knows the storage type
+func isStorageType(storageType string) bool {
+	for _, known := range storageTypes {
+		if known == storageType {
+			return true
+		}
+	}
+
+	return false
+}
+
+// getTimeoutEnv parses timeout of storage operations from environment variable
+func getTimeoutEnv(name string) (time.Duration, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultStorageTimeout, nil
+	}
+
+	timeout, err := time.ParseDuration(value)
+	if err != nil || timeout <= 0 {
+		return 0, fmt.Errorf("invalid timeout %q in environment variable %q", value, name)
+	}
+
+	return timeout, nil
+}
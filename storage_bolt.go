@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	bolt "go.etcd.io/bbolt"
+	"io"
+	"os"
+)
+
+var (
+	boltEntitiesBucket = []byte("entities") // sequence number -> entity
+	boltIdsBucket      = []byte("ids")      // entity ID -> sequence number
+)
+
+// boltStorage stores entities in embedded key-value database file. Every service has its own bucket
+// with entities ordered by insertion and an index of entity IDs.
+type boltStorage struct {
+	db *bolt.DB
+}
+
+func CreateBoltStorage(serviceNames []string) (*boltStorage, error) {
+	filename := os.Getenv("BOLT_FILE")
+	if filename == "" {
+		return nil, fmt.Errorf("could not find environment variable %q for bolt configuration", "BOLT_FILE")
+	}
+
+	timeout, err := getTimeoutEnv("BOLT_TIMEOUT")
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := bolt.Open(filename, 0o600, &bolt.Options{Timeout: timeout})
+	if err != nil {
+		return nil, fmt.Errorf("could not open bolt database %q: %w", filename, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, serviceName := range serviceNames {
+			b, err := tx.CreateBucketIfNotExists([]byte(serviceName))
+			if err != nil {
+				return err
+			}
+			if _, err = b.CreateBucketIfNotExists(boltEntitiesBucket); err != nil {
+				return err
+			}
+			if _, err = b.CreateBucketIfNotExists(boltIdsBucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("could not create bolt buckets: %w", err)
+	}
+
+	return &boltStorage{db: db}, nil
+}
+
+func (storage *boltStorage) Add(ctx context.Context, serviceName string, payload interface{}) (Entity, error) {
+	e, err := createEntity(payload)
+	if err != nil {
+		return e, err
+	}
+
+	if err = storage.Insert(ctx, serviceName, e); err != nil {
+		return Entity{}, err
+	}
+
+	return e, nil
+}
+
+// Insert appends the entity to the bucket of the service, entities are listed in order of insertion
+func (storage *boltStorage) Insert(_ context.Context, serviceName string, e Entity) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("could not encode entity: %w", err)
+	}
+
+	err = storage.db.Update(func(tx *bolt.Tx) error {
+		entities, ids, err := getBoltBuckets(tx, serviceName)
+		if err != nil {
+			return err
+		}
+		if ids.Get([]byte(e.Id)) != nil {
+			return errEntityExists
+		}
+
+		seq, err := entities.NextSequence()
+		if err != nil {
+			return err
+		}
+		key := encodeBoltSequence(seq)
+		if err = entities.Put(key, data); err != nil {
+			return err
+		}
+		return ids.Put([]byte(e.Id), key)
+	})
+	if err != nil {
+		return fmt.Errorf("could not write entity to bolt: %w", err)
+	}
+
+	return nil
+}
+
+// Update replaces the entity keeping its position in the bucket
+func (storage *boltStorage) Update(_ context.Context, serviceName string, e Entity) (Entity, error) {
+	err := storage.db.Update(func(tx *bolt.Tx) error {
+		entities, ids, err := getBoltBuckets(tx, serviceName)
+		if err != nil {
+			return err
+		}
+
+		seq := ids.Get([]byte(e.Id))
+		if seq == nil {
+			return fmt.Errorf("%w: %q", errEntityNotFound, e.Id)
+		}
+		var stored Entity
+		if err = json.Unmarshal(entities.Get(seq), &stored); err != nil {
+			return fmt.Errorf("could not decode entity: %w", err)
+		}
+		if err = checkVersion(stored, e.Version); err != nil {
+			return err
+		}
+		e.Version = stored.GetVersion() + 1
+
+		data, err := json.Marshal(e)
+		if err != nil {
+			return fmt.Errorf("could not encode entity: %w", err)
+		}
+
+		return entities.Put(seq, data)
+	})
+	if err != nil {
+		return Entity{}, fmt.Errorf("could not write entity to bolt: %w", err)
+	}
+
+	return e, nil
+}
+
+func (storage *boltStorage) List(ctx context.Context, serviceName string) ([]Entity, error) {
+	list, _, err := storage.ListPage(ctx, serviceName, "", 0)
+	return list, err
+}
+
+// ListPage returns entities in order of insertion starting after the cursor (ID of the last entity of previous page)
+func (storage *boltStorage) ListPage(_ context.Context, serviceName, cursor string, limit int) ([]Entity, string, error) {
+	list := []Entity{}
+	next := ""
+	err := storage.db.View(func(tx *bolt.Tx) error {
+		entities, ids, err := getBoltBuckets(tx, serviceName)
+		if err != nil {
+			return err
+		}
+
+		c := entities.Cursor()
+		k, v := c.First()
+		if cursor != "" {
+			seq := ids.Get([]byte(cursor))
+			if seq == nil {
+				return fmt.Errorf("could not find cursor entity %q", cursor)
+			}
+			// continue after the cursor entity
+			c.Seek(seq)
+			k, v = c.Next()
+		}
+
+		for ; k != nil; k, v = c.Next() {
+			if limit > 0 && len(list) == limit {
+				next = list[len(list)-1].Id
+				break
+			}
+
+			var e Entity
+			if err := json.Unmarshal(v, &e); err != nil {
+				return fmt.Errorf("could not decode entity: %w", err)
+			}
+			list = append(list, e)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return []Entity{}, "", fmt.Errorf("could not list entities from bolt: %w", err)
+	}
+
+	return list, next, nil
+}
+
+func (storage *boltStorage) Get(_ context.Context, serviceName, id string) (Entity, error) {
+	var e Entity
+	err := storage.db.View(func(tx *bolt.Tx) error {
+		entities, ids, err := getBoltBuckets(tx, serviceName)
+		if err != nil {
+			return err
+		}
+
+		seq := ids.Get([]byte(id))
+		if seq == nil {
+			return fmt.Errorf("%w: %q", errEntityNotFound, id)
+		}
+
+		return json.Unmarshal(entities.Get(seq), &e)
+	})
+
+	return e, err
+}
+
+func (storage *boltStorage) Delete(ctx context.Context, serviceName, id string) error {
+	return storage.DeleteVersion(ctx, serviceName, id, 0)
+}
+
+func (storage *boltStorage) DeleteVersion(_ context.Context, serviceName, id string, version int64) error {
+	return storage.db.Update(func(tx *bolt.Tx) error {
+		entities, ids, err := getBoltBuckets(tx, serviceName)
+		if err != nil {
+			return err
+		}
+
+		seq := ids.Get([]byte(id))
+		if seq == nil {
+			return fmt.Errorf("%w: %q", errEntityNotFound, id)
+		}
+		if version != 0 {
+			var stored Entity
+			if err = json.Unmarshal(entities.Get(seq), &stored); err != nil {
+				return fmt.Errorf("could not decode entity: %w", err)
+			}
+			if err = checkVersion(stored, version); err != nil {
+				return err
+			}
+		}
+		if err = entities.Delete(seq); err != nil {
+			return err
+		}
+
+		return ids.Delete([]byte(id))
+	})
+}
+
+// Health checks the database file is still writable
+func (storage *boltStorage) Health(_ context.Context) error {
+	return storage.db.Update(func(tx *bolt.Tx) error {
+		return nil
+	})
+}
+
+func (storage *boltStorage) Ready() bool {
+	return true
+}
+
+// Backup writes consistent copy of the whole database while the storage keeps serving requests
+func (storage *boltStorage) Backup(_ context.Context, w io.Writer) (int64, error) {
+	var size int64
+	err := storage.db.View(func(tx *bolt.Tx) error {
+		var err error
+		size, err = tx.WriteTo(w)
+		return err
+	})
+
+	return size, err
+}
+
+func (storage *boltStorage) Close() error {
+	return storage.db.Close()
+}
+
+func getBoltBuckets(tx *bolt.Tx, serviceName string) (*bolt.Bucket, *bolt.Bucket, error) {
+	b := tx.Bucket([]byte(serviceName))
+	if b == nil {
+		return nil, nil, fmt.Errorf("unknown service %q", serviceName)
+	}
+
+	return b.Bucket(boltEntitiesBucket), b.Bucket(boltIdsBucket), nil
+}
+
+func encodeBoltSequence(seq uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, seq)
+	return key
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBoltStorage(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("BOLT_FILE", filepath.Join(dir, "usa.db"))
+	ctx := context.Background()
+
+	s, err := CreateBoltStorage([]string{"dogs", "cats"})
+	assert.Nil(t, err)
+	assert.Nil(t, s.Health(ctx))
+
+	var ids []string
+	for i := 0; i < 5; i++ {
+		e, err := s.Add(ctx, "dogs", float64(i))
+		assert.Nil(t, err)
+		ids = append(ids, e.Id)
+	}
+	_, err = s.Add(ctx, "cats", "tom")
+	assert.Nil(t, err)
+
+	list, err := s.List(ctx, "dogs")
+	assert.Nil(t, err)
+	assert.Len(t, list, 5)
+	assert.Equal(t, float64(0), list[0].Payload)
+	assert.Equal(t, float64(4), list[4].Payload)
+
+	e, err := s.Get(ctx, "dogs", ids[2])
+	assert.Nil(t, err)
+	assert.Equal(t, float64(2), e.Payload)
+	_, err = s.Get(ctx, "cats", ids[2])
+	assert.Error(t, err)
+
+	assert.Nil(t, s.Delete(ctx, "dogs", ids[1]))
+	assert.Error(t, s.Delete(ctx, "dogs", ids[1]))
+
+	// paging
+	page, next, err := s.ListPage(ctx, "dogs", "", 2)
+	assert.Nil(t, err)
+	assert.Equal(t, []interface{}{float64(0), float64(2)}, []interface{}{page[0].Payload, page[1].Payload})
+	assert.Equal(t, ids[2], next)
+	page, next, err = s.ListPage(ctx, "dogs", next, 2)
+	assert.Nil(t, err)
+	assert.Len(t, page, 2)
+	assert.Equal(t, "", next)
+	_, _, err = s.ListPage(ctx, "dogs", "missing", 2)
+	assert.Error(t, err)
+	assert.ErrorIs(t, s.Insert(ctx, "dogs", e), errEntityExists)
+
+	// update keeps position of the entity
+	e.Payload = float64(20)
+	_, err = s.Update(ctx, "dogs", e)
+	assert.Nil(t, err)
+	_, err = s.Update(ctx, "dogs", e)
+	assert.ErrorIs(t, err, errVersionConflict)
+	assert.ErrorIs(t, s.DeleteVersion(ctx, "dogs", e.Id, e.Version), errVersionConflict)
+	page, _, err = s.ListPage(ctx, "dogs", "", 2)
+	assert.Nil(t, err)
+	assert.Equal(t, []interface{}{float64(0), float64(20)}, []interface{}{page[0].Payload, page[1].Payload})
+	_, err = s.Update(ctx, "dogs", Entity{Id: "missing"})
+	assert.ErrorIs(t, err, errEntityNotFound)
+
+	// online backup is a valid database
+	var backup bytes.Buffer
+	size, err := s.Backup(ctx, &backup)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(backup.Len()), size)
+	assert.Nil(t, s.Close())
+
+	backupFile := filepath.Join(dir, "backup.db")
+	assert.Nil(t, os.WriteFile(backupFile, backup.Bytes(), 0o600))
+	t.Setenv("BOLT_FILE", backupFile)
+	s, err = CreateBoltStorage([]string{"dogs", "cats"})
+	assert.Nil(t, err)
+	defer s.Close()
+
+	list, err = s.List(ctx, "dogs")
+	assert.Nil(t, err)
+	assert.Len(t, list, 4)
+}
+
+func TestListPageFallback(t *testing.T) {
+	ctx := context.Background()
+	s := CreateMemStorage([]string{"dogs"})
+	for i := 0; i < 3; i++ {
+		_, err := s.Add(ctx, "dogs", i)
+		assert.Nil(t, err)
+	}
+
+	page, next, err := listPage(ctx, s, "dogs", "", 2)
+	assert.Nil(t, err)
+	assert.Len(t, page, 2)
+	assert.Equal(t, page[1].Id, next)
+
+	page, next, err = listPage(ctx, s, "dogs", next, 2)
+	assert.Nil(t, err)
+	assert.Len(t, page, 1)
+	assert.Equal(t, 2, page[0].Payload)
+	assert.Equal(t, "", next)
+
+	_, _, err = listPage(ctx, s, "dogs", "missing", 2)
+	assert.Error(t, err)
+}
@@ -3,27 +3,44 @@ package main
 import (
 	"cloud.google.com/go/firestore"
 	"context"
+	"errors"
 	"fmt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"log"
 	"os"
+	"sort"
 	"time"
 )
 
-const createdKey = "usa-internal-created"
+const (
+	firestorePayloadKey = "payload"
+	firestoreMetaKey    = "usa"
+
+	// legacyCreatedKey was stored next to payload fields by older versions
+	legacyCreatedKey = "usa-internal-created"
+)
+
+const healthCheckCollection = "usa-internal-health"
 
 type firestoreStorage struct {
 	client           *firestore.Client
 	collectionPrefix string
+	timeout          time.Duration // timeout of one firestore operation
 }
 
-func CreateFirestoreStorage() (*firestoreStorage, error) {
+func CreateFirestoreStorage(ctx context.Context) (*firestoreStorage, error) {
 	googleProjectIdEnv := "GOOGLE_PROJECT_ID"
 	googleProjectId := os.Getenv(googleProjectIdEnv)
 	if googleProjectId == "" {
 		return nil, fmt.Errorf("could not find environment variable %q for firestore configuration", googleProjectIdEnv)
 	}
 
-	ctx := context.Background()
+	timeout, err := getTimeoutEnv("GOOGLE_FIRESTORE_TIMEOUT")
+	if err != nil {
+		return nil, err
+	}
+
 	client, err := firestore.NewClient(ctx, googleProjectId)
 
 	if value := os.Getenv("FIRESTORE_EMULATOR_HOST"); value != "" {
@@ -37,22 +54,76 @@ func CreateFirestoreStorage() (*firestoreStorage, error) {
 	return &firestoreStorage{
 		client:           client,
 		collectionPrefix: os.Getenv("GOOGLE_FIRESTORE_COLLECTION_PREFIX"),
+		timeout:          timeout,
 	}, nil
 }
 
-func (fs *firestoreStorage) Add(serviceName string, payload interface{}) (Entity, error) {
+func (fs *firestoreStorage) Add(ctx context.Context, serviceName string, payload interface{}) (Entity, error) {
 	e, err := createEntity(payload)
 	if err != nil {
 		return e, err
 	}
 
-	// store created value as part of payload
-	data, _ := payload.(map[string]interface{})
-	data[createdKey] = e.Created
+	// firestore stores timestamps with microsecond precision
+	e.Created = e.Created.Truncate(time.Microsecond)
+
+	if err = fs.Insert(ctx, serviceName, e); err != nil {
+		return Entity{}, err
+	}
+
+	return e, nil
+}
+
+func (fs *firestoreStorage) Insert(ctx context.Context, serviceName string, e Entity) error {
+	ctx, cancel := context.WithTimeout(ctx, fs.timeout)
+	defer cancel()
 
 	cn := fs.getCollectionName(serviceName)
-	ctx := context.Background()
-	_, err = fs.client.Collection(cn).Doc(e.Id).Set(ctx, payload)
+	_, err := fs.client.Collection(cn).Doc(e.Id).Create(ctx, encodeFirestoreDocument(e))
+	if status.Code(err) == codes.AlreadyExists {
+		return errEntityExists
+	}
+	if err != nil {
+		return fmt.Errorf("could not write data to firestore: %w", err)
+	}
+
+	return nil
+}
+
+// Update replaces payload of the document in a transaction, so created time of the entity is kept and its version
+// is checked and incremented atomically
+func (fs *firestoreStorage) Update(ctx context.Context, serviceName string, e Entity) (Entity, error) {
+	ctx, cancel := context.WithTimeout(ctx, fs.timeout)
+	defer cancel()
+
+	doc := fs.client.Collection(fs.getCollectionName(serviceName)).Doc(e.Id)
+	err := fs.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		snapshot, err := tx.Get(doc)
+		if status.Code(err) == codes.NotFound {
+			return fmt.Errorf("%w: %q", errEntityNotFound, e.Id)
+		}
+		if err != nil {
+			return err
+		}
+
+		stored, err := decodeFirestoreDocument(e.Id, snapshot.Data())
+		if err != nil {
+			return err
+		}
+		if err = checkVersion(stored, e.Version); err != nil {
+			return err
+		}
+
+		updated := time.Now().Truncate(time.Microsecond)
+		e.Version = stored.GetVersion() + 1
+		e.Updated = &updated
+		e.Owner = stored.Owner
+
+		return tx.Set(doc, encodeFirestoreDocument(e))
+	})
+	if errors.Is(err, errEntityNotFound) || errors.Is(err, errVersionConflict) {
+		return Entity{}, err
+	}
 	if err != nil {
 		return Entity{}, fmt.Errorf("could not write data to firestore: %w", err)
 	}
@@ -60,8 +131,10 @@ func (fs *firestoreStorage) Add(serviceName string, payload interface{}) (Entity
 	return e, nil
 }
 
-func (fs *firestoreStorage) List(serviceName string) ([]Entity, error) {
-	ctx := context.Background()
+func (fs *firestoreStorage) List(ctx context.Context, serviceName string) ([]Entity, error) {
+	ctx, cancel := context.WithTimeout(ctx, fs.timeout)
+	defer cancel()
+
 	cn := fs.getCollectionName(serviceName)
 	docs, err := fs.client.Collection(cn).
 		Documents(ctx).
@@ -72,50 +145,73 @@ func (fs *firestoreStorage) List(serviceName string) ([]Entity, error) {
 
 	entities := []Entity{}
 	for _, doc := range docs {
-		data := doc.Data()
-		created, ok := data[createdKey].(time.Time)
-		if !ok {
-			return []Entity{}, fmt.Errorf("could not decode created value")
+		e, err := decodeFirestoreDocument(doc.Ref.ID, doc.Data())
+		if err != nil {
+			return []Entity{}, err
 		}
-		delete(data, createdKey)
-
-		entities = append(entities, Entity{
-			Id:      doc.Ref.ID,
-			Created: created,
-			Payload: doc.Data(),
-		})
+		entities = append(entities, e)
 	}
 
+	sort.SliceStable(entities, func(i, j int) bool {
+		return entities[i].Created.Before(entities[j].Created)
+	})
+
 	return entities, nil
 }
 
-func (fs *firestoreStorage) Get(serviceName, id string) (Entity, error) {
-	ctx := context.Background()
+func (fs *firestoreStorage) Get(ctx context.Context, serviceName, id string) (Entity, error) {
+	ctx, cancel := context.WithTimeout(ctx, fs.timeout)
+	defer cancel()
+
 	cn := fs.getCollectionName(serviceName)
 	doc, err := fs.client.Collection(cn).Doc(id).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return Entity{}, fmt.Errorf("%w: %q", errEntityNotFound, id)
+	}
 	if err != nil {
 		return Entity{}, fmt.Errorf("could not find entity %q: %w", id, err)
 	}
 
-	data := doc.Data()
-	created, ok := data[createdKey].(time.Time)
-	if !ok {
-		return Entity{}, fmt.Errorf("could not decode created value")
-	}
-	delete(data, createdKey)
+	return decodeFirestoreDocument(doc.Ref.ID, doc.Data())
+}
 
-	return Entity{
-		Id:      doc.Ref.ID,
-		Created: created,
-		Payload: data,
-	}, nil
+func (fs *firestoreStorage) Delete(ctx context.Context, serviceName, id string) error {
+	return fs.DeleteVersion(ctx, serviceName, id, 0)
 }
 
-func (fs *firestoreStorage) Delete(serviceName, id string) error {
-	ctx := context.Background()
-	cn := fs.getCollectionName(serviceName)
-	_, err := fs.client.Collection(cn).Doc(id).Delete(ctx)
+// DeleteVersion checks version of the document in a transaction unless any version can be deleted
+func (fs *firestoreStorage) DeleteVersion(ctx context.Context, serviceName, id string, version int64) error {
+	ctx, cancel := context.WithTimeout(ctx, fs.timeout)
+	defer cancel()
+
+	doc := fs.client.Collection(fs.getCollectionName(serviceName)).Doc(id)
+	var err error
+	if version == 0 {
+		_, err = doc.Delete(ctx)
+	} else {
+		err = fs.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+			snapshot, err := tx.Get(doc)
+			if status.Code(err) == codes.NotFound {
+				return fmt.Errorf("%w: %q", errEntityNotFound, id)
+			}
+			if err != nil {
+				return err
+			}
 
+			stored, err := decodeFirestoreDocument(id, snapshot.Data())
+			if err != nil {
+				return err
+			}
+			if err = checkVersion(stored, version); err != nil {
+				return err
+			}
+
+			return tx.Delete(doc)
+		})
+	}
+	if errors.Is(err, errEntityNotFound) || errors.Is(err, errVersionConflict) {
+		return err
+	}
 	if err != nil {
 		return fmt.Errorf("could not delele entity %s: %w", id, err)
 	}
@@ -123,6 +219,95 @@ func (fs *firestoreStorage) Delete(serviceName, id string) error {
 	return nil
 }
 
+// Health pings firestore by reading a document which does not need to exist
+func (fs *firestoreStorage) Health(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, fs.timeout)
+	defer cancel()
+
+	cn := fs.getCollectionName(healthCheckCollection)
+	_, err := fs.client.Collection(cn).Doc("ping").Get(ctx)
+	if err != nil && status.Code(err) != codes.NotFound {
+		return fmt.Errorf("could not reach firestore: %w", err)
+	}
+
+	return nil
+}
+
+func (fs *firestoreStorage) Ready() bool {
+	return true
+}
+
 func (fs *firestoreStorage) getCollectionName(serviceName string) string {
 	return fmt.Sprintf("%s%s", fs.collectionPrefix, serviceName)
 }
+
+// encodeFirestoreDocument converts entity to firestore document; payload and metadata are stored in separate fields
+func encodeFirestoreDocument(e Entity) map[string]interface{} {
+	meta := map[string]interface{}{
+		"created": e.Created,
+		"version": e.GetVersion(),
+	}
+	if e.Updated != nil {
+		meta["updated"] = *e.Updated
+	}
+	if e.Owner != "" {
+		meta["owner"] = e.Owner
+	}
+	if e.ExpiresAt != nil {
+		meta["expires"] = *e.ExpiresAt
+	}
+
+	return map[string]interface{}{
+		firestorePayloadKey: e.Payload,
+		firestoreMetaKey:    meta,
+	}
+}
+
+// decodeFirestoreDocument converts firestore document to entity; documents written by older versions are supported
+func decodeFirestoreDocument(id string, data map[string]interface{}) (Entity, error) {
+	meta, ok := data[firestoreMetaKey].(map[string]interface{})
+	if !ok {
+		created, ok := data[legacyCreatedKey].(time.Time)
+		if !ok {
+			return Entity{}, fmt.Errorf("could not decode metadata of document %q", id)
+		}
+
+		payload := make(map[string]interface{}, len(data))
+		for k, v := range data {
+			if k != legacyCreatedKey {
+				payload[k] = v
+			}
+		}
+
+		return Entity{
+			Id:      id,
+			Created: created,
+			Payload: payload,
+		}, nil
+	}
+
+	created, ok := meta["created"].(time.Time)
+	if !ok {
+		return Entity{}, fmt.Errorf("could not decode created value of document %q", id)
+	}
+
+	e := Entity{
+		Id:      id,
+		Created: created,
+		Payload: data[firestorePayloadKey],
+	}
+	if version, ok := meta["version"].(int64); ok {
+		e.Version = version
+	}
+	if updated, ok := meta["updated"].(time.Time); ok {
+		e.Updated = &updated
+	}
+	if owner, ok := meta["owner"].(string); ok {
+		e.Owner = owner
+	}
+	if expires, ok := meta["expires"].(time.Time); ok {
+		e.ExpiresAt = &expires
+	}
+
+	return e, nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+	"time"
+)
+
+// samplePeoplePayload returns payload with all field types of people service from examples/sample.yml
+func samplePeoplePayload(t *testing.T) map[string]interface{} {
+	var payload map[string]interface{}
+	err := json.Unmarshal([]byte(`{
+		"firstname": "tomas",
+		"lastname": "kozak",
+		"email": "email@talko.cz",
+		"born": "1992/12/30",
+		"height": 180,
+		"family": {"daddy": "john", "mommy": "jane"},
+		"tags": [{"name": "a", "value": "b"}],
+		"nums": [5, 6.5e1]
+	}`), &payload)
+	assert.Nil(t, err)
+
+	cfg, err := ParseConfig("./examples/sample.yml", logrus.New())
+	assert.Nil(t, err)
+	service := Service{Cfg: cfg.ServiceConfigs[0]}
+	assert.Nil(t, service.Validate(context.Background(), payload))
+
+	return payload
+}
+
+func TestFirestoreCodec(t *testing.T) {
+	payload := samplePeoplePayload(t)
+	e := Entity{
+		Id:      "id",
+		Created: time.Date(2022, 5, 1, 10, 0, 0, 0, time.UTC),
+		Payload: payload,
+		Version: 3,
+	}
+
+	doc := encodeFirestoreDocument(e)
+	assert.NotContains(t, payload, firestoreMetaKey) // payload is not mutated
+
+	decoded, err := decodeFirestoreDocument("id", doc)
+	assert.Nil(t, err)
+	assert.Equal(t, e, decoded)
+
+	expiresAt := e.Created.Add(time.Hour)
+	expiring := e
+	expiring.ExpiresAt = &expiresAt
+	decoded, err = decodeFirestoreDocument("id", encodeFirestoreDocument(expiring))
+	assert.Nil(t, err)
+	assert.Equal(t, expiring, decoded)
+
+	updatedAt := e.Created.Add(time.Minute)
+	owned := e
+	owned.Updated = &updatedAt
+	owned.Owner = "alice"
+	decoded, err = decodeFirestoreDocument("id", encodeFirestoreDocument(owned))
+	assert.Nil(t, err)
+	assert.Equal(t, owned, decoded)
+
+	// document written by older version
+	legacy := map[string]interface{}{
+		"name":           "rex",
+		legacyCreatedKey: e.Created,
+	}
+	decoded, err = decodeFirestoreDocument("legacy", legacy)
+	assert.Nil(t, err)
+	assert.Equal(t, Entity{Id: "legacy", Created: e.Created, Payload: map[string]interface{}{"name": "rex"}}, decoded)
+
+	_, err = decodeFirestoreDocument("broken", map[string]interface{}{"name": "rex"})
+	assert.Error(t, err)
+}
+
+// TestFirestoreStorage runs against the firestore emulator only (FIRESTORE_EMULATOR_HOST)
+func TestFirestoreStorage(t *testing.T) {
+	if os.Getenv("FIRESTORE_EMULATOR_HOST") == "" {
+		t.Skip("FIRESTORE_EMULATOR_HOST is not set")
+	}
+	t.Setenv("GOOGLE_PROJECT_ID", "usa-test")
+	t.Setenv("GOOGLE_FIRESTORE_COLLECTION_PREFIX", fmt.Sprintf("test-%d-", time.Now().UnixNano()))
+
+	ctx := context.Background()
+	fs, err := CreateFirestoreStorage(ctx)
+	assert.Nil(t, err)
+	assert.Nil(t, fs.Health(ctx))
+
+	payload := samplePeoplePayload(t)
+	e, err := fs.Add(ctx, "people", payload)
+	assert.Nil(t, err)
+	assert.Equal(t, samplePeoplePayload(t), e.Payload) // payload is not mutated
+
+	found, err := fs.Get(ctx, "people", e.Id)
+	assert.Nil(t, err)
+	assert.Equal(t, e.Id, found.Id)
+	assert.True(t, e.Created.Equal(found.Created))
+	assert.Equal(t, payload, found.Payload)
+
+	list, err := fs.List(ctx, "people")
+	assert.Nil(t, err)
+	assert.Len(t, list, 1)
+	assert.Equal(t, payload, list[0].Payload)
+
+	found.Payload = map[string]interface{}{"name": "updated"}
+	_, err = fs.Update(ctx, "people", found)
+	assert.Nil(t, err)
+	updated, err := fs.Get(ctx, "people", e.Id)
+	assert.Nil(t, err)
+	assert.Equal(t, found.Payload, updated.Payload)
+	assert.Equal(t, int64(2), updated.Version)
+	assert.NotNil(t, updated.Updated)
+	_, err = fs.Update(ctx, "people", found)
+	assert.ErrorIs(t, err, errVersionConflict)
+	_, err = fs.Update(ctx, "people", Entity{Id: "missing"})
+	assert.ErrorIs(t, err, errEntityNotFound)
+
+	// update keeps the owner
+	assert.Nil(t, fs.Insert(ctx, "people", Entity{Id: "owned", Created: e.Created, Payload: payload, Owner: "alice"}))
+	_, err = fs.Update(ctx, "people", Entity{Id: "owned", Created: e.Created, Payload: found.Payload})
+	assert.Nil(t, err)
+	owned, err := fs.Get(ctx, "people", "owned")
+	assert.Nil(t, err)
+	assert.NotNil(t, owned.Updated)
+	assert.Equal(t, "alice", owned.Owner)
+
+	assert.ErrorIs(t, fs.DeleteVersion(ctx, "people", e.Id, 1), errVersionConflict)
+	assert.Nil(t, fs.DeleteVersion(ctx, "people", e.Id, 2))
+	_, err = fs.Get(ctx, "people", e.Id)
+	assert.Error(t, err)
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel/attribute"
+	"sync"
+	"time"
+)
+
+var (
+	storageOperationDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "usa_storage_operation_duration_seconds",
+		Help:    "Duration of storage operations.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"backend", "service", "operation"})
+
+	storageOperationErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "usa_storage_operation_errors_total",
+		Help: "Number of failed storage operations.",
+	}, []string{"backend", "service", "operation"})
+
+	storageEntities = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "usa_storage_entities",
+		Help: "Number of entities in the storage. Known after the first list operation of the service.",
+	}, []string{"backend", "service"})
+)
+
+// instrumentedStorage decorates any storage with prometheus metrics and tracing spans
+type instrumentedStorage struct {
+	backend string
+	next    Storage
+	counted sync.Map // services with number of entities set by list; the gauge is adjusted only for them
+}
+
+func InstrumentStorage(backend string, next Storage) Storage {
+	return &instrumentedStorage{
+		backend: backend,
+		next:    next,
+	}
+}
+
+// adjustEntities changes number of entities of the service once it is known
+func (storage *instrumentedStorage) adjustEntities(serviceName string, delta float64) {
+	if _, counted := storage.counted.Load(serviceName); counted {
+		storageEntities.WithLabelValues(storage.backend, serviceName).Add(delta)
+	}
+}
+
+// observe starts span for the operation and returns function which finishes the span and records metrics
+func (storage *instrumentedStorage) observe(ctx context.Context, serviceName, operation string, attrs ...attribute.KeyValue) (context.Context, func(error)) {
+	start := time.Now()
+	attrs = append(attrs,
+		attribute.String("usa.storage.backend", storage.backend),
+		attribute.String("usa.service", serviceName),
+	)
+	ctx, span := startSpan(ctx, "storage."+operation, attrs...)
+
+	return ctx, func(err error) {
+		storageOperationDuration.WithLabelValues(storage.backend, serviceName, operation).Observe(time.Since(start).Seconds())
+		if err != nil {
+			storageOperationErrors.WithLabelValues(storage.backend, serviceName, operation).Inc()
+		}
+		endSpan(span, err)
+	}
+}
+
+func (storage *instrumentedStorage) Add(ctx context.Context, serviceName string, payload interface{}) (Entity, error) {
+	ctx, done := storage.observe(ctx, serviceName, "add")
+	e, err := storage.next.Add(ctx, serviceName, payload)
+	done(err)
+	if err == nil {
+		storage.adjustEntities(serviceName, 1)
+	}
+
+	return e, err
+}
+
+func (storage *instrumentedStorage) Insert(ctx context.Context, serviceName string, e Entity) error {
+	ctx, done := storage.observe(ctx, serviceName, "insert", attribute.String("usa.entity.id", e.Id))
+	err := storage.next.Insert(ctx, serviceName, e)
+	done(err)
+	if err == nil {
+		storage.adjustEntities(serviceName, 1)
+	}
+
+	return err
+}
+
+func (storage *instrumentedStorage) Update(ctx context.Context, serviceName string, e Entity) (Entity, error) {
+	ctx, done := storage.observe(ctx, serviceName, "update", attribute.String("usa.entity.id", e.Id))
+	updated, err := storage.next.Update(ctx, serviceName, e)
+	done(err)
+
+	return updated, err
+}
+
+func (storage *instrumentedStorage) List(ctx context.Context, serviceName string) ([]Entity, error) {
+	ctx, done := storage.observe(ctx, serviceName, "list")
+	list, err := storage.next.List(ctx, serviceName)
+	done(err)
+	if err == nil {
+		storageEntities.WithLabelValues(storage.backend, serviceName).Set(float64(len(list)))
+		storage.counted.Store(serviceName, true)
+	}
+
+	return list, err
+}
+
+func (storage *instrumentedStorage) ListPage(ctx context.Context, serviceName, cursor string, limit int) ([]Entity, string, error) {
+	ctx, done := storage.observe(ctx, serviceName, "list_page")
+	list, next, err := listPage(ctx, storage.next, serviceName, cursor, limit)
+	done(err)
+
+	return list, next, err
+}
+
+func (storage *instrumentedStorage) Get(ctx context.Context, serviceName, id string) (Entity, error) {
+	ctx, done := storage.observe(ctx, serviceName, "get", attribute.String("usa.entity.id", id))
+	e, err := storage.next.Get(ctx, serviceName, id)
+	done(err)
+
+	return e, err
+}
+
+func (storage *instrumentedStorage) Delete(ctx context.Context, serviceName, id string) error {
+	ctx, done := storage.observe(ctx, serviceName, "delete", attribute.String("usa.entity.id", id))
+	err := storage.next.Delete(ctx, serviceName, id)
+	done(err)
+	if err == nil {
+		storage.adjustEntities(serviceName, -1)
+	}
+
+	return err
+}
+
+func (storage *instrumentedStorage) DeleteVersion(ctx context.Context, serviceName, id string, version int64) error {
+	ctx, done := storage.observe(ctx, serviceName, "delete", attribute.String("usa.entity.id", id))
+	err := storage.next.DeleteVersion(ctx, serviceName, id, version)
+	done(err)
+	if err == nil {
+		storage.adjustEntities(serviceName, -1)
+	}
+
+	return err
+}
+
+func (storage *instrumentedStorage) Health(ctx context.Context) error {
+	return storage.next.Health(ctx)
+}
+
+func (storage *instrumentedStorage) Ready() bool {
+	return storage.next.Ready()
+}
+
+func (storage *instrumentedStorage) Unwrap() Storage {
+	return storage.next
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"testing"
+)
+
+func TestInstrumentedStorage(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	otel.SetTracerProvider(provider)
+	defer otel.SetTracerProvider(sdktrace.NewTracerProvider())
+
+	serviceName := "instrumented"
+	s := InstrumentStorage("mem", CreateMemStorage([]string{serviceName}))
+	service := Service{Cfg: ServiceConfig{Name: serviceName}, Storage: s}
+	ctx := context.Background()
+
+	_, err := service.Put(ctx, map[string]interface{}{"name": "rex"}, nil)
+	assert.Nil(t, err)
+	_, err = service.Put(ctx, map[string]interface{}{"name": "max"}, nil)
+	assert.Nil(t, err)
+	// number of entities is unknown until the first list
+	assert.Equal(t, float64(0), testutil.ToFloat64(storageEntities.WithLabelValues("mem", serviceName)))
+	list, err := service.List(ctx)
+	assert.Nil(t, err)
+	assert.Len(t, list, 2)
+	assert.Equal(t, float64(2), testutil.ToFloat64(storageEntities.WithLabelValues("mem", serviceName)))
+
+	assert.Nil(t, service.Delete(ctx, list[0].Id, 0))
+	assert.Equal(t, float64(1), testutil.ToFloat64(storageEntities.WithLabelValues("mem", serviceName)))
+
+	_, err = service.Get(ctx, "missing")
+	assert.Error(t, err)
+	assert.Equal(t, float64(1), testutil.ToFloat64(storageOperationErrors.WithLabelValues("mem", serviceName, "get")))
+
+	// storage spans are children of service spans
+	spans := exporter.GetSpans()
+	assert.Len(t, spans, 10)
+	storageSpan, serviceSpan := spans[0], spans[1]
+	assert.Equal(t, "storage.insert", storageSpan.Name)
+	assert.Equal(t, "service.put", serviceSpan.Name)
+	assert.Equal(t, serviceSpan.SpanContext.SpanID(), storageSpan.Parent.SpanID())
+}
@@ -1,24 +1,31 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"sort"
+	"sync"
 )
 
 type memStorage struct {
 	services map[string][]Entity
+	ids      map[string]map[string]bool // IDs of entities of every service
+	mu       sync.RWMutex
 }
 
 func CreateMemStorage(serviceNames []string) *memStorage {
 	serviceMap := make(map[string][]Entity)
+	ids := make(map[string]map[string]bool)
 
 	for _, serviceName := range serviceNames {
 		serviceMap[serviceName] = []Entity{}
+		ids[serviceName] = make(map[string]bool)
 	}
 
-	return &memStorage{services: serviceMap}
+	return &memStorage{services: serviceMap, ids: ids}
 }
 
-func (storage *memStorage) Add(serviceName string, payload interface{}) (Entity, error) {
+func (storage *memStorage) Add(_ context.Context, serviceName string, payload interface{}) (Entity, error) {
 	e, err := createEntity(payload)
 	if err != nil {
 		return e, err
@@ -30,24 +37,164 @@ func (storage *memStorage) Add(serviceName string, payload interface{}) (Entity,
 }
 
 func (storage *memStorage) AddEntity(serviceName string, e Entity) {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
 	storage.services[serviceName] = append(storage.services[serviceName], e)
+	storage.getIds(serviceName)[e.Id] = true
+}
+
+func (storage *memStorage) Insert(_ context.Context, serviceName string, e Entity) error {
+	return storage.InsertEntity(serviceName, e)
+}
+
+// InsertEntity adds the entity to the position given by its created time unless an entity with the same ID exists
+func (storage *memStorage) InsertEntity(serviceName string, e Entity) error {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	if storage.getIds(serviceName)[e.Id] {
+		return errEntityExists
+	}
+	storage.insertSorted(serviceName, e)
+
+	return nil
+}
+
+// insertSorted adds the entity to the position given by its created time; caller must hold the lock
+func (storage *memStorage) insertSorted(serviceName string, e Entity) {
+	entities := storage.services[serviceName]
+	idx := sort.Search(len(entities), func(i int) bool {
+		return entities[i].Created.After(e.Created)
+	})
+	entities = append(entities, Entity{})
+	copy(entities[idx+1:], entities[idx:])
+	entities[idx] = e
+
+	storage.services[serviceName] = entities
+	storage.getIds(serviceName)[e.Id] = true
+}
+
+func (storage *memStorage) Update(_ context.Context, serviceName string, e Entity) (Entity, error) {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	for k, entity := range storage.services[serviceName] {
+		if entity.Id == e.Id {
+			if err := checkVersion(entity, e.Version); err != nil {
+				return Entity{}, err
+			}
+			e.Version = entity.GetVersion() + 1
+			storage.services[serviceName][k] = e
+			return e, nil
+		}
+	}
+
+	return Entity{}, fmt.Errorf("%w: %q", errEntityNotFound, e.Id)
+}
+
+// UpdateEntity replaces the entity with the same ID as it is (e.g. when an update is replayed)
+func (storage *memStorage) UpdateEntity(serviceName string, e Entity) error {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	for k, entity := range storage.services[serviceName] {
+		if entity.Id == e.Id {
+			storage.services[serviceName][k] = e
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%w: %q", errEntityNotFound, e.Id)
+}
+
+// ReplaceEntity replaces entity with the same ID or adds a new one ordered by created time
+func (storage *memStorage) ReplaceEntity(serviceName string, e Entity) {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	for k, entity := range storage.services[serviceName] {
+		if entity.Id == e.Id {
+			storage.services[serviceName][k] = e
+			return
+		}
+	}
+
+	storage.insertSorted(serviceName, e)
+}
+
+// getVersion returns the entity when it has given version (any version when 0)
+func (storage *memStorage) getVersion(serviceName, id string, version int64) (Entity, error) {
+	e, err := storage.Get(context.Background(), serviceName, id)
+	if err != nil {
+		return Entity{}, err
+	}
+
+	return e, checkVersion(e, version)
+}
+
+// hasEntity reports whether the service contains entity with the ID
+func (storage *memStorage) hasEntity(serviceName, id string) bool {
+	storage.mu.RLock()
+	defer storage.mu.RUnlock()
+
+	return storage.ids[serviceName][id]
+}
+
+// getIds returns IDs of entities of the service; caller must hold the lock
+func (storage *memStorage) getIds(serviceName string) map[string]bool {
+	ids, found := storage.ids[serviceName]
+	if !found {
+		ids = make(map[string]bool)
+		storage.ids[serviceName] = ids
+	}
+
+	return ids
 }
 
-func (storage *memStorage) List(serviceName string) ([]Entity, error) {
-	return storage.services[serviceName], nil
+// sortByCreated orders entities of the service from the oldest one
+func (storage *memStorage) sortByCreated(serviceName string) {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	entities := storage.services[serviceName]
+	sort.SliceStable(entities, func(i, j int) bool {
+		return entities[i].Created.Before(entities[j].Created)
+	})
+}
+
+// List returns a copy of entities of the service so the caller is not affected by later changes
+func (storage *memStorage) List(_ context.Context, serviceName string) ([]Entity, error) {
+	storage.mu.RLock()
+	defer storage.mu.RUnlock()
+
+	entities := make([]Entity, len(storage.services[serviceName]))
+	copy(entities, storage.services[serviceName])
+
+	return entities, nil
 }
 
-func (storage *memStorage) Get(serviceName, id string) (Entity, error) {
+func (storage *memStorage) Get(_ context.Context, serviceName, id string) (Entity, error) {
+	storage.mu.RLock()
+	defer storage.mu.RUnlock()
+
 	for _, entity := range storage.services[serviceName] {
 		if entity.Id == id {
 			return entity, nil
 		}
 	}
 
-	return Entity{}, fmt.Errorf("could not find entity with id %q", id)
+	return Entity{}, fmt.Errorf("%w: %q", errEntityNotFound, id)
+}
+
+func (storage *memStorage) Delete(ctx context.Context, serviceName, id string) error {
+	return storage.DeleteVersion(ctx, serviceName, id, 0)
 }
 
-func (storage *memStorage) Delete(serviceName, id string) error {
+func (storage *memStorage) DeleteVersion(_ context.Context, serviceName, id string, version int64) error {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
 	// find ID
 	idx := 0
 	found := false
@@ -59,11 +206,23 @@ func (storage *memStorage) Delete(serviceName, id string) error {
 	}
 
 	if !found {
-		return fmt.Errorf("could not find id %q in entity list", id)
+		return fmt.Errorf("%w: %q", errEntityNotFound, id)
+	}
+	if err := checkVersion(storage.services[serviceName][idx], version); err != nil {
+		return err
 	}
 
 	// delete ID from list
 	storage.services[serviceName] = append(storage.services[serviceName][:idx], storage.services[serviceName][idx+1:]...)
+	delete(storage.ids[serviceName], id)
 
 	return nil
 }
+
+func (storage *memStorage) Health(_ context.Context) error {
+	return nil
+}
+
+func (storage *memStorage) Ready() bool {
+	return true
+}
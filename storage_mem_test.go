@@ -1,32 +1,35 @@
 package main
 
 import (
+	"context"
 	"github.com/stretchr/testify/assert"
 	"testing"
+	"time"
 )
 
 func TestMemStorage(t *testing.T) {
 	firstServiceName := "first_service"
 	secondServiceName := "second_service"
 	s := CreateMemStorage([]string{firstServiceName, secondServiceName})
+	ctx := context.Background()
 
 	// add 3 items first service
 	var err error
-	_, err = s.Add(firstServiceName, 1)
+	_, err = s.Add(ctx, firstServiceName, 1)
 	assert.Nil(t, err)
-	_, err = s.Add(firstServiceName, 2)
+	_, err = s.Add(ctx, firstServiceName, 2)
 	assert.Nil(t, err)
-	_, err = s.Add(firstServiceName, 3)
+	_, err = s.Add(ctx, firstServiceName, 3)
 	assert.Nil(t, err)
 
 	// add 2 items second service
-	_, err = s.Add(secondServiceName, 1)
+	_, err = s.Add(ctx, secondServiceName, 1)
 	assert.Nil(t, err)
-	_, err = s.Add(secondServiceName, 2)
+	_, err = s.Add(ctx, secondServiceName, 2)
 	assert.Nil(t, err)
 
 	// get list and check length
-	list, err := s.List(firstServiceName)
+	list, err := s.List(ctx, firstServiceName)
 	assert.Nil(t, err)
 	assert.Len(t, list, 3)
 
@@ -36,7 +39,50 @@ func TestMemStorage(t *testing.T) {
 	assert.Equal(t, list[2].Payload, 3)
 
 	// delete 2 from list
-	assert.Nil(t, s.Delete(firstServiceName, list[1].Id))
+	assert.Nil(t, s.Delete(ctx, firstServiceName, list[1].Id))
+	list, err = s.List(ctx, firstServiceName)
+	assert.Nil(t, err)
+	assert.Len(t, list, 2)
 	assert.Equal(t, list[0].Payload, 1)
 	assert.Equal(t, list[1].Payload, 3)
 }
+
+func TestMemStorageInsert(t *testing.T) {
+	s := CreateMemStorage([]string{"dogs"})
+	ctx := context.Background()
+
+	now := time.Now()
+	for _, e := range []Entity{
+		{Id: "b", Created: now, Payload: 2},
+		{Id: "c", Created: now.Add(time.Second), Payload: 3},
+		{Id: "a", Created: now.Add(-time.Second), Payload: 1},
+	} {
+		assert.Nil(t, s.Insert(ctx, "dogs", e))
+	}
+	assert.ErrorIs(t, s.Insert(ctx, "dogs", Entity{Id: "a"}), errEntityExists)
+
+	// entities are ordered by created time
+	list, err := s.List(ctx, "dogs")
+	assert.Nil(t, err)
+	assert.Equal(t, []interface{}{1, 2, 3}, []interface{}{list[0].Payload, list[1].Payload, list[2].Payload})
+
+	// deleted ID can be used again
+	assert.Nil(t, s.Delete(ctx, "dogs", "a"))
+	assert.Nil(t, s.Insert(ctx, "dogs", Entity{Id: "a", Created: now, Payload: 1}))
+
+	// update replaces the entity in place
+	_, err = s.Update(ctx, "dogs", Entity{Id: "c", Created: now.Add(time.Second), Payload: 4})
+	assert.Nil(t, err)
+	e, err := s.Get(ctx, "dogs", "c")
+	assert.Nil(t, err)
+	assert.Equal(t, 4, e.Payload)
+	assert.Equal(t, int64(2), e.Version)
+	_, err = s.Update(ctx, "dogs", Entity{Id: "c", Payload: 5, Version: 1})
+	assert.ErrorIs(t, err, errVersionConflict)
+	assert.ErrorIs(t, s.DeleteVersion(ctx, "dogs", "c", 1), errVersionConflict)
+	assert.Nil(t, s.DeleteVersion(ctx, "dogs", "c", 2))
+	_, err = s.Update(ctx, "dogs", Entity{Id: "missing"})
+	assert.ErrorIs(t, err, errEntityNotFound)
+	_, err = s.Get(ctx, "dogs", "missing")
+	assert.ErrorIs(t, err, errEntityNotFound)
+}
@@ -0,0 +1,565 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	memWalOpAdd    = "add"
+	memWalOpUpdate = "update"
+	memWalOpDelete = "delete"
+
+	memWalFsyncAlways   = "always"   // every operation is synced before it is confirmed
+	memWalFsyncInterval = "interval" // operations are synced periodically, last interval can be lost on power failure
+	memWalFsyncNever    = "never"    // syncing is left to the operating system
+
+	memWalPrefix      = "wal-"
+	memWalSuffix      = ".log"
+	memSnapshotPrefix = "snapshot-"
+	memSnapshotSuffix = ".ndjson"
+
+	defaultMemWalFsyncInterval = time.Second
+	defaultMemSnapshotInterval = 10 * time.Minute
+)
+
+// walMemStorage is mem storage which appends every write operation to a write-ahead log before it is applied.
+// Snapshot with all entities is written periodically and on close; a new log is started with every snapshot.
+// On startup the latest snapshot is loaded and newer logs are replayed.
+type walMemStorage struct {
+	*memStorage
+	dir              string
+	fsync            string
+	fsyncInterval    time.Duration
+	snapshotInterval time.Duration
+	logger           *logrus.Logger
+
+	mu     sync.Mutex // serializes writes to the log
+	file   *os.File   // current log
+	seq    int64      // sequence number of the current log
+	size   int64      // size of valid data in the current log
+	ops    int        // operations written since the last snapshot
+	dirty  bool       // the log was written since the last sync
+	err    error      // failure of background sync reported by health check
+	failed bool       // partially written operation could not be removed, err is kept and writes are refused
+
+	stop context.CancelFunc
+	wg   sync.WaitGroup
+}
+
+type memWalOp struct {
+	Op      string  `json:"op"`
+	Service string  `json:"service"`
+	Entity  *Entity `json:"entity,omitempty"`
+	Id      string  `json:"id,omitempty"`
+}
+
+func CreateWalMemStorage(ctx context.Context, serviceNames []string, logger *logrus.Logger) (*walMemStorage, error) {
+	dir := os.Getenv("MEM_WAL_DIR")
+	if dir == "" {
+		return nil, fmt.Errorf("could not find environment variable %q for mem wal configuration", "MEM_WAL_DIR")
+	}
+
+	fsync := os.Getenv("MEM_WAL_FSYNC")
+	switch fsync {
+	case "":
+		fsync = memWalFsyncInterval
+	case memWalFsyncAlways, memWalFsyncInterval, memWalFsyncNever:
+	default:
+		return nil, fmt.Errorf("invalid fsync policy %q in environment variable %q", fsync, "MEM_WAL_FSYNC")
+	}
+
+	fsyncInterval := defaultMemWalFsyncInterval
+	if value := os.Getenv("MEM_WAL_FSYNC_INTERVAL"); value != "" {
+		var err error
+		fsyncInterval, err = time.ParseDuration(value)
+		if err != nil || fsyncInterval <= 0 {
+			return nil, fmt.Errorf("invalid fsync interval %q in environment variable %q", value, "MEM_WAL_FSYNC_INTERVAL")
+		}
+	}
+
+	snapshotInterval := defaultMemSnapshotInterval
+	if value := os.Getenv("MEM_SNAPSHOT_INTERVAL"); value != "" {
+		var err error
+		snapshotInterval, err = time.ParseDuration(value)
+		if err != nil || snapshotInterval <= 0 {
+			return nil, fmt.Errorf("invalid snapshot interval %q in environment variable %q", value, "MEM_SNAPSHOT_INTERVAL")
+		}
+	}
+
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("could not create mem wal directory: %w", err)
+	}
+
+	storage := &walMemStorage{
+		memStorage:       CreateMemStorage(serviceNames),
+		dir:              dir,
+		fsync:            fsync,
+		fsyncInterval:    fsyncInterval,
+		snapshotInterval: snapshotInterval,
+		logger:           logger,
+	}
+	if err := storage.load(); err != nil {
+		return nil, err
+	}
+
+	ctx, storage.stop = context.WithCancel(ctx)
+	storage.wg.Add(1)
+	go func() {
+		defer storage.wg.Done()
+		storage.runBackground(ctx)
+	}()
+
+	return storage, nil
+}
+
+// load reads the latest snapshot, replays newer logs and opens the last log for writing
+func (storage *walMemStorage) load() error {
+	snapshots, logs, err := storage.listFiles()
+	if err != nil {
+		return err
+	}
+
+	var snapshotSeq int64
+	entities := 0
+	if len(snapshots) > 0 {
+		snapshotSeq = snapshots[len(snapshots)-1]
+		_, entities, err = readMemWalFile(storage.getSnapshotPath(snapshotSeq), false, func(op memWalOp) {
+			storage.memStorage.AddEntity(op.Service, *op.Entity) // snapshot is ordered by created time
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	// logs included in the snapshot are leftovers of interrupted snapshot
+	var replay []int64
+	for _, seq := range logs {
+		if seq > snapshotSeq {
+			replay = append(replay, seq)
+		}
+	}
+
+	storage.seq = snapshotSeq + 1
+	for k, seq := range replay {
+		last := k == len(replay)-1
+		size, count, err := readMemWalFile(storage.getLogPath(seq), last, storage.applyOp)
+		if err != nil {
+			return err
+		}
+		storage.ops += count
+		if last {
+			storage.seq, storage.size = seq, size
+		}
+	}
+
+	file, err := os.OpenFile(storage.getLogPath(storage.seq), os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("could not open mem wal: %w", err)
+	}
+	// incomplete operation at the end of the log was never confirmed
+	if err = file.Truncate(storage.size); err == nil {
+		_, err = file.Seek(storage.size, io.SeekStart)
+	}
+	if err != nil {
+		_ = file.Close()
+		return fmt.Errorf("could not open mem wal: %w", err)
+	}
+	storage.file = file
+
+	storage.logger.Infof("mem storage: %d entities loaded from snapshot, %d operations replayed from %d log(s) in %q", entities, storage.ops, len(replay), storage.dir)
+
+	return nil
+}
+
+// listFiles returns sequence numbers of snapshots and logs ordered from the oldest
+func (storage *walMemStorage) listFiles() ([]int64, []int64, error) {
+	entries, err := os.ReadDir(storage.dir)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not read mem wal directory: %w", err)
+	}
+
+	var snapshots, logs []int64
+	for _, entry := range entries {
+		if seq, ok := parseMemWalName(entry.Name(), memSnapshotPrefix, memSnapshotSuffix); ok {
+			snapshots = append(snapshots, seq)
+		} else if seq, ok = parseMemWalName(entry.Name(), memWalPrefix, memWalSuffix); ok {
+			logs = append(logs, seq)
+		}
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i] < snapshots[j] })
+	sort.Slice(logs, func(i, j int) bool { return logs[i] < logs[j] })
+
+	return snapshots, logs, nil
+}
+
+// readMemWalFile calls fn for every operation of the file and returns size of valid data and number of operations.
+// Incomplete last line is allowed only in the last log, it is a write interrupted by a crash.
+func readMemWalFile(filename string, allowIncomplete bool, fn func(op memWalOp)) (int64, int, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return 0, 0, fmt.Errorf("could not open %q: %w", filename, err)
+	}
+	defer file.Close()
+
+	var size int64
+	count := 0
+	reader := bufio.NewReaderSize(file, 64*1024)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF && len(line) > 0 && allowIncomplete {
+			return size, count, nil
+		}
+		if err == io.EOF && len(line) == 0 {
+			return size, count, nil
+		}
+		if err == io.EOF {
+			err = errors.New("incomplete operation")
+		}
+		if err != nil {
+			return size, count, fmt.Errorf("could not read operation %d of %q: %w", count+1, filename, err)
+		}
+
+		var op memWalOp
+		err = json.Unmarshal(line, &op)
+		if err == nil && (op.Op == memWalOpAdd || op.Op == memWalOpUpdate) && op.Entity == nil {
+			err = errors.New("missing entity")
+		}
+		if err != nil {
+			return size, count, fmt.Errorf("could not decode operation %d of %q: %w", count+1, filename, err)
+		}
+
+		fn(op)
+		size += int64(len(line))
+		count++
+	}
+}
+
+func (storage *walMemStorage) applyOp(op memWalOp) {
+	switch op.Op {
+	case memWalOpAdd:
+		_ = storage.memStorage.InsertEntity(op.Service, *op.Entity) // entities are kept ordered by created time
+	case memWalOpUpdate:
+		_ = storage.memStorage.UpdateEntity(op.Service, *op.Entity)
+	case memWalOpDelete:
+		_ = storage.memStorage.Delete(context.Background(), op.Service, op.Id) // already deleted entity is fine
+	}
+}
+
+// appendOp writes the operation to the log and applies it; caller must hold the lock
+func (storage *walMemStorage) appendOp(op memWalOp) error {
+	data, err := json.Marshal(op)
+	if err != nil {
+		return fmt.Errorf("could not encode mem wal operation: %w", err)
+	}
+	data = append(data, '\n')
+
+	if storage.failed {
+		return fmt.Errorf("mem wal refuses writes: %w", storage.err)
+	}
+
+	if _, err = storage.file.Write(data); err == nil && storage.fsync == memWalFsyncAlways {
+		err = storage.file.Sync()
+	}
+	if err != nil {
+		// partially written operation would break following operations
+		truncateErr := storage.file.Truncate(storage.size)
+		if truncateErr == nil {
+			_, truncateErr = storage.file.Seek(storage.size, io.SeekStart)
+		}
+		if truncateErr != nil {
+			storage.failed = true
+			storage.err = fmt.Errorf("mem wal contains partially written operation: %w", truncateErr)
+			storage.logger.WithError(storage.err).Error("mem wal refuses further writes")
+		}
+		return fmt.Errorf("could not write mem wal: %w", err)
+	}
+
+	storage.size += int64(len(data))
+	storage.ops++
+	storage.dirty = storage.fsync == memWalFsyncInterval
+	storage.applyOp(op)
+
+	return nil
+}
+
+func (storage *walMemStorage) Add(ctx context.Context, serviceName string, payload interface{}) (Entity, error) {
+	e, err := createEntity(payload)
+	if err != nil {
+		return e, err
+	}
+
+	if err = storage.Insert(ctx, serviceName, e); err != nil {
+		return Entity{}, err
+	}
+
+	return e, nil
+}
+
+func (storage *walMemStorage) Insert(_ context.Context, serviceName string, e Entity) error {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	if storage.memStorage.hasEntity(serviceName, e.Id) {
+		return errEntityExists
+	}
+
+	return storage.appendOp(memWalOp{Op: memWalOpAdd, Service: serviceName, Entity: &e})
+}
+
+func (storage *walMemStorage) Update(_ context.Context, serviceName string, e Entity) (Entity, error) {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	current, err := storage.memStorage.getVersion(serviceName, e.Id, e.Version)
+	if err != nil {
+		return Entity{}, err
+	}
+	e.Version = current.GetVersion() + 1
+
+	if err = storage.appendOp(memWalOp{Op: memWalOpUpdate, Service: serviceName, Entity: &e}); err != nil {
+		return Entity{}, err
+	}
+
+	return e, nil
+}
+
+func (storage *walMemStorage) Delete(ctx context.Context, serviceName, id string) error {
+	return storage.DeleteVersion(ctx, serviceName, id, 0)
+}
+
+func (storage *walMemStorage) DeleteVersion(_ context.Context, serviceName, id string, version int64) error {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	if _, err := storage.memStorage.getVersion(serviceName, id, version); err != nil {
+		return err
+	}
+
+	return storage.appendOp(memWalOp{Op: memWalOpDelete, Service: serviceName, Id: id})
+}
+
+func (storage *walMemStorage) Health(_ context.Context) error {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	return storage.err
+}
+
+// runBackground syncs the log and writes snapshots periodically until the context is canceled
+func (storage *walMemStorage) runBackground(ctx context.Context) {
+	snapshotTicker := time.NewTicker(storage.snapshotInterval)
+	defer snapshotTicker.Stop()
+
+	var syncTick <-chan time.Time
+	if storage.fsync == memWalFsyncInterval {
+		syncTicker := time.NewTicker(storage.fsyncInterval)
+		defer syncTicker.Stop()
+		syncTick = syncTicker.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-syncTick:
+			storage.sync()
+		case <-snapshotTicker.C:
+			if err := storage.snapshot(); err != nil {
+				storage.logger.WithError(err).Error("could not write mem snapshot")
+			}
+		}
+	}
+}
+
+func (storage *walMemStorage) sync() {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	if !storage.dirty || storage.failed {
+		return
+	}
+
+	storage.err = storage.file.Sync()
+	if storage.err != nil {
+		storage.logger.WithError(storage.err).Error("could not sync mem wal")
+		return
+	}
+	storage.dirty = false
+}
+
+// snapshot starts a new log and writes all entities to a snapshot, then logs included in the snapshot are removed
+func (storage *walMemStorage) snapshot() error {
+	storage.mu.Lock()
+	if storage.ops == 0 {
+		storage.mu.Unlock()
+		return nil // nothing changed since the last snapshot
+	}
+
+	seq := storage.seq
+	if err := storage.rotate(); err != nil {
+		storage.mu.Unlock()
+		return err
+	}
+	ops := storage.ops
+	storage.ops = 0
+	services := storage.copyServices()
+	storage.mu.Unlock()
+
+	count, err := storage.writeSnapshot(seq, services)
+	if err != nil {
+		storage.mu.Lock()
+		storage.ops += ops // the next snapshot has to include the operations
+		storage.mu.Unlock()
+		return err
+	}
+
+	snapshots, logs, err := storage.listFiles()
+	if err != nil {
+		return err
+	}
+	for _, old := range snapshots {
+		if old < seq {
+			_ = os.Remove(storage.getSnapshotPath(old))
+		}
+	}
+	removed := 0
+	for _, old := range logs {
+		if old <= seq {
+			_ = os.Remove(storage.getLogPath(old))
+			removed++
+		}
+	}
+
+	storage.logger.Infof("mem storage: snapshot with %d entities written, %d log(s) removed", count, removed)
+
+	return nil
+}
+
+// rotate syncs and closes the current log and starts a new one; caller must hold the lock
+func (storage *walMemStorage) rotate() error {
+	file, err := os.OpenFile(storage.getLogPath(storage.seq+1), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return fmt.Errorf("could not create mem wal: %w", err)
+	}
+
+	if err = storage.file.Sync(); err != nil {
+		_ = file.Close()
+		return fmt.Errorf("could not sync mem wal: %w", err)
+	}
+	_ = storage.file.Close()
+
+	storage.file = file
+	storage.seq++
+	storage.size = 0
+	storage.dirty = false
+
+	return nil
+}
+
+// copyServices returns copy of entities of all services, so the snapshot can be written without the lock
+func (storage *walMemStorage) copyServices() map[string][]Entity {
+	storage.memStorage.mu.RLock()
+	defer storage.memStorage.mu.RUnlock()
+
+	services := make(map[string][]Entity, len(storage.memStorage.services))
+	for serviceName, entities := range storage.memStorage.services {
+		services[serviceName] = append([]Entity(nil), entities...)
+	}
+
+	return services
+}
+
+// writeSnapshot writes snapshot including all logs up to the sequence number; it is renamed only when complete
+func (storage *walMemStorage) writeSnapshot(seq int64, services map[string][]Entity) (int, error) {
+	tmp := storage.getSnapshotPath(seq) + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return 0, fmt.Errorf("could not create mem snapshot: %w", err)
+	}
+	defer os.Remove(tmp)
+
+	serviceNames := make([]string, 0, len(services))
+	for serviceName := range services {
+		serviceNames = append(serviceNames, serviceName)
+	}
+	sort.Strings(serviceNames)
+
+	count := 0
+	writer := bufio.NewWriter(file)
+	encoder := json.NewEncoder(writer)
+	for _, serviceName := range serviceNames {
+		for k := range services[serviceName] {
+			if err = encoder.Encode(memWalOp{Op: memWalOpAdd, Service: serviceName, Entity: &services[serviceName][k]}); err != nil {
+				break
+			}
+			count++
+		}
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return 0, fmt.Errorf("could not write mem snapshot: %w", err)
+	}
+
+	if err = os.Rename(tmp, storage.getSnapshotPath(seq)); err != nil {
+		return 0, fmt.Errorf("could not write mem snapshot: %w", err)
+	}
+
+	return count, nil
+}
+
+// Close stops background operations, writes the final snapshot and closes the log
+func (storage *walMemStorage) Close() error {
+	storage.stop()
+	storage.wg.Wait()
+
+	err := storage.snapshot()
+
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+	if syncErr := storage.file.Sync(); err == nil {
+		err = syncErr
+	}
+	if closeErr := storage.file.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+func (storage *walMemStorage) getLogPath(seq int64) string {
+	return filepath.Join(storage.dir, fmt.Sprintf("%s%020d%s", memWalPrefix, seq, memWalSuffix))
+}
+
+func (storage *walMemStorage) getSnapshotPath(seq int64) string {
+	return filepath.Join(storage.dir, fmt.Sprintf("%s%020d%s", memSnapshotPrefix, seq, memSnapshotSuffix))
+}
+
+func parseMemWalName(name, prefix, suffix string) (int64, bool) {
+	if !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, suffix) {
+		return 0, false
+	}
+	seq, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(name, prefix), suffix), 10, 64)
+
+	return seq, err == nil
+}
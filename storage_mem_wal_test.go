@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func createTestWalMemStorage(t *testing.T, dir string) *walMemStorage {
+	t.Setenv("MEM_WAL_DIR", dir)
+	s, err := CreateWalMemStorage(context.Background(), []string{"dogs", "cats"}, logrus.New())
+	assert.Nil(t, err)
+
+	return s
+}
+
+func TestWalMemStorage(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	t.Setenv("MEM_WAL_FSYNC", memWalFsyncAlways)
+
+	s := createTestWalMemStorage(t, dir)
+	var ids []string
+	for i := 0; i < 3; i++ {
+		e, err := s.Add(ctx, "dogs", map[string]interface{}{"age": float64(i)})
+		assert.Nil(t, err)
+		ids = append(ids, e.Id)
+	}
+	old := Entity{Id: "old", Created: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), Payload: "old", Version: 1}
+	assert.Nil(t, s.Insert(ctx, "cats", old))
+	assert.ErrorIs(t, s.Insert(ctx, "cats", old), errEntityExists)
+	old.Payload = "updated"
+	updated, err := s.Update(ctx, "cats", old)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), updated.Version)
+	_, err = s.Update(ctx, "cats", old)
+	assert.ErrorIs(t, err, errVersionConflict)
+	assert.ErrorIs(t, s.DeleteVersion(ctx, "cats", "old", 1), errVersionConflict)
+	old.Version = 2
+	assert.Nil(t, s.Delete(ctx, "dogs", ids[1]))
+	assert.Error(t, s.Delete(ctx, "dogs", ids[1]))
+	assert.Nil(t, s.Health(ctx))
+	expected, _ := s.List(ctx, "dogs")
+	expected = append([]Entity(nil), expected...)
+
+	// the log is replayed without snapshot when the storage was not closed
+	s.stop()
+	s.wg.Wait()
+	assert.Nil(t, s.file.Close())
+	s = createTestWalMemStorage(t, dir)
+	list, _ := s.List(ctx, "dogs")
+	assert.Equal(t, len(expected), len(list))
+	for k := range expected {
+		assert.Equal(t, expected[k].Id, list[k].Id)
+		assert.True(t, expected[k].Created.Equal(list[k].Created))
+	}
+	e, err := s.Get(ctx, "cats", "old")
+	assert.Nil(t, err)
+	assert.Equal(t, old, e)
+	assert.Nil(t, s.Close())
+
+	// close writes a snapshot and starts a new log
+	snapshots, logs, err := s.listFiles()
+	assert.Nil(t, err)
+	assert.Len(t, snapshots, 1)
+	assert.Equal(t, []int64{snapshots[0] + 1}, logs)
+
+	s = createTestWalMemStorage(t, dir)
+	list, _ = s.List(ctx, "dogs")
+	assert.Equal(t, []string{ids[0], ids[2]}, []string{list[0].Id, list[1].Id})
+	_, err = s.Add(ctx, "dogs", "after snapshot")
+	assert.Nil(t, err)
+	assert.Nil(t, s.Close())
+
+	s = createTestWalMemStorage(t, dir)
+	list, _ = s.List(ctx, "dogs")
+	assert.Len(t, list, 3)
+	assert.Nil(t, s.Close())
+}
+
+func TestWalMemStorageCorruptLog(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	s := createTestWalMemStorage(t, dir)
+	_, err := s.Add(ctx, "dogs", "rex")
+	assert.Nil(t, err)
+	logPath := s.getLogPath(s.seq)
+
+	// operation interrupted by a crash is ignored and removed from the log
+	file, err := os.OpenFile(logPath, os.O_APPEND|os.O_WRONLY, 0o600)
+	assert.Nil(t, err)
+	_, err = file.WriteString(`{"op":"add","service":"dogs","ent`)
+	assert.Nil(t, err)
+	assert.Nil(t, file.Close())
+
+	s = createTestWalMemStorage(t, dir)
+	_, err = s.Add(ctx, "dogs", "max")
+	assert.Nil(t, err)
+	list, _ := s.List(ctx, "dogs")
+	assert.Len(t, list, 2)
+
+	// corrupt operation in the middle of the log is refused
+	data, err := os.ReadFile(logPath)
+	assert.Nil(t, err)
+	assert.Nil(t, os.WriteFile(logPath, append([]byte("{broken}\n"), data...), 0o600))
+	t.Setenv("MEM_WAL_DIR", dir)
+	_, err = CreateWalMemStorage(ctx, []string{"dogs"}, logrus.New())
+	assert.Contains(t, err.Error(), "could not decode operation 1")
+
+	t.Setenv("MEM_WAL_DIR", filepath.Join(dir, "other"))
+	t.Setenv("MEM_WAL_FSYNC", "sometimes")
+	_, err = CreateWalMemStorage(ctx, []string{"dogs"}, logrus.New())
+	assert.Error(t, err)
+}
+
+func TestWalMemStorageFailedWrite(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	s := createTestWalMemStorage(t, dir)
+	_, err := s.Add(ctx, "dogs", "rex")
+	assert.Nil(t, err)
+
+	// both write and truncate fail on a closed log
+	file := s.file
+	assert.Nil(t, file.Close())
+	_, err = s.Add(ctx, "dogs", "max")
+	assert.Error(t, err)
+	assert.Contains(t, s.Health(ctx).Error(), "partially written operation")
+
+	// writes are refused even when the log would be writable again
+	s.file, err = os.OpenFile(s.getLogPath(s.seq), os.O_WRONLY, 0o600)
+	assert.Nil(t, err)
+	_, err = s.Add(ctx, "dogs", "max")
+	assert.Contains(t, err.Error(), "mem wal refuses writes")
+	s.sync()
+	assert.Error(t, s.Health(ctx))
+	list, _ := s.List(ctx, "dogs")
+	assert.Len(t, list, 1)
+
+	s.stop()
+	s.wg.Wait()
+	assert.Nil(t, s.file.Close())
+}
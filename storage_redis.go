@@ -0,0 +1,372 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// redisStorage stores every entity as JSON string; sorted set of IDs scored by created time keeps order of the service
+type redisStorage struct {
+	client    *redis.Client
+	keyPrefix string
+	ttl       time.Duration // entities expire after ttl, 0 means never
+	timeout   time.Duration // timeout of one redis operation
+}
+
+func CreateRedisStorage() (*redisStorage, error) {
+	addr := os.Getenv("REDIS_ADDR")
+	if addr == "" {
+		return nil, fmt.Errorf("could not find environment variable %q for redis configuration", "REDIS_ADDR")
+	}
+
+	db := 0
+	if value := os.Getenv("REDIS_DB"); value != "" {
+		var err error
+		db, err = strconv.Atoi(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value of REDIS_DB %q: %w", value, err)
+		}
+	}
+
+	var ttl time.Duration
+	if value := os.Getenv("REDIS_TTL"); value != "" {
+		var err error
+		ttl, err = time.ParseDuration(value)
+		if err != nil || ttl <= 0 {
+			return nil, fmt.Errorf("invalid value of REDIS_TTL %q, positive duration expected", value)
+		}
+	}
+
+	timeout, err := getTimeoutEnv("REDIS_TIMEOUT")
+	if err != nil {
+		return nil, err
+	}
+
+	keyPrefix := os.Getenv("REDIS_KEY_PREFIX")
+	if keyPrefix == "" {
+		keyPrefix = "usa:"
+	}
+
+	client := redis.NewClient(&redis.Options{
+		Addr:     addr,
+		Password: os.Getenv("REDIS_PASSWORD"),
+		DB:       db,
+	})
+
+	return &redisStorage{
+		client:    client,
+		keyPrefix: keyPrefix,
+		ttl:       ttl,
+		timeout:   timeout,
+	}, nil
+}
+
+func (storage *redisStorage) Add(ctx context.Context, serviceName string, payload interface{}) (Entity, error) {
+	e, err := createEntity(payload)
+	if err != nil {
+		return e, err
+	}
+	// sorted set score keeps microsecond precision
+	e.Created = e.Created.Truncate(time.Microsecond)
+
+	if err = storage.Insert(ctx, serviceName, e); err != nil {
+		return Entity{}, err
+	}
+
+	return e, nil
+}
+
+// redisInsertScript stores the entity and adds its ID to the sorted set unless the entity exists
+var redisInsertScript = redis.NewScript(`
+if not redis.call("SET", KEYS[1], ARGV[1], "NX") then
+	return 0
+end
+if tonumber(ARGV[4]) > 0 then
+	redis.call("PEXPIRE", KEYS[1], ARGV[4])
+end
+redis.call("ZADD", KEYS[2], ARGV[2], ARGV[3])
+return 1
+`)
+
+func (storage *redisStorage) Insert(ctx context.Context, serviceName string, e Entity) error {
+	ctx, cancel := context.WithTimeout(ctx, storage.timeout)
+	defer cancel()
+
+	// entity expires ttl after it was created
+	var ttl time.Duration
+	if storage.ttl > 0 {
+		ttl = time.Until(e.Created.Add(storage.ttl))
+		if ttl < time.Millisecond {
+			return fmt.Errorf("%w: %q", errEntityExpired, e.Id)
+		}
+	}
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("could not encode entity: %w", err)
+	}
+
+	keys := []string{storage.getEntityKey(serviceName, e.Id), storage.getIndexKey(serviceName)}
+	inserted, err := redisInsertScript.Run(ctx, storage.client, keys, data, e.Created.UnixMicro(), e.Id, ttl.Milliseconds()).Int()
+	if err != nil {
+		return fmt.Errorf("could not write entity to redis: %w", err)
+	}
+	if inserted == 0 {
+		return errEntityExists
+	}
+
+	return nil
+}
+
+// redisUpdateScript replaces the entity when the stored entity has the expected version; it keeps expiration of the
+// entity unless new expiration and score in the sorted set are given
+var redisUpdateScript = redis.NewScript(`
+local data = redis.call("GET", KEYS[1])
+if not data then
+	return -1
+end
+if (cjson.decode(data)["version"] or 1) ~= tonumber(ARGV[2]) then
+	return 0
+end
+if tonumber(ARGV[3]) > 0 then
+	redis.call("SET", KEYS[1], ARGV[1], "PX", ARGV[3])
+	redis.call("ZADD", KEYS[2], "XX", ARGV[4], ARGV[5])
+else
+	redis.call("SET", KEYS[1], ARGV[1], "KEEPTTL")
+end
+return 1
+`)
+
+// Update replaces the entity keeping its expiration and position in the index. Records of ref indexes are shared by
+// the referencing entities, so their expiration is renewed to outlive the last written referencing entity.
+func (storage *redisStorage) Update(ctx context.Context, serviceName string, e Entity) (Entity, error) {
+	for attempt := 1; ; attempt++ {
+		expected := e.Version
+		if expected == 0 {
+			current, err := storage.Get(ctx, serviceName, e.Id)
+			if err != nil {
+				return Entity{}, err
+			}
+			expected = current.GetVersion()
+		}
+
+		updated, err := storage.update(ctx, serviceName, e, expected)
+		if err != nil {
+			return Entity{}, err
+		}
+		if updated {
+			e.Version = expected + 1
+			return e, nil
+		}
+		// any version can be replaced, so the update is repeated when the entity was changed in the meantime
+		if e.Version != 0 || attempt == maxVersionConflicts {
+			return Entity{}, fmt.Errorf("%w: %q", errVersionConflict, e.Id)
+		}
+	}
+}
+
+// update stores the entity with the next version unless the stored entity has other than the expected version
+func (storage *redisStorage) update(ctx context.Context, serviceName string, e Entity, expected int64) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, storage.timeout)
+	defer cancel()
+
+	e.Version = expected + 1
+	data, err := json.Marshal(e)
+	if err != nil {
+		return false, fmt.Errorf("could not encode entity: %w", err)
+	}
+
+	var ttl time.Duration
+	if storage.ttl > 0 && strings.HasSuffix(serviceName, refsServiceSuffix) {
+		ttl = storage.ttl
+	}
+
+	keys := []string{storage.getEntityKey(serviceName, e.Id), storage.getIndexKey(serviceName)}
+	updated, err := redisUpdateScript.Run(ctx, storage.client, keys, data, expected, ttl.Milliseconds(), time.Now().UnixMicro(), e.Id).Int()
+	if err != nil {
+		return false, fmt.Errorf("could not write entity to redis: %w", err)
+	}
+	if updated < 0 {
+		return false, fmt.Errorf("%w: %q", errEntityNotFound, e.Id)
+	}
+
+	return updated == 1, nil
+}
+
+func (storage *redisStorage) List(ctx context.Context, serviceName string) ([]Entity, error) {
+	list, _, err := storage.ListPage(ctx, serviceName, "", 0)
+	return list, err
+}
+
+// ListPage returns entities ordered by creation time starting after the cursor (ID of the last entity of previous page)
+func (storage *redisStorage) ListPage(ctx context.Context, serviceName, cursor string, limit int) ([]Entity, string, error) {
+	ctx, cancel := context.WithTimeout(ctx, storage.timeout)
+	defer cancel()
+
+	if err := storage.removeExpired(ctx, serviceName); err != nil {
+		return []Entity{}, "", fmt.Errorf("could not list entities from redis: %w", err)
+	}
+
+	index := storage.getIndexKey(serviceName)
+	start := int64(0)
+	if cursor != "" {
+		rank, err := storage.client.ZRank(ctx, index, cursor).Result()
+		if err == redis.Nil {
+			return []Entity{}, "", fmt.Errorf("could not find cursor entity %q", cursor)
+		}
+		if err != nil {
+			return []Entity{}, "", fmt.Errorf("could not list entities from redis: %w", err)
+		}
+		start = rank + 1
+	}
+
+	stop := int64(-1)
+	if limit > 0 {
+		// one more entity tells whether there is next page
+		stop = start + int64(limit)
+	}
+
+	ids, err := storage.client.ZRange(ctx, index, start, stop).Result()
+	if err != nil {
+		return []Entity{}, "", fmt.Errorf("could not list entities from redis: %w", err)
+	}
+	if len(ids) == 0 {
+		return []Entity{}, "", nil
+	}
+
+	keys := make([]string, len(ids))
+	for k, id := range ids {
+		keys[k] = storage.getEntityKey(serviceName, id)
+	}
+	values, err := storage.client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return []Entity{}, "", fmt.Errorf("could not list entities from redis: %w", err)
+	}
+
+	list := []Entity{}
+	for k, value := range values {
+		data, ok := value.(string)
+		if !ok {
+			// entity expired or deleted in the meantime
+			continue
+		}
+
+		var e Entity
+		if err = json.Unmarshal([]byte(data), &e); err != nil {
+			return []Entity{}, "", fmt.Errorf("could not decode entity %q: %w", ids[k], err)
+		}
+		list = append(list, e)
+	}
+
+	if limit > 0 && len(ids) > limit {
+		if len(list) > limit {
+			list = list[:limit]
+		}
+		return list, ids[limit-1], nil
+	}
+
+	return list, "", nil
+}
+
+func (storage *redisStorage) Get(ctx context.Context, serviceName, id string) (Entity, error) {
+	ctx, cancel := context.WithTimeout(ctx, storage.timeout)
+	defer cancel()
+
+	data, err := storage.client.Get(ctx, storage.getEntityKey(serviceName, id)).Bytes()
+	if err == redis.Nil {
+		return Entity{}, fmt.Errorf("%w: %q", errEntityNotFound, id)
+	}
+	if err != nil {
+		return Entity{}, fmt.Errorf("could not read entity %q from redis: %w", id, err)
+	}
+
+	var e Entity
+	if err = json.Unmarshal(data, &e); err != nil {
+		return Entity{}, fmt.Errorf("could not decode entity %q: %w", id, err)
+	}
+
+	return e, nil
+}
+
+// redisDeleteScript deletes the entity and its ID from the sorted set when the entity has the expected version
+// (any version when 0)
+var redisDeleteScript = redis.NewScript(`
+local data = redis.call("GET", KEYS[1])
+if not data then
+	return -1
+end
+if tonumber(ARGV[1]) ~= 0 and (cjson.decode(data)["version"] or 1) ~= tonumber(ARGV[1]) then
+	return 0
+end
+redis.call("DEL", KEYS[1])
+redis.call("ZREM", KEYS[2], ARGV[2])
+return 1
+`)
+
+func (storage *redisStorage) Delete(ctx context.Context, serviceName, id string) error {
+	return storage.DeleteVersion(ctx, serviceName, id, 0)
+}
+
+func (storage *redisStorage) DeleteVersion(ctx context.Context, serviceName, id string, version int64) error {
+	ctx, cancel := context.WithTimeout(ctx, storage.timeout)
+	defer cancel()
+
+	keys := []string{storage.getEntityKey(serviceName, id), storage.getIndexKey(serviceName)}
+	deleted, err := redisDeleteScript.Run(ctx, storage.client, keys, version, id).Int()
+	if err != nil {
+		return fmt.Errorf("could not delete entity %q: %w", id, err)
+	}
+	if deleted < 0 {
+		// the entity could expire, so its ID is removed from the index anyway
+		_ = storage.client.ZRem(ctx, storage.getIndexKey(serviceName), id).Err()
+		return fmt.Errorf("%w: %q", errEntityNotFound, id)
+	}
+	if deleted == 0 {
+		return fmt.Errorf("%w: %q", errVersionConflict, id)
+	}
+
+	return nil
+}
+
+func (storage *redisStorage) Health(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, storage.timeout)
+	defer cancel()
+
+	if err := storage.client.Ping(ctx).Err(); err != nil {
+		return fmt.Errorf("could not reach redis: %w", err)
+	}
+
+	return nil
+}
+
+func (storage *redisStorage) Ready() bool {
+	return true
+}
+
+func (storage *redisStorage) Close() error {
+	return storage.client.Close()
+}
+
+// removeExpired removes IDs of expired entities from the sorted set; entities themselves are expired by redis
+func (storage *redisStorage) removeExpired(ctx context.Context, serviceName string) error {
+	if storage.ttl == 0 {
+		return nil
+	}
+
+	expired := time.Now().Add(-storage.ttl).UnixMicro()
+	return storage.client.ZRemRangeByScore(ctx, storage.getIndexKey(serviceName), "-inf", fmt.Sprintf("(%d", expired)).Err()
+}
+
+func (storage *redisStorage) getEntityKey(serviceName, id string) string {
+	return fmt.Sprintf("%s%s:entity:%s", storage.keyPrefix, serviceName, id)
+}
+
+func (storage *redisStorage) getIndexKey(serviceName string) string {
+	return fmt.Sprintf("%s%s:index", storage.keyPrefix, serviceName)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func createTestRedisStorage(t *testing.T, ttl string) (*redisStorage, *miniredis.Miniredis) {
+	mr := miniredis.RunT(t)
+	t.Setenv("REDIS_ADDR", mr.Addr())
+	t.Setenv("REDIS_TTL", ttl)
+
+	s, err := CreateRedisStorage()
+	assert.Nil(t, err)
+	t.Cleanup(func() {
+		_ = s.Close()
+	})
+
+	return s, mr
+}
+
+func TestRedisStorage(t *testing.T) {
+	s, mr := createTestRedisStorage(t, "")
+	ctx := context.Background()
+	assert.Nil(t, s.Health(ctx))
+
+	var ids []string
+	for i := 0; i < 5; i++ {
+		e, err := s.Add(ctx, "dogs", float64(i))
+		assert.Nil(t, err)
+		ids = append(ids, e.Id)
+		// entities are ordered by created time with microsecond precision
+		time.Sleep(time.Microsecond)
+	}
+	_, err := s.Add(ctx, "cats", "tom")
+	assert.Nil(t, err)
+	assert.True(t, mr.Exists("usa:dogs:index"))
+	assert.Equal(t, 0*time.Second, mr.TTL("usa:dogs:entity:"+ids[0]))
+
+	list, err := s.List(ctx, "dogs")
+	assert.Nil(t, err)
+	assert.Len(t, list, 5)
+	for k, e := range list {
+		assert.Equal(t, ids[k], e.Id)
+		assert.Equal(t, float64(k), e.Payload)
+	}
+
+	e, err := s.Get(ctx, "dogs", ids[2])
+	assert.Nil(t, err)
+	assert.Equal(t, list[2], e)
+	_, err = s.Get(ctx, "cats", ids[2])
+	assert.Error(t, err)
+
+	assert.Nil(t, s.Delete(ctx, "dogs", ids[1]))
+	assert.Error(t, s.Delete(ctx, "dogs", ids[1]))
+
+	// paging
+	page, next, err := s.ListPage(ctx, "dogs", "", 2)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{ids[0], ids[2]}, []string{page[0].Id, page[1].Id})
+	assert.Equal(t, ids[2], next)
+	page, next, err = s.ListPage(ctx, "dogs", next, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{ids[3], ids[4]}, []string{page[0].Id, page[1].Id})
+	assert.Equal(t, "", next)
+	_, _, err = s.ListPage(ctx, "dogs", "missing", 2)
+	assert.Error(t, err)
+
+	// inserted entity keeps its ID and created time
+	old := Entity{Id: "old", Created: list[0].Created.Add(-time.Hour), Payload: "old", Version: 1}
+	assert.Nil(t, s.Insert(ctx, "dogs", old))
+	assert.ErrorIs(t, s.Insert(ctx, "dogs", old), errEntityExists)
+	page, _, err = s.ListPage(ctx, "dogs", "", 1)
+	assert.Nil(t, err)
+	assert.Equal(t, old, page[0])
+
+	// update replaces payload of existing entity only and increments its version
+	old.Payload = "updated"
+	_, err = s.Update(ctx, "dogs", old)
+	assert.Nil(t, err)
+	_, err = s.Update(ctx, "dogs", old)
+	assert.ErrorIs(t, err, errVersionConflict)
+	e, err = s.Get(ctx, "dogs", "old")
+	assert.Nil(t, err)
+	old.Version = 2
+	assert.Equal(t, old, e)
+	_, err = s.Update(ctx, "dogs", Entity{Id: "missing", Created: old.Created})
+	assert.ErrorIs(t, err, errEntityNotFound)
+	assert.ErrorIs(t, s.DeleteVersion(ctx, "dogs", "old", 1), errVersionConflict)
+	assert.ErrorIs(t, s.DeleteVersion(ctx, "dogs", "missing", 1), errEntityNotFound)
+
+	mr.SetError("server is down")
+	assert.Error(t, s.Health(ctx))
+}
+
+func TestRedisStorageTTL(t *testing.T) {
+	s, mr := createTestRedisStorage(t, "1h")
+	ctx := context.Background()
+
+	e, err := s.Add(ctx, "dogs", "rex")
+	assert.Nil(t, err)
+	// ttl is counted from created time of the entity
+	assert.InDelta(t, float64(time.Hour), float64(mr.TTL("usa:dogs:entity:"+e.Id)), float64(time.Second))
+
+	mr.FastForward(2 * time.Hour)
+	list, err := s.List(ctx, "dogs")
+	assert.Nil(t, err)
+	assert.Len(t, list, 0)
+	_, err = s.Get(ctx, "dogs", e.Id)
+	assert.Error(t, err)
+
+	// already expired entity is not stored
+	old := Entity{Id: "old", Created: time.Now().Add(-2 * time.Hour), Payload: "max"}
+	assert.ErrorIs(t, s.Insert(ctx, "dogs", old), errEntityExpired)
+
+	// records of ref index expire after the last written referencing entity
+	refs := getRefsServiceName("dogs")
+	record := Entity{Id: "record", Created: time.Now().Truncate(time.Microsecond), Payload: "rex", Version: 1}
+	assert.Nil(t, s.Insert(ctx, refs, record))
+	mr.FastForward(30 * time.Minute)
+	record.Payload = "rex max"
+	_, err = s.Update(ctx, refs, record)
+	assert.Nil(t, err)
+	assert.InDelta(t, float64(time.Hour), float64(mr.TTL("usa:"+refs+":entity:record")), float64(time.Second))
+	list, err = s.List(ctx, refs)
+	assert.Nil(t, err)
+	assert.Len(t, list, 1)
+
+	// ttl of other entities is kept
+	e, err = s.Add(ctx, "dogs", "rex")
+	assert.Nil(t, err)
+	mr.FastForward(30 * time.Minute)
+	_, err = s.Update(ctx, "dogs", Entity{Id: e.Id, Created: e.Created, Payload: "max"})
+	assert.Nil(t, err)
+	assert.InDelta(t, float64(30*time.Minute), float64(mr.TTL("usa:dogs:entity:"+e.Id)), float64(time.Second))
+
+	t.Setenv("REDIS_TTL", "-1h")
+	_, err = CreateRedisStorage()
+	assert.Error(t, err)
+}
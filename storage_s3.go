@@ -4,25 +4,74 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/sirupsen/logrus"
+	"hash/fnv"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
-const s3Timeout = 5 * time.Second
+const (
+	s3LoadPolicyFail = "fail" // initial load fails on the first corrupt object
+	s3LoadPolicySkip = "skip" // corrupt objects are skipped and reported
+
+	s3LayoutObjects  = "objects"  // one object per entity
+	s3LayoutSegments = "segments" // operations appended to segment objects, compacted into snapshot
+
+	defaultS3LoadWorkers = 16
+
+	s3KeyLockCount = 64
+)
+
+var errS3CorruptObject = errors.New("corrupt s3 object")
 
 type s3Storage struct {
-	client     *s3.S3
-	memStorage *memStorage
-	bucketName string
+	client      *s3.S3
+	memStorage  *memStorage
+	bucketName  string
+	timeout     time.Duration // timeout of one s3 request
+	loadWorkers int           // number of parallel downloads during initial load
+	loadPolicy  string
+	layout      string
+	segments    *s3Segments // state of segments layout, nil for objects layout
+	etags       *s3ETags    // ETags of cached objects, objects layout only
+	keyLocks    s3KeyLocks  // inserts of objects, objects layout only
+	resync      time.Duration
+	readThrough bool
+	logger      *logrus.Logger
+	loaded      int32 // set to 1 after initial load is finished
+	loadErr     atomic.Value
 }
 
-func CreateS3Storage(serviceNames []string) (*s3Storage, error) {
-	endpoint := os.Getenv("AWS_S3_ENDPOINT")
+// s3KeyLocks serialize writes of the same object key within the instance; keys share a fixed number of locks
+type s3KeyLocks [s3KeyLockCount]sync.Mutex
+
+// s3Precondition makes a write conditional: IfMatch fails when the object does not have the ETag anymore,
+// IfNoneMatch "*" fails when the object exists
+type s3Precondition struct {
+	IfMatch     string
+	IfNoneMatch string
+}
+
+// s3LoadReport summarizes initial load of one service
+type s3LoadReport struct {
+	mu      sync.Mutex
+	loaded  int
+	skipped []string
+}
+
+// CreateS3Storage creates the storage and starts loading of existing entities in the background.
+// The storage is not ready until all entities are loaded; the application exits when the load fails.
+func CreateS3Storage(ctx context.Context, serviceNames []string, logger *logrus.Logger) (*s3Storage, error) {
 	requiredVariables := []string{
 		"AWS_ACCESS_KEY",
 		"AWS_SECRET_KEY",
@@ -36,8 +85,97 @@ func CreateS3Storage(serviceNames []string) (*s3Storage, error) {
 		}
 	}
 
+	timeout, err := getTimeoutEnv("AWS_S3_TIMEOUT")
+	if err != nil {
+		return nil, err
+	}
+
+	loadWorkers := defaultS3LoadWorkers
+	if value := os.Getenv("AWS_S3_LOAD_WORKERS"); value != "" {
+		loadWorkers, err = strconv.Atoi(value)
+		if err != nil || loadWorkers < 1 {
+			return nil, fmt.Errorf("invalid number of workers %q in environment variable %q", value, "AWS_S3_LOAD_WORKERS")
+		}
+	}
+
+	loadPolicy := os.Getenv("AWS_S3_LOAD_POLICY")
+	if loadPolicy == "" {
+		loadPolicy = s3LoadPolicyFail
+	}
+	if loadPolicy != s3LoadPolicyFail && loadPolicy != s3LoadPolicySkip {
+		return nil, fmt.Errorf("invalid load policy %q in environment variable %q (use %q or %q)", loadPolicy, "AWS_S3_LOAD_POLICY", s3LoadPolicyFail, s3LoadPolicySkip)
+	}
+
+	layout := os.Getenv("AWS_S3_LAYOUT")
+	if layout == "" {
+		layout = s3LayoutObjects
+	}
+	if layout != s3LayoutObjects && layout != s3LayoutSegments {
+		return nil, fmt.Errorf("invalid layout %q in environment variable %q (use %q or %q)", layout, "AWS_S3_LAYOUT", s3LayoutObjects, s3LayoutSegments)
+	}
+
+	var resync time.Duration
+	if value := os.Getenv("AWS_S3_RESYNC_INTERVAL"); value != "" {
+		resync, err = time.ParseDuration(value)
+		if err != nil || resync <= 0 {
+			return nil, fmt.Errorf("invalid resync interval %q in environment variable %q", value, "AWS_S3_RESYNC_INTERVAL")
+		}
+	}
+	readThrough := os.Getenv("AWS_S3_READ_THROUGH") == "true"
+	if layout == s3LayoutSegments && (resync > 0 || readThrough) {
+		return nil, fmt.Errorf("resync and read-through are not supported by %q layout", s3LayoutSegments)
+	}
+
+	storage := &s3Storage{
+		client:      createS3Client(),
+		memStorage:  CreateMemStorage(serviceNames),
+		bucketName:  os.Getenv("AWS_BUCKET_NAME"),
+		timeout:     timeout,
+		loadWorkers: loadWorkers,
+		loadPolicy:  loadPolicy,
+		layout:      layout,
+		etags:       createS3ETags(),
+		resync:      resync,
+		readThrough: readThrough,
+		logger:      logger,
+	}
+
+	if layout == s3LayoutSegments {
+		if storage.segments, err = createS3Segments(serviceNames); err != nil {
+			return nil, err
+		}
+	}
+
+	go func() {
+		if err := storage.loadServices(ctx, serviceNames); err != nil {
+			err = fmt.Errorf("could not load existing entities from s3 object storage: %w", err)
+			storage.loadErr.Store(err)
+			if ctx.Err() != nil {
+				return // shutting down
+			}
+			// the application cannot serve requests without existing entities
+			logger.WithError(err).Fatal("s3 storage initial load failed")
+			return
+		}
+
+		atomic.StoreInt32(&storage.loaded, 1)
+		logger.Info("s3 storage initial load finished")
+
+		if storage.segments != nil {
+			storage.runCompaction(ctx, serviceNames)
+		}
+		if storage.resync > 0 {
+			storage.runResync(ctx, serviceNames)
+		}
+	}()
+
+	return storage, nil
+}
+
+// createS3Client creates client configured by AWS_* environment variables (AWS_S3_ENDPOINT for S3 compatible storages)
+func createS3Client() *s3.S3 {
 	var configs []*aws.Config
-	if endpoint != "" {
+	if endpoint := os.Getenv("AWS_S3_ENDPOINT"); endpoint != "" {
 		configs = append(configs, &aws.Config{Endpoint: &endpoint})
 		if !strings.HasPrefix(endpoint, "https") {
 			configs = append(configs, &aws.Config{
@@ -51,25 +189,18 @@ func CreateS3Storage(serviceNames []string) (*s3Storage, error) {
 	})
 
 	sess := session.Must(session.NewSession(configs...))
-	s3Client := s3.New(sess)
-
-	storage := &s3Storage{
-		client:     s3Client,
-		memStorage: CreateMemStorage(serviceNames),
-		bucketName: os.Getenv("AWS_BUCKET_NAME"),
-	}
-
-	if err := storage.loadServices(serviceNames); err != nil {
-		return nil, fmt.Errorf("could not load existing entities from s3 object storage: %w", err)
-	}
-
-	return storage, nil
+	return s3.New(sess)
 }
 
 // loadServices iterates through all known services and load them
-func (storage *s3Storage) loadServices(serviceNames []string) error {
+func (storage *s3Storage) loadServices(ctx context.Context, serviceNames []string) error {
 	for _, serviceName := range serviceNames {
-		if err := storage.loadService(serviceName); err != nil {
+		load := storage.loadService
+		if storage.segments != nil {
+			load = storage.loadSegmentedService
+		}
+
+		if err := load(ctx, serviceName); err != nil {
 			return err
 		}
 	}
@@ -77,120 +208,439 @@ func (storage *s3Storage) loadServices(serviceNames []string) error {
 	return nil
 }
 
-// loadService lists service objects on s3 storage and initiate download
-func (storage *s3Storage) loadService(serviceName string) error {
+// loadService lists all service objects on s3 storage page by page and downloads them using a pool of workers
+func (storage *s3Storage) loadService(ctx context.Context, serviceName string) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	report := &s3LoadReport{}
+	keys := make(chan string)
+	errs := make(chan error, 1)
+	var wg sync.WaitGroup
+	for i := 0; i < storage.loadWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range keys {
+				err := storage.loadEntity(ctx, serviceName, key)
+				if err == nil {
+					if loaded := report.addLoaded(); loaded%1000 == 0 {
+						storage.logger.Infof("service %q: %d entities loaded", serviceName, loaded)
+					}
+					continue
+				}
+				if storage.loadPolicy == s3LoadPolicySkip && errors.Is(err, errS3CorruptObject) {
+					storage.logger.WithError(err).Warnf("skipping corrupt object %q", key)
+					report.addSkipped(key)
+					continue
+				}
+
+				select {
+				case errs <- err:
+				default:
+				}
+				cancel()
+				return
+			}
+		}()
+	}
+
 	prefix := fmt.Sprintf("%s/", serviceName)
-	list, err := storage.client.ListObjects(&s3.ListObjectsInput{
-		Bucket: &storage.bucketName,
-		Prefix: &prefix,
+	listErr := storage.listObjects(ctx, prefix, func(object *s3.Object) error {
+		// keys starting with underscore are used by segments layout
+		if strings.HasPrefix(*object.Key, prefix+"_") {
+			return nil
+		}
+
+		select {
+		case keys <- *object.Key:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 	})
+	close(keys)
+	wg.Wait()
 
-	if err != nil {
-		return fmt.Errorf("could not list s3 objects with prefix %s: %w", prefix, err)
+	select {
+	case err := <-errs:
+		return err
+	default:
+	}
+	if listErr != nil {
+		return listErr
 	}
 
-	for _, object := range list.Contents {
-		if err = storage.loadEntity(serviceName, *object.Key); err != nil {
-			return err
-		}
+	storage.memStorage.sortByCreated(serviceName)
+	if len(report.skipped) > 0 {
+		storage.logger.Warnf("service %q: %d corrupt object(s) skipped: %s", serviceName, len(report.skipped), strings.Join(report.skipped, ", "))
 	}
+	storage.logger.Infof("service %q: %d entities loaded from s3", serviceName, report.loaded)
 
 	return nil
 }
 
+// listObjects calls the function for every object with given prefix; it follows continuation tokens of ListObjectsV2
+func (storage *s3Storage) listObjects(ctx context.Context, prefix string, fn func(object *s3.Object) error) error {
+	input := &s3.ListObjectsV2Input{
+		Bucket: &storage.bucketName,
+		Prefix: &prefix,
+	}
+
+	listed := 0
+	for {
+		listCtx, cancelFn := context.WithTimeout(ctx, storage.timeout)
+		page, err := storage.client.ListObjectsV2WithContext(listCtx, input)
+		cancelFn()
+		if err != nil {
+			return fmt.Errorf("could not list s3 objects with prefix %s: %w", prefix, err)
+		}
+
+		for _, object := range page.Contents {
+			if err = fn(object); err != nil {
+				return err
+			}
+		}
+
+		listed += len(page.Contents)
+		storage.logger.Debugf("prefix %q: %d objects listed", prefix, listed)
+
+		if page.IsTruncated == nil || !*page.IsTruncated {
+			return nil
+		}
+		input.ContinuationToken = page.NextContinuationToken
+	}
+}
+
 // loadEntity downloads entity file, decode content and puts entity to memory cache
-func (storage *s3Storage) loadEntity(serviceName, objectKey string) error {
-	objectOutput, err := storage.client.GetObject(&s3.GetObjectInput{
+func (storage *s3Storage) loadEntity(ctx context.Context, serviceName, objectKey string) error {
+	e, etag, err := storage.fetchEntity(ctx, objectKey)
+	if err != nil {
+		return err
+	}
+
+	storage.memStorage.AddEntity(serviceName, e)
+	storage.etags.set(serviceName, objectKey, etag)
+	return nil
+}
+
+// fetchEntity downloads and decodes entity object
+func (storage *s3Storage) fetchEntity(ctx context.Context, objectKey string) (Entity, string, error) {
+	var e Entity
+	data, etag, err := storage.getObject(ctx, objectKey)
+	if err != nil {
+		return e, "", err
+	}
+
+	if err = json.Unmarshal(data, &e); err != nil {
+		return e, "", fmt.Errorf("%w: could not decode json from %q output object, %v", errS3CorruptObject, objectKey, err)
+	}
+
+	return e, etag, nil
+}
+
+// getObject downloads content of the object
+func (storage *s3Storage) getObject(ctx context.Context, key string) ([]byte, string, error) {
+	ctx, cancelFn := context.WithTimeout(ctx, storage.timeout)
+	defer cancelFn()
+
+	objectOutput, err := storage.client.GetObjectWithContext(ctx, &s3.GetObjectInput{
 		Bucket: &storage.bucketName,
-		Key:    &objectKey,
+		Key:    &key,
 	})
 	if err != nil {
-		return fmt.Errorf("could not download %q object content from s3 object storage, %w", objectKey, err)
+		return nil, "", fmt.Errorf("could not download %q object content from s3 object storage, %w", key, err)
 	}
+	defer objectOutput.Body.Close()
 
 	buf := new(bytes.Buffer)
-	_, err = buf.ReadFrom(objectOutput.Body)
-	if err != nil {
-		return fmt.Errorf("could not read data from %q output object, %w", objectKey, err)
+	if _, err = buf.ReadFrom(objectOutput.Body); err != nil {
+		return nil, "", fmt.Errorf("could not read data from %q output object, %w", key, err)
 	}
 
-	var e Entity
-	err = json.Unmarshal(buf.Bytes(), &e)
-	_ = objectOutput.Body.Close()
-	if err != nil {
-		return fmt.Errorf("could not decode json from %q output object, %w", objectKey, err)
+	return buf.Bytes(), aws.StringValue(objectOutput.ETag), nil
+}
+
+// putObject uploads the object and returns its ETag
+func (storage *s3Storage) putObject(ctx context.Context, key string, data []byte, contentType string, precondition s3Precondition) (string, error) {
+	ctx, cancelFn := context.WithTimeout(ctx, storage.timeout)
+	defer cancelFn()
+
+	req, output := storage.client.PutObjectRequest(&s3.PutObjectInput{
+		Bucket:      &storage.bucketName,
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(data),
+		ContentType: &contentType,
+	})
+	setS3Precondition(req, ctx, precondition)
+	if err := req.Send(); err != nil {
+		return "", fmt.Errorf("could not upload %q to s3: %w", key, err)
+	}
+
+	return aws.StringValue(output.ETag), nil
+}
+
+// deleteObject removes the object from the bucket
+func (storage *s3Storage) deleteObject(ctx context.Context, key, ifMatch string) error {
+	ctx, cancelFn := context.WithTimeout(ctx, storage.timeout)
+	defer cancelFn()
+
+	req, _ := storage.client.DeleteObjectRequest(&s3.DeleteObjectInput{
+		Bucket: &storage.bucketName,
+		Key:    &key,
+	})
+	setS3Precondition(req, ctx, s3Precondition{IfMatch: ifMatch})
+	if err := req.Send(); err != nil {
+		return fmt.Errorf("could not delete object %q from s3 bucket: %w", key, err)
 	}
 
-	storage.memStorage.AddEntity(serviceName, e)
 	return nil
 }
 
+func setS3Precondition(req *request.Request, ctx context.Context, precondition s3Precondition) {
+	req.SetContext(ctx)
+	if precondition.IfMatch != "" {
+		req.HTTPRequest.Header.Set("If-Match", precondition.IfMatch)
+	}
+	if precondition.IfNoneMatch != "" {
+		req.HTTPRequest.Header.Set("If-None-Match", precondition.IfNoneMatch)
+	}
+}
+
+// lock locks the object key and returns function unlocking it
+func (locks *s3KeyLocks) lock(key string) func() {
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(key))
+	mu := &locks[hash.Sum32()%s3KeyLockCount]
+	mu.Lock()
+
+	return mu.Unlock
+}
+
 // Add creates new record in memory and uploads entity to s3 object storage
-func (storage *s3Storage) Add(serviceName string, payload interface{}) (Entity, error) {
+func (storage *s3Storage) Add(ctx context.Context, serviceName string, payload interface{}) (Entity, error) {
 	e, err := createEntity(payload)
 	if err != nil {
 		return e, err
 	}
 
+	if err = storage.Insert(ctx, serviceName, e); err != nil {
+		return Entity{}, err
+	}
+
+	return e, nil
+}
+
+// Insert uploads the entity only when its object does not exist (If-None-Match), so only one of concurrent inserts
+// of the same ID (in any instance) succeeds; inserts of the same key are serialized within the instance
+func (storage *s3Storage) Insert(ctx context.Context, serviceName string, e Entity) error {
+	if !storage.Ready() {
+		return errStorageNotReady
+	}
+
+	if storage.segments != nil {
+		return storage.appendSegmentOp(ctx, serviceName, s3SegmentOp{Op: s3SegmentOpAdd, Entity: &e}, func() error {
+			if storage.memStorage.hasEntity(serviceName, e.Id) {
+				return errEntityExists
+			}
+			return nil
+		})
+	}
+
+	key := getS3ObjectKey(serviceName, e.Id)
+	defer storage.keyLocks.lock(key)()
+
+	if storage.memStorage.hasEntity(serviceName, e.Id) {
+		return errEntityExists
+	}
+
+	// entity could be written by another instance
+	if storage.readThrough {
+		err := storage.refreshEntity(ctx, serviceName, key)
+		if err == nil {
+			return errEntityExists
+		}
+		if !isS3NotFound(err) {
+			return err
+		}
+	}
+
 	data, err := json.Marshal(e)
 	if err != nil {
-		return Entity{}, fmt.Errorf("could not marshal data for s3 upload: %w", err)
+		return fmt.Errorf("could not marshal data for s3 upload: %w", err)
 	}
 
-	ctx := context.Background()
-	var cancelFn func()
-	ctx, cancelFn = context.WithTimeout(ctx, s3Timeout)
+	etag, err := storage.putObject(ctx, key, data, "application/json", s3Precondition{IfNoneMatch: "*"})
+	if isS3PreconditionFailed(err) {
+		return fmt.Errorf("%w: %q", errEntityExists, e.Id)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err = storage.memStorage.InsertEntity(serviceName, e); err != nil {
+		return err
+	}
+	storage.etags.set(serviceName, key, etag)
+
+	return nil
+}
 
-	if cancelFn != nil {
-		defer cancelFn()
+// Update uploads the entity only when the object was not changed since it was cached (If-Match of its ETag),
+// so concurrent updates of the same version can not overwrite each other
+func (storage *s3Storage) Update(ctx context.Context, serviceName string, e Entity) (Entity, error) {
+	if !storage.Ready() {
+		return Entity{}, errStorageNotReady
 	}
 
 	key := getS3ObjectKey(serviceName, e.Id)
-	contentType := "application/json"
-	_, err = storage.client.PutObjectWithContext(ctx, &s3.PutObjectInput{
-		Bucket:      &storage.bucketName,
-		Key:         aws.String(key),
-		Body:        bytes.NewReader(data),
-		ContentType: &contentType,
-	})
+	if storage.segments != nil {
+		version := e.Version
+		err := storage.appendSegmentOp(ctx, serviceName, s3SegmentOp{Op: s3SegmentOpUpdate, Entity: &e}, func() error {
+			current, err := storage.memStorage.getVersion(serviceName, e.Id, version)
+			e.Version = current.GetVersion() + 1
+			return err
+		})
+		if err != nil {
+			return Entity{}, err
+		}
+		return e, nil
+	}
+	if storage.readThrough {
+		// entity could be written or deleted by another instance
+		err := storage.refreshEntity(ctx, serviceName, key)
+		if isS3NotFound(err) {
+			return Entity{}, fmt.Errorf("%w: %q", errEntityNotFound, e.Id)
+		}
+		if err != nil {
+			return Entity{}, err
+		}
+	}
 
+	current, err := storage.memStorage.getVersion(serviceName, e.Id, e.Version)
 	if err != nil {
-		return Entity{}, fmt.Errorf("could not upload to s3: %w", err)
+		return Entity{}, err
 	}
+	e.Version = current.GetVersion() + 1
 
-	storage.memStorage.AddEntity(serviceName, e)
+	data, err := json.Marshal(e)
+	if err != nil {
+		return Entity{}, fmt.Errorf("could not marshal data for s3 upload: %w", err)
+	}
+
+	etag, err := storage.putObject(ctx, key, data, "application/json", s3Precondition{IfMatch: storage.etags.get(serviceName, key)})
+	if isS3PreconditionFailed(err) {
+		return Entity{}, fmt.Errorf("%w: %q", errVersionConflict, e.Id)
+	}
+	if err != nil {
+		return Entity{}, err
+	}
+
+	storage.memStorage.ReplaceEntity(serviceName, e)
+	storage.etags.set(serviceName, key, etag)
 
 	return e, nil
 }
 
-func (storage *s3Storage) List(serviceName string) ([]Entity, error) {
-	return storage.memStorage.List(serviceName)
+func (storage *s3Storage) List(ctx context.Context, serviceName string) ([]Entity, error) {
+	if !storage.Ready() {
+		return nil, errStorageNotReady
+	}
+
+	return storage.memStorage.List(ctx, serviceName)
+}
+
+func (storage *s3Storage) Get(ctx context.Context, serviceName, id string) (Entity, error) {
+	if !storage.Ready() {
+		return Entity{}, errStorageNotReady
+	}
+
+	e, err := storage.memStorage.Get(ctx, serviceName, id)
+	if err != nil && storage.readThrough {
+		return storage.getThrough(ctx, serviceName, id, err)
+	}
+
+	return e, err
 }
 
-func (storage *s3Storage) Get(serviceName, id string) (Entity, error) {
-	return storage.memStorage.Get(serviceName, id)
+func (storage *s3Storage) Delete(ctx context.Context, serviceName, id string) error {
+	return storage.DeleteVersion(ctx, serviceName, id, 0)
 }
 
-func (storage *s3Storage) Delete(serviceName, id string) error {
-	ctx := context.Background()
-	var cancelFn func()
-	ctx, cancelFn = context.WithTimeout(ctx, s3Timeout)
+func (storage *s3Storage) DeleteVersion(ctx context.Context, serviceName, id string, version int64) error {
+	if !storage.Ready() {
+		return errStorageNotReady
+	}
+
+	if storage.segments != nil {
+		return storage.appendSegmentOp(ctx, serviceName, s3SegmentOp{Op: s3SegmentOpDelete, Id: id}, func() error {
+			_, err := storage.memStorage.getVersion(serviceName, id, version)
+			return err
+		})
+	}
 
-	if cancelFn != nil {
-		defer cancelFn()
+	// entity must exist (possibly written by another instance)
+	current, err := storage.Get(ctx, serviceName, id)
+	if err != nil {
+		return err
+	}
+	if err = checkVersion(current, version); err != nil {
+		return err
 	}
 
 	key := getS3ObjectKey(serviceName, id)
-	_, err := storage.client.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+	ifMatch := ""
+	if version != 0 {
+		ifMatch = storage.etags.get(serviceName, key)
+	}
+	err = storage.deleteObject(ctx, key, ifMatch)
+	if isS3PreconditionFailed(err) {
+		return fmt.Errorf("%w: %q", errVersionConflict, id)
+	}
+	if err != nil {
+		return err
+	}
+
+	storage.etags.remove(serviceName, key)
+	return storage.memStorage.Delete(ctx, serviceName, id)
+}
+
+// Health checks the bucket is accessible and the initial load did not fail
+func (storage *s3Storage) Health(ctx context.Context) error {
+	if err, ok := storage.loadErr.Load().(error); ok {
+		return err
+	}
+
+	ctx, cancelFn := context.WithTimeout(ctx, storage.timeout)
+	defer cancelFn()
+
+	_, err := storage.client.HeadBucketWithContext(ctx, &s3.HeadBucketInput{
 		Bucket: &storage.bucketName,
-		Key:    &key,
 	})
-
 	if err != nil {
-		return fmt.Errorf("could not delete object from s3 bucket: %w", err)
+		return fmt.Errorf("could not reach s3 bucket %q: %w", storage.bucketName, err)
 	}
 
-	return storage.memStorage.Delete(serviceName, id)
+	return nil
+}
+
+// Ready returns true when all existing entities are loaded from s3
+func (storage *s3Storage) Ready() bool {
+	return atomic.LoadInt32(&storage.loaded) == 1
+}
+
+func (report *s3LoadReport) addLoaded() int {
+	report.mu.Lock()
+	defer report.mu.Unlock()
+	report.loaded++
+
+	return report.loaded
+}
+
+func (report *s3LoadReport) addSkipped(key string) {
+	report.mu.Lock()
+	defer report.mu.Unlock()
+	report.skipped = append(report.skipped, key)
 }
 
 func getS3ObjectKey(serviceName, entityId string) string {
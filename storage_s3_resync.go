@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// s3ETags remembers ETags of objects in the memory cache so resync downloads only changed objects
+type s3ETags struct {
+	mu    sync.Mutex
+	items map[string]map[string]s3ETag // service name -> object key -> ETag
+}
+
+type s3ETag struct {
+	etag    string
+	updated time.Time // when the cache was updated
+}
+
+func createS3ETags() *s3ETags {
+	return &s3ETags{items: make(map[string]map[string]s3ETag)}
+}
+
+func (etags *s3ETags) set(serviceName, key, etag string) {
+	etags.mu.Lock()
+	defer etags.mu.Unlock()
+
+	if etags.items[serviceName] == nil {
+		etags.items[serviceName] = make(map[string]s3ETag)
+	}
+	etags.items[serviceName][key] = s3ETag{etag: etag, updated: time.Now()}
+}
+
+func (etags *s3ETags) remove(serviceName, key string) {
+	etags.mu.Lock()
+	defer etags.mu.Unlock()
+
+	delete(etags.items[serviceName], key)
+}
+
+// get returns ETag of the cached object, empty when it is not known
+func (etags *s3ETags) get(serviceName, key string) string {
+	etags.mu.Lock()
+	defer etags.mu.Unlock()
+
+	return etags.items[serviceName][key].etag
+}
+
+// list returns copy of all known ETags of the service
+func (etags *s3ETags) list(serviceName string) map[string]s3ETag {
+	etags.mu.Lock()
+	defer etags.mu.Unlock()
+
+	list := make(map[string]s3ETag, len(etags.items[serviceName]))
+	for key, etag := range etags.items[serviceName] {
+		list[key] = etag
+	}
+
+	return list
+}
+
+// runResync synchronizes memory cache with the bucket periodically until the context is canceled
+func (storage *s3Storage) runResync(ctx context.Context, serviceNames []string) {
+	ticker := time.NewTicker(storage.resync)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, serviceName := range serviceNames {
+				if err := storage.resyncService(ctx, serviceName); err != nil {
+					storage.logger.WithError(err).Errorf("could not resync service %q with s3", serviceName)
+				}
+			}
+		}
+	}
+}
+
+// resyncService compares bucket listing with the cache (by key and ETag); new and changed objects are
+// downloaded, objects missing in the bucket are removed from the cache. Objects written by this instance
+// after the listing started are left untouched.
+func (storage *s3Storage) resyncService(ctx context.Context, serviceName string) error {
+	started := time.Now()
+	prefix := fmt.Sprintf("%s/", serviceName)
+	listed := make(map[string]string)
+	err := storage.listObjects(ctx, prefix, func(object *s3.Object) error {
+		if !strings.HasPrefix(*object.Key, prefix+"_") {
+			listed[*object.Key] = aws.StringValue(object.ETag)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	known := storage.etags.list(serviceName)
+	changed, removed := 0, 0
+	for key, etag := range listed {
+		cached, found := known[key]
+		if found && (cached.etag == etag || cached.updated.After(started)) {
+			continue
+		}
+
+		err = storage.refreshEntity(ctx, serviceName, key)
+		if isS3NotFound(err) {
+			continue // deleted in the meantime
+		}
+		if errors.Is(err, errS3CorruptObject) {
+			storage.logger.WithError(err).Warnf("skipping corrupt object %q", key)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		changed++
+	}
+
+	for key, cached := range known {
+		if _, found := listed[key]; found || cached.updated.After(started) {
+			continue
+		}
+
+		id := strings.TrimSuffix(strings.TrimPrefix(key, prefix), ".json")
+		_ = storage.memStorage.Delete(ctx, serviceName, id) // could be deleted in the meantime
+		storage.etags.remove(serviceName, key)
+		removed++
+	}
+
+	if changed > 0 {
+		storage.memStorage.sortByCreated(serviceName)
+	}
+	if changed > 0 || removed > 0 {
+		storage.logger.Infof("service %q: resync with s3 finished, %d changed, %d removed", serviceName, changed, removed)
+	}
+
+	return nil
+}
+
+// getThrough downloads entity missing in the cache (e.g. written by another instance) directly from s3
+func (storage *s3Storage) getThrough(ctx context.Context, serviceName, id string, cacheErr error) (Entity, error) {
+	err := storage.refreshEntity(ctx, serviceName, getS3ObjectKey(serviceName, id))
+	if isS3NotFound(err) {
+		return Entity{}, cacheErr
+	}
+	if err != nil {
+		return Entity{}, err
+	}
+
+	return storage.memStorage.Get(ctx, serviceName, id)
+}
+
+// refreshEntity downloads entity object and replaces the cached entity
+func (storage *s3Storage) refreshEntity(ctx context.Context, serviceName, objectKey string) error {
+	e, etag, err := storage.fetchEntity(ctx, objectKey)
+	if err != nil {
+		return err
+	}
+
+	storage.memStorage.ReplaceEntity(serviceName, e)
+	storage.etags.set(serviceName, objectKey, etag)
+	return nil
+}
+
+func isS3NotFound(err error) bool {
+	var awsErr awserr.Error
+	return errors.As(err, &awsErr) && awsErr.Code() == s3.ErrCodeNoSuchKey
+}
+
+// isS3PreconditionFailed reports whether conditional write failed because the object was changed
+func isS3PreconditionFailed(err error) bool {
+	var reqErr awserr.RequestFailure
+	return errors.As(err, &reqErr) && reqErr.StatusCode() == http.StatusPreconditionFailed
+}
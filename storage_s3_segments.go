@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	s3SegmentOpAdd    = "add"
+	s3SegmentOpUpdate = "update"
+	s3SegmentOpDelete = "delete"
+
+	defaultS3SegmentSize     = 1000
+	defaultS3CompactInterval = 10 * time.Minute
+)
+
+// s3Segments holds state of segments layout. Every service has a snapshot object with all entities
+// and segment objects with operations made after the snapshot. New operations are appended to the
+// current segment which is rewritten on every write; when it is full a new segment is started.
+// Compaction writes a new snapshot and removes compacted segments.
+type s3Segments struct {
+	size            int           // max operations in one segment
+	compactInterval time.Duration // interval of snapshot compaction
+	logs            map[string]*s3SegmentLog
+}
+
+// s3SegmentLog is the current (open) segment of one service
+type s3SegmentLog struct {
+	mu   sync.Mutex
+	seq  int64    // sequence number of the current segment
+	ops  [][]byte // encoded operations of the current segment
+	size int      // number of operations written since last compaction
+}
+
+type s3SegmentOp struct {
+	Op     string  `json:"op"`
+	Entity *Entity `json:"entity,omitempty"`
+	Id     string  `json:"id,omitempty"`
+}
+
+type s3Snapshot struct {
+	Segment  int64    `json:"segment"` // all segments up to this sequence number are part of the snapshot
+	Entities []Entity `json:"entities"`
+}
+
+func createS3Segments(serviceNames []string) (*s3Segments, error) {
+	size := defaultS3SegmentSize
+	if value := os.Getenv("AWS_S3_SEGMENT_SIZE"); value != "" {
+		var err error
+		size, err = strconv.Atoi(value)
+		if err != nil || size < 1 {
+			return nil, fmt.Errorf("invalid segment size %q in environment variable %q", value, "AWS_S3_SEGMENT_SIZE")
+		}
+	}
+
+	compactInterval := defaultS3CompactInterval
+	if value := os.Getenv("AWS_S3_COMPACT_INTERVAL"); value != "" {
+		var err error
+		compactInterval, err = time.ParseDuration(value)
+		if err != nil || compactInterval <= 0 {
+			return nil, fmt.Errorf("invalid compact interval %q in environment variable %q", value, "AWS_S3_COMPACT_INTERVAL")
+		}
+	}
+
+	logs := make(map[string]*s3SegmentLog, len(serviceNames))
+	for _, serviceName := range serviceNames {
+		logs[serviceName] = &s3SegmentLog{seq: 1}
+	}
+
+	return &s3Segments{
+		size:            size,
+		compactInterval: compactInterval,
+		logs:            logs,
+	}, nil
+}
+
+// loadSegmentedService loads the snapshot and replays all segments written after the snapshot
+func (storage *s3Storage) loadSegmentedService(ctx context.Context, serviceName string) error {
+	log := storage.segments.logs[serviceName]
+	log.mu.Lock()
+	defer log.mu.Unlock()
+
+	snapshot, err := storage.loadSnapshot(ctx, serviceName)
+	if err != nil {
+		return err
+	}
+	for _, e := range snapshot.Entities {
+		storage.memStorage.AddEntity(serviceName, e)
+	}
+
+	var seqs []int64
+	err = storage.listObjects(ctx, getS3SegmentPrefix(serviceName), func(object *s3.Object) error {
+		seq, err := strconv.ParseInt(strings.TrimSuffix(path.Base(*object.Key), ".ndjson"), 10, 64)
+		if err != nil {
+			storage.logger.Warnf("ignoring unknown object %q in segments of service %q", *object.Key, serviceName)
+			return nil
+		}
+		// segments included in the snapshot are leftovers of interrupted compaction
+		if seq > snapshot.Segment {
+			seqs = append(seqs, seq)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+
+	ops := 0
+	for _, seq := range seqs {
+		count, err := storage.replaySegment(ctx, serviceName, seq)
+		if err != nil {
+			return err
+		}
+		ops += count
+	}
+
+	log.seq = snapshot.Segment + 1
+	if len(seqs) > 0 {
+		log.seq = seqs[len(seqs)-1] + 1
+	}
+	log.size = ops
+
+	storage.logger.Infof("service %q: %d entities loaded from s3 snapshot, %d operations replayed from %d segment(s)", serviceName, len(snapshot.Entities), ops, len(seqs))
+
+	return nil
+}
+
+func (storage *s3Storage) loadSnapshot(ctx context.Context, serviceName string) (s3Snapshot, error) {
+	var snapshot s3Snapshot
+	data, _, err := storage.getObject(ctx, getS3SnapshotKey(serviceName))
+	if isS3NotFound(err) {
+		return snapshot, nil // no snapshot yet
+	}
+	if err != nil {
+		return snapshot, err
+	}
+
+	if err = json.Unmarshal(data, &snapshot); err != nil {
+		return snapshot, fmt.Errorf("%w: could not decode snapshot of service %q: %v", errS3CorruptObject, serviceName, err)
+	}
+
+	return snapshot, nil
+}
+
+// replaySegment applies operations of the segment to the memory cache
+func (storage *s3Storage) replaySegment(ctx context.Context, serviceName string, seq int64) (int, error) {
+	key := getS3SegmentKey(serviceName, seq)
+	data, _, err := storage.getObject(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var op s3SegmentOp
+		err = json.Unmarshal(scanner.Bytes(), &op)
+		if err == nil && (op.Op == s3SegmentOpAdd || op.Op == s3SegmentOpUpdate) && op.Entity == nil {
+			err = errors.New("missing entity")
+		}
+		if err != nil {
+			err = fmt.Errorf("%w: could not decode operation %d of segment %q: %v", errS3CorruptObject, count+1, key, err)
+			if storage.loadPolicy == s3LoadPolicySkip {
+				storage.logger.WithError(err).Warn("skipping corrupt operation")
+				continue
+			}
+			return count, err
+		}
+
+		storage.applySegmentOp(serviceName, op)
+		count++
+	}
+
+	return count, scanner.Err()
+}
+
+func (storage *s3Storage) applySegmentOp(serviceName string, op s3SegmentOp) {
+	switch op.Op {
+	case s3SegmentOpAdd:
+		_ = storage.memStorage.InsertEntity(serviceName, *op.Entity) // entities are kept ordered by created time
+	case s3SegmentOpUpdate:
+		_ = storage.memStorage.UpdateEntity(serviceName, *op.Entity)
+	case s3SegmentOpDelete:
+		_ = storage.memStorage.Delete(context.Background(), serviceName, op.Id) // already deleted entity is fine
+	}
+}
+
+// appendSegmentOp appends the operation to the current segment of the service and uploads it.
+// The operation is applied to the memory cache only when the upload succeeds. The check (when given) runs while
+// other operations of the service wait, so it can verify and change the operation atomically.
+func (storage *s3Storage) appendSegmentOp(ctx context.Context, serviceName string, op s3SegmentOp, check func() error) error {
+	log, found := storage.segments.logs[serviceName]
+	if !found {
+		return fmt.Errorf("unknown service %q", serviceName)
+	}
+
+	log.mu.Lock()
+	defer log.mu.Unlock()
+
+	if check != nil {
+		if err := check(); err != nil {
+			return err
+		}
+	}
+	data, err := json.Marshal(op)
+	if err != nil {
+		return fmt.Errorf("could not encode segment operation: %w", err)
+	}
+
+	ops := append(log.ops[:len(log.ops):len(log.ops)], data)
+	if _, err = storage.putObject(ctx, getS3SegmentKey(serviceName, log.seq), bytes.Join(ops, []byte("\n")), "application/x-ndjson", s3Precondition{}); err != nil {
+		return err
+	}
+
+	log.ops = ops
+	log.size++
+	if len(log.ops) >= storage.segments.size {
+		log.seq++
+		log.ops = nil
+	}
+	storage.applySegmentOp(serviceName, op)
+
+	return nil
+}
+
+// runCompaction compacts all services periodically until the context is canceled
+func (storage *s3Storage) runCompaction(ctx context.Context, serviceNames []string) {
+	ticker := time.NewTicker(storage.segments.compactInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, serviceName := range serviceNames {
+				if err := storage.compact(ctx, serviceName); err != nil {
+					storage.logger.WithError(err).Errorf("could not compact s3 segments of service %q", serviceName)
+				}
+			}
+		}
+	}
+}
+
+// compact writes all entities of the service to a new snapshot and removes compacted segments
+func (storage *s3Storage) compact(ctx context.Context, serviceName string) error {
+	log := storage.segments.logs[serviceName]
+	log.mu.Lock()
+	defer log.mu.Unlock()
+
+	if log.size == 0 {
+		return nil // nothing changed since last compaction
+	}
+
+	entities, err := storage.memStorage.List(ctx, serviceName)
+	if err != nil {
+		return err
+	}
+
+	lastSeq := log.seq
+	if len(log.ops) == 0 {
+		lastSeq-- // current segment was not written yet
+	}
+
+	data, err := json.Marshal(s3Snapshot{Segment: lastSeq, Entities: entities})
+	if err != nil {
+		return fmt.Errorf("could not encode snapshot: %w", err)
+	}
+	if _, err = storage.putObject(ctx, getS3SnapshotKey(serviceName), data, "application/json", s3Precondition{}); err != nil {
+		return err
+	}
+
+	// new operations go to a new segment, old segments are not needed anymore
+	log.seq = lastSeq + 1
+	log.ops = nil
+	log.size = 0
+
+	var keys []string
+	err = storage.listObjects(ctx, getS3SegmentPrefix(serviceName), func(object *s3.Object) error {
+		seq, err := strconv.ParseInt(strings.TrimSuffix(path.Base(*object.Key), ".ndjson"), 10, 64)
+		if err == nil && seq <= lastSeq {
+			keys = append(keys, *object.Key)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err = storage.deleteObject(ctx, key, ""); err != nil {
+			return err
+		}
+	}
+
+	storage.logger.Infof("service %q: snapshot with %d entities written, %d segment(s) removed", serviceName, len(entities), len(keys))
+
+	return nil
+}
+
+func getS3SnapshotKey(serviceName string) string {
+	return fmt.Sprintf("%s/_snapshot.json", serviceName)
+}
+
+func getS3SegmentPrefix(serviceName string) string {
+	return fmt.Sprintf("%s/_segments/", serviceName)
+}
+
+func getS3SegmentKey(serviceName string, seq int64) string {
+	return fmt.Sprintf("%s%020d.ndjson", getS3SegmentPrefix(serviceName), seq)
+}
@@ -0,0 +1,460 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testBucketName = "usa-test"
+
+// fakeS3 is a minimal in-process S3 stand-in with path style addressing for one bucket
+type fakeS3 struct {
+	mu       sync.Mutex
+	objects  map[string][]byte
+	pageSize int
+}
+
+type fakeS3Object struct {
+	Key  string `xml:"Key"`
+	ETag string `xml:"ETag"`
+	Size int    `xml:"Size"`
+}
+
+type fakeS3ListResult struct {
+	XMLName               xml.Name       `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListBucketResult"`
+	Name                  string         `xml:"Name"`
+	Prefix                string         `xml:"Prefix"`
+	KeyCount              int            `xml:"KeyCount"`
+	MaxKeys               int            `xml:"MaxKeys"`
+	IsTruncated           bool           `xml:"IsTruncated"`
+	NextContinuationToken string         `xml:"NextContinuationToken,omitempty"`
+	Contents              []fakeS3Object `xml:"Contents"`
+}
+
+func newFakeS3(t *testing.T) *fakeS3 {
+	fake := &fakeS3{
+		objects:  make(map[string][]byte),
+		pageSize: 1000,
+	}
+
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	t.Setenv("AWS_ACCESS_KEY", "test")
+	t.Setenv("AWS_SECRET_KEY", "test")
+	t.Setenv("AWS_REGION", "eu-west-1")
+	t.Setenv("AWS_BUCKET_NAME", testBucketName)
+	t.Setenv("AWS_S3_ENDPOINT", server.URL)
+
+	return fake
+}
+
+func fakeS3ETag(data []byte) string {
+	sum := md5.Sum(data)
+	return fmt.Sprintf("%q", hex.EncodeToString(sum[:]))
+}
+
+func (fake *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	if parts[0] != testBucketName {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if len(parts) == 1 || parts[1] == "" {
+		switch r.Method {
+		case http.MethodHead:
+			w.WriteHeader(http.StatusOK)
+		case http.MethodGet:
+			fake.list(w, r)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	key := parts[1]
+	_, exists := fake.objects[key]
+	ifMatch, ifNoneMatch := r.Header.Get("If-Match"), r.Header.Get("If-None-Match")
+	if (ifMatch != "" && fakeS3ETag(fake.objects[key]) != ifMatch) || (ifNoneMatch == "*" && exists) {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		_, _ = fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?><Error><Code>PreconditionFailed</Code><Message>precondition failed</Message></Error>`)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		data, found := fake.objects[key]
+		if !found {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?><Error><Code>NoSuchKey</Code><Message>not found</Message></Error>`)
+			return
+		}
+		w.Header().Set("ETag", fakeS3ETag(data))
+		_, _ = w.Write(data)
+	case http.MethodPut:
+		data, _ := io.ReadAll(r.Body)
+		fake.objects[key] = data
+		w.Header().Set("ETag", fakeS3ETag(data))
+	case http.MethodDelete:
+		delete(fake.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (fake *fakeS3) list(w http.ResponseWriter, r *http.Request) {
+	prefix := r.URL.Query().Get("prefix")
+	var keys []string
+	for key := range fake.objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	start, _ := strconv.Atoi(r.URL.Query().Get("continuation-token"))
+	end := start + fake.pageSize
+	result := fakeS3ListResult{Name: testBucketName, Prefix: prefix, MaxKeys: fake.pageSize}
+	if end < len(keys) {
+		result.IsTruncated = true
+		result.NextContinuationToken = strconv.Itoa(end)
+	} else {
+		end = len(keys)
+	}
+
+	for _, key := range keys[start:end] {
+		data := fake.objects[key]
+		result.Contents = append(result.Contents, fakeS3Object{Key: key, ETag: fakeS3ETag(data), Size: len(data)})
+	}
+	result.KeyCount = len(result.Contents)
+
+	w.Header().Set("Content-Type", "application/xml")
+	_ = xml.NewEncoder(w).Encode(result)
+}
+
+func (fake *fakeS3) putEntity(t *testing.T, serviceName string, e Entity) {
+	data, err := json.Marshal(e)
+	assert.Nil(t, err)
+
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	fake.objects[getS3ObjectKey(serviceName, e.Id)] = data
+}
+
+func waitForS3Storage(t *testing.T, storage *s3Storage) {
+	assert.Eventually(t, func() bool {
+		return storage.Ready() || storage.Health(context.Background()) != nil
+	}, 10*time.Second, 10*time.Millisecond)
+}
+
+func TestS3StorageLoadPagination(t *testing.T) {
+	fake := newFakeS3(t)
+	fake.pageSize = 100
+	t.Setenv("AWS_S3_LOAD_WORKERS", "4")
+
+	created := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 250; i++ {
+		fake.putEntity(t, "dogs", Entity{Id: fmt.Sprintf("dog-%03d", i), Created: created.Add(time.Duration(i) * time.Second), Payload: i})
+	}
+	fake.putEntity(t, "cats", Entity{Id: "cat", Created: created, Payload: "cat"})
+
+	storage, err := CreateS3Storage(context.Background(), []string{"dogs", "cats"}, logrus.New())
+	assert.Nil(t, err)
+	waitForS3Storage(t, storage)
+	assert.True(t, storage.Ready())
+
+	ctx := context.Background()
+	dogs, err := storage.List(ctx, "dogs")
+	assert.Nil(t, err)
+	assert.Len(t, dogs, 250)
+	assert.Equal(t, "dog-000", dogs[0].Id) // ordered by created
+	assert.Equal(t, "dog-249", dogs[249].Id)
+
+	cats, err := storage.List(ctx, "cats")
+	assert.Nil(t, err)
+	assert.Len(t, cats, 1)
+
+	// new entities are written to the bucket
+	e, err := storage.Add(ctx, "cats", map[string]interface{}{"name": "tom"})
+	assert.Nil(t, err)
+	assert.Contains(t, fake.objects, getS3ObjectKey("cats", e.Id))
+	assert.Nil(t, storage.Delete(ctx, "cats", e.Id))
+	assert.NotContains(t, fake.objects, getS3ObjectKey("cats", e.Id))
+}
+
+func TestS3StorageConditionalWrite(t *testing.T) {
+	fake := newFakeS3(t)
+	ctx := context.Background()
+	storage, err := CreateS3Storage(ctx, []string{"dogs"}, logrus.New())
+	assert.Nil(t, err)
+	waitForS3Storage(t, storage)
+
+	e, err := storage.Add(ctx, "dogs", "rex")
+	assert.Nil(t, err)
+	e.Payload = "max"
+	_, err = storage.Update(ctx, "dogs", e)
+	assert.Nil(t, err)
+
+	// object changed by another writer since it was cached is not overwritten nor deleted
+	fake.putEntity(t, "dogs", Entity{Id: e.Id, Created: e.Created, Payload: "other", Version: 3})
+	e.Version = 0
+	_, err = storage.Update(ctx, "dogs", e)
+	assert.ErrorIs(t, err, errVersionConflict)
+	assert.ErrorIs(t, storage.DeleteVersion(ctx, "dogs", e.Id, 2), errVersionConflict)
+	assert.Contains(t, fake.objects, getS3ObjectKey("dogs", e.Id))
+}
+
+func TestS3StorageConcurrentInsert(t *testing.T) {
+	for _, layout := range []string{s3LayoutObjects, s3LayoutSegments} {
+		t.Run(layout, func(t *testing.T) {
+			fake := newFakeS3(t)
+			t.Setenv("AWS_S3_LAYOUT", layout)
+			ctx := context.Background()
+			storage, err := CreateS3Storage(ctx, []string{"dogs"}, logrus.New())
+			assert.Nil(t, err)
+			waitForS3Storage(t, storage)
+
+			// only one of concurrent inserts of the same ID is stored
+			created := time.Now().UTC().Truncate(time.Microsecond)
+			errs := make(chan error, 20)
+			var wg sync.WaitGroup
+			for i := 0; i < 20; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					errs <- storage.Insert(ctx, "dogs", Entity{Id: "rex", Created: created, Payload: float64(i), Version: 1})
+				}(i)
+			}
+			wg.Wait()
+			close(errs)
+			stored := 0
+			for err := range errs {
+				if err == nil {
+					stored++
+				} else {
+					assert.ErrorIs(t, err, errEntityExists)
+				}
+			}
+			assert.Equal(t, 1, stored)
+
+			// the bucket holds the cached entity
+			cached, err := storage.Get(ctx, "dogs", "rex")
+			assert.Nil(t, err)
+			reopened, err := CreateS3Storage(ctx, []string{"dogs"}, logrus.New())
+			assert.Nil(t, err)
+			waitForS3Storage(t, reopened)
+			loaded, err := reopened.Get(ctx, "dogs", "rex")
+			assert.Nil(t, err)
+			assert.Equal(t, cached.Payload, loaded.Payload)
+
+			if layout == s3LayoutObjects {
+				// object written by another instance is not overwritten
+				fake.putEntity(t, "dogs", Entity{Id: "max", Created: created, Payload: "other"})
+				assert.ErrorIs(t, reopened.Insert(ctx, "dogs", Entity{Id: "max", Created: created, Payload: "mine"}), errEntityExists)
+				assert.Contains(t, string(fake.objects[getS3ObjectKey("dogs", "max")]), "other")
+			}
+		})
+	}
+}
+
+func TestS3StorageLoadPolicy(t *testing.T) {
+	fake := newFakeS3(t)
+	fake.putEntity(t, "dogs", Entity{Id: "rex", Created: time.Now(), Payload: "rex"})
+	fake.objects["dogs/broken.json"] = []byte("{not a json")
+
+	// fail policy (default) stops the application
+	exitCode := make(chan int, 1)
+	logger := logrus.New()
+	logger.ExitFunc = func(code int) { exitCode <- code }
+	storage, err := CreateS3Storage(context.Background(), []string{"dogs"}, logger)
+	assert.Nil(t, err)
+	waitForS3Storage(t, storage)
+	assert.False(t, storage.Ready())
+	assert.Error(t, storage.Health(context.Background()))
+	assert.Equal(t, 1, <-exitCode)
+
+	// skip policy
+	t.Setenv("AWS_S3_LOAD_POLICY", s3LoadPolicySkip)
+	storage, err = CreateS3Storage(context.Background(), []string{"dogs"}, logrus.New())
+	assert.Nil(t, err)
+	waitForS3Storage(t, storage)
+	assert.True(t, storage.Ready())
+	assert.Nil(t, storage.Health(context.Background()))
+	list, err := storage.List(context.Background(), "dogs")
+	assert.Nil(t, err)
+	assert.Len(t, list, 1)
+
+	// invalid policy
+	t.Setenv("AWS_S3_LOAD_POLICY", "ignore")
+	_, err = CreateS3Storage(context.Background(), []string{"dogs"}, logrus.New())
+	assert.Error(t, err)
+}
+
+func TestS3StorageSegmentsLayout(t *testing.T) {
+	fake := newFakeS3(t)
+	t.Setenv("AWS_S3_LAYOUT", s3LayoutSegments)
+	t.Setenv("AWS_S3_SEGMENT_SIZE", "2")
+	ctx := context.Background()
+
+	open := func() *s3Storage {
+		storage, err := CreateS3Storage(ctx, []string{"dogs"}, logrus.New())
+		assert.Nil(t, err)
+		waitForS3Storage(t, storage)
+		assert.True(t, storage.Ready())
+		return storage
+	}
+
+	storage := open()
+	var ids []string
+	for i := 0; i < 5; i++ {
+		e, err := storage.Add(ctx, "dogs", map[string]interface{}{"num": float64(i)})
+		assert.Nil(t, err)
+		ids = append(ids, e.Id)
+	}
+	assert.Nil(t, storage.Delete(ctx, "dogs", ids[1]))
+	assert.Error(t, storage.Delete(ctx, "dogs", "missing"))
+
+	// 6 operations in segments of size 2, no object per entity
+	assert.Len(t, fake.objects, 3)
+	assert.Contains(t, fake.objects, getS3SegmentKey("dogs", 3))
+
+	// operations are replayed after restart
+	storage = open()
+	list, err := storage.List(ctx, "dogs")
+	assert.Nil(t, err)
+	assert.Len(t, list, 4)
+	assert.Equal(t, ids[0], list[0].Id)
+	assert.Equal(t, ids[2], list[1].Id)
+
+	// compaction replaces segments with snapshot
+	assert.Nil(t, storage.compact(ctx, "dogs"))
+	assert.Len(t, fake.objects, 1)
+	assert.Contains(t, fake.objects, getS3SnapshotKey("dogs"))
+
+	e, err := storage.Add(ctx, "dogs", map[string]interface{}{"num": float64(5)})
+	assert.Nil(t, err)
+	assert.Contains(t, fake.objects, getS3SegmentKey("dogs", 4))
+
+	// leftover segment of interrupted compaction is ignored
+	fake.objects[getS3SegmentKey("dogs", 1)] = []byte(`{"op":"delete","id":"` + ids[0] + `"}`)
+
+	storage = open()
+	list, err = storage.List(ctx, "dogs")
+	assert.Nil(t, err)
+	assert.Len(t, list, 5)
+	assert.Equal(t, ids[0], list[0].Id)
+	assert.Equal(t, e.Id, list[4].Id)
+	assert.Equal(t, map[string]interface{}{"num": float64(5)}, list[4].Payload)
+
+	// inserted entity is ordered by created time also after restart
+	old := Entity{Id: "old", Created: list[0].Created.Add(-time.Hour), Payload: "old"}
+	assert.Nil(t, storage.Insert(ctx, "dogs", old))
+	assert.ErrorIs(t, storage.Insert(ctx, "dogs", old), errEntityExists)
+	old.Payload = "updated"
+	_, err = storage.Update(ctx, "dogs", old)
+	assert.Nil(t, err)
+	_, err = storage.Update(ctx, "dogs", Entity{Id: "old", Version: 1})
+	assert.ErrorIs(t, err, errVersionConflict)
+	assert.ErrorIs(t, storage.DeleteVersion(ctx, "dogs", "old", 1), errVersionConflict)
+	_, err = storage.Update(ctx, "dogs", Entity{Id: "missing"})
+	assert.ErrorIs(t, err, errEntityNotFound)
+	storage = open()
+	list, err = storage.List(ctx, "dogs")
+	assert.Nil(t, err)
+	assert.Equal(t, "old", list[0].Id)
+	assert.Equal(t, "updated", list[0].Payload)
+}
+
+func TestS3StorageResync(t *testing.T) {
+	fake := newFakeS3(t)
+	t.Setenv("AWS_S3_READ_THROUGH", "true")
+	ctx := context.Background()
+
+	open := func() *s3Storage {
+		storage, err := CreateS3Storage(ctx, []string{"dogs"}, logrus.New())
+		assert.Nil(t, err)
+		waitForS3Storage(t, storage)
+		return storage
+	}
+	first, second := open(), open()
+
+	// read-through on cache miss
+	e, err := first.Add(ctx, "dogs", map[string]interface{}{"name": "rex"})
+	assert.Nil(t, err)
+	found, err := second.Get(ctx, "dogs", e.Id)
+	assert.Nil(t, err)
+	assert.Equal(t, e.Id, found.Id)
+	_, err = second.Get(ctx, "dogs", "missing")
+	assert.Error(t, err)
+
+	// new entity written by another instance
+	other, err := first.Add(ctx, "dogs", map[string]interface{}{"name": "max"})
+	assert.Nil(t, err)
+	assert.Nil(t, second.resyncService(ctx, "dogs"))
+	list, err := second.List(ctx, "dogs")
+	assert.Nil(t, err)
+	assert.Len(t, list, 2)
+
+	// changed object
+	other.Payload = map[string]interface{}{"name": "maxi"}
+	fake.putEntity(t, "dogs", other)
+	assert.Nil(t, second.resyncService(ctx, "dogs"))
+	found, err = second.Get(ctx, "dogs", other.Id)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{"name": "maxi"}, found.Payload)
+
+	// deleted by another instance
+	assert.Nil(t, first.Delete(ctx, "dogs", e.Id))
+	assert.Nil(t, second.resyncService(ctx, "dogs"))
+	list, err = second.List(ctx, "dogs")
+	assert.Nil(t, err)
+	assert.Len(t, list, 1)
+	assert.Equal(t, other.Id, list[0].Id)
+
+	// insert checks entities written by another instance
+	inserted := Entity{Id: "inserted", Created: other.Created.Add(-time.Hour), Payload: "old"}
+	assert.Nil(t, first.Insert(ctx, "dogs", inserted))
+	assert.ErrorIs(t, second.Insert(ctx, "dogs", inserted), errEntityExists)
+	list, err = second.List(ctx, "dogs")
+	assert.Nil(t, err)
+	assert.Equal(t, "inserted", list[0].Id)
+
+	// updated by another instance
+	inserted.Payload = "updated"
+	_, err = first.Update(ctx, "dogs", inserted)
+	assert.Nil(t, err)
+	_, err = first.Update(ctx, "dogs", Entity{Id: "missing"})
+	assert.ErrorIs(t, err, errEntityNotFound)
+	_, err = second.Update(ctx, "dogs", Entity{Id: "inserted", Payload: "stale", Version: 1})
+	assert.ErrorIs(t, err, errVersionConflict)
+	assert.ErrorIs(t, second.DeleteVersion(ctx, "dogs", "inserted", 1), errVersionConflict)
+	assert.Nil(t, second.resyncService(ctx, "dogs"))
+	found, err = second.Get(ctx, "dogs", "inserted")
+	assert.Nil(t, err)
+	assert.Equal(t, "updated", found.Payload)
+
+	// resync is not supported by segments layout
+	t.Setenv("AWS_S3_LAYOUT", s3LayoutSegments)
+	_, err = CreateS3Storage(ctx, []string{"dogs"}, logrus.New())
+	assert.Error(t, err)
+}
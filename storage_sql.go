@@ -0,0 +1,612 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	_ "github.com/jackc/pgx/v5/stdlib"
+	_ "modernc.org/sqlite"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// sqlTimeFormat has fixed width, so timestamps are ordered correctly also when stored as text (sqlite)
+const sqlTimeFormat = "2006-01-02 15:04:05.000000-07:00"
+
+// sqlDialect contains differences between supported databases; queries use $n placeholders supported by both
+type sqlDialect struct {
+	driverName    string
+	timeType      string
+	payloadType   string
+	varcharLength bool // length of VARCHAR columns is enforced
+}
+
+var sqlDialects = map[string]sqlDialect{
+	"sqlite":   {driverName: "sqlite", timeType: "TIMESTAMP", payloadType: "TEXT"},
+	"postgres": {driverName: "pgx", timeType: "TIMESTAMPTZ", payloadType: "JSONB", varcharLength: true},
+}
+
+// sqlColumn is top-level scalar field of the payload materialised as typed column
+type sqlColumn struct {
+	field   string
+	sqlType string
+	isInt   bool
+}
+
+type sqlTable struct {
+	name    string
+	columns []sqlColumn
+}
+
+// sqlStorage stores every service in its own table (id, created, updated, expires, version, owner, payload)
+type sqlStorage struct {
+	db      *sql.DB
+	tables  map[string]sqlTable
+	timeout time.Duration // timeout of one database operation
+}
+
+func CreateSqlStorage(ctx context.Context, serviceConfigs []ServiceConfig) (*sqlStorage, error) {
+	driver := os.Getenv("SQL_DRIVER")
+	if driver == "" {
+		driver = "sqlite"
+	}
+	dialect, ok := sqlDialects[driver]
+	if !ok {
+		return nil, fmt.Errorf("unknown SQL_DRIVER %q, use sqlite or postgres", driver)
+	}
+
+	dsn := os.Getenv("SQL_DSN")
+	if dsn == "" {
+		return nil, fmt.Errorf("could not find environment variable %q for sql configuration", "SQL_DSN")
+	}
+
+	timeout, err := getTimeoutEnv("SQL_TIMEOUT")
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := sql.Open(dialect.driverName, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("could not open sql database: %w", err)
+	}
+	if driver == "sqlite" {
+		// sqlite allows only one writer at a time
+		db.SetMaxOpenConns(1)
+	}
+
+	storage := &sqlStorage{
+		db:      db,
+		tables:  make(map[string]sqlTable, len(serviceConfigs)),
+		timeout: timeout,
+	}
+
+	materialise := os.Getenv("SQL_COLUMNS") == "true"
+	prefix := os.Getenv("SQL_TABLE_PREFIX")
+	for _, serviceConfig := range serviceConfigs {
+		table := sqlTable{name: prefix + serviceConfig.Name}
+		if materialise {
+			table.columns, err = getSqlColumns(serviceConfig)
+			if err != nil {
+				_ = db.Close()
+				return nil, err
+			}
+		}
+
+		if err = storage.createTable(ctx, dialect, table); err != nil {
+			_ = db.Close()
+			return nil, fmt.Errorf("could not create table for service %q: %w", serviceConfig.Name, err)
+		}
+		storage.tables[serviceConfig.Name] = table
+	}
+
+	return storage, nil
+}
+
+// getSqlColumns returns columns for top-level scalar fields of the service ordered by name
+func getSqlColumns(serviceConfig ServiceConfig) ([]sqlColumn, error) {
+	var columns []sqlColumn
+	for name, field := range serviceConfig.Fields {
+		fieldType, err := field.GetType()
+		if err != nil {
+			return nil, err
+		}
+
+		column := sqlColumn{field: name}
+		switch fieldType {
+		case FieldTypeString, FieldTypeDate, FieldTypeRef:
+			column.sqlType = "TEXT"
+		case FieldTypeInt:
+			column.sqlType = "BIGINT"
+			column.isInt = true
+		case FieldTypeFloat:
+			column.sqlType = "DOUBLE PRECISION"
+		default:
+			continue
+		}
+
+		switch name {
+		case "id", "created", "updated", "expires", "version", "payload":
+			return nil, fmt.Errorf("field %q of service %q collides with sql column of the same name", name, serviceConfig.Name)
+		}
+		columns = append(columns, column)
+	}
+
+	sort.Slice(columns, func(i, j int) bool {
+		return columns[i].field < columns[j].field
+	})
+
+	return columns, nil
+}
+
+// createTable creates the table with indexes; materialised columns missing in existing table are added and filled
+func (storage *sqlStorage) createTable(ctx context.Context, dialect sqlDialect, table sqlTable) error {
+	ctx, cancel := context.WithTimeout(ctx, storage.timeout)
+	defer cancel()
+
+	tn := quoteSqlIdentifier(table.name)
+	statements := []string{
+		fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (id TEXT PRIMARY KEY, created %s NOT NULL, updated %s NOT NULL, expires %s, version BIGINT NOT NULL DEFAULT 1, owner TEXT, payload %s NOT NULL)",
+			tn, dialect.timeType, dialect.timeType, dialect.timeType, dialect.payloadType),
+		fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON %s (created, id)", quoteSqlIdentifier(table.name+"_created_idx"), tn),
+	}
+	for _, statement := range statements {
+		if _, err := storage.db.ExecContext(ctx, statement); err != nil {
+			return err
+		}
+	}
+
+	existing, err := storage.getTableColumns(ctx, table.name)
+	if err != nil {
+		return err
+	}
+
+	// tables created before entities could expire
+	if !existing["expires"] {
+		if _, err = storage.db.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %s ADD COLUMN expires %s", tn, dialect.timeType)); err != nil {
+			return err
+		}
+	}
+	// tables created with IDs limited to UUIDs, which are shorter than IDs of internal records (e.g. history)
+	if dialect.varcharLength {
+		limited, err := storage.isIdLimited(ctx, table.name)
+		if err != nil {
+			return err
+		}
+		if limited {
+			if _, err = storage.db.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %s ALTER COLUMN id TYPE TEXT", tn)); err != nil {
+				return err
+			}
+		}
+	}
+	// tables created before entities had versions
+	if !existing["version"] {
+		if _, err = storage.db.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %s ADD COLUMN version BIGINT NOT NULL DEFAULT 1", tn)); err != nil {
+			return err
+		}
+	}
+	// tables created before owners of entities were stored
+	if !existing["owner"] {
+		if _, err = storage.db.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %s ADD COLUMN owner TEXT", tn)); err != nil {
+			return err
+		}
+	}
+
+	added := false
+	for _, column := range table.columns {
+		cn := quoteSqlIdentifier(column.field)
+		if !existing[column.field] {
+			if _, err = storage.db.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", tn, cn, column.sqlType)); err != nil {
+				return err
+			}
+			added = true
+		}
+
+		index := quoteSqlIdentifier(fmt.Sprintf("%s_%s_idx", table.name, column.field))
+		if _, err = storage.db.ExecContext(ctx, fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON %s (%s)", index, tn, cn)); err != nil {
+			return err
+		}
+	}
+
+	if added {
+		return storage.fillColumns(ctx, table)
+	}
+
+	return nil
+}
+
+// isIdLimited reports whether the id column of the table has limited length
+func (storage *sqlStorage) isIdLimited(ctx context.Context, tableName string) (bool, error) {
+	var length sql.NullInt64
+	err := storage.db.QueryRowContext(ctx, "SELECT character_maximum_length FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = $1 AND column_name = 'id'", tableName).Scan(&length)
+	if err != nil {
+		return false, fmt.Errorf("could not read type of id column: %w", err)
+	}
+
+	return length.Valid, nil
+}
+
+func (storage *sqlStorage) getTableColumns(ctx context.Context, tableName string) (map[string]bool, error) {
+	rows, err := storage.db.QueryContext(ctx, fmt.Sprintf("SELECT * FROM %s WHERE 1 = 0", quoteSqlIdentifier(tableName)))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	names, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+
+	columns := make(map[string]bool, len(names))
+	for _, name := range names {
+		columns[name] = true
+	}
+
+	return columns, nil
+}
+
+// fillColumns sets materialised columns of rows stored before the columns existed
+func (storage *sqlStorage) fillColumns(ctx context.Context, table sqlTable) error {
+	rows, err := storage.db.QueryContext(ctx, fmt.Sprintf("SELECT id, payload FROM %s", quoteSqlIdentifier(table.name)))
+	if err != nil {
+		return err
+	}
+
+	payloads := make(map[string]interface{})
+	for rows.Next() {
+		var id string
+		var data []byte
+		if err = rows.Scan(&id, &data); err != nil {
+			_ = rows.Close()
+			return err
+		}
+		var payload interface{}
+		if err = json.Unmarshal(data, &payload); err != nil {
+			_ = rows.Close()
+			return fmt.Errorf("could not decode payload of entity %q: %w", id, err)
+		}
+		payloads[id] = payload
+	}
+	if err = rows.Close(); err != nil {
+		return err
+	}
+
+	var assignments []string
+	for k, column := range table.columns {
+		assignments = append(assignments, fmt.Sprintf("%s = $%d", quoteSqlIdentifier(column.field), k+1))
+	}
+	query := fmt.Sprintf("UPDATE %s SET %s WHERE id = $%d", quoteSqlIdentifier(table.name), strings.Join(assignments, ", "), len(table.columns)+1)
+	for id, payload := range payloads {
+		args := append(table.columnValues(payload), id)
+		if _, err = storage.db.ExecContext(ctx, query, args...); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (storage *sqlStorage) Add(ctx context.Context, serviceName string, payload interface{}) (Entity, error) {
+	e, err := createEntity(payload)
+	if err != nil {
+		return e, err
+	}
+	// stored with microsecond precision
+	e.Created = e.Created.UTC().Truncate(time.Microsecond)
+
+	if err = storage.Insert(ctx, serviceName, e); err != nil {
+		return Entity{}, err
+	}
+
+	return e, nil
+}
+
+func (storage *sqlStorage) Insert(ctx context.Context, serviceName string, e Entity) error {
+	ctx, cancel := context.WithTimeout(ctx, storage.timeout)
+	defer cancel()
+
+	table, err := storage.getTable(serviceName)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(e.Payload)
+	if err != nil {
+		return fmt.Errorf("could not encode entity: %w", err)
+	}
+
+	columns := []string{"id", "created", "updated", "expires", "version", "owner", "payload"}
+	created := e.Created.UTC().Format(sqlTimeFormat)
+	args := []interface{}{e.Id, created, created, formatSqlExpiration(e.ExpiresAt), e.GetVersion(), formatSqlOwner(e.Owner), string(data)}
+	for _, column := range table.columns {
+		columns = append(columns, quoteSqlIdentifier(column.field))
+	}
+	args = append(args, table.columnValues(e.Payload)...)
+
+	placeholders := make([]string, len(args))
+	for k := range args {
+		placeholders[k] = fmt.Sprintf("$%d", k+1)
+	}
+
+	query := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s) ON CONFLICT (id) DO NOTHING",
+		quoteSqlIdentifier(table.name), strings.Join(columns, ", "), strings.Join(placeholders, ", "))
+	res, err := storage.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return fmt.Errorf("could not write entity to sql database: %w", err)
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("could not write entity to sql database: %w", err)
+	}
+	if affected == 0 {
+		return errEntityExists
+	}
+
+	return nil
+}
+
+// Update replaces payload and materialised columns of the entity; created time is kept and the version is checked
+// and incremented by the same statement
+func (storage *sqlStorage) Update(ctx context.Context, serviceName string, e Entity) (Entity, error) {
+	ctx, cancel := context.WithTimeout(ctx, storage.timeout)
+	defer cancel()
+
+	table, err := storage.getTable(serviceName)
+	if err != nil {
+		return Entity{}, err
+	}
+
+	data, err := json.Marshal(e.Payload)
+	if err != nil {
+		return Entity{}, fmt.Errorf("could not encode entity: %w", err)
+	}
+
+	assignments := []string{"version = version + 1", "updated = $1", "expires = $2", "payload = $3"}
+	args := []interface{}{time.Now().UTC().Format(sqlTimeFormat), formatSqlExpiration(e.ExpiresAt), string(data)}
+	for k, column := range table.columns {
+		assignments = append(assignments, fmt.Sprintf("%s = $%d", quoteSqlIdentifier(column.field), len(args)+k+1))
+	}
+	args = append(args, table.columnValues(e.Payload)...)
+	args = append(args, e.Id)
+
+	query := fmt.Sprintf("UPDATE %s SET %s WHERE id = $%d", quoteSqlIdentifier(table.name), strings.Join(assignments, ", "), len(args))
+	if e.Version != 0 {
+		args = append(args, e.Version)
+		query += fmt.Sprintf(" AND version = $%d", len(args))
+	}
+	// the version is incremented by the database, so the stored one is returned by the query
+	version := e.Version
+	err = storage.db.QueryRowContext(ctx, query+" RETURNING version", args...).Scan(&e.Version)
+	if err == sql.ErrNoRows {
+		return Entity{}, storage.getMissingError(ctx, table, e.Id, version)
+	}
+	if err != nil {
+		return Entity{}, fmt.Errorf("could not write entity to sql database: %w", err)
+	}
+
+	return e, nil
+}
+
+// getMissingError tells why no row with the ID and version was changed
+func (storage *sqlStorage) getMissingError(ctx context.Context, table sqlTable, id string, version int64) error {
+	var stored int64
+	err := storage.db.QueryRowContext(ctx, fmt.Sprintf("SELECT version FROM %s WHERE id = $1", quoteSqlIdentifier(table.name)), id).Scan(&stored)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("%w: %q", errEntityNotFound, id)
+	}
+	if err != nil {
+		return fmt.Errorf("could not read entity %q: %w", id, err)
+	}
+
+	return checkVersion(Entity{Id: id, Version: stored}, version)
+}
+
+func (storage *sqlStorage) List(ctx context.Context, serviceName string) ([]Entity, error) {
+	list, _, err := storage.ListPage(ctx, serviceName, "", 0)
+	return list, err
+}
+
+// ListPage returns entities ordered by creation time starting after the cursor (ID of the last entity of previous page)
+func (storage *sqlStorage) ListPage(ctx context.Context, serviceName, cursor string, limit int) ([]Entity, string, error) {
+	ctx, cancel := context.WithTimeout(ctx, storage.timeout)
+	defer cancel()
+
+	table, err := storage.getTable(serviceName)
+	if err != nil {
+		return []Entity{}, "", err
+	}
+	tn := quoteSqlIdentifier(table.name)
+
+	query := fmt.Sprintf("SELECT id, created, expires, version, owner, payload FROM %s", tn)
+	var args []interface{}
+	if cursor != "" {
+		var created time.Time
+		err = storage.db.QueryRowContext(ctx, fmt.Sprintf("SELECT created FROM %s WHERE id = $1", tn), cursor).Scan(&created)
+		if err == sql.ErrNoRows {
+			return []Entity{}, "", fmt.Errorf("could not find cursor entity %q", cursor)
+		}
+		if err != nil {
+			return []Entity{}, "", fmt.Errorf("could not list entities from sql database: %w", err)
+		}
+
+		query += " WHERE created > $1 OR (created = $1 AND id > $2)"
+		args = append(args, created.UTC().Format(sqlTimeFormat), cursor)
+	}
+	query += " ORDER BY created, id"
+	if limit > 0 {
+		// one more entity tells whether there is next page
+		query += fmt.Sprintf(" LIMIT %d", limit+1)
+	}
+
+	rows, err := storage.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return []Entity{}, "", fmt.Errorf("could not list entities from sql database: %w", err)
+	}
+	defer rows.Close()
+
+	list := []Entity{}
+	for rows.Next() {
+		e, err := scanSqlEntity(rows)
+		if err != nil {
+			return []Entity{}, "", err
+		}
+		list = append(list, e)
+	}
+	if err = rows.Err(); err != nil {
+		return []Entity{}, "", fmt.Errorf("could not list entities from sql database: %w", err)
+	}
+
+	if limit > 0 && len(list) > limit {
+		return list[:limit], list[limit-1].Id, nil
+	}
+
+	return list, "", nil
+}
+
+func (storage *sqlStorage) Get(ctx context.Context, serviceName, id string) (Entity, error) {
+	ctx, cancel := context.WithTimeout(ctx, storage.timeout)
+	defer cancel()
+
+	table, err := storage.getTable(serviceName)
+	if err != nil {
+		return Entity{}, err
+	}
+
+	row := storage.db.QueryRowContext(ctx, fmt.Sprintf("SELECT id, created, expires, version, owner, payload FROM %s WHERE id = $1", quoteSqlIdentifier(table.name)), id)
+	e, err := scanSqlEntity(row)
+	if err == sql.ErrNoRows {
+		return Entity{}, fmt.Errorf("%w: %q", errEntityNotFound, id)
+	}
+
+	return e, err
+}
+
+func (storage *sqlStorage) Delete(ctx context.Context, serviceName, id string) error {
+	return storage.DeleteVersion(ctx, serviceName, id, 0)
+}
+
+func (storage *sqlStorage) DeleteVersion(ctx context.Context, serviceName, id string, version int64) error {
+	ctx, cancel := context.WithTimeout(ctx, storage.timeout)
+	defer cancel()
+
+	table, err := storage.getTable(serviceName)
+	if err != nil {
+		return err
+	}
+
+	query := fmt.Sprintf("DELETE FROM %s WHERE id = $1", quoteSqlIdentifier(table.name))
+	args := []interface{}{id}
+	if version != 0 {
+		query += " AND version = $2"
+		args = append(args, version)
+	}
+	res, err := storage.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return fmt.Errorf("could not delete entity %q: %w", id, err)
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("could not delete entity %q: %w", id, err)
+	}
+	if affected == 0 {
+		return storage.getMissingError(ctx, table, id, version)
+	}
+
+	return nil
+}
+
+func (storage *sqlStorage) Health(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, storage.timeout)
+	defer cancel()
+
+	if err := storage.db.PingContext(ctx); err != nil {
+		return fmt.Errorf("could not reach sql database: %w", err)
+	}
+
+	return nil
+}
+
+func (storage *sqlStorage) Ready() bool {
+	return true
+}
+
+func (storage *sqlStorage) Close() error {
+	return storage.db.Close()
+}
+
+func (storage *sqlStorage) getTable(serviceName string) (sqlTable, error) {
+	table, ok := storage.tables[serviceName]
+	if !ok {
+		return sqlTable{}, fmt.Errorf("unknown service %q", serviceName)
+	}
+
+	return table, nil
+}
+
+// columnValues returns values of materialised columns; missing values and values of unexpected type are NULL
+func (table sqlTable) columnValues(payload interface{}) []interface{} {
+	fields, _ := payload.(map[string]interface{})
+	values := make([]interface{}, len(table.columns))
+	for k, column := range table.columns {
+		switch value := fields[column.field].(type) {
+		case string:
+			values[k] = value
+		case float64:
+			if column.isInt {
+				values[k] = int64(value)
+			} else {
+				values[k] = value
+			}
+		}
+	}
+
+	return values
+}
+
+func scanSqlEntity(row interface{ Scan(...interface{}) error }) (Entity, error) {
+	var e Entity
+	var data []byte
+	var expires sql.NullTime
+	var owner sql.NullString
+	if err := row.Scan(&e.Id, &e.Created, &expires, &e.Version, &owner, &data); err != nil {
+		return Entity{}, err
+	}
+	if err := json.Unmarshal(data, &e.Payload); err != nil {
+		return Entity{}, fmt.Errorf("could not decode payload of entity %q: %w", e.Id, err)
+	}
+	e.Created = e.Created.UTC()
+	if expires.Valid {
+		expiresAt := expires.Time.UTC()
+		e.ExpiresAt = &expiresAt
+	}
+	e.Owner = owner.String
+
+	return e, nil
+}
+
+// formatSqlOwner returns value of owner column, NULL when the entity has no owner
+func formatSqlOwner(owner string) interface{} {
+	if owner == "" {
+		return nil
+	}
+
+	return owner
+}
+
+// formatSqlExpiration returns value of expires column, NULL when the entity does not expire
+func formatSqlExpiration(expiresAt *time.Time) interface{} {
+	if expiresAt == nil {
+		return nil
+	}
+
+	return expiresAt.UTC().Format(sqlTimeFormat)
+}
+
+func quoteSqlIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
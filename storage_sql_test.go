@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func sqlTestServiceConfig(name string) ServiceConfig {
+	return ServiceConfig{
+		Name: name,
+		Fields: map[string]*FieldConfig{
+			"name":    {Name: "name", Type: "string"},
+			"age":     {Name: "age", Type: "int"},
+			"weight":  {Name: "weight", Type: "float"},
+			"address": {Name: "address", Type: "object"},
+		},
+	}
+}
+
+func TestSqlStorage(t *testing.T) {
+	t.Setenv("SQL_DSN", filepath.Join(t.TempDir(), "usa.db"))
+	ctx := context.Background()
+
+	s, err := CreateSqlStorage(ctx, []ServiceConfig{sqlTestServiceConfig("dogs"), sqlTestServiceConfig("good-cats")})
+	assert.Nil(t, err)
+	defer s.Close()
+	assert.Nil(t, s.Health(ctx))
+
+	var ids []string
+	for i := 0; i < 5; i++ {
+		e, err := s.Add(ctx, "dogs", map[string]interface{}{"age": float64(i)})
+		assert.Nil(t, err)
+		ids = append(ids, e.Id)
+		// entities are ordered by created time stored with microsecond precision
+		time.Sleep(time.Microsecond)
+	}
+	_, err = s.Add(ctx, "good-cats", map[string]interface{}{"name": "tom"})
+	assert.Nil(t, err)
+
+	list, err := s.List(ctx, "dogs")
+	assert.Nil(t, err)
+	assert.Len(t, list, 5)
+	for k, e := range list {
+		assert.Equal(t, ids[k], e.Id)
+		assert.Equal(t, map[string]interface{}{"age": float64(k)}, e.Payload)
+	}
+
+	e, err := s.Get(ctx, "dogs", ids[2])
+	assert.Nil(t, err)
+	assert.Equal(t, list[2], e)
+	_, err = s.Get(ctx, "good-cats", ids[2])
+	assert.Error(t, err)
+	_, err = s.Get(ctx, "unknown", ids[2])
+	assert.Error(t, err)
+
+	assert.Nil(t, s.Delete(ctx, "dogs", ids[1]))
+	assert.Error(t, s.Delete(ctx, "dogs", ids[1]))
+
+	// paging
+	page, next, err := s.ListPage(ctx, "dogs", "", 2)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{ids[0], ids[2]}, []string{page[0].Id, page[1].Id})
+	assert.Equal(t, ids[2], next)
+	page, next, err = s.ListPage(ctx, "dogs", next, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{ids[3], ids[4]}, []string{page[0].Id, page[1].Id})
+	assert.Equal(t, "", next)
+	_, _, err = s.ListPage(ctx, "dogs", "missing", 2)
+	assert.Error(t, err)
+
+	// inserted entity keeps its ID, created time and owner
+	old := Entity{Id: "old", Created: list[0].Created.Add(-time.Hour), Payload: "old", Version: 1, Owner: "alice"}
+	assert.Nil(t, s.Insert(ctx, "dogs", old))
+	assert.ErrorIs(t, s.Insert(ctx, "dogs", old), errEntityExists)
+	page, _, err = s.ListPage(ctx, "dogs", "", 1)
+	assert.Nil(t, err)
+	assert.Equal(t, old, page[0])
+
+	// update replaces payload of existing entity only and increments its version
+	old.Payload = "updated"
+	_, err = s.Update(ctx, "dogs", old)
+	assert.Nil(t, err)
+	_, err = s.Update(ctx, "dogs", old)
+	assert.ErrorIs(t, err, errVersionConflict)
+	e, err = s.Get(ctx, "dogs", "old")
+	assert.Nil(t, err)
+	old.Version = 2
+	assert.Equal(t, old, e)
+	// any version is replaced and the version incremented by the database is returned
+	updated, err := s.Update(ctx, "dogs", Entity{Id: "old", Created: old.Created, Payload: "any"})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), updated.Version)
+	e, err = s.Get(ctx, "dogs", "old")
+	assert.Nil(t, err)
+	assert.Equal(t, "alice", e.Owner)
+	_, err = s.Update(ctx, "dogs", Entity{Id: "missing", Created: old.Created})
+	assert.ErrorIs(t, err, errEntityNotFound)
+	assert.ErrorIs(t, s.DeleteVersion(ctx, "dogs", "old", 1), errVersionConflict)
+	assert.ErrorIs(t, s.DeleteVersion(ctx, "dogs", "missing", 1), errEntityNotFound)
+
+	// expiration is kept in its own column
+	expiresAt := old.Created.Add(time.Hour)
+	expiring := Entity{Id: "expiring", Created: old.Created, Payload: "expiring", Version: 1, ExpiresAt: &expiresAt}
+	assert.Nil(t, s.Insert(ctx, "dogs", expiring))
+	e, err = s.Get(ctx, "dogs", "expiring")
+	assert.Nil(t, err)
+	assert.Equal(t, expiring, e)
+}
+
+func TestSqlStorageColumns(t *testing.T) {
+	t.Setenv("SQL_DSN", filepath.Join(t.TempDir(), "usa.db"))
+	ctx := context.Background()
+	services := []ServiceConfig{sqlTestServiceConfig("dogs")}
+
+	// entity stored before columns were materialised
+	s, err := CreateSqlStorage(ctx, services)
+	assert.Nil(t, err)
+	_, err = s.Add(ctx, "dogs", map[string]interface{}{"name": "rex", "age": float64(3), "weight": 12.5})
+	assert.Nil(t, err)
+	assert.Nil(t, s.Close())
+
+	t.Setenv("SQL_COLUMNS", "true")
+	s, err = CreateSqlStorage(ctx, services)
+	assert.Nil(t, err)
+	defer s.Close()
+	assert.Equal(t, []sqlColumn{
+		{field: "age", sqlType: "BIGINT", isInt: true},
+		{field: "name", sqlType: "TEXT"},
+		{field: "weight", sqlType: "DOUBLE PRECISION"},
+	}, s.tables["dogs"].columns)
+
+	_, err = s.Add(ctx, "dogs", map[string]interface{}{"name": "max", "age": float64(5)})
+	assert.Nil(t, err)
+
+	rows, err := s.db.QueryContext(ctx, `SELECT name, age, weight FROM dogs ORDER BY age`)
+	assert.Nil(t, err)
+	defer rows.Close()
+
+	type row struct {
+		name   string
+		age    int64
+		weight *float64
+	}
+	var result []row
+	for rows.Next() {
+		var r row
+		assert.Nil(t, rows.Scan(&r.name, &r.age, &r.weight))
+		result = append(result, r)
+	}
+	weight := 12.5
+	assert.Equal(t, []row{{name: "rex", age: 3, weight: &weight}, {name: "max", age: 5}}, result)
+
+	_, err = getSqlColumns(ServiceConfig{Name: "dogs", Fields: map[string]*FieldConfig{"created": {Type: "date"}}})
+	assert.Error(t, err)
+}
+
+// testSqlHistory stores versions of an entity, whose history records have IDs longer than UUIDs
+func testSqlHistory(t *testing.T, s *sqlStorage) {
+	ctx := context.Background()
+	cfg := sqlTestServiceConfig("dogs")
+	cfg.History = true
+	dogs := Service{Cfg: cfg, Storage: s}
+	failed := testutil.ToFloat64(historyWriteErrors.WithLabelValues("dogs"))
+
+	e, err := dogs.Put(ctx, map[string]interface{}{"name": "rex"}, nil)
+	assert.Nil(t, err)
+	_, err = dogs.Update(ctx, e.Id, map[string]interface{}{"name": "max"}, 0)
+	assert.Nil(t, err)
+	versions, err := dogs.History(ctx, e.Id)
+	assert.Nil(t, err)
+	assert.Len(t, versions, 2)
+	assert.Equal(t, failed, testutil.ToFloat64(historyWriteErrors.WithLabelValues("dogs")))
+}
+
+func TestSqlStorageHistory(t *testing.T) {
+	t.Setenv("SQL_DSN", filepath.Join(t.TempDir(), "usa.db"))
+	cfg := sqlTestServiceConfig("dogs")
+	cfg.History = true
+
+	s, err := CreateSqlStorage(context.Background(), (&Config{ServiceConfigs: []ServiceConfig{cfg}}).GetStorageServiceConfigs())
+	assert.Nil(t, err)
+	defer s.Close()
+	testSqlHistory(t, s)
+}
+
+// TestSqlStoragePostgres runs against PostgreSQL only (SQL_TEST_POSTGRES_DSN)
+func TestSqlStoragePostgres(t *testing.T) {
+	dsn := os.Getenv("SQL_TEST_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("SQL_TEST_POSTGRES_DSN is not set")
+	}
+	prefix := fmt.Sprintf("test_%d_", time.Now().UnixNano())
+	t.Setenv("SQL_DRIVER", "postgres")
+	t.Setenv("SQL_DSN", dsn)
+	t.Setenv("SQL_TABLE_PREFIX", prefix)
+	ctx := context.Background()
+	cfg := sqlTestServiceConfig("dogs")
+	cfg.History = true
+	services := (&Config{ServiceConfigs: []ServiceConfig{cfg}}).GetStorageServiceConfigs()
+
+	// table created when IDs were limited to UUIDs
+	db, err := sql.Open("pgx", dsn)
+	assert.Nil(t, err)
+	defer db.Close()
+	for _, service := range services {
+		table := quoteSqlIdentifier(prefix + service.Name)
+		_, err = db.ExecContext(ctx, fmt.Sprintf("CREATE TABLE %s (id VARCHAR(36) PRIMARY KEY, created TIMESTAMPTZ NOT NULL, updated TIMESTAMPTZ NOT NULL, payload JSONB NOT NULL)", table))
+		assert.Nil(t, err)
+		defer db.ExecContext(ctx, fmt.Sprintf("DROP TABLE %s", table))
+	}
+
+	s, err := CreateSqlStorage(ctx, services)
+	assert.Nil(t, err)
+	defer s.Close()
+	limited, err := s.isIdLimited(ctx, prefix+getHistoryServiceName("dogs"))
+	assert.Nil(t, err)
+	assert.False(t, limited)
+	testSqlHistory(t, s)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestGetTimeoutEnv(t *testing.T) {
+	timeout, err := getTimeoutEnv("USA_TEST_TIMEOUT")
+	assert.Nil(t, err)
+	assert.Equal(t, defaultStorageTimeout, timeout)
+
+	t.Setenv("USA_TEST_TIMEOUT", "1500ms")
+	timeout, err = getTimeoutEnv("USA_TEST_TIMEOUT")
+	assert.Nil(t, err)
+	assert.Equal(t, 1500*time.Millisecond, timeout)
+
+	for _, value := range []string{"5", "-1s", "0s", "fast"} {
+		t.Setenv("USA_TEST_TIMEOUT", value)
+		_, err = getTimeoutEnv("USA_TEST_TIMEOUT")
+		assert.Error(t, err, value)
+	}
+}
+
+func TestCreateStorages(t *testing.T) {
+	t.Setenv("BOLT_FILE", filepath.Join(t.TempDir(), "usa.db"))
+	ctx := context.Background()
+	logger := logrus.New()
+
+	dogs, cats, mice := testServiceConfig("dogs"), testServiceConfig("cats"), testServiceConfig("mice")
+	cats.Storage = "bolt"
+	mice.Storage = "mem"
+	cfg := &Config{ServiceConfigs: []ServiceConfig{dogs, cats, mice}, logger: logger}
+
+	storages, err := CreateStorages(ctx, "mem", cfg, logger)
+	assert.Nil(t, err)
+	assert.Len(t, storages, 2)
+	assert.Equal(t, "mem", dogs.GetStorage("mem"))
+	assert.Equal(t, "bolt", cats.GetStorage("mem"))
+
+	// every storage knows only its services
+	_, err = storages["mem"].Add(ctx, "dogs", "rex")
+	assert.Nil(t, err)
+	_, err = storages["bolt"].Add(ctx, "cats", "tom")
+	assert.Nil(t, err)
+	_, err = storages["bolt"].Add(ctx, "dogs", "rex")
+	assert.Error(t, err)
+
+	for _, stg := range storages {
+		assert.Nil(t, closeStorage(stg))
+	}
+
+	// named storages of the same type are separate instances with own settings
+	kennelFile := filepath.Join(t.TempDir(), "kennel.db")
+	kennel, shelter := testServiceConfig("dogs"), testServiceConfig("cats")
+	kennel.Storage, shelter.Storage = "kennel", "shelter"
+	cfg = &Config{ServiceConfigs: []ServiceConfig{kennel, shelter}, logger: logger, StorageConfigs: []StorageConfig{
+		{Name: "kennel", Type: "bolt", Env: map[string]string{"BOLT_FILE": kennelFile}},
+		{Name: "shelter", Type: "bolt"},
+	}}
+	storages, err = CreateStorages(ctx, "mem", cfg, logger)
+	assert.Nil(t, err)
+	assert.Len(t, storages, 2)
+	assert.NotSame(t, storages["kennel"], storages["shelter"])
+	assert.FileExists(t, kennelFile)
+	assert.NotEqual(t, kennelFile, os.Getenv("BOLT_FILE")) // environment is restored
+	for _, stg := range storages {
+		assert.Nil(t, closeStorage(stg))
+	}
+
+	mice.Storage = "unknown"
+	cfg = &Config{ServiceConfigs: []ServiceConfig{dogs, mice}, logger: logger}
+	_, err = CreateStorages(ctx, "mem", cfg, logger)
+	assert.Contains(t, fmt.Sprint(err), `unknown storage type "unknown"`)
+}
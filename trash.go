@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"os"
+	"time"
+)
+
+const (
+	trashServiceSuffix = "__trash"
+
+	defaultTrashPurgeInterval = time.Hour
+)
+
+// trashRecord is payload of the deleted entity stored in the trash service of the service. The trash entity has
+// the same ID as the deleted entity and is created at the time of the deletion.
+type trashRecord struct {
+	Created   time.Time   `json:"created"`
+	Payload   interface{} `json:"payload"`
+	Version   int64       `json:"version"`
+	ExpiresAt *time.Time  `json:"expires_at"`
+	Owner     string      `json:"owner"`
+}
+
+func getTrashServiceName(serviceName string) string {
+	return serviceName + trashServiceSuffix
+}
+
+// moveToTrash stores the entity in the trash and deletes it from the service unless it was changed in the meantime
+func (e *Service) moveToTrash(ctx context.Context, current Entity, deletedAt time.Time) error {
+	trashName := getTrashServiceName(e.Cfg.Name)
+	if err := e.Storage.Insert(ctx, trashName, encodeTrashEntity(current, deletedAt)); err != nil {
+		return fmt.Errorf("could not move entity %q to trash: %w", current.Id, err)
+	}
+
+	if err := e.Storage.DeleteVersion(ctx, e.Cfg.Name, current.Id, current.GetVersion()); err != nil {
+		// keep the entity where it was
+		_ = e.Storage.Delete(ctx, trashName, current.Id)
+		return err
+	}
+
+	return nil
+}
+
+// Trash returns deleted entities of the service which were not purged yet and are not expired
+func (e *Service) Trash(ctx context.Context) (list []Entity, err error) {
+	ctx, span := e.startSpan(ctx, "service.trash")
+	defer func() { endSpan(span, err) }()
+
+	list, err = e.listTrash(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return e.withoutExpired(list), nil
+}
+
+// listTrash returns all deleted entities of the service including expired ones
+func (e *Service) listTrash(ctx context.Context) ([]Entity, error) {
+	stored, err := e.Storage.List(ctx, getTrashServiceName(e.Cfg.Name))
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]Entity, 0, len(stored))
+	for _, s := range stored {
+		deleted, err := decodeTrashEntity(s)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, deleted)
+	}
+
+	return list, nil
+}
+
+// GetDeleted returns the deleted entity from the trash; expired entity is reported as not found
+func (e *Service) GetDeleted(ctx context.Context, id string) (entity Entity, err error) {
+	ctx, span := e.startSpan(ctx, "service.get_deleted", attribute.String("usa.entity.id", id))
+	defer func() { endSpan(span, err) }()
+
+	stored, err := e.Storage.Get(ctx, getTrashServiceName(e.Cfg.Name), id)
+	if err != nil {
+		return Entity{}, err
+	}
+
+	entity, err = decodeTrashEntity(stored)
+	if err != nil {
+		return Entity{}, err
+	}
+	if e.isExpired(entity, time.Now()) {
+		return Entity{}, fmt.Errorf("%w: %q expired", errEntityNotFound, id)
+	}
+
+	return entity, nil
+}
+
+// Undelete moves the deleted entity from the trash back to the service keeping its ID and created time; its version
+// follows the version of the deletion, so the restored entity does not match ETags read before the deletion. Values of
+// unique keys are released by the deletion, so the restore fails with errUniqueViolation when other entity uses them
+// meanwhile.
+func (e *Service) Undelete(ctx context.Context, id string) (entity Entity, err error) {
+	ctx, span := e.startSpan(ctx, "service.undelete", attribute.String("usa.entity.id", id))
+	defer func() { endSpan(span, err) }()
+
+	deleted, err := e.GetDeleted(ctx, id)
+	if err != nil {
+		return Entity{}, err
+	}
+
+	entity = Entity{Id: deleted.Id, Created: deleted.Created, Payload: deleted.Payload, Version: deleted.GetVersion() + 2, ExpiresAt: deleted.ExpiresAt, Owner: deleted.Owner}
+	if err = e.insert(ctx, entity); err != nil {
+		return Entity{}, err
+	}
+	if err = e.Storage.Delete(ctx, getTrashServiceName(e.Cfg.Name), id); err != nil {
+		return entity, fmt.Errorf("entity %q restored but not removed from trash: %w", id, err)
+	}
+
+	if e.Cfg.History {
+		v := entityVersion{Version: int(entity.Version), Timestamp: time.Now(), Actor: getActor(ctx), Payload: entity.Payload}
+		e.recordVersion(ctx, nil, id, v)
+	}
+
+	return entity, nil
+}
+
+// PurgeTrash permanently deletes entities deleted before given time (including their history) and returns their number;
+// entities referencing them are handled by on_delete of their ref fields, so entities restricted by a ref field are
+// kept and errRefRestricted is returned
+func (e *Service) PurgeTrash(ctx context.Context, before time.Time) (int, error) {
+	trashName := getTrashServiceName(e.Cfg.Name)
+	stored, err := e.Storage.List(ctx, trashName)
+	if err != nil {
+		return 0, err
+	}
+
+	// the list can be shared by the storage, so entities are deleted after they are collected
+	var deleted []Entity
+	for _, s := range stored {
+		if s.Created.Before(before) {
+			entity, err := decodeTrashEntity(s)
+			if err != nil {
+				return 0, err
+			}
+			deleted = append(deleted, entity)
+		}
+	}
+
+	purged, restricted := 0, 0
+	for _, entity := range deleted {
+		err = e.deletePermanently(ctx, trashName, entity)
+		if errors.Is(err, errRefRestricted) {
+			restricted++
+			continue
+		}
+		if err != nil {
+			return purged, fmt.Errorf("could not purge entity %q: %w", entity.Id, err)
+		}
+		if err = e.deleteHistory(ctx, entity.Id, int(entity.GetVersion())+1); err != nil {
+			return purged, err
+		}
+		purged++
+	}
+
+	return purged, getRestrictedError(restricted)
+}
+
+type trashPurger struct {
+	services []Service
+	interval time.Duration
+}
+
+// createTrashPurger returns purger of services with soft delete and trash retention, nil is returned when there
+// is nothing to purge
+func createTrashPurger(services []Service) (*trashPurger, error) {
+	purger := &trashPurger{interval: defaultTrashPurgeInterval}
+	for _, service := range services {
+		if service.Cfg.SoftDelete && service.Cfg.TrashRetention != "" {
+			purger.services = append(purger.services, service)
+		}
+	}
+	if len(purger.services) == 0 {
+		return nil, nil
+	}
+
+	if value := os.Getenv("TRASH_PURGE_INTERVAL"); value != "" {
+		interval, err := time.ParseDuration(value)
+		if err != nil || interval <= 0 {
+			return nil, fmt.Errorf("invalid purge interval %q in environment variable %q", value, "TRASH_PURGE_INTERVAL")
+		}
+		purger.interval = interval
+	}
+
+	return purger, nil
+}
+
+// Run purges entities deleted before the trash retention of their service until the context is canceled
+func (purger *trashPurger) Run(ctx context.Context, logger *logrus.Logger) {
+	ticker := time.NewTicker(purger.interval)
+	defer ticker.Stop()
+
+	for {
+		purger.purge(ctx, logger)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (purger *trashPurger) purge(ctx context.Context, logger *logrus.Logger) {
+	for _, service := range purger.services {
+		retention, err := service.Cfg.ParseTrashRetention()
+		if err != nil {
+			logger.WithError(err).Errorf("could not purge trash of service %q", service.Cfg.Name)
+			continue
+		}
+
+		purged, err := service.PurgeTrash(ctx, time.Now().Add(-retention))
+		if err != nil {
+			logger.WithError(err).Errorf("could not purge trash of service %q", service.Cfg.Name)
+		}
+		if purged > 0 {
+			logger.Infof("%d deleted entities of service %q purged", purged, service.Cfg.Name)
+		}
+	}
+}
+
+func encodeTrashEntity(e Entity, deletedAt time.Time) Entity {
+	payload := map[string]interface{}{
+		"created": e.Created.Format(time.RFC3339Nano),
+		"payload": e.Payload,
+		"version": float64(e.GetVersion()),
+	}
+	if e.ExpiresAt != nil {
+		payload["expires_at"] = e.ExpiresAt.Format(time.RFC3339Nano)
+	}
+	if e.Owner != "" {
+		payload["owner"] = e.Owner
+	}
+
+	return Entity{Id: e.Id, Created: deletedAt, Payload: payload}
+}
+
+func decodeTrashEntity(stored Entity) (Entity, error) {
+	data, err := json.Marshal(stored.Payload)
+	if err != nil {
+		return Entity{}, fmt.Errorf("could not decode deleted entity %q: %w", stored.Id, err)
+	}
+
+	var record trashRecord
+	if err = json.Unmarshal(data, &record); err != nil {
+		return Entity{}, fmt.Errorf("could not decode deleted entity %q: %w", stored.Id, err)
+	}
+	deletedAt := stored.Created
+
+	return Entity{Id: stored.Id, Created: record.Created, Payload: record.Payload, Version: record.Version, ExpiresAt: record.ExpiresAt, Owner: record.Owner, DeletedAt: &deletedAt}, nil
+}
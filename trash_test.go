@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestTrashPurger(t *testing.T) {
+	ctx := context.Background()
+	cfg := testServiceConfig("dogs")
+	cfg.SoftDelete = true
+	cfg.TrashRetention = "30d"
+	cfg.History = true
+	dogs := Service{Cfg: cfg, Storage: CreateMemStorage([]string{"dogs", "dogs__trash", "dogs__history"})}
+	cats := Service{Cfg: testServiceConfig("cats"), Storage: CreateMemStorage([]string{"cats"})}
+
+	old := Entity{Id: "old", Created: time.Now().Add(-60 * 24 * time.Hour), Payload: "old"}
+	older := Entity{Id: "older", Created: time.Now().Add(-90 * 24 * time.Hour), Payload: "older"}
+	recent := Entity{Id: "recent", Created: time.Now(), Payload: "recent"}
+	assert.Nil(t, dogs.Storage.Insert(ctx, getTrashServiceName("dogs"), encodeTrashEntity(older, time.Now().Add(-32*24*time.Hour))))
+	assert.Nil(t, dogs.Storage.Insert(ctx, getTrashServiceName("dogs"), encodeTrashEntity(old, time.Now().Add(-31*24*time.Hour))))
+	assert.Nil(t, dogs.Storage.Insert(ctx, getTrashServiceName("dogs"), encodeTrashEntity(recent, time.Now())))
+	for _, id := range []string{"old", "recent"} {
+		for version := 1; version <= 2; version++ {
+			assert.Nil(t, dogs.Storage.Insert(ctx, getHistoryServiceName("dogs"), Entity{Id: getVersionId(id, version), Created: time.Now()}))
+		}
+	}
+
+	purger, err := createTrashPurger([]Service{dogs, cats})
+	assert.Nil(t, err)
+	assert.Len(t, purger.services, 1)
+	purger.purge(ctx, logrus.New())
+
+	trash, err := dogs.Trash(ctx)
+	assert.Nil(t, err)
+	assert.Len(t, trash, 1)
+	assert.Equal(t, "recent", trash[0].Id)
+	assert.True(t, recent.Created.Equal(trash[0].Created))
+
+	// history of purged entities is deleted
+	history, err := dogs.Storage.List(ctx, getHistoryServiceName("dogs"))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{getVersionId("recent", 1), getVersionId("recent", 2)}, []string{history[0].Id, history[1].Id})
+	assert.Len(t, history, 2)
+
+	// nothing to purge without retention
+	purger, err = createTrashPurger([]Service{cats})
+	assert.Nil(t, err)
+	assert.Nil(t, purger)
+
+	t.Setenv("TRASH_PURGE_INTERVAL", "often")
+	_, err = createTrashPurger([]Service{dogs})
+	assert.Error(t, err)
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	uniqueServiceSuffix = "__unique"
+
+	// uniquePendingTimeout is time after which value claimed by a change which did not finish (e.g. interrupted by
+	// a crash) can be claimed by other entity
+	uniquePendingTimeout = time.Minute
+)
+
+var errUniqueViolation = errors.New("value of unique key is already used")
+
+// uniqueRecord is payload of the value stored in the unique service of the service. The record ID is derived from
+// the key and values, so the storage rejects the second record of the same values.
+type uniqueRecord struct {
+	Key      string `json:"key"`
+	EntityId string `json:"entity_id"`
+}
+
+func getUniqueServiceName(serviceName string) string {
+	return serviceName + uniqueServiceSuffix
+}
+
+// getUniqueIds returns IDs of records of all unique keys of the payload; keys with a missing value are skipped
+func (e *Service) getUniqueIds(payload interface{}) (map[string]string, error) {
+	ids := map[string]string{}
+	fields, ok := payload.(map[string]interface{})
+	if !ok {
+		return ids, nil
+	}
+	for _, key := range e.Cfg.GetUniqueKeys() {
+		values := make([]interface{}, 0, len(key.Fields))
+		for _, name := range key.Fields {
+			value, found := fields[name]
+			if !found || value == nil {
+				break
+			}
+			if s, ok := value.(string); ok && key.CaseInsensitive {
+				value = strings.ToLower(s)
+			}
+			values = append(values, value)
+		}
+		if len(values) < len(key.Fields) {
+			continue
+		}
+
+		data, err := json.Marshal(values)
+		if err != nil {
+			return nil, fmt.Errorf("could not encode unique key %q: %w", key.GetName(), err)
+		}
+		sum := sha256.Sum256(append([]byte(key.GetName()+"\x00"), data...))
+		ids[hex.EncodeToString(sum[:16])] = key.GetName()
+	}
+
+	return ids, nil
+}
+
+// insert stores a new entity after the values of its unique keys are claimed and its references are indexed
+func (e *Service) insert(ctx context.Context, entity Entity) error {
+	ids, err := e.getUniqueIds(entity.Payload)
+	if err != nil {
+		return err
+	}
+	claimed, err := e.claimUniqueIds(ctx, entity.Id, ids)
+	if err != nil {
+		return err
+	}
+	if err = e.addRefIds(ctx, entity.Id, e.getRefValues(entity.Payload)); err != nil {
+		e.releaseUniqueIds(ctx, entity.Id, claimed)
+		return err
+	}
+
+	// references are kept when the insert fails as the entity can be stored anyway (e.g. the response timed out)
+	if err = e.Storage.Insert(ctx, e.Cfg.Name, entity); err != nil {
+		e.releaseUniqueIds(ctx, entity.Id, claimed)
+		return err
+	}
+
+	return nil
+}
+
+// claimUniqueIds stores records of the values for the entity and returns IDs of the new ones; nothing is claimed
+// when any value is used by other entity
+func (e *Service) claimUniqueIds(ctx context.Context, entityId string, ids map[string]string) ([]string, error) {
+	var claimed []string
+	for id, key := range ids {
+		created, err := e.claimUniqueId(ctx, entityId, id, key)
+		if err != nil {
+			e.releaseUniqueIds(ctx, entityId, claimed)
+			return nil, err
+		}
+		if created {
+			claimed = append(claimed, id)
+		}
+	}
+
+	return claimed, nil
+}
+
+func (e *Service) claimUniqueId(ctx context.Context, entityId, id, key string) (bool, error) {
+	name := getUniqueServiceName(e.Cfg.Name)
+	record := uniqueRecord{Key: key, EntityId: entityId}
+	for attempt := 1; ; attempt++ {
+		now := time.Now()
+		err := e.Storage.Insert(ctx, name, Entity{Id: id, Created: now.Truncate(time.Microsecond), Payload: encodeUniqueRecord(record), Version: 1})
+		if err == nil {
+			return true, nil
+		}
+		if !errors.Is(err, errEntityExists) {
+			return false, fmt.Errorf("could not store unique key %q: %w", key, err)
+		}
+
+		existing, err := e.Storage.Get(ctx, name, id)
+		if errors.Is(err, errEntityNotFound) && attempt < maxVersionConflicts {
+			continue
+		}
+		if err != nil {
+			return false, fmt.Errorf("could not read unique key %q: %w", key, err)
+		}
+		previous, err := decodeUniqueRecord(existing)
+		if err != nil {
+			return false, err
+		}
+		if previous.EntityId == entityId {
+			return false, nil
+		}
+
+		stale, err := e.isUniqueRecordStale(ctx, existing, previous, now)
+		if err != nil {
+			return false, err
+		}
+		if !stale || attempt >= maxVersionConflicts {
+			return false, fmt.Errorf("%w: %q", errUniqueViolation, key)
+		}
+		err = e.Storage.DeleteVersion(ctx, name, existing.Id, existing.GetVersion())
+		if err != nil && !errors.Is(err, errEntityNotFound) && !errors.Is(err, errVersionConflict) {
+			return false, fmt.Errorf("could not delete unique key %q: %w", key, err)
+		}
+	}
+}
+
+// isUniqueRecordStale reports whether the record is left by a change which did not finish or by an entity which
+// does not have the values anymore (e.g. it expired)
+func (e *Service) isUniqueRecordStale(ctx context.Context, stored Entity, record uniqueRecord, now time.Time) (bool, error) {
+	if now.Sub(stored.Created) <= uniquePendingTimeout {
+		return false, nil
+	}
+
+	owner, err := e.getCurrent(ctx, record.EntityId)
+	if errors.Is(err, errEntityNotFound) {
+		return true, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("could not read owner of unique key %q: %w", record.Key, err)
+	}
+	ids, err := e.getUniqueIds(owner.Payload)
+	if err != nil {
+		return false, err
+	}
+	_, found := ids[stored.Id]
+
+	return !found, nil
+}
+
+// RebuildUniqueIndex claims values of unique keys of all entities of the service and deletes values not used by any
+// entity anymore, so entities stored without claiming their values (existing entities of a new unique key, restored
+// or migrated entities) are checked too. It returns number of newly claimed values; values shared by more entities
+// are claimed by one of them and the error errUniqueViolation is returned.
+func (e *Service) RebuildUniqueIndex(ctx context.Context) (claimed int, err error) {
+	ctx, span := e.startSpan(ctx, "service.rebuild_unique_index")
+	defer func() { endSpan(span, err) }()
+
+	list, err := e.List(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	used := make(map[string]bool)
+	var violations []string
+	for _, entity := range list {
+		ids, err := e.getUniqueIds(entity.Payload)
+		if err != nil {
+			return claimed, err
+		}
+		for id, key := range ids {
+			created, err := e.claimUniqueId(ctx, entity.Id, id, key)
+			if errors.Is(err, errUniqueViolation) {
+				violations = append(violations, fmt.Sprintf("%q of entity %q", key, entity.Id))
+				continue
+			}
+			if err != nil {
+				return claimed, err
+			}
+			used[id] = true
+			if created {
+				claimed++
+			}
+		}
+	}
+
+	if err = e.deleteUnusedUniqueIds(ctx, used); err != nil {
+		return claimed, err
+	}
+	if len(violations) > 0 {
+		return claimed, fmt.Errorf("%w: %s", errUniqueViolation, strings.Join(violations, ", "))
+	}
+
+	return claimed, e.storeUniqueIndexKeys(ctx)
+}
+
+// deleteUnusedUniqueIds deletes stale records which are not used by any entity
+func (e *Service) deleteUnusedUniqueIds(ctx context.Context, used map[string]bool) error {
+	name := getUniqueServiceName(e.Cfg.Name)
+	stored, err := e.Storage.List(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	// the list can be shared by the storage, so records are deleted after they are collected
+	var unused []Entity
+	for _, record := range stored {
+		if record.Id != indexId && !used[record.Id] {
+			unused = append(unused, record)
+		}
+	}
+
+	now := time.Now()
+	for _, existing := range unused {
+		record, err := decodeUniqueRecord(existing)
+		if err != nil {
+			return err
+		}
+		// the value can be claimed by a change in progress
+		stale, err := e.isUniqueRecordStale(ctx, existing, record, now)
+		if err != nil {
+			return err
+		}
+		if !stale {
+			continue
+		}
+		err = e.Storage.DeleteVersion(ctx, name, existing.Id, existing.GetVersion())
+		if err != nil && !errors.Is(err, errEntityNotFound) && !errors.Is(err, errVersionConflict) {
+			return fmt.Errorf("could not delete unique key %q: %w", record.Key, err)
+		}
+	}
+
+	return nil
+}
+
+// storeUniqueIndexKeys records unique keys whose values are claimed
+func (e *Service) storeUniqueIndexKeys(ctx context.Context) error {
+	return e.storeIndexKeys(ctx, getUniqueServiceName(e.Cfg.Name), getIndexKeys(e.Cfg.GetUniqueKeys()))
+}
+
+// isUniqueIndexCurrent reports whether values of the current unique keys were claimed
+func (e *Service) isUniqueIndexCurrent(ctx context.Context) (bool, error) {
+	return e.isIndexCurrent(ctx, getUniqueServiceName(e.Cfg.Name), getIndexKeys(e.Cfg.GetUniqueKeys()))
+}
+
+// releaseUniqueIds deletes records of the entity; records left by a failure are stale and claimed again later
+func (e *Service) releaseUniqueIds(ctx context.Context, entityId string, ids []string) {
+	name := getUniqueServiceName(e.Cfg.Name)
+	for _, id := range ids {
+		existing, err := e.Storage.Get(ctx, name, id)
+		if err != nil {
+			continue
+		}
+		if record, err := decodeUniqueRecord(existing); err == nil && record.EntityId == entityId {
+			_ = e.Storage.DeleteVersion(ctx, name, id, existing.GetVersion())
+		}
+	}
+}
+
+// releaseUniqueValues deletes records of unique keys of the entity payload
+func (e *Service) releaseUniqueValues(ctx context.Context, entity Entity) {
+	ids, err := e.getUniqueIds(entity.Payload)
+	if err != nil {
+		return
+	}
+	e.releaseUniqueIds(ctx, entity.Id, getUniqueIdList(ids, nil))
+}
+
+// getUniqueIdList returns IDs which are not in the excluded ones
+func getUniqueIdList(ids, excluded map[string]string) []string {
+	list := make([]string, 0, len(ids))
+	for id := range ids {
+		if _, found := excluded[id]; !found {
+			list = append(list, id)
+		}
+	}
+
+	return list
+}
+
+func encodeUniqueRecord(record uniqueRecord) map[string]interface{} {
+	return map[string]interface{}{
+		"key":       record.Key,
+		"entity_id": record.EntityId,
+	}
+}
+
+func decodeUniqueRecord(stored Entity) (uniqueRecord, error) {
+	data, err := json.Marshal(stored.Payload)
+	if err != nil {
+		return uniqueRecord{}, fmt.Errorf("could not decode unique key %q: %w", stored.Id, err)
+	}
+
+	var record uniqueRecord
+	if err = json.Unmarshal(data, &record); err != nil {
+		return uniqueRecord{}, fmt.Errorf("could not decode unique key %q: %w", stored.Id, err)
+	}
+
+	return record, nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestUniqueKeys(t *testing.T) {
+	ctx := context.Background()
+	yes := true
+	cfg := testServiceConfig("people")
+	cfg.Fields["email"] = &FieldConfig{Name: "email", Type: "string", Unique: &yes, CaseInsensitive: &yes}
+	cfg.Fields["team"] = &FieldConfig{Name: "team", Type: "string"}
+	cfg.UniqueKeys = []UniqueKeyConfig{{Fields: []string{"team", "name"}}}
+	cfg.SoftDelete = true
+	people := Service{Cfg: cfg, Storage: CreateMemStorage([]string{"people", "people__trash", "people__unique"})}
+
+	alice, err := people.Put(ctx, map[string]interface{}{"name": "alice", "email": "alice@example.com", "team": "a"}, nil)
+	assert.Nil(t, err)
+	_, err = people.Put(ctx, map[string]interface{}{"name": "bob", "email": "Alice@Example.com"}, nil)
+	assert.ErrorIs(t, err, errUniqueViolation)
+	_, err = people.Put(ctx, map[string]interface{}{"name": "alice", "team": "a"}, nil)
+	assert.ErrorIs(t, err, errUniqueViolation)
+
+	// missing values are not unique and composite key is unique as a whole
+	_, err = people.Put(ctx, map[string]interface{}{"name": "alice", "team": "b"}, nil)
+	assert.Nil(t, err)
+	bob, err := people.Put(ctx, map[string]interface{}{"name": "bob"}, nil)
+	assert.Nil(t, err)
+	_, err = people.Put(ctx, map[string]interface{}{"name": "bob"}, nil)
+	assert.Nil(t, err)
+
+	// update keeps its own values and releases the old ones
+	_, err = people.Update(ctx, bob.Id, map[string]interface{}{"name": "bob", "email": "ALICE@example.com"}, 0)
+	assert.ErrorIs(t, err, errUniqueViolation)
+	_, err = people.Update(ctx, alice.Id, map[string]interface{}{"name": "alice", "email": "alice@example.com", "team": "a"}, 0)
+	assert.Nil(t, err)
+	_, err = people.Update(ctx, alice.Id, map[string]interface{}{"name": "alice", "email": "alice@example.org", "team": "a"}, 0)
+	assert.Nil(t, err)
+	_, err = people.Update(ctx, bob.Id, map[string]interface{}{"name": "bob", "email": "alice@example.com"}, 0)
+	assert.Nil(t, err)
+
+	// deleted entity releases its values and cannot be restored while they are used
+	assert.Nil(t, people.Delete(ctx, alice.Id, 0))
+	carol, err := people.Put(ctx, map[string]interface{}{"name": "carol", "email": "alice@example.org"}, nil)
+	assert.Nil(t, err)
+	_, err = people.Undelete(ctx, alice.Id)
+	assert.ErrorIs(t, err, errUniqueViolation)
+	assert.Nil(t, people.Delete(ctx, carol.Id, 0))
+	_, err = people.Undelete(ctx, alice.Id)
+	assert.Nil(t, err)
+}
+
+func TestUniqueKeysStaleRecord(t *testing.T) {
+	ctx := context.Background()
+	yes := true
+	cfg := testServiceConfig("people")
+	cfg.Fields["name"].Unique = &yes
+	cfg.Expiration = true
+	people := Service{Cfg: cfg, Storage: CreateMemStorage([]string{"people", "people__unique"})}
+
+	// record of unfinished change blocks the value until it is abandoned
+	ids, err := people.getUniqueIds(map[string]interface{}{"name": "alice"})
+	assert.Nil(t, err)
+	pending := Entity{Id: getUniqueIdList(ids, nil)[0], Created: time.Now(), Payload: encodeUniqueRecord(uniqueRecord{Key: "name", EntityId: "missing"})}
+	assert.Nil(t, people.Storage.Insert(ctx, getUniqueServiceName("people"), pending))
+	_, err = people.Put(ctx, map[string]interface{}{"name": "alice"}, nil)
+	assert.ErrorIs(t, err, errUniqueViolation)
+
+	pending.Created = time.Now().Add(-2 * uniquePendingTimeout)
+	_, err = people.Storage.Update(ctx, getUniqueServiceName("people"), pending)
+	assert.Nil(t, err)
+	alice, err := people.Put(ctx, map[string]interface{}{"name": "alice"}, nil)
+	assert.Nil(t, err)
+
+	// expired entity does not hold its values
+	expiresAt := time.Now().Add(time.Hour)
+	bob, err := people.Put(ctx, map[string]interface{}{"name": "bob"}, &expiresAt)
+	assert.Nil(t, err)
+	past := time.Now().Add(-time.Second)
+	bob.ExpiresAt = &past
+	_, err = people.Storage.Update(ctx, "people", bob)
+	assert.Nil(t, err)
+	_, err = people.DeleteExpired(ctx)
+	assert.Nil(t, err)
+	records, err := people.Storage.List(ctx, getUniqueServiceName("people"))
+	assert.Nil(t, err)
+	assert.Len(t, records, 1)
+	assert.Equal(t, alice.Id, records[0].Payload.(map[string]interface{})["entity_id"])
+}
+
+func TestRebuildUniqueIndex(t *testing.T) {
+	ctx := context.Background()
+	yes := true
+	cfg := testServiceConfig("people")
+	people := Service{Cfg: cfg, Storage: CreateMemStorage([]string{"people", "people__unique"})}
+
+	// entities stored before the field was unique
+	for _, e := range []Entity{
+		{Id: "alice", Created: time.Now(), Payload: map[string]interface{}{"name": "alice"}},
+		{Id: "bob", Created: time.Now(), Payload: map[string]interface{}{"name": "bob"}},
+		{Id: "copy", Created: time.Now(), Payload: map[string]interface{}{"name": "alice"}},
+	} {
+		assert.Nil(t, people.Storage.Insert(ctx, "people", e))
+	}
+	people.Cfg.Fields["name"].Unique = &yes
+	ids, err := people.getUniqueIds(map[string]interface{}{"name": "carol"})
+	assert.Nil(t, err)
+	stale := Entity{Id: getUniqueIdList(ids, nil)[0], Created: time.Now().Add(-2 * uniquePendingTimeout), Payload: encodeUniqueRecord(uniqueRecord{Key: "name", EntityId: "carol"})}
+	assert.Nil(t, people.Storage.Insert(ctx, getUniqueServiceName("people"), stale))
+	current, err := people.isUniqueIndexCurrent(ctx)
+	assert.Nil(t, err)
+	assert.False(t, current)
+
+	// values used by more entities are reported and the index is not complete
+	claimed, err := people.RebuildUniqueIndex(ctx)
+	assert.ErrorIs(t, err, errUniqueViolation)
+	assert.Contains(t, err.Error(), `"copy"`)
+	assert.Equal(t, 2, claimed)
+	current, err = people.isUniqueIndexCurrent(ctx)
+	assert.Nil(t, err)
+	assert.False(t, current)
+	_, err = people.Put(ctx, map[string]interface{}{"name": "bob"}, nil)
+	assert.ErrorIs(t, err, errUniqueViolation)
+	err = rebuildIndexes(ctx, []Service{people}, logrus.New())
+	assert.ErrorContains(t, err, `services people, run reindex command`)
+
+	// stale value is deleted
+	records, err := people.Storage.List(ctx, getUniqueServiceName("people"))
+	assert.Nil(t, err)
+	assert.Len(t, records, 2)
+
+	// the index is rebuilt on startup until it is complete
+	assert.Nil(t, people.Storage.Delete(ctx, "people", "copy"))
+	assert.Nil(t, rebuildIndexes(ctx, []Service{people}, logrus.New()))
+	current, err = people.isUniqueIndexCurrent(ctx)
+	assert.Nil(t, err)
+	assert.True(t, current)
+
+	// changed unique keys are indexed again
+	people.Cfg.UniqueKeys = []UniqueKeyConfig{{Fields: []string{"name", "age"}}}
+	current, err = people.isUniqueIndexCurrent(ctx)
+	assert.Nil(t, err)
+	assert.False(t, current)
+}
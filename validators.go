@@ -3,32 +3,70 @@ package main
 import (
 	"fmt"
 	"net/mail"
+	"regexp"
+	"strings"
 	"time"
 )
 
-// ValidateServiceNames checks for reserved service names
+var serviceNameRegExp = regexp.MustCompile(`^[a-z][a-z0-9_-]{0,62}$`)
+
+// ValidateServiceNames checks service names are unique lowercase slugs; names with "__" are used by internal services
 func ValidateServiceNames(names []string) error {
-	reservedNames := map[string]bool{
-		"metrics":   true,
-		"log_level": true,
+	for _, name := range names {
+		if strings.Contains(name, "__") {
+			return fmt.Errorf("invalid service name %q: \"__\" is reserved for internal services", name)
+		}
 	}
 
-	for _, name := range names {
-		_, found := reservedNames[name]
-		if found {
-			return fmt.Errorf("could not use reserved serice name: %q", name)
+	return validateSlugs("service name", names)
+}
+
+// ValidateServicePaths checks service paths are unique lowercase slugs which do not collide with built-in routes
+func ValidateServicePaths(paths []string) error {
+	if err := validateSlugs("service path", paths); err != nil {
+		return err
+	}
+
+	for _, path := range paths {
+		for _, reserved := range reservedPaths {
+			if path == reserved {
+				return fmt.Errorf("could not use reserved service path: %q", path)
+			}
 		}
 	}
 
 	return nil
 }
 
+func validateSlugs(kind string, values []string) error {
+	seen := make(map[string]bool, len(values))
+	for _, value := range values {
+		if !serviceNameRegExp.MatchString(value) {
+			return fmt.Errorf("invalid %s %q: must start with a lowercase letter and contain only lowercase letters, digits, '_' and '-'", kind, value)
+		}
+		if seen[value] {
+			return fmt.Errorf("duplicate %s %q", kind, value)
+		}
+		seen[value] = true
+	}
+
+	return nil
+}
+
 func Validate(field FieldConfig, value interface{}, valueSet bool) error {
 	// field required, not set
 	if field.Required != nil && *field.Required && !valueSet {
 		return fmt.Errorf("field %q: required", field.Name)
 	}
 
+	// field set to null
+	if valueSet && value == nil {
+		if field.Nullable != nil && *field.Nullable {
+			return nil
+		}
+		return fmt.Errorf("field %q: cannot be null", field.Name)
+	}
+
 	// field not required, not set
 	if field.Required == nil && !valueSet {
 		return nil
@@ -52,7 +90,12 @@ func Validate(field FieldConfig, value interface{}, valueSet bool) error {
 			return fmt.Errorf("field %q: could not expand object", field.Name)
 		}
 		for n, f := range *field.Fields {
-			if err := Validate(*f, v[n], v[n] != nil); err != nil {
+			// computed field is set by the server
+			if f.Computed != nil {
+				continue
+			}
+			value, set := v[n]
+			if err := Validate(*f, value, set); err != nil {
 				return err
 			}
 		}
@@ -96,6 +139,12 @@ func Validate(field FieldConfig, value interface{}, valueSet bool) error {
 			return fmt.Errorf("field %q: could not convert to float", field.Name)
 		}
 		return validateFloat(field, floatValue)
+	case FieldTypeRef:
+		strValue, converted := value.(string)
+		if !converted || strValue == "" {
+			return fmt.Errorf("field %q: reference must be id of an entity", field.Name)
+		}
+		return nil
 	}
 
 	panic(fmt.Sprintf("should never happen; field: %s", field.Name))
@@ -9,14 +9,39 @@ func TestValidateServiceNames(t *testing.T) {
 	cases := map[string]bool{
 		"dogs":                   true,
 		"very_long_service_name": true,
-		"metrics":                false, // reserved
-		"log_level":              false, // reserved
+		"dog-tags2":              true,
+		"":                       false,
+		"Dogs":                   false,
+		"2dogs":                  false,
+		"hot dogs":               false,
+		"dogs/cats":              false,
+		"openapi.json":           false,
+		"dogs__history":          false, // reserved for history services
 	}
 
 	for serviceName, expectation := range cases {
 		err := ValidateServiceNames([]string{serviceName})
-		assert.Equal(t, expectation, err == nil)
+		assert.Equal(t, expectation, err == nil, serviceName)
 	}
+
+	assert.Error(t, ValidateServiceNames([]string{"dogs", "cats", "dogs"})) // duplicate
+}
+
+func TestValidateServicePaths(t *testing.T) {
+	cases := map[string]bool{
+		"dogs":      true,
+		"metrics":   false, // reserved
+		"log_level": false, // reserved
+		"healthz":   false, // reserved
+		"Dogs":      false,
+	}
+
+	for path, expectation := range cases {
+		err := ValidateServicePaths([]string{path})
+		assert.Equal(t, expectation, err == nil, path)
+	}
+
+	assert.Error(t, ValidateServicePaths([]string{"dogs", "dogs"})) // duplicate
 }
 
 func TestValidateArray(t *testing.T) {
@@ -133,3 +158,19 @@ func TestValidateFloat(t *testing.T) {
 	assert.NoError(t, validateFloat(field, 0))
 	assert.NoError(t, validateFloat(field, 3.1415))
 }
+
+func TestValidateNullable(t *testing.T) {
+	yes := true
+	fields := map[string]*FieldConfig{
+		"name":    {Name: "name", Type: "string", Required: &yes},
+		"comment": {Name: "comment", Type: "string", Nullable: &yes},
+		"age":     {Name: "age", Type: "int"},
+	}
+	root := FieldConfig{Name: "root", Type: "object", Fields: &fields}
+
+	assert.NoError(t, Validate(root, map[string]interface{}{"name": "rex"}, true))
+	assert.NoError(t, Validate(root, map[string]interface{}{"name": "rex", "comment": nil}, true))
+	assert.Error(t, Validate(root, map[string]interface{}{"name": "rex", "age": nil}, true)) // not nullable
+	assert.Error(t, Validate(root, map[string]interface{}{"name": nil}, true))               // required is not nullable
+	assert.Error(t, Validate(root, map[string]interface{}{"comment": nil}, true))            // required is missing
+}